@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	clusterstorepkg "github.com/argon-chat/k3sd/pkg/clusterstore"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// configUsage lists the subcommands of the config command.
+const configUsage = "usage: k3sd config encrypt|decrypt|render --config-path FILE"
+
+// runConfig encrypts or decrypts the config file in place, in the SOPS format with age keys, or
+// renders it as composed for the selected environment. Encrypting and decrypting only change
+// the encrypted values, so the file can be kept and reviewed in git.
+func runConfig() error {
+	args := utils.CommandArgs
+	if len(args) != 1 {
+		return errors.New(configUsage)
+	}
+	if utils.ConfigPath == "" {
+		return errors.New(configUsage)
+	}
+	switch args[0] {
+	case "encrypt":
+		opts := clusterstorepkg.EncryptOptions{Recipients: utils.AgeRecipients, EncryptedRegex: utils.EncryptedRegex}
+		if err := clusterstorepkg.EncryptConfig(utils.ConfigPath, opts); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Encrypted %s\n", utils.ConfigPath)
+		return nil
+	case "decrypt":
+		if err := clusterstorepkg.DecryptConfig(utils.ConfigPath); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Decrypted %s\n", utils.ConfigPath)
+		return nil
+	case "render":
+		return renderConfig()
+	}
+	return errors.New(configUsage)
+}
+
+// renderConfig prints the config as composed for the selected environment, in the format of
+// --output or else that of the config.
+func renderConfig() error {
+	format := clusterstorepkg.FormatOf(utils.ConfigPath)
+	switch utils.OutputFormat {
+	case "table":
+	case "json", "yaml", "toml":
+		format = clusterstorepkg.Format(utils.OutputFormat)
+	default:
+		return fmt.Errorf("unknown output format %q", utils.OutputFormat)
+	}
+	out, err := clusterstorepkg.RenderEnvironment(utils.ConfigPath, utils.Environment, format)
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimRight(string(out), "\n"))
+	return nil
+}
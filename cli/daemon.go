@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+
+	"github.com/argon-chat/k3sd/pkg/daemon"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/metrics"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// newMetrics returns the metrics of the long-running commands, daemon and serve, which serve
+// them on /metrics, and nil for the other commands.
+func newMetrics(command string) *metrics.Metrics {
+	if command == "daemon" || command == "serve" {
+		return metrics.New()
+	}
+	return nil
+}
+
+// runDaemon watches the config path (a file or a directory of configs), applies changes and
+// reconciles drift until ctx is cancelled by SIGINT or SIGTERM.
+func runDaemon(ctx context.Context, engine *k3sd.Engine) error {
+	d := daemon.New(daemon.Options{
+		ConfigPath:       utils.ConfigPath,
+		Environment:      utils.Environment,
+		Listen:           utils.ListenAddr,
+		WatchInterval:    utils.WatchInterval,
+		DriftInterval:    utils.DriftInterval,
+		MinApplyInterval: utils.MinApplyInterval,
+		Selector:         utils.Selection,
+	}, engine)
+	return d.Run(ctx)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	clusterpkg "github.com/argon-chat/k3sd/pkg/cluster"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// runDestroy asks for the required confirmations and uninstalls the selected clusters.
+//
+// Protected clusters are refused outright. Unless --yes is given, a yes/no confirmation is
+// read from the terminal. Production clusters additionally require their context name to be
+// typed, or passed with --confirm when running non-interactively.
+func runDestroy(ctx context.Context, engine *k3sd.Engine, clusters []types.Cluster) ([]types.Cluster, error) {
+	var targets []*types.Cluster
+	for ci := range clusters {
+		if utils.Selection.MatchCluster(clusters[ci].Context) {
+			targets = append(targets, &clusters[ci])
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no clusters match the selection")
+	}
+	for _, cluster := range targets {
+		if err := clusterpkg.CheckDestroyAllowed(cluster); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("The following clusters will be destroyed:")
+	for _, cluster := range targets {
+		fmt.Printf("  - %s (%s, %d workers)\n", cluster.DisplayName(), cluster.Address, len(cluster.Workers))
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	interactive := stdinIsTerminal()
+	if !utils.AutoApprove {
+		if !interactive {
+			return nil, fmt.Errorf("refusing to destroy clusters without confirmation; pass --yes to run non-interactively")
+		}
+		fmt.Print("Are you sure you want to destroy these clusters? (yes/y/no/n): ")
+		response, _ := reader.ReadString('\n')
+		switch strings.TrimSpace(strings.ToLower(response)) {
+		case "yes", "y":
+		case "no", "n":
+			fmt.Println("Destroy canceled.")
+			return clusters, nil
+		default:
+			return nil, fmt.Errorf("unrecognized answer %q, destroy canceled", strings.TrimSpace(response))
+		}
+	}
+
+	for _, cluster := range targets {
+		if !cluster.IsProduction() || confirmedUpFront(cluster) {
+			continue
+		}
+		if !interactive {
+			return nil, fmt.Errorf("cluster %s is a production cluster; pass --confirm %s to destroy it non-interactively", cluster.DisplayName(), cluster.DisplayName())
+		}
+		fmt.Printf("Cluster %s is a production cluster. Type its name to confirm: ", cluster.DisplayName())
+		response, _ := reader.ReadString('\n')
+		if strings.TrimSpace(response) != cluster.DisplayName() {
+			return nil, fmt.Errorf("confirmation for %s did not match, destroy canceled", cluster.DisplayName())
+		}
+	}
+
+	return engine.Destroy(ctx, clusters, utils.Selection)
+}
+
+func confirmedUpFront(cluster *types.Cluster) bool {
+	for _, name := range utils.ConfirmContexts {
+		if name == cluster.DisplayName() {
+			return true
+		}
+	}
+	return false
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
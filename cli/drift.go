@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/argon-chat/k3sd/pkg/drift"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// runDrift detects (and with --reconcile, reconciles) drift of the selected clusters and
+// prints the drift items. It returns the number of items that are still drifted.
+func runDrift(ctx context.Context, engine *k3sd.Engine, clusters []types.Cluster) (int, error) {
+	if err := engine.ResolveSecrets(ctx, clusters); err != nil {
+		return 0, err
+	}
+	items := engine.Drift(ctx, clusters, utils.Selection)
+	if utils.Reconcile && len(items) > 0 {
+		items = engine.Reconcile(ctx, items, clusters)
+	}
+	var err error
+	switch utils.OutputFormat {
+	case "json":
+		err = drift.RenderJSON(os.Stdout, items)
+	case "table", "":
+		err = drift.RenderTable(os.Stdout, items)
+	default:
+		err = fmt.Errorf("unknown output format %q", utils.OutputFormat)
+	}
+	return drift.Pending(items), err
+}
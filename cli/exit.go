@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/argon-chat/k3sd/pkg/lock"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Exit codes of the command-line tool.
+const (
+	// exitFailure is the exit code of any failure not covered by a more specific code.
+	exitFailure = 1
+	// exitDriftDetected is the exit code of the drift command when unreconciled drift remains.
+	exitDriftDetected = 2
+	// exitConfigError is the exit code when the config cannot be loaded or is invalid.
+	exitConfigError = 3
+	// exitConnectionFailure is the exit code when every failed step failed to reach its node.
+	exitConnectionFailure = 4
+	// exitPartialFailure is the exit code when some steps of a run failed.
+	exitPartialFailure = 5
+	// exitLocked is the exit code when the config or a cluster is locked by another run.
+	exitLocked = 6
+	// exitInterrupted is the exit code when the run was interrupted by SIGINT or SIGTERM
+	// (128 + SIGINT, as shells report it).
+	exitInterrupted = 130
+)
+
+// exitCode maps the error of a run to an exit code. An interrupt wins, then a lock held by
+// another run, then a config error
+// anywhere in the run; otherwise the run is a connection failure if every failed step is one,
+// and a partial failure if not.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
+	}
+	var locked *lock.LockedError
+	if errors.As(err, &locked) {
+		return exitLocked
+	}
+	if utils.IsConfigError(err) {
+		return exitConfigError
+	}
+	failures := leafErrors(err)
+	if len(failures) == 0 {
+		return exitFailure
+	}
+	for _, failure := range failures {
+		if !utils.IsConnectionError(failure) {
+			var stepErr *utils.StepError
+			if errors.As(failure, &stepErr) {
+				return exitPartialFailure
+			}
+			return exitFailure
+		}
+	}
+	return exitConnectionFailure
+}
+
+// leafErrors flattens errors joined with errors.Join.
+func leafErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	var leaves []error
+	for _, e := range joined.Unwrap() {
+		leaves = append(leaves, leafErrors(e)...)
+	}
+	return leaves
+}
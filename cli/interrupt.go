@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyInterrupt returns a context cancelled on the first SIGINT or SIGTERM. The running step
+// is then aborted and the progress made so far is saved; a second signal exits immediately.
+func notifyInterrupt(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %v, aborting the running step and saving progress (send it again to exit immediately)", sig)
+			// restore the default handling so a second signal terminates the process
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// logCloseTimeout is how long the CLI waits for buffered log messages before exiting.
+const logCloseTimeout = 5 * time.Second
+
+// traceShutdownTimeout is how long the CLI waits for buffered spans to be exported before exiting.
+const traceShutdownTimeout = 5 * time.Second
+
+// newLogger builds the CLI logger from the logging flags: console messages on stderr at the
+// configured level and format, every message at debug level in a per-run log file for the
+// commands that change clusters, and, with --log-endpoint, every message at the console level
+// posted to a remote collector. With a terminal progress view, console messages are routed
+// through the view.
+//
+// Parameters:
+//
+//	view: Progress view of the run, or nil.
+//
+// Returns:
+//
+//	*utils.Logger: the logger; Close it before exiting.
+//	error: Error if a logging flag is invalid or the run log cannot be created.
+func newLogger(view *progressView) (*utils.Logger, error) {
+	level := slog.LevelWarn
+	if utils.Verbose {
+		level = slog.LevelDebug
+	}
+	if utils.LogLevel != "" {
+		parsed, err := utils.ParseLevel(utils.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		level = parsed
+	}
+	console, err := utils.NewLogHandler(view.consoleWriter(os.Stderr), utils.LogFormat, level)
+	if err != nil {
+		return nil, err
+	}
+	sinks := utils.MultiHandler{view.handler(console)}
+	if utils.LogEndpoint != "" {
+		sinks = append(sinks, utils.NewRemoteHandler(utils.LogEndpoint, level))
+	}
+	var runLog string
+	if !utils.NoLogFile && writesRunLog(utils.Command) {
+		dir := utils.LogDir
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			dir = filepath.Join(home, ".k3sd", "logs")
+		}
+		file, err := utils.OpenRunLog(dir, utils.Command)
+		if err != nil {
+			return nil, err
+		}
+		fileHandler, _ := utils.NewLogHandler(file, utils.LogFormat, slog.LevelDebug)
+		sinks = append(sinks, utils.WithCloser(fileHandler, file))
+		runLog = file.Name()
+	}
+	logger := utils.NewLogger("cli", sinks)
+	if runLog != "" {
+		logger.Debug("k3sd %s, run log %s", utils.Version, runLog)
+	}
+	return logger, nil
+}
+
+// writesRunLog reports whether a command gets a per-run log file: the commands that change
+// clusters do, the reporting commands do not.
+func writesRunLog(command string) bool {
+	switch command {
+	case "", "destroy", "daemon", "serve", "drift":
+		return true
+	}
+	return false
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"archive/tar"
-	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,15 +13,24 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/argon-chat/k3sd/cli/tui"
 	clusterpkg "github.com/argon-chat/k3sd/pkg/cluster"
 	clusterstorepkg "github.com/argon-chat/k3sd/pkg/clusterstore"
-	"github.com/argon-chat/k3sd/pkg/db"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/tracing"
+	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the command given on the command line and returns the exit code. Deferred cleanup
+// (closing the database, flushing and closing the logger) runs before the process exits.
+func run() int {
 	utils.ParseFlags()
 
 	err := downloadAndExtractYamls(utils.Version)
@@ -29,65 +38,212 @@ func main() {
 		log.Printf("yamls download failed: %v", err)
 	}
 
-	ctx, err := db.OpenGormDB(db.GetDBPath())
-	if err != nil {
-		panic("failed to open database: " + err.Error())
-	}
-	// TODO: this really needs to be placed in a more appropriate location
-	db.DbCtx = ctx
-
 	if utils.VersionFlag {
 		fmt.Printf("K3SD version: %s\n", utils.Version)
-		os.Exit(0)
+		return 0
 	}
 
 	if utils.GenerateFlag {
 		err := tui.RunGenerateTUI()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "TUI error: %v\n", err)
-			os.Exit(1)
+			return exitFailure
 		}
-		os.Exit(0)
+		return 0
+	}
+
+	// validating and managing configs and secrets need neither the database nor a connection to the clusters
+	switch utils.Command {
+	case "validate":
+		if err := runValidate(); err != nil {
+			log.Printf("%v", err)
+			return exitCode(err)
+		}
+		return 0
+	case "schema":
+		if err := runSchema(); err != nil {
+			log.Printf("failed to print schema: %v", err)
+			return exitFailure
+		}
+		return 0
+	case "secret":
+		if err := runSecret(); err != nil {
+			log.Printf("%v", err)
+			return exitFailure
+		}
+		return 0
+	case "config":
+		if err := runConfig(); err != nil {
+			log.Printf("%v", err)
+			return exitCode(err)
+		}
+		return 0
+	}
+
+	view, err := newProgressView(utils.Command)
+	if err != nil {
+		log.Printf("invalid progress option: %v", err)
+		return exitFailure
 	}
+	defer view.Stop()
 
-	clusters, err := clusterstorepkg.LoadClusters(utils.ConfigPath)
+	logger, err := newLogger(view)
 	if err != nil {
-		log.Fatalf("failed to load clusters: %v", err)
+		log.Printf("invalid logging options: %v", err)
+		return exitFailure
 	}
+	// write out the last messages, often the errors, before the process exits
+	defer func() {
+		if err := logger.Close(logCloseTimeout); err != nil {
+			log.Printf("failed to write log messages: %v", err)
+		}
+	}()
 
-	logger := utils.NewLogger("cli")
-	go logger.LogWorker()
-	go logger.LogWorkerErr()
-	go logger.LogWorkerFile()
-	go logger.LogWorkerCmd()
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Endpoint:       utils.TraceEndpoint,
+		File:           utils.TraceFile,
+		ServiceVersion: utils.Version,
+	})
+	if err != nil {
+		log.Printf("invalid tracing options: %v", err)
+		return exitFailure
+	}
+	// export the spans still buffered before the process exits
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Printf("failed to export spans: %v", err)
+		}
+	}()
 
-	checkCommandExists()
+	if err := checkCommandExists(); err != nil {
+		log.Printf("%v", err)
+		return exitFailure
+	}
 
-	if utils.Uninstall {
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Are you sure you want to uninstall the clusters? (yes/y/no/n): ")
-		response, _ := reader.ReadString('\n')
-		response = strings.TrimSpace(strings.ToLower(response))
+	webhooks, err := loadWebhooks(utils.WebhooksPath)
+	if err != nil {
+		log.Printf("failed to load webhooks: %v", err)
+		return exitConfigError
+	}
 
-		switch response {
-		case "yes", "y":
-			clusters, err = clusterpkg.UninstallCluster(clusters, logger)
-			if err != nil {
-				log.Fatalf("failed to uninstall clusters: %v", err)
-			}
-		case "no", "n":
-			fmt.Println("Uninstallation canceled.")
-			return
-		default:
-			log.Fatalf("And just what do you mean by '%s'?", response)
+	engine, err := k3sd.New(k3sd.Config{
+		DBPath:          utils.DBPath,
+		Logger:          logger,
+		HelmAtomic:      utils.HelmAtomic,
+		YamlsPath:       utils.YamlsPath,
+		LogKubeconfigs:  utils.LogKubeconfigs,
+		Metrics:         newMetrics(utils.Command),
+		Webhooks:        webhooks,
+		SecretStorePath: utils.SecretStorePath,
+	})
+	if err != nil {
+		log.Printf("failed to open database: %v", err)
+		return exitFailure
+	}
+	defer engine.Close()
+
+	ctx, stop := notifyInterrupt(context.Background())
+	defer stop()
+
+	// the daemon and the API server load the config themselves, since it changes while they run
+	if utils.Command == "daemon" {
+		if err := runDaemon(ctx, engine); err != nil {
+			log.Printf("daemon failed: %v", err)
+			return exitFailure
 		}
-	} else {
-		clusters = clusterpkg.CreateCluster(clusters, logger, []string{})
+		return 0
+	}
+	if utils.Command == "serve" {
+		if err := runServe(ctx, engine); err != nil {
+			log.Printf("API server failed: %v", err)
+			return exitFailure
+		}
+		return 0
 	}
 
-	if err := clusterstorepkg.SaveClusters(utils.ConfigPath, clusters); err != nil {
-		log.Fatalf("failed to save clusters: %v", err)
+	if utils.Command == "force-unlock" {
+		if err := runForceUnlock(ctx, engine); err != nil {
+			log.Printf("failed to remove locks: %v", err)
+			return exitCode(err)
+		}
+		return 0
 	}
+
+	// commands changing the clusters hold the lock of their config for the whole run
+	if utils.Command == "" || utils.Command == "destroy" {
+		held, err := lockConfig(utils.ConfigPath)
+		if err != nil {
+			log.Printf("%v", err)
+			return exitCode(err)
+		}
+		defer held.Release()
+	}
+
+	clusters, err := clusterstorepkg.LoadEnvironment(utils.ConfigPath, utils.Environment)
+	if err != nil {
+		log.Printf("failed to load clusters: %v", err)
+		return exitConfigError
+	}
+
+	var runErr error
+	switch utils.Command {
+	case "":
+		var summary *clusterpkg.Summary
+		started := time.Now()
+		clusters, summary, runErr = engine.Apply(progressContext(ctx, view), clusters, utils.Selection)
+		view.Stop()
+		fmt.Println()
+		if err := clusterpkg.RenderSummary(os.Stdout, summary); err != nil {
+			log.Printf("failed to print run summary: %v", err)
+		}
+		if err := writeReports(context.WithoutCancel(ctx), engine, clusters, summary, runErr, started); err != nil {
+			log.Printf("failed to write run report: %v", err)
+		}
+	case "destroy":
+		var destroyed []types.Cluster
+		destroyed, runErr = runDestroy(ctx, engine, clusters)
+		if destroyed == nil {
+			log.Printf("failed to destroy clusters: %s", utils.Redact(runErr.Error()))
+			return exitCode(runErr)
+		}
+	case "drift":
+		pending, err := runDrift(ctx, engine, clusters)
+		if err != nil {
+			log.Printf("failed to check drift: %v", err)
+			return exitCode(err)
+		}
+		if pending > 0 {
+			return exitDriftDetected
+		}
+		return 0
+	case "webhook-test":
+		if err := engine.ResolveSecrets(ctx, clusters); err != nil {
+			log.Printf("failed to resolve secrets: %v", err)
+			return exitConfigError
+		}
+		if err := runWebhookTest(ctx, engine.Webhooks(), clusters); err != nil {
+			log.Printf("webhook test failed: %v", err)
+			return exitFailure
+		}
+		return 0
+	case "status":
+		if err := runStatus(ctx, engine, clusters); err != nil {
+			log.Printf("failed to report status: %v", err)
+			return exitCode(err)
+		}
+		return 0
+	default:
+		log.Printf("unknown command %q", utils.Command)
+		return exitFailure
+	}
+
+	if runErr != nil {
+		logger.LogErr("run finished with errors:\n%v", runErr)
+		return exitCode(runErr)
+	}
+	return 0
 }
 
 func downloadAndExtractYamls(version string) error {
@@ -156,7 +312,9 @@ func downloadAndExtractYamls(version string) error {
 	return nil
 }
 
-func checkCommandExists() {
+// checkCommandExists returns an error naming the first command k3sd runs that is not
+// installed.
+func checkCommandExists() error {
 	commands := []string{
 		"linkerd",
 		"step",
@@ -165,7 +323,8 @@ func checkCommandExists() {
 
 	for _, cmd := range commands {
 		if _, err := exec.LookPath(cmd); err != nil {
-			log.Fatalf("Command %s not found. Please install it.", cmd)
+			return fmt.Errorf("command %s not found, please install it", cmd)
 		}
 	}
+	return nil
 }
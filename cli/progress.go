@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Progress display modes (--progress).
+const (
+	progressAuto  = "auto"
+	progressTTY   = "tty"
+	progressPlain = "plain"
+	progressNone  = "none"
+)
+
+// failureLogLines is how many log lines of a failed step are shown under it.
+const failureLogLines = 20
+
+// progressRefresh is how often the live area of the terminal view is redrawn.
+const progressRefresh = 100 * time.Millisecond
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// stepState is the display state of a node or addon.
+//
+// Fields:
+//   - name: Node or addon name.
+//   - step: Current or last step.
+//   - started: Start of the current or last step.
+//   - command: Command the running step runs.
+//   - running: Whether a step is running.
+//   - failedStep: First step that failed, if any.
+type stepState struct {
+	name       string
+	step       string
+	started    time.Time
+	command    string
+	running    bool
+	failedStep string
+}
+
+// clusterState is the display state of a cluster: its nodes and addons in the order their
+// first step ran.
+type clusterState struct {
+	name    string
+	started time.Time
+	last    time.Time
+	nodes   []*stepState
+	addons  []*stepState
+	failed  int
+}
+
+// progressView shows the progress of an apply run. On a terminal it keeps a live area at the
+// bottom with a spinner per cluster, node and addon, the elapsed time and the running command;
+// log messages of a step are kept back and shown only if the step fails. Otherwise it prints a
+// line when a step starts and ends.
+type progressView struct {
+	out io.Writer
+	tty bool
+
+	mu       sync.Mutex
+	clusters []*clusterState
+	logs     map[utils.StepInfo][]string
+	drawn    int
+	frame    int
+	done     bool
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// newProgressView returns the progress view selected by --progress for the command, or nil
+// if the command shows no progress.
+//
+// Parameters:
+//
+//	command: The command given on the command line.
+//
+// Returns:
+//
+//	*progressView: the view, or nil.
+//	error: Error if --progress is invalid.
+func newProgressView(command string) (*progressView, error) {
+	mode := utils.ProgressMode
+	switch mode {
+	case progressAuto, progressTTY, progressPlain, progressNone:
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q (want auto, tty, plain or none)", mode)
+	}
+	if command != "" || mode == progressNone {
+		return nil, nil
+	}
+	if mode == progressAuto {
+		// the terminal view hides the step logs, so it is only used for the default output
+		mode = progressPlain
+		if term.IsTerminal(int(os.Stdout.Fd())) && utils.LogFormat == utils.LogFormatText && !utils.Verbose && utils.LogLevel == "" {
+			mode = progressTTY
+		}
+	}
+	view := &progressView{
+		out:     os.Stdout,
+		tty:     mode == progressTTY,
+		logs:    make(map[utils.StepInfo][]string),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if view.tty {
+		fmt.Fprint(view.out, "\x1b[?25l")
+		go view.refresh()
+	} else {
+		close(view.stopped)
+	}
+	return view, nil
+}
+
+// refresh redraws the live area until Stop.
+func (v *progressView) refresh() {
+	defer close(v.stopped)
+	ticker := time.NewTicker(progressRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			v.mu.Lock()
+			v.frame++
+			v.redraw()
+			v.mu.Unlock()
+		}
+	}
+}
+
+// progressContext returns ctx reporting the progress of the steps to view, if there is one.
+func progressContext(ctx context.Context, view *progressView) context.Context {
+	if view == nil {
+		return ctx
+	}
+	return utils.WithProgress(ctx, view)
+}
+
+// Stop stops the view, leaving the final state of the live area on the terminal.
+func (v *progressView) Stop() {
+	if v == nil {
+		return
+	}
+	v.stopOnce.Do(func() {
+		close(v.stop)
+		<-v.stopped
+		if v.tty {
+			v.mu.Lock()
+			v.redraw()
+			// keep the final state on the terminal; later output goes below it
+			v.drawn = 0
+			v.done = true
+			fmt.Fprint(v.out, "\x1b[?25h")
+			v.mu.Unlock()
+		}
+	})
+}
+
+// StepStarted implements utils.Progress.
+func (v *progressView) StepStarted(step utils.StepInfo) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	state := v.state(step, now)
+	state.step = step.Step
+	state.started = now
+	state.command = ""
+	state.running = true
+	if !v.tty {
+		fmt.Fprintf(v.out, "%s [%s] %s %s ...\n", now.Format("15:04:05"), step.Cluster, target(step), step.Step)
+	}
+}
+
+// StepCommand implements utils.Progress.
+func (v *progressView) StepCommand(step utils.StepInfo, command string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.state(step, time.Now()).command = command
+}
+
+// StepFinished implements utils.Progress.
+func (v *progressView) StepFinished(step utils.StepInfo, duration time.Duration, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	state := v.state(step, now)
+	state.running = false
+	state.command = ""
+	logs := v.logs[step]
+	delete(v.logs, step)
+	if err == nil {
+		if !v.tty {
+			fmt.Fprintf(v.out, "%s [%s] %s %s ok (%s)\n", now.Format("15:04:05"), step.Cluster, target(step), step.Step, duration.Round(time.Millisecond))
+		}
+		return
+	}
+	if state.failedStep == "" {
+		state.failedStep = step.Step
+	}
+	v.cluster(step.Cluster, now).failed++
+	if !v.tty {
+		fmt.Fprintf(v.out, "%s [%s] %s %s FAILED (%s): %s\n", now.Format("15:04:05"), step.Cluster, target(step), step.Step, duration.Round(time.Millisecond), utils.Redact(err.Error()))
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "✗ %s %s %s failed after %s: %s\n", step.Cluster, target(step), step.Step, duration.Round(time.Millisecond), utils.Redact(err.Error()))
+	for _, line := range logs {
+		b.WriteString("    │ " + line + "\n")
+	}
+	v.printAbove(v.out, b.String())
+}
+
+// stepLog keeps a log line of a running step, to be shown if the step fails.
+func (v *progressView) stepLog(step utils.StepInfo, line string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	logs := append(v.logs[step], line)
+	if len(logs) > failureLogLines {
+		logs = logs[len(logs)-failureLogLines:]
+	}
+	v.logs[step] = logs
+}
+
+func (v *progressView) cluster(name string, now time.Time) *clusterState {
+	for _, c := range v.clusters {
+		if c.name == name {
+			c.last = now
+			return c
+		}
+	}
+	c := &clusterState{name: name, started: now, last: now}
+	v.clusters = append(v.clusters, c)
+	return c
+}
+
+// state returns the node or addon the step acts on; steps of the cluster as a whole (such
+// as record) are shown as the cluster's "-" node.
+func (v *progressView) state(step utils.StepInfo, now time.Time) *stepState {
+	c := v.cluster(step.Cluster, now)
+	list, name := &c.nodes, step.Node
+	if step.Addon != "" {
+		list, name = &c.addons, step.Addon
+	}
+	if name == "" {
+		name = "-"
+	}
+	for _, s := range *list {
+		if s.name == name {
+			return s
+		}
+	}
+	s := &stepState{name: name}
+	*list = append(*list, s)
+	return s
+}
+
+// printAbove writes text above the live area and redraws it. The caller holds v.mu.
+func (v *progressView) printAbove(w io.Writer, text string) {
+	v.clear()
+	fmt.Fprint(w, text)
+	v.redraw()
+}
+
+// clear erases the live area. The caller holds v.mu.
+func (v *progressView) clear() {
+	if v.drawn > 0 {
+		fmt.Fprintf(v.out, "\x1b[%dA\r\x1b[J", v.drawn)
+		v.drawn = 0
+	}
+}
+
+// redraw replaces the live area with the current state. The caller holds v.mu.
+func (v *progressView) redraw() {
+	if !v.tty || v.done {
+		return
+	}
+	width := 100
+	if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+		width = w
+	}
+	now := time.Now()
+	var lines []string
+	for _, c := range v.clusters {
+		running := false
+		for _, s := range append(append([]*stepState{}, c.nodes...), c.addons...) {
+			running = running || s.running
+		}
+		end := c.last
+		if running {
+			end = now
+		}
+		lines = append(lines, fmt.Sprintf("%s %s  %s", v.icon(running, c.failed > 0), c.name, formatElapsed(end.Sub(c.started))))
+		for _, s := range c.nodes {
+			lines = append(lines, "  "+v.stepLine(s, now))
+		}
+		for _, s := range c.addons {
+			lines = append(lines, "  "+v.stepLine(s, now))
+		}
+	}
+	v.clear()
+	for _, line := range lines {
+		fmt.Fprintln(v.out, truncate(line, width-1))
+	}
+	v.drawn = len(lines)
+}
+
+func (v *progressView) stepLine(s *stepState, now time.Time) string {
+	if s.running {
+		line := fmt.Sprintf("%s %s  %s  %s", v.icon(true, false), s.name, s.step, formatElapsed(now.Sub(s.started)))
+		if s.command != "" {
+			line += "  $ " + strings.Join(strings.Fields(s.command), " ")
+		}
+		return line
+	}
+	result := "done"
+	if s.failedStep != "" {
+		result = s.failedStep + " failed"
+	}
+	return fmt.Sprintf("%s %s  %s", v.icon(false, s.failedStep != ""), s.name, result)
+}
+
+func (v *progressView) icon(running, failed bool) string {
+	switch {
+	case running:
+		return spinnerFrames[v.frame%len(spinnerFrames)]
+	case failed:
+		return "✗"
+	}
+	return "✓"
+}
+
+// target names what a step acts on: the addon, the node, or "-" for the cluster.
+func target(step utils.StepInfo) string {
+	switch {
+	case step.Addon != "":
+		return step.Addon
+	case step.Node != "":
+		return step.Node
+	}
+	return "-"
+}
+
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if width <= 1 || len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// aboveWriter writes log output above the live area of a terminal view.
+type aboveWriter struct {
+	view *progressView
+	w    io.Writer
+}
+
+func (a aboveWriter) Write(p []byte) (int, error) {
+	a.view.mu.Lock()
+	defer a.view.mu.Unlock()
+	a.view.printAbove(a.w, string(p))
+	return len(p), nil
+}
+
+// consoleWriter returns the writer of console log messages: w itself, or for a terminal view a
+// writer that prints above the live area.
+func (v *progressView) consoleWriter(w io.Writer) io.Writer {
+	if v == nil || !v.tty {
+		return w
+	}
+	return aboveWriter{view: v, w: w}
+}
+
+// handler wraps the console log handler for a terminal view: messages of a step are kept back
+// and shown only if the step fails, other messages go to the console.
+func (v *progressView) handler(console slog.Handler) slog.Handler {
+	if v == nil || !v.tty {
+		return console
+	}
+	return progressHandler{view: v, next: console}
+}
+
+// progressHandler routes log records by the step fields they carry.
+type progressHandler struct {
+	view  *progressView
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func (h progressHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h progressHandler) Handle(ctx context.Context, r slog.Record) error {
+	step := utils.StepInfo{}
+	collect := func(a slog.Attr) bool {
+		switch a.Key {
+		case utils.FieldCluster:
+			step.Cluster = a.Value.String()
+		case utils.FieldNode:
+			step.Node = a.Value.String()
+		case utils.FieldAddon:
+			step.Addon = a.Value.String()
+		case utils.FieldStep:
+			step.Step = a.Value.String()
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		collect(a)
+	}
+	r.Attrs(collect)
+	if step.Step == "" {
+		if h.next.Enabled(ctx, r.Level) {
+			return h.next.Handle(ctx, r)
+		}
+		return nil
+	}
+	message, _, _ := strings.Cut(r.Message, "\n")
+	h.view.stepLog(step, fmt.Sprintf("%-5s %s", r.Level, message))
+	return nil
+}
+
+func (h progressHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return progressHandler{view: h.view, next: h.next.WithAttrs(attrs), attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h progressHandler) WithGroup(name string) slog.Handler {
+	return progressHandler{view: h.view, next: h.next.WithGroup(name), attrs: h.attrs}
+}
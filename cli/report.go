@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	clusterpkg "github.com/argon-chat/k3sd/pkg/cluster"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/report"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// writeReports writes the JSON and JUnit reports of an apply run to the files given with
+// --report and --junit. It does nothing if neither is set.
+func writeReports(ctx context.Context, engine *k3sd.Engine, clusters []types.Cluster, summary *clusterpkg.Summary, runErr error, started time.Time) error {
+	if utils.ReportPath == "" && utils.JUnitPath == "" {
+		return nil
+	}
+	runReport := report.Build(ctx, clusters, summary, runErr, started, engine.Logger())
+	var errs []error
+	if utils.ReportPath != "" {
+		errs = append(errs, writeReportFile(utils.ReportPath, runReport, report.RenderJSON))
+	}
+	if utils.JUnitPath != "" {
+		errs = append(errs, writeReportFile(utils.JUnitPath, runReport, report.RenderJUnit))
+	}
+	return errors.Join(errs...)
+}
+
+func writeReportFile(path string, runReport *report.Report, render func(io.Writer, *report.Report) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := render(f, runReport); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/argon-chat/k3sd/pkg/secrets"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// secretUsage lists the subcommands of the secret command.
+const secretUsage = "usage: k3sd secret set|get|delete NAME, or k3sd secret list"
+
+// runSecret manages the local encrypted secret store read by secret: references. The value of
+// "set" is read from stdin, or typed without echo on a terminal, so it does not end up in the
+// shell history.
+func runSecret() error {
+	store, err := secrets.OpenStore(utils.SecretStorePath)
+	if err != nil {
+		return err
+	}
+	args := utils.CommandArgs
+	if len(args) == 0 {
+		return errors.New(secretUsage)
+	}
+	if args[0] == "list" {
+		names, err := store.Names()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if len(args) != 2 {
+		return errors.New(secretUsage)
+	}
+	name := args[1]
+	switch args[0] {
+	case "set":
+		value, err := readSecretValue(name)
+		if err != nil {
+			return err
+		}
+		if err := store.Set(name, value); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Stored %s in %s; refer to it as %s%s\n", name, store.Path(), secrets.SchemeSecret, name)
+		return nil
+	case "get":
+		value, err := store.Get(name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	case "delete":
+		return store.Delete(name)
+	}
+	return errors.New(secretUsage)
+}
+
+// readSecretValue reads the value of a secret from stdin: one line typed without echo on a
+// terminal, all of it without trailing line breaks otherwise.
+func readSecretValue(name string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "Value of %s: ", name)
+		value, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(value), err
+	}
+	value, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(value), "\r\n"), nil
+}
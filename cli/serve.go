@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/server"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// runServe serves the REST API until ctx is cancelled by SIGINT or SIGTERM.
+func runServe(ctx context.Context, engine *k3sd.Engine) error {
+	token, err := apiToken()
+	if err != nil {
+		return err
+	}
+	srv, err := server.New(server.Options{
+		ConfigPath:  utils.ConfigPath,
+		Environment: utils.Environment,
+		Listen:      utils.ListenAddr,
+		Token:       token,
+	}, engine)
+	if err != nil {
+		return err
+	}
+	return srv.Run(ctx)
+}
+
+// apiToken reads the API token from --api-token-file, or from K3SD_API_TOKEN if no file is given.
+// The token is never taken from a flag value, which would expose it in the process list.
+func apiToken() (string, error) {
+	if utils.APITokenFile != "" {
+		data, err := os.ReadFile(utils.APITokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading API token: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if token := os.Getenv("K3SD_API_TOKEN"); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("no API token: set K3SD_API_TOKEN or pass --api-token-file")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/status"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// runStatus prints the live status of the selected clusters in the requested output format.
+func runStatus(ctx context.Context, engine *k3sd.Engine, clusters []types.Cluster) error {
+	if err := engine.ResolveSecrets(ctx, clusters); err != nil {
+		return err
+	}
+	statuses := engine.Status(ctx, clusters, utils.Selection)
+	switch utils.OutputFormat {
+	case "json":
+		return status.RenderJSON(os.Stdout, statuses)
+	case "table", "":
+		return status.RenderTable(os.Stdout, statuses)
+	default:
+		return fmt.Errorf("unknown output format %q", utils.OutputFormat)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	clusterstorepkg "github.com/argon-chat/k3sd/pkg/clusterstore"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/lock"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// lockConfig locks the config file against concurrent runs, taking over an abandoned lock.
+func lockConfig(configPath string) (*lock.Held, error) {
+	held, stale, err := lock.File(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if stale != nil {
+		log.Printf("taking over stale lock on %s", stale)
+	}
+	return held, nil
+}
+
+// runForceUnlock removes the lock of the config file and the database locks of the selected
+// clusters, for locks left behind by a run that was killed or lost its host.
+func runForceUnlock(ctx context.Context, engine *k3sd.Engine) error {
+	owner, err := lock.ForceUnlockFile(utils.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		fmt.Printf("Removed lock of %s held by %s\n", utils.ConfigPath, owner)
+	}
+	clusters, err := clusterstorepkg.LoadEnvironment(utils.ConfigPath, utils.Environment)
+	if err != nil {
+		return err
+	}
+	removed, err := engine.Unlock(ctx, clusters, utils.Selection)
+	if err != nil {
+		return err
+	}
+	for _, l := range removed {
+		fmt.Printf("Removed lock %s held by %s@%s (pid %d) since %s\n", l.Key, l.Owner, l.Host, l.PID, l.AcquiredAt.Format("2006-01-02 15:04:05"))
+	}
+	if owner == nil && len(removed) == 0 {
+		fmt.Println("No locks found.")
+	}
+	return nil
+}
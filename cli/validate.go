@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	clusterstorepkg "github.com/argon-chat/k3sd/pkg/clusterstore"
+	"github.com/argon-chat/k3sd/pkg/utils"
+	"github.com/argon-chat/k3sd/pkg/validate"
+)
+
+// validateResult is the outcome of validating a config file.
+//
+// Fields:
+//   - File: Path of the config file.
+//   - Valid: Whether the config can be used.
+//   - Clusters: Number of clusters in a valid config.
+//   - Problems: Problems found in the config.
+//   - Error: Error reading or decoding the config, if it has no problems listed.
+type validateResult struct {
+	File     string             `json:"file"`
+	Valid    bool               `json:"valid"`
+	Clusters int                `json:"clusters"`
+	Problems []validate.Problem `json:"problems,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// runValidate validates the config file, or every config file of a directory, without
+// connecting to any cluster, and prints the problems found in the requested output format.
+func runValidate() error {
+	files, err := clusterstorepkg.ListConfigFiles(utils.ConfigPath)
+	if err != nil {
+		return &utils.ConfigError{Source: utils.ConfigPath, Err: err}
+	}
+	results := make([]validateResult, 0, len(files))
+	invalid := 0
+	for _, file := range files {
+		result := validateResult{File: file}
+		clusters, err := clusterstorepkg.LoadEnvironment(file, utils.Environment)
+		var problems *validate.Error
+		var configErr *utils.ConfigError
+		switch {
+		case errors.As(err, &problems):
+			result.Problems = problems.Problems
+		case errors.As(err, &configErr):
+			result.Error = configErr.Err.Error()
+		case err != nil:
+			result.Error = err.Error()
+		default:
+			result.Valid = true
+			result.Clusters = len(clusters)
+		}
+		if !result.Valid {
+			invalid++
+		}
+		results = append(results, result)
+	}
+	switch utils.OutputFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	case "table", "":
+		for _, result := range results {
+			switch {
+			case result.Valid:
+				fmt.Printf("%s: valid (clusters: %d)\n", result.File, result.Clusters)
+			case result.Error != "":
+				fmt.Printf("%s: %s\n", result.File, result.Error)
+			default:
+				fmt.Printf("%s: invalid (problems: %d)\n", result.File, len(result.Problems))
+				for _, problem := range result.Problems {
+					fmt.Printf("  %s\n", problem)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown output format %q", utils.OutputFormat)
+	}
+	if invalid > 0 {
+		return &utils.ConfigError{Source: utils.ConfigPath, Err: fmt.Errorf("%d of %d config files are invalid", invalid, len(files))}
+	}
+	return nil
+}
+
+// runSchema prints the JSON Schema of cluster configs.
+func runSchema() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(validate.ConfigSchema())
+}
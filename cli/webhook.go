@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/argon-chat/k3sd/pkg/notify"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// loadWebhooks reads the global webhooks from the JSON file given with --webhooks, a list in
+// the format of a cluster's "webhooks" field. Without the flag there are none.
+func loadWebhooks(path string) ([]types.Webhook, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &utils.ConfigError{Source: path, Err: err}
+	}
+	var webhooks []types.Webhook
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, &utils.ConfigError{Source: path, Err: err}
+	}
+	return webhooks, nil
+}
+
+// runWebhookTest posts a test event to the global webhooks and those of the selected clusters
+// and prints the outcome per webhook.
+func runWebhookTest(ctx context.Context, global []types.Webhook, clusters []types.Cluster) error {
+	failed := 0
+	report := func(scope string, webhooks []types.Webhook, results []error) {
+		for wi, err := range results {
+			if err != nil {
+				failed++
+				fmt.Printf("%-12s %-40s FAILED: %s\n", scope, webhookHost(webhooks[wi]), utils.Redact(err.Error()))
+				continue
+			}
+			fmt.Printf("%-12s %-40s ok\n", scope, webhookHost(webhooks[wi]))
+		}
+	}
+	total := len(global)
+	report("global", global, notify.Test(ctx, global, ""))
+	for ci := range clusters {
+		if !utils.Selection.MatchCluster(clusters[ci].Context) || len(clusters[ci].Webhooks) == 0 {
+			continue
+		}
+		name := clusters[ci].DisplayName()
+		total += len(clusters[ci].Webhooks)
+		report(name, clusters[ci].Webhooks, notify.Test(ctx, clusters[ci].Webhooks, name))
+	}
+	if total == 0 {
+		return errors.New("no webhooks configured")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d webhooks failed", failed, total)
+	}
+	return nil
+}
+
+// webhookHost returns the host of a webhook URL for display; the full URL may hold a token.
+func webhookHost(webhook types.Webhook) string {
+	if host := notify.Host(webhook.URL); host != "" {
+		return host
+	}
+	return "(invalid URL)"
+}
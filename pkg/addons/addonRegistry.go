@@ -1,6 +1,9 @@
 package addons
 
 import (
+	"context"
+	"sort"
+
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
@@ -10,35 +13,106 @@ import (
 // Fields:
 //   - Up: Function to apply (install/upgrade) the addon.
 //   - Down: Function to delete (uninstall) the addon.
+//   - Release: Helm release installed by the addon, if any (used for health checks).
+//   - Deployments: Deployments that must be ready for the addon to be healthy.
+//   - Manifests: Returns the manifests the addon applies for a cluster (used for drift detection).
 type AddonMigration struct {
-	Up   func(*types.Cluster, *utils.Logger)
-	Down func(*types.Cluster, *utils.Logger)
+	Up          func(context.Context, *types.Cluster, *utils.Logger) error
+	Down        func(context.Context, *types.Cluster, *utils.Logger) error
+	Release     *Workload
+	Deployments []Workload
+	Manifests   func(context.Context, *types.Cluster) []Manifest
+}
+
+// Workload identifies a namespaced Kubernetes object (deployment or Helm release) owned by an addon.
+//
+// Fields:
+//   - Name: Object name.
+//   - Namespace: Object namespace.
+type Workload struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// Manifest is a manifest applied by an addon, together with its substitutions.
+//
+// Fields:
+//   - Name: Component name used in log messages.
+//   - Path: Path or URL of the manifest.
+//   - Subs: Substitutions applied to the manifest before it is applied.
+type Manifest struct {
+	Name string
+	Path string
+	Subs map[string]string
 }
 
 // AddonRegistry maps addon names to their migration logic (Up/Down).
 var AddonRegistry = map[string]AddonMigration{
 	"cert-manager": {
-		Up:   ApplyCertManagerAddon,
-		Down: DeleteCertManagerAddon,
+		Up:        ApplyCertManagerAddon,
+		Down:      DeleteCertManagerAddon,
+		Manifests: certManagerManifests,
+		Deployments: []Workload{
+			{Name: "cert-manager", Namespace: "cert-manager"},
+			{Name: "cert-manager-cainjector", Namespace: "cert-manager"},
+			{Name: "cert-manager-webhook", Namespace: "cert-manager"},
+		},
 	},
 	"traefik": {
-		Up:   ApplyTraefikAddon,
-		Down: DeleteTraefikAddon,
+		Up:          ApplyTraefikAddon,
+		Down:        DeleteTraefikAddon,
+		Manifests:   traefikManifests,
+		Release:     &Workload{Name: "traefik", Namespace: "kube-system"},
+		Deployments: []Workload{{Name: "traefik", Namespace: "kube-system"}},
 	},
 	"prometheus": {
-		Up:   ApplyPrometheusAddon,
-		Down: DeletePrometheusAddon,
+		Up:      ApplyPrometheusAddon,
+		Down:    DeletePrometheusAddon,
+		Release: &Workload{Name: "kube-prom-stack", Namespace: "monitoring"},
 	},
 	"cluster-issuer": {
-		Up:   ApplyClusterIssuerAddon,
-		Down: DeleteClusterIssuerAddon,
+		Up:        ApplyClusterIssuerAddon,
+		Down:      DeleteClusterIssuerAddon,
+		Manifests: clusterIssuerManifests,
 	},
 	"gitea": {
-		Up:   ApplyGiteaAddon,
-		Down: DeleteGiteaAddon,
+		Up:          ApplyGiteaAddon,
+		Down:        DeleteGiteaAddon,
+		Manifests:   giteaManifests,
+		Deployments: []Workload{{Name: "gitea", Namespace: "default"}},
 	},
 	"linkerd": {
 		Up:   ApplyLinkerdAddon,
 		Down: DeleteLinkerdAddon,
+		Deployments: []Workload{
+			{Name: "linkerd-identity", Namespace: "linkerd"},
+			{Name: "linkerd-destination", Namespace: "linkerd"},
+			{Name: "linkerd-proxy-injector", Namespace: "linkerd"},
+		},
 	},
 }
+
+// AddonVariants maps the addons that are configured under a name of their own but applied by
+// another addon of the registry to that addon: gitea-ingress is applied with gitea, and
+// linkerd-mc installs linkerd with multicluster support.
+var AddonVariants = map[string]string{
+	"gitea-ingress": "gitea",
+	"linkerd-mc":    "linkerd",
+}
+
+// Names returns the names of all addons a config may configure, sorted: those of the registry
+// and their variants.
+//
+// Returns:
+//   - []string: The addon names.
+func Names() []string {
+	names := make([]string, 0, len(AddonRegistry)+len(AddonVariants))
+	for name := range AddonRegistry {
+		names = append(names, name)
+	}
+	for name := range AddonVariants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,57 +1,87 @@
 package addons
 
 import (
+	"context"
+	"errors"
+
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
 
+const (
+	certManagerManifestURL = "https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.yaml"
+	certManagerCRDsURL     = "https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.crds.yaml"
+)
+
 // ApplyCertManagerAddon installs and configures the cert-manager addon on the cluster if enabled.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to apply the addon to.
 //	logger: Logger for output.
-func ApplyCertManagerAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if a manifest cannot be applied or a deployment does not become ready.
+func ApplyCertManagerAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
 	addon, ok := cluster.Addons["cert-manager"]
 	if !ok || !addon.Enabled {
-		return
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	applyCertManager(kubeconfig, logger, &addon)
+	return applyCertManager(ctx, cluster, kubeconfig, logger)
+}
+
+func applyCertManager(ctx context.Context, cluster *types.Cluster, kubeconfigPath string, logger *utils.Logger) error {
+	var errs []error
+	for _, m := range certManagerManifests(ctx, cluster) {
+		errs = append(errs, clusterutils.ApplyComponentYAML(ctx, m.Name, kubeconfigPath, m.Path, logger, m.Subs))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	logger.Log("Waiting for cert-manager-webhook deployment to be ready...")
+	for _, deployment := range []string{"cert-manager", "cert-manager-cainjector", "cert-manager-webhook"} {
+		if err := clusterutils.WaitForDeploymentReady(ctx, kubeconfigPath, deployment, "cert-manager", logger); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func applyCertManager(kubeconfigPath string, logger *utils.Logger, addon *types.AddonConfig) {
+func certManagerManifests(_ context.Context, cluster *types.Cluster) []Manifest {
+	addon := cluster.Addons["cert-manager"]
 	manifestPath := addon.Path
 	if manifestPath == "" {
-		manifestPath = "https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.yaml"
+		manifestPath = certManagerManifestURL
+	}
+	return []Manifest{
+		{Name: "cert-manager", Path: manifestPath, Subs: addon.Subs},
+		{Name: "cert-manager CRDs", Path: certManagerCRDsURL},
 	}
-	clusterutils.ApplyComponentYAML("cert-manager", kubeconfigPath, manifestPath, logger, addon.Subs)
-	crdsPath := "https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.crds.yaml"
-	clusterutils.ApplyComponentYAML("cert-manager CRDs", kubeconfigPath, crdsPath, logger, nil)
-	logger.Log("Waiting for cert-manager-webhook deployment to be ready...")
-	clusterutils.WaitForDeploymentReady(kubeconfigPath, "cert-manager", "cert-manager", logger)
-	clusterutils.WaitForDeploymentReady(kubeconfigPath, "cert-manager-cainjector", "cert-manager", logger)
-	clusterutils.WaitForDeploymentReady(kubeconfigPath, "cert-manager-webhook", "cert-manager", logger)
 }
 
 // DeleteCertManagerAddon uninstalls the cert-manager addon and its CRDs from the cluster.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to uninstall the addon from.
 //	logger: Logger for output.
-func DeleteCertManagerAddon(cluster *types.Cluster, logger *utils.Logger) {
-	addon, ok := cluster.Addons["cert-manager"]
-	if !ok {
-		return
+//
+// Returns:
+//
+//	Error if a manifest cannot be deleted.
+func DeleteCertManagerAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+	if _, ok := cluster.Addons["cert-manager"]; !ok {
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	manifestPath := addon.Path
-	if manifestPath == "" {
-		manifestPath = "https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.yaml"
+	var errs []error
+	for _, m := range certManagerManifests(ctx, cluster) {
+		errs = append(errs, clusterutils.DeleteComponentYAML(ctx, m.Name, kubeconfig, m.Path, logger, m.Subs))
 	}
-	clusterutils.DeleteComponentYAML("cert-manager", kubeconfig, manifestPath, logger, addon.Subs)
-	crdsPath := "https://github.com/cert-manager/cert-manager/releases/download/v1.17.2/cert-manager.crds.yaml"
-	clusterutils.DeleteComponentYAML("cert-manager CRDs", kubeconfig, crdsPath, logger, nil)
+	return errors.Join(errs...)
 }
@@ -1,6 +1,9 @@
 package addons
 
 import (
+	"context"
+	"errors"
+
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
@@ -10,41 +13,58 @@ import (
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to apply the addon to.
 //	logger: Logger for output.
-func ApplyClusterIssuerAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if the manifest cannot be applied.
+func ApplyClusterIssuerAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
 	addon, ok := cluster.Addons["cluster-issuer"]
 	if !ok || !addon.Enabled {
-		return
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	applyClusterIssuer(kubeconfig, logger, &addon)
+	return applyClusterIssuer(ctx, cluster, kubeconfig, logger)
+}
+
+func applyClusterIssuer(ctx context.Context, cluster *types.Cluster, kubeconfigPath string, logger *utils.Logger) error {
+	var errs []error
+	for _, m := range clusterIssuerManifests(ctx, cluster) {
+		errs = append(errs, clusterutils.ApplyComponentYAML(ctx, m.Name, kubeconfigPath, m.Path, logger, m.Subs))
+	}
+	return errors.Join(errs...)
 }
 
-func applyClusterIssuer(kubeconfigPath string, logger *utils.Logger, addon *types.AddonConfig) {
-	substitutions := addon.Subs
+func clusterIssuerManifests(ctx context.Context, cluster *types.Cluster) []Manifest {
+	addon := cluster.Addons["cluster-issuer"]
 	manifestPath := addon.Path
 	if manifestPath == "" {
-		manifestPath = clusterutils.ResolveYamlPath("clusterissuer.yaml")
+		manifestPath = clusterutils.ResolveYamlPath(ctx, "clusterissuer.yaml")
 	}
-	clusterutils.ApplyComponentYAML("clusterissuer", kubeconfigPath, manifestPath, logger, substitutions)
+	return []Manifest{{Name: "clusterissuer", Path: manifestPath, Subs: addon.Subs}}
 }
 
 // DeleteClusterIssuerAddon uninstalls the ClusterIssuer addon from the cluster.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to uninstall the addon from.
 //	logger: Logger for output.
-func DeleteClusterIssuerAddon(cluster *types.Cluster, logger *utils.Logger) {
-	addon, ok := cluster.Addons["cluster-issuer"]
-	if !ok {
-		return
+//
+// Returns:
+//
+//	Error if the manifest cannot be deleted.
+func DeleteClusterIssuerAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+	if _, ok := cluster.Addons["cluster-issuer"]; !ok {
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	manifestPath := addon.Path
-	if manifestPath == "" {
-		manifestPath = clusterutils.ResolveYamlPath("clusterissuer.yaml")
+	var errs []error
+	for _, m := range clusterIssuerManifests(ctx, cluster) {
+		errs = append(errs, clusterutils.DeleteComponentYAML(ctx, m.Name, kubeconfig, m.Path, logger, m.Subs))
 	}
-	clusterutils.DeleteComponentYAML("clusterissuer", kubeconfig, manifestPath, logger, addon.Subs)
+	return errors.Join(errs...)
 }
@@ -1,75 +1,98 @@
 package addons
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
 
-// ApplyCustomAddons installs all enabled custom addons (manifest or Helm) for the given cluster
-// or uninstalls them if they are not enabled.
+// ApplyCustomAddon installs the manifest and/or Helm chart of a single custom addon.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	name: Name of the custom addon in the cluster config.
+//	cluster: The cluster to apply the addon to.
+//	logger: Logger for output.
+//
+// Returns:
+//
+//	Error if the addon is incomplete or cannot be installed.
+func ApplyCustomAddon(ctx context.Context, name string, cluster *types.Cluster, logger *utils.Logger) error {
+	addon, ok := cluster.CustomAddons[name]
+	if !ok {
+		return nil
+	}
+	var errs []error
+	if addon.Manifest != nil {
+		errs = append(errs, applyCustomManifestAddon(ctx, name, cluster, addon.Manifest, logger))
+	}
+	if addon.Helm != nil {
+		errs = append(errs, applyCustomHelmAddon(ctx, name, cluster, addon.Helm, logger))
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteCustomAddon uninstalls the manifest and/or Helm release of a single custom addon.
 //
 // Parameters:
 //
-//	cluster: The cluster to apply custom addons to.
+//	ctx: Context of the operation.
+//	name: Name of the custom addon in the cluster config.
+//	cluster: The cluster to uninstall the addon from.
 //	logger: Logger for output.
-func ApplyCustomAddons(cluster *types.Cluster, logger *utils.Logger, version *types.Cluster) {
-	for name, addon := range cluster.CustomAddons {
-		migrationStatus := clusterutils.ComputeAddonMigrationStatus(name, cluster, version, true)
-		switch migrationStatus {
-		case clusterutils.AddonApply:
-			logger.Log("Applying custom addon '%s' for cluster '%s'", name, cluster.Address)
-			if addon.Manifest != nil {
-				applyCustomManifestAddon(name, cluster, addon.Manifest, logger)
-			}
-			if addon.Helm != nil {
-				applyCustomHelmAddon(name, cluster, addon.Helm, logger)
-			}
-			break
-		case clusterutils.AddonDelete:
-			logger.Log("Deleting custom addon '%s' for cluster '%s'", name, cluster.Address)
-			if addon.Manifest != nil {
-				deleteCustomManifestAddon(name, cluster, addon.Manifest, logger)
-			}
-			if addon.Helm != nil {
-				deleteCustomHelmAddon(name, cluster, addon.Helm, logger)
-			}
-			break
-		case clusterutils.AddonNoop:
-			break
-		}
+//
+// Returns:
+//
+//	Error if the addon is incomplete or cannot be uninstalled.
+func DeleteCustomAddon(ctx context.Context, name string, cluster *types.Cluster, logger *utils.Logger) error {
+	addon, ok := cluster.CustomAddons[name]
+	if !ok {
+		return nil
+	}
+	var errs []error
+	if addon.Manifest != nil {
+		errs = append(errs, deleteCustomManifestAddon(ctx, name, cluster, addon.Manifest, logger))
+	}
+	if addon.Helm != nil {
+		errs = append(errs, deleteCustomHelmAddon(ctx, name, cluster, addon.Helm, logger))
 	}
+	return errors.Join(errs...)
 }
 
-func applyCustomManifestAddon(name string, cluster *types.Cluster, manifest *types.ManifestConfig, logger *utils.Logger) {
+func applyCustomManifestAddon(ctx context.Context, name string, cluster *types.Cluster, manifest *types.ManifestConfig, logger *utils.Logger) error {
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
 	manifestPath := manifest.Path
 	subs := manifest.Subs
 	if manifestPath == "" {
 		logger.Log("Custom manifest addon '%s' missing path", name)
-		return
+		return &utils.ConfigError{Source: "customAddons." + name, Err: errors.New("manifest path is missing")}
 	}
 	logger.Log("Applying custom manifest addon '%s' from %s", name, manifestPath)
-	clusterutils.ApplyComponentYAML(name, kubeconfig, manifestPath, logger, subs)
+	return clusterutils.ApplyComponentYAML(ctx, name, kubeconfig, manifestPath, logger, subs)
 }
 
-func deleteCustomManifestAddon(name string, cluster *types.Cluster, manifest *types.ManifestConfig, logger *utils.Logger) {
+func deleteCustomManifestAddon(ctx context.Context, name string, cluster *types.Cluster, manifest *types.ManifestConfig, logger *utils.Logger) error {
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
 	manifestPath := manifest.Path
 	subs := manifest.Subs
 	if manifestPath == "" {
 		logger.Log("Custom manifest addon '%s' missing path", name)
-		return
+		return &utils.ConfigError{Source: "customAddons." + name, Err: errors.New("manifest path is missing")}
 	}
 	logger.Log("Deleting custom manifest addon '%s' from %s", name, manifestPath)
-	clusterutils.DeleteComponentYAML(name, kubeconfig, manifestPath, logger, subs)
+	return clusterutils.DeleteComponentYAML(ctx, name, kubeconfig, manifestPath, logger, subs)
 }
 
-func applyCustomHelmAddon(name string, cluster *types.Cluster, helm *types.HelmConfig, logger *utils.Logger) {
+func applyCustomHelmAddon(ctx context.Context, name string, cluster *types.Cluster, helm *types.HelmConfig, logger *utils.Logger) error {
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
 	if helm.Chart == "" || helm.Repo.URL == "" {
 		logger.Log("Custom Helm addon '%s' missing chart or repo URL", name)
-		return
+		return &utils.ConfigError{Source: "customAddons." + name, Err: errors.New("helm chart or repo URL is missing")}
 	}
 	logger.Log("Installing custom Helm addon '%s' (chart: %s, repo: %s)", name, helm.Chart, helm.Repo.URL)
 	namespace := helm.Namespace
@@ -77,6 +100,7 @@ func applyCustomHelmAddon(name string, cluster *types.Cluster, helm *types.HelmC
 		namespace = "default"
 	}
 	err := clusterutils.InstallHelmChart(
+		ctx,
 		kubeconfig,
 		name,
 		namespace,
@@ -89,21 +113,25 @@ func applyCustomHelmAddon(name string, cluster *types.Cluster, helm *types.HelmC
 	)
 	if err != nil {
 		logger.LogErr("Helm install failed for custom addon '%s': %v", name, err)
+		return fmt.Errorf("custom Helm addon %s: %w", name, err)
 	}
+	return nil
 }
 
-func deleteCustomHelmAddon(name string, cluster *types.Cluster, helm *types.HelmConfig, logger *utils.Logger) {
+func deleteCustomHelmAddon(ctx context.Context, name string, cluster *types.Cluster, helm *types.HelmConfig, logger *utils.Logger) error {
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
 	if helm.Chart == "" || helm.Repo.URL == "" {
 		logger.Log("Custom Helm addon '%s' missing chart or repo URL", name)
-		return
+		return &utils.ConfigError{Source: "customAddons." + name, Err: errors.New("helm chart or repo URL is missing")}
 	}
 	namespace := helm.Namespace
 	if namespace == "" {
 		namespace = "default"
 	}
 	logger.Log("Uninstalling custom Helm addon '%s' (chart: %s, repo: %s)", name, helm.Chart, helm.Repo.URL)
-	if err := clusterutils.UninstallHelmRelease(kubeconfig, name, namespace, logger); err != nil {
+	if err := clusterutils.UninstallHelmRelease(ctx, kubeconfig, name, namespace, logger); err != nil {
 		logger.LogErr("Helm uninstall failed for custom addon '%s': %v", name, err)
+		return fmt.Errorf("custom Helm addon %s: %w", name, err)
 	}
+	return nil
 }
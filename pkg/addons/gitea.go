@@ -1,6 +1,9 @@
 package addons
 
 import (
+	"context"
+	"errors"
+
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
@@ -10,22 +13,44 @@ import (
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to apply the addon to.
 //	logger: Logger for output.
-func ApplyGiteaAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if a manifest cannot be applied or Gitea does not become ready.
+func ApplyGiteaAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
 	addon, ok := cluster.Addons["gitea"]
 	if !ok || !addon.Enabled {
-		return
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	applyGitea(cluster, kubeconfig, logger, &addon)
+	return applyGitea(ctx, cluster, kubeconfig, logger)
 }
 
-func applyGitea(clusterObj *types.Cluster, kubeconfigPath string, logger *utils.Logger, addon *types.AddonConfig) {
-	substitutions := addon.Subs
-	if substitutions == nil {
-		substitutions = make(map[string]string)
+func applyGitea(ctx context.Context, clusterObj *types.Cluster, kubeconfigPath string, logger *utils.Logger) error {
+	var errs []error
+	for _, m := range giteaManifests(ctx, clusterObj) {
+		errs = append(errs, clusterutils.ApplyComponentYAML(ctx, m.Name, kubeconfigPath, m.Path, logger, m.Subs))
 	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return clusterutils.WaitForDeploymentReady(ctx, kubeconfigPath, "gitea", "default", logger)
+}
+
+func giteaManifests(ctx context.Context, clusterObj *types.Cluster) []Manifest {
+	manifests := []Manifest{giteaManifest(ctx, clusterObj)}
+	if ingressAddon, ok := clusterObj.Addons["gitea-ingress"]; ok && ingressAddon.Enabled {
+		manifests = append(manifests, giteaIngressManifest(ctx, clusterObj))
+	}
+	return manifests
+}
+
+func giteaManifest(ctx context.Context, clusterObj *types.Cluster) Manifest {
+	addon := clusterObj.Addons["gitea"]
+	substitutions := copySubs(addon.Subs)
 	if substitutions["${POSTGRES_USER}"] == "" {
 		substitutions["${POSTGRES_USER}"] = "gitea"
 	}
@@ -37,52 +62,53 @@ func applyGitea(clusterObj *types.Cluster, kubeconfigPath string, logger *utils.
 	}
 	manifestPath := addon.Path
 	if manifestPath == "" {
-		manifestPath = clusterutils.ResolveYamlPath("gitea.yaml")
-	}
-	clusterutils.ApplyComponentYAML("gitea", kubeconfigPath, manifestPath, logger, substitutions)
-	if ingressAddon, ok := clusterObj.Addons["gitea-ingress"]; ok && ingressAddon.Enabled {
-		applyGiteaIngress(clusterObj, kubeconfigPath, logger, &ingressAddon)
+		manifestPath = clusterutils.ResolveYamlPath(ctx, "gitea.yaml")
 	}
-	clusterutils.WaitForDeploymentReady(kubeconfigPath, "gitea", "default", logger)
+	return Manifest{Name: "gitea", Path: manifestPath, Subs: substitutions}
 }
 
-func applyGiteaIngress(clusterObj *types.Cluster, kubeconfigPath string, logger *utils.Logger, addon *types.AddonConfig) {
-	substitutions := addon.Subs
-	if substitutions == nil {
-		substitutions = make(map[string]string)
-	}
+func giteaIngressManifest(ctx context.Context, clusterObj *types.Cluster) Manifest {
+	addon := clusterObj.Addons["gitea-ingress"]
+	substitutions := copySubs(addon.Subs)
 	if substitutions["${DOMAIN}"] == "" {
 		substitutions["${DOMAIN}"] = clusterObj.Domain
 	}
 	manifestPath := addon.Path
 	if manifestPath == "" {
-		manifestPath = clusterutils.ResolveYamlPath("gitea.ingress.yaml")
+		manifestPath = clusterutils.ResolveYamlPath(ctx, "gitea.ingress.yaml")
+	}
+	return Manifest{Name: "gitea-ingress", Path: manifestPath, Subs: substitutions}
+}
+
+func copySubs(subs map[string]string) map[string]string {
+	result := make(map[string]string, len(subs))
+	for k, v := range subs {
+		result[k] = v
 	}
-	clusterutils.ApplyComponentYAML("gitea-ingress", kubeconfigPath, manifestPath, logger, substitutions)
+	return result
 }
 
 // DeleteGiteaAddon uninstalls the Gitea addon and its ingress from the cluster.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to uninstall the addon from.
 //	logger: Logger for output.
-func DeleteGiteaAddon(cluster *types.Cluster, logger *utils.Logger) {
-	addon, ok := cluster.Addons["gitea"]
-	if !ok {
-		return
+//
+// Returns:
+//
+//	Error if a manifest cannot be deleted.
+func DeleteGiteaAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+	if _, ok := cluster.Addons["gitea"]; !ok {
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	manifestPath := addon.Path
-	if manifestPath == "" {
-		manifestPath = clusterutils.ResolveYamlPath("gitea.yaml")
-	}
-	clusterutils.DeleteComponentYAML("gitea", kubeconfig, manifestPath, logger, addon.Subs)
-	if ingressAddon, ok := cluster.Addons["gitea-ingress"]; ok {
-		manifestPath := ingressAddon.Path
-		if manifestPath == "" {
-			manifestPath = clusterutils.ResolveYamlPath("gitea.ingress.yaml")
-		}
-		clusterutils.DeleteComponentYAML("gitea-ingress", kubeconfig, manifestPath, logger, ingressAddon.Subs)
+	m := giteaManifest(ctx, cluster)
+	err := clusterutils.DeleteComponentYAML(ctx, m.Name, kubeconfig, m.Path, logger, m.Subs)
+	if _, ok := cluster.Addons["gitea-ingress"]; ok {
+		m := giteaIngressManifest(ctx, cluster)
+		err = errors.Join(err, clusterutils.DeleteComponentYAML(ctx, m.Name, kubeconfig, m.Path, logger, m.Subs))
 	}
+	return err
 }
@@ -2,53 +2,70 @@ package addons
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"path"
+	"strings"
 
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
 
-var LinkChannel = []*types.Cluster{}
-
-func runStepCertCreate(args []string, logger *utils.Logger) {
-	cmd := exec.Command("step", args...)
-	outPipe, _ := cmd.StdoutPipe()
-	errPipe, _ := cmd.StderrPipe()
-	_ = cmd.Start()
-	go clusterutils.StreamOutput(outPipe, false, logger)
-	go clusterutils.StreamOutput(errPipe, true, logger)
-	_ = cmd.Wait()
+func runStepCertCreate(ctx context.Context, args []string, logger *utils.Logger) error {
+	cmd := utils.ExecCommand(ctx, "step", args...)
+	if err := clusterutils.PipeAndLog(cmd, logger); err != nil {
+		return fmt.Errorf("step %s: %w", strings.Join(args[:2], " "), err)
+	}
 	logger.Log("Command executed successfully")
+	return nil
 }
 
 // ApplyLinkerdAddon installs and configures Linkerd or Linkerd multicluster on the cluster if enabled.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to apply the addon to.
 //	logger: Logger for output.
-func ApplyLinkerdAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if the certificates cannot be created or Linkerd cannot be installed.
+func ApplyLinkerdAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
 	linkerd, ok := cluster.Addons["linkerd"]
 	linkerdMC, okMC := cluster.Addons["linkerd-mc"]
 	multicluster := okMC && linkerdMC.Enabled
 	standard := ok && linkerd.Enabled
 	if !multicluster && !standard {
-		return
+		return nil
 	}
-	runLinkerdInstall(cluster, logger, multicluster)
+	return runLinkerdInstall(ctx, cluster, logger, multicluster)
 }
 
-func LinkClusters(cluster *types.Cluster, otherClusters *[]types.Cluster, logger *utils.Logger) {
+// LinkClusters links the cluster to the clusters in its LinksTo list with Linkerd multicluster,
+// and unlinks the clusters that no longer exist or no longer run Linkerd.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	cluster: The cluster to link from.
+//	otherClusters: All clusters of the config.
+//	logger: Logger for output.
+//
+// Returns:
+//
+//	Error joining the failures of the individual links.
+func LinkClusters(ctx context.Context, cluster *types.Cluster, otherClusters *[]types.Cluster, logger *utils.Logger) error {
 	_, kubeconfig := getLinkerdPaths(logger.Id, cluster.NodeName)
 	if len(cluster.LinksTo) == 0 {
 		logger.Log("No links to other clusters defined for %s", cluster.NodeName)
 	}
+	var errs []error
 	for _, link := range cluster.LinksTo {
 		var otherCluster *types.Cluster
 		for _, c := range *otherClusters {
@@ -71,12 +88,12 @@ func LinkClusters(cluster *types.Cluster, otherClusters *[]types.Cluster, logger
 			}
 		}
 		if shouldUnlink {
-			UnlinkLinkerdGateway(cluster, link, logger)
+			errs = append(errs, UnlinkLinkerdGateway(ctx, cluster, link, logger))
 			continue
 		}
 
 		alreadyLinked := false
-		gateways, err := getCurrentLinkerdGateways(cluster, logger)
+		gateways, err := GetLinkerdGateways(ctx, cluster, logger)
 		if err == nil {
 			for _, gw := range gateways {
 				if gw.ClusterName == otherCluster.Context {
@@ -100,18 +117,26 @@ func LinkClusters(cluster *types.Cluster, otherClusters *[]types.Cluster, logger
 			fmt.Sprintf("--api-server-address=https://%s:6443", otherCluster.Address),
 		}
 		logger.Log("Linking to cluster %s with command: linkerd multicluster %v", link, args)
-		runLinkerdCmd("multicluster", args, logger, kubeconfig, true)
+		if err := runLinkerdCmd(ctx, "multicluster", args, logger, kubeconfig, true); err != nil {
+			errs = append(errs, fmt.Errorf("link %s to %s: %w", cluster.NodeName, link, err))
+			continue
+		}
 		logger.Log("Successfully linked to cluster %s", link)
 	}
+	return errors.Join(errs...)
 }
 
-func runLinkerdInstall(cluster *types.Cluster, logger *utils.Logger, multicluster bool) {
+func runLinkerdInstall(ctx context.Context, cluster *types.Cluster, logger *utils.Logger, multicluster bool) error {
 	dir, kubeconfig := getLinkerdPaths(logger.Id, cluster.NodeName)
 	// clusterutils.ApplyComponentYAML("gateway CRDs", kubeconfig, "https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.2.1/standard-install.yaml", logger, nil)
-	runLinkerdCmd("check", []string{"--pre", "--kubeconfig", kubeconfig}, logger, kubeconfig, false)
-	setupLinkerdCertsAndCRDs(dir, kubeconfig, cluster, logger)
-	runLinkerdInstallCmd(dir, kubeconfig, cluster, logger, multicluster)
-	updateCRDs(kubeconfig, logger)
+	runLinkerdCheck(ctx, []string{"--pre", "--kubeconfig", kubeconfig}, logger, kubeconfig)
+	if err := setupLinkerdCertsAndCRDs(ctx, dir, kubeconfig, cluster, logger); err != nil {
+		return err
+	}
+	if err := runLinkerdInstallCmd(ctx, dir, kubeconfig, cluster, logger, multicluster); err != nil {
+		return err
+	}
+	return updateCRDs(ctx, kubeconfig, logger)
 }
 
 func getLinkerdPaths(loggerId, nodeName string) (string, string) {
@@ -120,13 +145,17 @@ func getLinkerdPaths(loggerId, nodeName string) (string, string) {
 	return dir, kubeconfig
 }
 
-func setupLinkerdCertsAndCRDs(dir, kubeconfig string, cluster *types.Cluster, logger *utils.Logger) {
-	createRootCerts(dir, logger)
-	installCRDs(kubeconfig, logger)
-	createIssuerCerts(dir, cluster, logger)
+func setupLinkerdCertsAndCRDs(ctx context.Context, dir, kubeconfig string, cluster *types.Cluster, logger *utils.Logger) error {
+	if err := createRootCerts(ctx, dir, logger); err != nil {
+		return err
+	}
+	if err := installCRDs(ctx, kubeconfig, logger); err != nil {
+		return err
+	}
+	return createIssuerCerts(ctx, dir, cluster, logger)
 }
 
-func runLinkerdInstallCmd(dir, kubeconfig string, cluster *types.Cluster, logger *utils.Logger, multicluster bool) {
+func runLinkerdInstallCmd(ctx context.Context, dir, kubeconfig string, cluster *types.Cluster, logger *utils.Logger, multicluster bool) error {
 	args := []string{
 		"--proxy-log-level=linkerd=debug,warn",
 		"--cluster-domain=cluster.local",
@@ -136,43 +165,62 @@ func runLinkerdInstallCmd(dir, kubeconfig string, cluster *types.Cluster, logger
 		"--identity-issuer-key-file=" + path.Join(dir, fmt.Sprintf("%s-issuer.key", cluster.NodeName)),
 		"--kubeconfig", kubeconfig,
 	}
-	runLinkerdCmd("install", args, logger, kubeconfig, true)
+	if err := runLinkerdCmd(ctx, "install", args, logger, kubeconfig, true); err != nil {
+		return err
+	}
 	logger.Log("Linkerd installed successfully.")
-	runLinkerdCmd("check", []string{"--kubeconfig", kubeconfig}, logger, kubeconfig, false)
+	runLinkerdCheck(ctx, []string{"--kubeconfig", kubeconfig}, logger, kubeconfig)
 
 	if multicluster {
-		runLinkerdCmd("multicluster", []string{"install", "--kubeconfig", kubeconfig}, logger, kubeconfig, true)
+		if err := runLinkerdCmd(ctx, "multicluster", []string{"install", "--kubeconfig", kubeconfig}, logger, kubeconfig, true); err != nil {
+			return err
+		}
 		logger.Log("Linkerd multicluster installed.")
-		runLinkerdCmd("multicluster", []string{"check", "--kubeconfig", kubeconfig}, logger, kubeconfig, false)
+		if err := runLinkerdCmd(ctx, "multicluster", []string{"check", "--kubeconfig", kubeconfig}, logger, kubeconfig, false); err != nil {
+			logger.LogErr("linkerd multicluster check failed: %v", err)
+		}
 	}
+	return nil
 }
 
-func runLinkerdCmd(cmd string, args []string, logger *utils.Logger, kubeconfig string, apply bool) {
+// runLinkerdCheck runs "linkerd check". A failed check is logged but does not abort the install,
+// since the pre-install check also fails on clusters where Linkerd is already installed.
+func runLinkerdCheck(ctx context.Context, args []string, logger *utils.Logger, kubeconfig string) {
+	if err := runLinkerdCmd(ctx, "check", args, logger, kubeconfig, false); err != nil {
+		logger.LogErr("linkerd check failed: %v", err)
+	}
+}
+
+func runLinkerdCmd(ctx context.Context, cmd string, args []string, logger *utils.Logger, kubeconfig string, apply bool) error {
 	parts := append([]string{cmd}, args...)
-	c := exec.Command("linkerd", parts...)
+	c := utils.ExecCommand(ctx, "linkerd", parts...)
+	var err error
 	if apply {
-		clusterutils.PipeAndApply(c, kubeconfig, logger)
+		err = clusterutils.PipeAndApply(ctx, c, kubeconfig, logger)
 	} else {
-		clusterutils.PipeAndLog(c, logger)
+		err = clusterutils.PipeAndLog(c, logger)
 	}
+	if err != nil {
+		return fmt.Errorf("linkerd %s: %w", cmd, err)
+	}
+	return nil
 }
 
-func updateCRDs(kubeconfig string, logger *utils.Logger) {
-	runLinkerdCmd("upgrade", []string{"--crds", "--kubeconfig", kubeconfig}, logger, kubeconfig, true)
+func updateCRDs(ctx context.Context, kubeconfig string, logger *utils.Logger) error {
+	return runLinkerdCmd(ctx, "upgrade", []string{"--crds", "--kubeconfig", kubeconfig}, logger, kubeconfig, true)
 }
 
-func installCRDs(kubeconfig string, logger *utils.Logger) {
-	run := exec.Command("linkerd", "install", "--crds", "--kubeconfig", kubeconfig)
-	clusterutils.PipeAndApply(run, kubeconfig, logger)
+func installCRDs(ctx context.Context, kubeconfig string, logger *utils.Logger) error {
+	return runLinkerdCmd(ctx, "install", []string{"--crds", "--kubeconfig", kubeconfig}, logger, kubeconfig, true)
 }
 
-func createRootCerts(dir string, logger *utils.Logger) {
+func createRootCerts(ctx context.Context, dir string, logger *utils.Logger) error {
 	caCrt := path.Join(dir, "ca.crt")
 	caKey := path.Join(dir, "ca.key")
 	if _, errCrt := os.Stat(caCrt); errCrt == nil {
 		if _, errKey := os.Stat(caKey); errKey == nil {
 			logger.Log("Root CA cert and key already exist, skipping creation.")
-			return
+			return nil
 		}
 	}
 	args := []string{
@@ -183,10 +231,10 @@ func createRootCerts(dir string, logger *utils.Logger) {
 		"--profile", "root-ca",
 		"--no-password", "--insecure", "--force", "--not-after", "438000h",
 	}
-	runStepCertCreate(args, logger)
+	return runStepCertCreate(ctx, args, logger)
 }
 
-func createIssuerCerts(dir string, cluster *types.Cluster, logger *utils.Logger) {
+func createIssuerCerts(ctx context.Context, dir string, cluster *types.Cluster, logger *utils.Logger) error {
 	args := []string{
 		"certificate", "create",
 		"identity.linkerd.cluster.local",
@@ -198,35 +246,54 @@ func createIssuerCerts(dir string, cluster *types.Cluster, logger *utils.Logger)
 		"--not-after", "438000h",
 		"--no-password", "--insecure", "--force",
 	}
-	runStepCertCreate(args, logger)
+	return runStepCertCreate(ctx, args, logger)
 }
 
 // UnlinkLinkerdGateway unlinks a specific multicluster gateway by cluster name or by IP address for the given cluster using the linkerd CLI.
 // If gatewayClusterName is an IP address, it will search cluster.LinksTo for a matching address and use the corresponding context name if found.
-func UnlinkLinkerdGateway(cluster *types.Cluster, gatewayClusterName string, logger *utils.Logger) {
+// It returns an error if the unlink command fails.
+func UnlinkLinkerdGateway(ctx context.Context, cluster *types.Cluster, gatewayClusterName string, logger *utils.Logger) error {
 	logger.Log("Unlinking Linkerd gateway for cluster %s with name %s", cluster.NodeName, gatewayClusterName)
 	_, kubeconfig := getLinkerdPaths(logger.Id, cluster.NodeName)
 
 	clusterNameToUnlink := gatewayClusterName
 	if net.ParseIP(gatewayClusterName) != nil {
-		return
+		return nil
 	}
 
-	unlinkCmd := exec.Command("linkerd", "multicluster", "unlink", "--cluster-name", clusterNameToUnlink, "--kubeconfig", kubeconfig)
-	clusterutils.PipeAndDelete(unlinkCmd, kubeconfig, logger)
+	unlinkCmd := utils.ExecCommand(ctx, "linkerd", "multicluster", "unlink", "--cluster-name", clusterNameToUnlink, "--kubeconfig", kubeconfig)
+	if err := clusterutils.PipeAndDelete(ctx, unlinkCmd, kubeconfig, logger); err != nil {
+		return fmt.Errorf("unlink %s from %s: %w", clusterNameToUnlink, cluster.NodeName, err)
+	}
+	return nil
 }
 
 // LinkerdGateway represents a Linkerd multicluster gateway in another cluster.
 //
 // Fields:
 //   - ClusterName: Name of the remote cluster with the gateway.
+//   - Alive: Whether the gateway is reachable from this cluster.
+//   - PairedServices: Number of services mirrored through the gateway.
 type LinkerdGateway struct {
-	ClusterName string `json:"clusterName"`
+	ClusterName    string `json:"clusterName"`
+	Alive          bool   `json:"alive"`
+	PairedServices int    `json:"pairedServices"`
 }
 
-func getCurrentLinkerdGateways(cluster *types.Cluster, logger *utils.Logger) ([]LinkerdGateway, error) {
+// GetLinkerdGateways lists the Linkerd multicluster gateways linked from the given cluster.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	cluster: The cluster whose links are listed.
+//	logger: Logger for output (used for the kubeconfig session ID).
+//
+// Returns:
+//
+//	Gateways and error if the linkerd CLI fails or its output cannot be decoded.
+func GetLinkerdGateways(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) ([]LinkerdGateway, error) {
 	_, kubeconfig := getLinkerdPaths(logger.Id, cluster.NodeName)
-	cmd := exec.Command("linkerd", "multicluster", "gateways", "-o", "json", "--kubeconfig", kubeconfig)
+	cmd := utils.ExecCommand(ctx, "linkerd", "multicluster", "gateways", "-o", "json", "--kubeconfig", kubeconfig)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
@@ -240,35 +307,52 @@ func getCurrentLinkerdGateways(cluster *types.Cluster, logger *utils.Logger) ([]
 	return gateways, nil
 }
 
-func unlinkAllLinkerdGateways(cluster *types.Cluster, logger *utils.Logger) {
-	gateways, err := getCurrentLinkerdGateways(cluster, logger)
+func unlinkAllLinkerdGateways(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+	gateways, err := GetLinkerdGateways(ctx, cluster, logger)
 	if err != nil {
 		logger.LogErr("Failed to get current Linkerd gateways: %v", err)
-		return
+		return nil
 	}
+	var errs []error
 	for _, gw := range gateways {
-		UnlinkLinkerdGateway(cluster, gw.ClusterName, logger)
+		errs = append(errs, UnlinkLinkerdGateway(ctx, cluster, gw.ClusterName, logger))
 	}
+	return errors.Join(errs...)
 }
 
 // DeleteLinkerdAddon uninstalls Linkerd and Linkerd multicluster from the cluster using the linkerd CLI.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to uninstall the addon from.
 //	logger: Logger for output.
-func DeleteLinkerdAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error joining the failures of the unlink and uninstall steps.
+func DeleteLinkerdAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+	_, ok := cluster.Addons["linkerd"]
+	_, okMC := cluster.Addons["linkerd-mc"]
+	if !ok && !okMC {
+		return nil
+	}
 	_, kubeconfig := getLinkerdPaths(logger.Id, cluster.NodeName)
 
-	unlinkAllLinkerdGateways(cluster, logger)
+	errs := []error{unlinkAllLinkerdGateways(ctx, cluster, logger)}
 
 	if _, ok := cluster.Addons["linkerd-mc"]; ok {
-		cmd := exec.Command("linkerd", "multicluster", "uninstall", "--kubeconfig", kubeconfig)
+		cmd := utils.ExecCommand(ctx, "linkerd", "multicluster", "uninstall", "--kubeconfig", kubeconfig)
 		logger.Log("Uninstalling linkerd multicluster on %s", cluster.NodeName)
-		clusterutils.PipeAndDelete(cmd, kubeconfig, logger)
+		if err := clusterutils.PipeAndDelete(ctx, cmd, kubeconfig, logger); err != nil {
+			errs = append(errs, fmt.Errorf("uninstall linkerd multicluster: %w", err))
+		}
 	}
 
-	cmd := exec.Command("linkerd", "uninstall", "--kubeconfig", kubeconfig)
+	cmd := utils.ExecCommand(ctx, "linkerd", "uninstall", "--kubeconfig", kubeconfig)
 	logger.Log("Uninstalling linkerd on %s", cluster.NodeName)
-	clusterutils.PipeAndDelete(cmd, kubeconfig, logger)
+	if err := clusterutils.PipeAndDelete(ctx, cmd, kubeconfig, logger); err != nil {
+		errs = append(errs, fmt.Errorf("uninstall linkerd: %w", err))
+	}
+	return errors.Join(errs...)
 }
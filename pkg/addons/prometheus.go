@@ -1,6 +1,9 @@
 package addons
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
@@ -10,24 +13,30 @@ import (
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to apply the addon to.
 //	logger: Logger for output.
-func ApplyPrometheusAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if the Helm chart cannot be installed.
+func ApplyPrometheusAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
 	addon, ok := cluster.Addons["prometheus"]
 	if !ok || !addon.Enabled {
-		return
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	applyPrometheus(kubeconfig, logger, &addon)
+	return applyPrometheus(ctx, kubeconfig, logger, &addon)
 }
 
-func applyPrometheus(kubeconfigPath string, logger *utils.Logger, addon *types.AddonConfig) {
-	clusterutils.EnsureNamespace(kubeconfigPath, "monitoring", logger)
+func applyPrometheus(ctx context.Context, kubeconfigPath string, logger *utils.Logger, addon *types.AddonConfig) error {
+	clusterutils.EnsureNamespace(ctx, kubeconfigPath, "monitoring", logger)
 	valuesFile := addon.Path
 	if valuesFile == "" {
-		valuesFile = clusterutils.ResolveYamlPath("prom-stack-values.yaml")
+		valuesFile = clusterutils.ResolveYamlPath(ctx, "prom-stack-values.yaml")
 	}
 	if err := clusterutils.InstallHelmChart(
+		ctx,
 		kubeconfigPath,
 		"kube-prom-stack",
 		"monitoring",
@@ -39,24 +48,33 @@ func applyPrometheus(kubeconfigPath string, logger *utils.Logger, addon *types.A
 		logger,
 	); err != nil {
 		logger.LogErr("failed to install Prometheus Helm chart: %v", err)
+		return fmt.Errorf("install Prometheus Helm chart: %w", err)
 	}
+	return nil
 }
 
 // DeletePrometheusAddon uninstalls the Prometheus stack from the cluster by uninstalling the Helm release.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to uninstall the addon from.
 //	logger: Logger for output.
-func DeletePrometheusAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if the Helm release cannot be uninstalled.
+func DeletePrometheusAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
 	_, ok := cluster.Addons["prometheus"]
 	if !ok {
-		return
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
 	releaseName := "kube-prom-stack"
 	namespace := "monitoring"
-	if err := clusterutils.UninstallHelmRelease(kubeconfig, releaseName, namespace, logger); err != nil {
+	if err := clusterutils.UninstallHelmRelease(ctx, kubeconfig, releaseName, namespace, logger); err != nil {
 		logger.LogErr("failed to uninstall Prometheus Helm release: %v", err)
+		return fmt.Errorf("uninstall Prometheus Helm release: %w", err)
 	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package addons
 
 import (
+	"context"
+	"errors"
+
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
@@ -10,41 +13,59 @@ import (
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to apply the addon to.
 //	logger: Logger for output.
-func ApplyTraefikAddon(cluster *types.Cluster, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if the values cannot be applied or Traefik does not become ready.
+func ApplyTraefikAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
 	addon, ok := cluster.Addons["traefik"]
 	if !ok || !addon.Enabled {
-		return
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	applyTraefikValues(kubeconfig, logger, &addon)
+	return applyTraefikValues(ctx, cluster, kubeconfig, logger)
+}
+
+func applyTraefikValues(ctx context.Context, cluster *types.Cluster, kubeconfigPath string, logger *utils.Logger) error {
+	for _, m := range traefikManifests(ctx, cluster) {
+		if err := clusterutils.ApplyComponentYAML(ctx, m.Name, kubeconfigPath, m.Path, logger, m.Subs); err != nil {
+			return err
+		}
+	}
+	return clusterutils.WaitForDeploymentReady(ctx, kubeconfigPath, "traefik", "kube-system", logger)
 }
 
-func applyTraefikValues(kubeconfigPath string, logger *utils.Logger, addon *types.AddonConfig) {
+func traefikManifests(ctx context.Context, cluster *types.Cluster) []Manifest {
+	addon := cluster.Addons["traefik"]
 	manifestPath := addon.Path
 	if manifestPath == "" {
-		manifestPath = clusterutils.ResolveYamlPath("traefik-values.yaml")
+		manifestPath = clusterutils.ResolveYamlPath(ctx, "traefik-values.yaml")
 	}
-	clusterutils.ApplyComponentYAML("traefik-values", kubeconfigPath, manifestPath, logger, addon.Subs)
-	clusterutils.WaitForDeploymentReady(kubeconfigPath, "traefik", "kube-system", logger)
+	return []Manifest{{Name: "traefik-values", Path: manifestPath, Subs: addon.Subs}}
 }
 
 // DeleteTraefikAddon uninstalls the Traefik addon from the cluster.
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster to uninstall the addon from.
 //	logger: Logger for output.
-func DeleteTraefikAddon(cluster *types.Cluster, logger *utils.Logger) {
-	addon, ok := cluster.Addons["traefik"]
-	if !ok {
-		return
+//
+// Returns:
+//
+//	Error if the values cannot be deleted.
+func DeleteTraefikAddon(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+	if _, ok := cluster.Addons["traefik"]; !ok {
+		return nil
 	}
 	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
-	manifestPath := addon.Path
-	if manifestPath == "" {
-		manifestPath = clusterutils.ResolveYamlPath("traefik-values.yaml")
+	var errs []error
+	for _, m := range traefikManifests(ctx, cluster) {
+		errs = append(errs, clusterutils.DeleteComponentYAML(ctx, m.Name, kubeconfig, m.Path, logger, m.Subs))
 	}
-	clusterutils.DeleteComponentYAML("traefik-values", kubeconfig, manifestPath, logger, addon.Subs)
+	return errors.Join(errs...)
 }
@@ -1,6 +1,8 @@
 package cluster
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -8,181 +10,427 @@ import (
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
 	"github.com/argon-chat/k3sd/pkg/db"
 	"github.com/argon-chat/k3sd/pkg/k8s"
+	"github.com/argon-chat/k3sd/pkg/secrets"
+	"github.com/argon-chat/k3sd/pkg/tracing"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
-// CreateCluster provisions and configures all clusters in the provided list.
+// CreateCluster provisions and configures all selected clusters in the provided list.
 // It connects to each master node, sets up the cluster, applies addons, and joins workers.
 //
+// A failure on one cluster, node or addon does not stop the run; every step is recorded in the
+// returned Summary and the run continues with the next one. When ctx is cancelled the running
+// step is aborted, no further steps are started, and the nodes set up so far are recorded in
+// the database with the previously recorded addon state. The install state of the nodes is
+// recorded in the database as well, never in the config. The run is traced in a span whose
+// trace ID is recorded in the Summary.
+//
 // Parameters:
 //
-//	clusters: List of clusters to create.
+//	ctx: Context of the run; cancelling it aborts the running remote command.
+//	store: Database holding the recorded cluster versions and install state.
+//	resolver: Resolver that resolved the secret references of the clusters, whose references are
+//	recorded in place of the values.
+//	clusters: List of clusters to create, with the Done flags of their recorded install state.
 //	logger: Logger for output.
-//	additional: Additional shell commands to run on the master node.
+//	selector: Restricts the run to specific clusters, nodes and addons.
 //
 // Returns:
 //
-//	Updated list of clusters
-func CreateCluster(clusters []types.Cluster, logger *utils.Logger, additional []string) []types.Cluster {
+//	Updated list of clusters, the summary of all steps, and the joined errors of all failed
+//	steps (each a *utils.StepError), joined with ctx.Err() if the run was cancelled.
+func CreateCluster(ctx context.Context, store *db.Store, resolver *secrets.Resolver, clusters []types.Cluster, logger *utils.Logger, selector utils.Selector) ([]types.Cluster, *Summary, error) {
+	ctx, span := tracing.Start(ctx, "CreateCluster")
+	summary := &Summary{TraceID: tracing.TraceID(ctx)}
+	var linkQueue []*types.Cluster
+	visited := make(map[int]bool)
 	for ci, cluster := range clusters {
-		client, err := clusterutils.SSHConnect(cluster.User, cluster.Password, cluster.Address)
+		if !selector.MatchCluster(cluster.Context) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		visited[ci] = true
+		name := cluster.DisplayName()
+		logger := logger.With(utils.FieldCluster, name)
+		var client *ssh.Client
+		err := summary.run(ctx, logger, name, cluster.NodeName, "", "connect", func(ctx context.Context, _ *utils.Logger) (err error) {
+			client, err = clusterutils.SSHConnect(ctx, cluster.User, cluster.Password, cluster.Address)
+			return err
+		})
 		if err != nil {
 			logger.LogErr("error connecting to cluster %s: %v", cluster.Address, err)
+			continue
 		}
 
 		defer closeSSHClient(client)
 
-		if err := handleMasterNode(&clusters[ci], client, logger, additional); err != nil {
-			logger.LogErr("error handling master node %s: %v", cluster.Address, err)
+		if selector.MatchNode(cluster.NodeName) {
+			handleMasterNode(ctx, &clusters[ci], client, logger, summary)
+			if err := saveNodeStates(ctx, store, &clusters[ci]); err != nil {
+				logger.LogErr("error recording install state of cluster %s: %v", cluster.Address, err)
+				_ = summary.record(name, "", "", "record", err)
+			}
 		}
-		if err := setupWorkerNodes(&clusters[ci], client, logger); err != nil {
-			logger.LogErr("error setting up worker nodes: %v", err)
+		setupWorkerNodes(ctx, &clusters[ci], client, logger, selector, summary)
+		if err := saveNodeStates(ctx, store, &clusters[ci]); err != nil {
+			logger.LogErr("error recording install state of cluster %s: %v", cluster.Address, err)
+			_ = summary.record(name, "", "", "record", err)
 		}
 		linkerdMC, okMC := cluster.Addons["linkerd-mc"]
-		if okMC && linkerdMC.Enabled {
-			addons.LinkChannel = append(addons.LinkChannel, &clusters[ci])
+		if okMC && linkerdMC.Enabled && selector.MatchAddon("linkerd-mc") {
+			linkQueue = append(linkQueue, &clusters[ci])
+		}
+		if utils.OptionsFrom(ctx).LogKubeconfigs {
+			k8s.LogFiles(logger)
 		}
-		k8s.LogFiles(logger)
 	}
 
-	for _, cluster := range clusters {
-		version, err := db.InsertCluster(&cluster)
+	for ci := range clusters {
+		cluster := &clusters[ci]
+		if !selector.MatchCluster(cluster.Context) {
+			continue
+		}
+		name := cluster.DisplayName()
+		logger := logger.With(utils.FieldCluster, name)
+		interrupted := ctx.Err() != nil
+		if interrupted && !visited[ci] {
+			continue
+		}
+		recordCtx, recordSelector := ctx, selector
+		if interrupted {
+			// record the nodes that were set up, but keep the addons as they were
+			recordCtx = context.WithoutCancel(ctx)
+			recordSelector = utils.Selector{SkipAddons: true}
+		}
+		oldVersion, err := store.GetLatestClusterVersion(recordCtx, cluster)
+		if err != nil {
+			logger.LogErr("error getting old cluster version for %s: %v", cluster.Address, err)
+			_ = summary.record(name, "", "", "record", fmt.Errorf("read recorded version: %w", err))
+			continue
+		}
+		err = summary.run(recordCtx, logger, name, "", "", "record", func(ctx context.Context, _ *utils.Logger) error {
+			previous, err := store.InsertCluster(ctx, recordedState(cluster, oldVersion, recordSelector), resolver)
+			if err == nil {
+				summary.setVersion(name, previous+1)
+			}
+			return err
+		})
 		if err != nil {
 			logger.LogErr("error inserting cluster %s: %v", cluster.Address, err)
 		}
-		applyOptionalComponents(&cluster, version, logger)
+		if !interrupted && !selector.SkipAddons {
+			applyAddonsWithHooks(ctx, cluster, oldVersion, logger, selector, summary)
+		}
 	}
 
-	for _, cluster := range addons.LinkChannel {
-		addons.LinkClusters(cluster, &clusters, logger)
+	for _, cluster := range linkQueue {
+		if ctx.Err() != nil {
+			break
+		}
+		logger := logger.With(utils.FieldCluster, cluster.DisplayName())
+		err := summary.run(ctx, logger, cluster.DisplayName(), "", "linkerd-mc", "link", func(ctx context.Context, logger *utils.Logger) error {
+			return addons.LinkClusters(ctx, cluster, &clusters, logger)
+		})
+		if err != nil {
+			logger.LogErr("error linking cluster %s: %v", cluster.Address, err)
+		}
 	}
-	return clusters
+	return clusters, summary, tracing.End(span, errors.Join(summary.Err(), ctx.Err()))
+}
+
+// saveNodeStates records the install state of the nodes of a cluster in the database, also
+// when ctx was cancelled, so the nodes set up or uninstalled so far are not handled again by the
+// next run.
+func saveNodeStates(ctx context.Context, store *db.Store, cluster *types.Cluster) error {
+	if err := store.SaveNodeStates(context.WithoutCancel(ctx), cluster); err != nil {
+		return fmt.Errorf("record install state: %w", err)
+	}
+	return nil
 }
 
 func closeSSHClient(client *ssh.Client) {
 	_ = client.Close()
 }
 
-func handleMasterNode(cluster *types.Cluster, client *ssh.Client, logger *utils.Logger, additional []string) error {
-	return setupMasterNode(cluster, client, logger, additional)
+func handleMasterNode(ctx context.Context, cluster *types.Cluster, client *ssh.Client, logger *utils.Logger, summary *Summary) {
+	setupMasterNode(ctx, cluster, client, logger, summary)
 }
 
-func setupMasterNode(cluster *types.Cluster, client *ssh.Client, logger *utils.Logger, additional []string) error {
-	if err := runBaseClusterSetup(cluster, client, logger, additional); err != nil {
-		return err
+// setupMasterNode installs k3s on the master, between its preInstall and postInstall hooks, and
+// labels it. A failed hook skips the rest of the master.
+func setupMasterNode(ctx context.Context, cluster *types.Cluster, client *ssh.Client, logger *utils.Logger, summary *Summary) {
+	name := cluster.DisplayName()
+	if !cluster.Done {
+		target := remoteHookTarget{client: client, node: &cluster.Worker}
+		if err := runRemoteHooks(ctx, cluster, phasePreInstall, target, logger, summary); err != nil {
+			logger.LogErr("error in hooks of master node %s: %v", cluster.Address, err)
+			return
+		}
+		err := summary.run(ctx, logger, name, cluster.NodeName, "", "install", func(ctx context.Context, logger *utils.Logger) error {
+			return runBaseClusterSetup(ctx, cluster, client, logger)
+		})
+		if err != nil {
+			logger.LogErr("error handling master node %s: %v", cluster.Address, err)
+			return
+		}
+		if err := runRemoteHooks(ctx, cluster, phasePostInstall, target, logger, summary); err != nil {
+			logger.LogErr("error in hooks of master node %s: %v", cluster.Address, err)
+			return
+		}
 	}
 	kubeconfigPath := buildKubeconfigPath(logger.Id, cluster.NodeName)
-	labelMasterNode(cluster, kubeconfigPath, logger)
-	return nil
+	err := summary.run(ctx, logger, name, cluster.NodeName, "", "label", func(ctx context.Context, logger *utils.Logger) error {
+		return labelMasterNode(ctx, cluster, kubeconfigPath, logger)
+	})
+	if err != nil {
+		logger.LogErr("error labeling master node %s: %v", cluster.NodeName, err)
+	}
 }
 
 func buildKubeconfigPath(loggerId, nodeName string) string {
 	return "./kubeconfigs/" + loggerId + "/" + nodeName + ".yaml"
 }
 
-func runBaseClusterSetup(cluster *types.Cluster, client *ssh.Client, logger *utils.Logger, additional []string) error {
+func runBaseClusterSetup(ctx context.Context, cluster *types.Cluster, client *ssh.Client, logger *utils.Logger) error {
 	if cluster.Done {
 		return nil
 	}
-	baseCmds := append(baseClusterCommands(*cluster), additional...)
+	baseCmds := baseClusterCommands(*cluster)
 	logger.Log("Connecting to cluster: %s", cluster.Address)
-	if err := clusterutils.ExecuteCommands(client, baseCmds, cluster.Password, logger); err != nil {
-		return fmt.Errorf("exec master: %v", err)
+	if err := clusterutils.ExecuteCommands(ctx, client, baseCmds, cluster.Password, logger); err != nil {
+		return fmt.Errorf("exec master: %w", err)
 	}
 	markClusterDone(cluster)
-	k8s.SaveKubeConfig(client, *cluster, cluster.NodeName, logger)
-	return nil
+	return k8s.SaveKubeConfig(ctx, client, *cluster, cluster.NodeName, logger)
 }
 
 func markClusterDone(cluster *types.Cluster) {
 	cluster.Done = true
 }
 
-func labelMasterNode(cluster *types.Cluster, kubeconfigPath string, logger *utils.Logger) {
-	_ = clusterutils.LabelNode(kubeconfigPath, cluster.NodeName, cluster.GetLabels(), logger)
+func labelMasterNode(ctx context.Context, cluster *types.Cluster, kubeconfigPath string, logger *utils.Logger) error {
+	return clusterutils.LabelNode(ctx, kubeconfigPath, cluster.NodeName, cluster.GetLabels(), logger)
 }
 
-func applyOptionalComponents(cluster *types.Cluster, version int, logger *utils.Logger) {
-	oldVersion, err := db.GetClusterVersion(cluster, version)
-	if err != nil {
-		logger.LogErr("error getting old cluster version for %s: %v", cluster.Address, err)
+// applyAddonsWithHooks applies the addon changes of a cluster between its preAddons and
+// postAddons hooks. A failed preAddons hook skips the addons.
+func applyAddonsWithHooks(ctx context.Context, cluster *types.Cluster, oldVersion *types.Cluster, logger *utils.Logger, selector utils.Selector, summary *Summary) {
+	if err := runLocalHooks(ctx, cluster, phasePreAddons, logger, summary); err != nil {
+		logger.LogErr("error in addon hooks of cluster %s, skipping addons: %v", cluster.Address, err)
 		return
 	}
-	for name, migration := range addons.AddonRegistry {
-		migrationStatus := clusterutils.ComputeAddonMigrationStatus(name, cluster, oldVersion, false)
+	applyOptionalComponents(ctx, cluster, oldVersion, logger, selector, summary)
+	if ctx.Err() != nil {
+		return
+	}
+	if err := runLocalHooks(ctx, cluster, phasePostAddons, logger, summary); err != nil {
+		logger.LogErr("error in addon hooks of cluster %s: %v", cluster.Address, err)
+	}
+}
 
-		switch migrationStatus {
-		case clusterutils.AddonApply:
-			logger.Log("Applying addon %s for cluster %s", name, cluster.Address)
-			migration.Up(cluster, logger)
-			break
-		case clusterutils.AddonDelete:
-			logger.Log("Deleting addon %s for cluster %s", name, cluster.Address)
-			migration.Down(cluster, logger)
-			break
-		case clusterutils.AddonNoop:
-			break
+func applyOptionalComponents(ctx context.Context, cluster *types.Cluster, oldVersion *types.Cluster, logger *utils.Logger, selector utils.Selector, summary *Summary) {
+	for _, name := range sortedNames(addons.AddonRegistry) {
+		migration := addons.AddonRegistry[name]
+		if !selector.MatchAddon(name) {
+			continue
+		}
+		// an addon that was never configured has nothing to delete
+		if !hasKey(cluster.Addons, name) && (oldVersion == nil || !hasKey(oldVersion.Addons, name)) {
+			continue
 		}
+		migrateAddon(ctx, cluster, name, false, addonAction(name, cluster, oldVersion, selector, false), migration.Up, migration.Down, logger, summary)
+	}
+	for _, name := range sortedNames(cluster.CustomAddons) {
+		if !selector.MatchAddon(name) {
+			continue
+		}
+		up := func(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+			return addons.ApplyCustomAddon(ctx, name, cluster, logger)
+		}
+		down := func(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) error {
+			return addons.DeleteCustomAddon(ctx, name, cluster, logger)
+		}
+		migrateAddon(ctx, cluster, name, true, addonAction(name, cluster, oldVersion, selector, true), up, down, logger, summary)
 	}
-	addons.ApplyCustomAddons(cluster, logger, oldVersion)
 }
 
-func setupWorkerNodes(cluster *types.Cluster, client *ssh.Client, logger *utils.Logger) error {
-	return clusterutils.ForEachWorker(cluster.Workers, func(worker *types.Worker) error {
-		return joinAndLabelWorker(cluster, worker, client, logger)
-	})
+// migrateAddon runs up or down for an addon depending on its migration status and records the
+// addon and the step in the summary.
+func migrateAddon(ctx context.Context, cluster *types.Cluster, name string, custom bool, status clusterutils.AddonMigrationStatus, up, down func(context.Context, *types.Cluster, *utils.Logger) error, logger *utils.Logger, summary *Summary) {
+	summary.addAddon(AddonResult{Cluster: cluster.DisplayName(), Name: name, Custom: custom, Migration: migrationName(status)})
+	kind := "addon"
+	if custom {
+		kind = "custom addon"
+	}
+	switch status {
+	case clusterutils.AddonApply:
+		logger.Log("Applying %s %s for cluster %s", kind, name, cluster.Address)
+		err := summary.run(ctx, logger, cluster.DisplayName(), "", name, "apply", func(ctx context.Context, logger *utils.Logger) error {
+			trace.SpanFromContext(ctx).SetAttributes(migrationAttributes(status, custom)...)
+			return up(ctx, cluster, logger)
+		})
+		if err != nil {
+			logger.LogErr("error applying %s %s for cluster %s: %v", kind, name, cluster.Address, err)
+		}
+	case clusterutils.AddonDelete:
+		logger.Log("Deleting %s %s for cluster %s", kind, name, cluster.Address)
+		err := summary.run(ctx, logger, cluster.DisplayName(), "", name, "delete", func(ctx context.Context, logger *utils.Logger) error {
+			trace.SpanFromContext(ctx).SetAttributes(migrationAttributes(status, custom)...)
+			return down(ctx, cluster, logger)
+		})
+		if err != nil {
+			logger.LogErr("error deleting %s %s for cluster %s: %v", kind, name, cluster.Address, err)
+		}
+	case clusterutils.AddonNoop:
+	}
+}
+
+// migrationAttributes returns the span attributes describing an addon migration.
+func migrationAttributes(status clusterutils.AddonMigrationStatus, custom bool) []attribute.KeyValue {
+	return []attribute.KeyValue{tracing.AttrMigration.String(migrationName(status)), tracing.AttrCustom.Bool(custom)}
+}
+
+func migrationName(status clusterutils.AddonMigrationStatus) string {
+	switch status {
+	case clusterutils.AddonApply:
+		return "apply"
+	case clusterutils.AddonDelete:
+		return "delete"
+	}
+	return "noop"
+}
+
+// addonAction returns the migration to perform for an addon. An addon named explicitly in the
+// selector is re-applied even if its config did not change.
+func addonAction(name string, cluster *types.Cluster, oldVersion *types.Cluster, selector utils.Selector, custom bool) clusterutils.AddonMigrationStatus {
+	status := clusterutils.ComputeAddonMigrationStatus(name, cluster, oldVersion, custom)
+	if status != clusterutils.AddonNoop || !selector.ExplicitAddon(name) {
+		return status
+	}
+	enabled := cluster.Addons[name].Enabled
+	if custom {
+		enabled = cluster.CustomAddons[name].Enabled
+	}
+	if enabled {
+		return clusterutils.AddonApply
+	}
+	return status
+}
+
+func setupWorkerNodes(ctx context.Context, cluster *types.Cluster, client *ssh.Client, logger *utils.Logger, selector utils.Selector, summary *Summary) {
+	for i := range cluster.Workers {
+		worker := &cluster.Workers[i]
+		if !selector.MatchNode(worker.NodeName) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		joinAndLabelWorker(ctx, cluster, worker, client, logger, summary)
+	}
 }
 
-func joinAndLabelWorker(cluster *types.Cluster, worker *types.Worker, client *ssh.Client, logger *utils.Logger) error {
-	markWorkerDone(worker)
-	token, err := getK3sToken(client, cluster, logger)
+func joinAndLabelWorker(ctx context.Context, cluster *types.Cluster, worker *types.Worker, client *ssh.Client, logger *utils.Logger, summary *Summary) {
+	name := cluster.DisplayName()
+	if !worker.Done {
+		if err := runWorkerHooks(ctx, cluster, phasePreJoin, worker, client, logger, summary); err != nil {
+			logger.LogErr("error in hooks of worker %s: %v", worker.NodeName, err)
+			return
+		}
+		err := summary.run(ctx, logger, name, worker.NodeName, "", "join", func(ctx context.Context, logger *utils.Logger) error {
+			return joinNewWorker(ctx, cluster, worker, client, logger)
+		})
+		if err != nil {
+			logger.LogErr("error joining worker %s: %v", worker.NodeName, err)
+			return
+		}
+		markWorkerDone(worker)
+		if err := runWorkerHooks(ctx, cluster, phasePostJoin, worker, client, logger, summary); err != nil {
+			logger.LogErr("error in hooks of worker %s: %v", worker.NodeName, err)
+			return
+		}
+	}
+	err := summary.run(ctx, logger, name, worker.NodeName, "", "label", func(ctx context.Context, logger *utils.Logger) error {
+		return k8s.LabelWorkerNode(ctx, cluster, worker, logger)
+	})
 	if err != nil {
+		logger.LogErr("error labeling worker %s: %v", worker.NodeName, err)
+	}
+}
+
+// runWorkerHooks runs the join hooks of a phase on a worker: through the master on a private
+// network, over a connection of its own otherwise.
+func runWorkerHooks(ctx context.Context, cluster *types.Cluster, phase string, worker *types.Worker, client *ssh.Client, logger *utils.Logger, summary *Summary) error {
+	if len(cluster.Hooks.All()[phase]) == 0 {
 		return nil
 	}
-	if err := joinWorker(cluster, worker, client, logger, token); err != nil {
+	if cluster.PrivateNet {
+		target := remoteHookTarget{client: client, jump: worker.User + "@" + worker.Address, node: worker}
+		return runRemoteHooks(ctx, cluster, phase, target, logger, summary)
+	}
+	var workerClient *ssh.Client
+	err := summary.run(ctx, logger, cluster.DisplayName(), worker.NodeName, "", "connect", func(ctx context.Context, _ *utils.Logger) (err error) {
+		workerClient, err = clusterutils.SSHConnect(ctx, worker.User, worker.Password, worker.Address)
+		return err
+	})
+	if err != nil {
 		return err
 	}
-	return k8s.LabelWorkerNode(cluster, worker, logger)
+	defer closeSSHClient(workerClient)
+	return runRemoteHooks(ctx, cluster, phase, remoteHookTarget{client: workerClient, node: worker}, logger, summary)
+}
+
+func joinNewWorker(ctx context.Context, cluster *types.Cluster, worker *types.Worker, client *ssh.Client, logger *utils.Logger) error {
+	token, err := getK3sToken(ctx, client, cluster, logger)
+	if err != nil {
+		return fmt.Errorf("join token: %w", err)
+	}
+	return joinWorker(ctx, cluster, worker, client, logger, token)
 }
 
 func markWorkerDone(worker *types.Worker) {
 	worker.Done = true
 }
 
-func getK3sToken(client *ssh.Client, cluster *types.Cluster, logger *utils.Logger) (string, error) {
-	token, err := clusterutils.ExecuteRemoteScript(client, "echo $(k3s token create)", logger)
+func getK3sToken(ctx context.Context, client *ssh.Client, cluster *types.Cluster, logger *utils.Logger) (string, error) {
+	token, err := clusterutils.ExecuteRemoteScript(ctx, client, "echo $(k3s token create)", logger)
+	utils.RegisterSecret(token)
 	utils.LogIfError(logger, err, "token error for %s: %v", cluster.Address)
 	return token, err
 }
 
-func joinWorker(cluster *types.Cluster, worker *types.Worker, client *ssh.Client, logger *utils.Logger, token string) error {
+func joinWorker(ctx context.Context, cluster *types.Cluster, worker *types.Worker, client *ssh.Client, logger *utils.Logger, token string) error {
 	if worker.Done {
 		return nil
 	}
 	if cluster.PrivateNet {
-		return joinWorkerPrivateNet(cluster, worker, client, logger, token)
+		return joinWorkerPrivateNet(ctx, cluster, worker, client, logger, token)
 	}
-	return joinWorkerPublicNet(cluster, worker, logger, token)
+	return joinWorkerPublicNet(ctx, cluster, worker, logger, token)
 }
 
-func joinWorkerPrivateNet(cluster *types.Cluster, worker *types.Worker, client *ssh.Client, logger *utils.Logger, token string) error {
+func joinWorkerPrivateNet(ctx context.Context, cluster *types.Cluster, worker *types.Worker, client *ssh.Client, logger *utils.Logger, token string) error {
 	joinCmds := []string{
 		fmt.Sprintf("ssh %s@%s \"sudo apt update && sudo apt install -y curl\"", worker.User, worker.Address),
 		fmt.Sprintf("ssh %s@%s \"curl -sfL https://get.k3s.io | K3S_URL=https://%s:6443 K3S_TOKEN='%s' INSTALL_K3S_EXEC='--node-name %s' sh -\"", worker.User, worker.Address, cluster.Address, strings.TrimSpace(token), worker.NodeName),
 	}
-	if err := clusterutils.ExecuteCommands(client, joinCmds, cluster.Password, logger); err != nil {
-		return fmt.Errorf("worker join %s: %v", worker.Address, err)
+	if err := clusterutils.ExecuteCommands(ctx, client, joinCmds, cluster.Password, logger); err != nil {
+		return fmt.Errorf("worker join %s: %w", worker.Address, err)
 	}
 	return nil
 }
 
-func joinWorkerPublicNet(cluster *types.Cluster, worker *types.Worker, logger *utils.Logger, token string) error {
-	workerClient, err := clusterutils.SSHConnect(worker.User, worker.Password, worker.Address)
+func joinWorkerPublicNet(ctx context.Context, cluster *types.Cluster, worker *types.Worker, logger *utils.Logger, token string) error {
+	workerClient, err := clusterutils.SSHConnect(ctx, worker.User, worker.Password, worker.Address)
 	if err != nil {
-		logger.Log("Failed to connect to worker %s directly: %v", worker.Address, err)
-		return nil
+		logger.Warn("Failed to connect to worker %s directly: %v", worker.Address, err)
+		return fmt.Errorf("connect to worker %s: %w", worker.Address, err)
 	}
 	defer func() {
 		if err := workerClient.Close(); err != nil {
@@ -193,8 +441,8 @@ func joinWorkerPublicNet(cluster *types.Cluster, worker *types.Worker, logger *u
 		"sudo apt update && sudo apt install -y curl",
 		fmt.Sprintf("curl -sfL https://get.k3s.io | K3S_URL=https://%s:6443 K3S_TOKEN='%s' INSTALL_K3S_EXEC='--node-name %s' sh -", cluster.Address, strings.TrimSpace(token), worker.NodeName),
 	}
-	if err := clusterutils.ExecuteCommands(workerClient, joinCmds, worker.Password, logger); err != nil {
-		return fmt.Errorf("worker join %s: %v", worker.Address, err)
+	if err := clusterutils.ExecuteCommands(ctx, workerClient, joinCmds, worker.Password, logger); err != nil {
+		return fmt.Errorf("worker join %s: %w", worker.Address, err)
 	}
 	return nil
 }
@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/clusterutils"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// Hook phases, as named in the config and in the steps of the summary.
+const (
+	phasePreInstall  = "preInstall"
+	phasePostInstall = "postInstall"
+	phasePreJoin     = "preJoin"
+	phasePostJoin    = "postJoin"
+	phasePreAddons   = "preAddons"
+	phasePostAddons  = "postAddons"
+)
+
+// remoteHookTarget is the node a remote hook runs on.
+//
+// Fields:
+//   - client: SSH client of the node, or of the master for a worker of a private network.
+//   - jump: "user@address" of a worker reached through the master, or "".
+//   - node: The node.
+type remoteHookTarget struct {
+	client *ssh.Client
+	jump   string
+	node   *types.Worker
+}
+
+// runRemoteHooks runs the hooks of a phase on a node as a step of its own, if there are any.
+// It returns an error if a hook without ContinueOnError failed; the caller then skips the
+// rest of the node.
+func runRemoteHooks(ctx context.Context, cluster *types.Cluster, phase string, target remoteHookTarget, logger *utils.Logger, summary *Summary) error {
+	hooks := cluster.Hooks.All()[phase]
+	if len(hooks) == 0 {
+		return nil
+	}
+	return summary.run(ctx, logger, cluster.DisplayName(), target.node.NodeName, "", phase, func(ctx context.Context, logger *utils.Logger) error {
+		return runHooks(phase, hooks, logger, func(hook types.Hook, env map[string]string) (string, error) {
+			return clusterutils.RunScript(ctx, target.client, hook.Run, env, hook.Sudo, target.node.Password, target.jump, logger)
+		}, hookEnv(cluster, target.node, phase, ""))
+	})
+}
+
+// runLocalHooks runs the addon hooks of a phase on the local host as a step of its own, if
+// there are any. It returns an error if a hook without ContinueOnError failed; the caller then
+// skips the addons.
+func runLocalHooks(ctx context.Context, cluster *types.Cluster, phase string, logger *utils.Logger, summary *Summary) error {
+	hooks := cluster.Hooks.All()[phase]
+	if len(hooks) == 0 {
+		return nil
+	}
+	kubeconfig, err := filepath.Abs(buildKubeconfigPath(logger.Id, cluster.NodeName))
+	if err != nil {
+		kubeconfig = buildKubeconfigPath(logger.Id, cluster.NodeName)
+	}
+	return summary.run(ctx, logger, cluster.DisplayName(), "", "", phase, func(ctx context.Context, logger *utils.Logger) error {
+		return runHooks(phase, hooks, logger, func(hook types.Hook, env map[string]string) (string, error) {
+			cmd := utils.ExecCommand(ctx, "sh", "-c", hook.Run)
+			cmd.Env = os.Environ()
+			for key, value := range env {
+				cmd.Env = append(cmd.Env, key+"="+value)
+			}
+			output, err := cmd.CombinedOutput()
+			return string(output), err
+		}, hookEnv(cluster, &cluster.Worker, phase, kubeconfig))
+	})
+}
+
+// runHooks runs hooks in order with run and logs their output. A failed hook with
+// ContinueOnError is logged and the next hook runs; any other failure stops the phase.
+func runHooks(phase string, hooks []types.Hook, logger *utils.Logger, run func(types.Hook, map[string]string) (string, error), base map[string]string) error {
+	for i, hook := range hooks {
+		name := hook.Name
+		if name == "" {
+			name = phase + "[" + strconv.Itoa(i) + "]"
+		}
+		if strings.TrimSpace(hook.Run) == "" {
+			return &utils.ConfigError{Source: "hook " + name, Err: fmt.Errorf("run is empty")}
+		}
+		env := make(map[string]string, len(base)+len(hook.Env)+1)
+		for key, value := range base {
+			env[key] = value
+		}
+		for key, value := range hook.Env {
+			env[key] = value
+		}
+		env["K3SD_HOOK_NAME"] = name
+		logger.Log("Running hook %s", name)
+		output, err := run(hook, env)
+		if output != "" {
+			logger.Debug("hook %s output:\n%s", name, strings.TrimRight(output, "\n"))
+		}
+		if err == nil {
+			continue
+		}
+		if hook.ContinueOnError {
+			logger.Warn("hook %s failed, continuing: %v", name, err)
+			continue
+		}
+		if line := lastLine(output); line != "" {
+			return fmt.Errorf("hook %s: %w: %s", name, err, line)
+		}
+		return fmt.Errorf("hook %s: %w", name, err)
+	}
+	return nil
+}
+
+// hookEnv returns the environment variables describing the cluster and the node to a hook.
+// kubeconfig is the local path of the cluster's kubeconfig, for addon hooks.
+func hookEnv(cluster *types.Cluster, node *types.Worker, phase, kubeconfig string) map[string]string {
+	workers := make([]string, len(cluster.Workers))
+	for wi, worker := range cluster.Workers {
+		workers[wi] = worker.NodeName
+	}
+	env := map[string]string{
+		"K3SD_HOOK":           phase,
+		"K3SD_CLUSTER":        cluster.DisplayName(),
+		"K3SD_CONTEXT":        cluster.Context,
+		"K3SD_DOMAIN":         cluster.Domain,
+		"K3SD_ENVIRONMENT":    cluster.Environment,
+		"K3SD_MASTER_ADDRESS": cluster.Address,
+		"K3SD_MASTER_NODE":    cluster.NodeName,
+		"K3SD_WORKERS":        strings.Join(workers, ","),
+		"K3SD_PRIVATE_NET":    strconv.FormatBool(cluster.PrivateNet),
+		"K3SD_NODE_NAME":      node.NodeName,
+		"K3SD_NODE_ADDRESS":   node.Address,
+		"K3SD_NODE_LABELS":    node.GetLabels(),
+	}
+	if kubeconfig != "" {
+		env["KUBECONFIG"] = kubeconfig
+	}
+	return env
+}
+
+func lastLine(output string) string {
+	output = strings.TrimRight(output, "\n")
+	if i := strings.LastIndex(output, "\n"); i >= 0 {
+		return output[i+1:]
+	}
+	return output
+}
@@ -0,0 +1,121 @@
+package cluster
+
+import (
+	"context"
+	"sort"
+
+	"github.com/argon-chat/k3sd/pkg/addons"
+	"github.com/argon-chat/k3sd/pkg/clusterutils"
+	"github.com/argon-chat/k3sd/pkg/db"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// PlanStep is a single action a run would perform on a cluster.
+//
+// Fields:
+//   - Action: "install", "join", "apply" or "delete".
+//   - Kind: "master", "worker", "addon" or "customAddon".
+//   - Name: Node or addon name.
+type PlanStep struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+}
+
+// Plan lists the actions a run would perform on a cluster.
+//
+// Fields:
+//   - Cluster: Cluster display name.
+//   - RecordedVersion: Latest version recorded in the database (0 if never recorded).
+//   - Steps: Actions in the order a run performs them.
+type Plan struct {
+	Cluster         string     `json:"cluster"`
+	RecordedVersion int        `json:"recordedVersion"`
+	Steps           []PlanStep `json:"steps"`
+}
+
+// PlanCluster computes the actions CreateCluster would perform on the cluster without
+// connecting to it, by comparing the config with the latest version recorded in the database.
+//
+// Parameters:
+//
+//	ctx: Context of the database queries.
+//	store: Database holding the recorded cluster versions.
+//	cluster: The cluster (desired state).
+//	selector: Restricts the plan to specific nodes and addons.
+//
+// Returns:
+//
+//	*Plan: the planned actions.
+//	error: Error if the recorded version cannot be read.
+func PlanCluster(ctx context.Context, store *db.Store, cluster *types.Cluster, selector utils.Selector) (*Plan, error) {
+	record, err := store.GetLatestClusterRecord(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	oldVersion, err := store.GetLatestClusterVersion(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Cluster: cluster.DisplayName(), Steps: []PlanStep{}}
+	if record != nil {
+		plan.RecordedVersion = record.Version
+	}
+
+	if !cluster.Done && selector.MatchNode(cluster.NodeName) {
+		plan.Steps = append(plan.Steps, PlanStep{Action: "install", Kind: "master", Name: cluster.NodeName})
+	}
+	for _, worker := range cluster.Workers {
+		if !worker.Done && selector.MatchNode(worker.NodeName) {
+			plan.Steps = append(plan.Steps, PlanStep{Action: "join", Kind: "worker", Name: worker.NodeName})
+		}
+	}
+
+	for _, name := range sortedNames(addons.AddonRegistry) {
+		if !selector.MatchAddon(name) {
+			continue
+		}
+		_, configured := cluster.Addons[name]
+		recorded := oldVersion != nil && hasKey(oldVersion.Addons, name)
+		if !configured && !recorded {
+			continue
+		}
+		if step, ok := planAddonStep("addon", name, addonAction(name, cluster, oldVersion, selector, false)); ok {
+			plan.Steps = append(plan.Steps, step)
+		}
+	}
+	for _, name := range sortedNames(cluster.CustomAddons) {
+		if !selector.MatchAddon(name) {
+			continue
+		}
+		if step, ok := planAddonStep("customAddon", name, addonAction(name, cluster, oldVersion, selector, true)); ok {
+			plan.Steps = append(plan.Steps, step)
+		}
+	}
+	return plan, nil
+}
+
+func planAddonStep(kind, name string, status clusterutils.AddonMigrationStatus) (PlanStep, bool) {
+	switch status {
+	case clusterutils.AddonApply:
+		return PlanStep{Action: "apply", Kind: kind, Name: name}, true
+	case clusterutils.AddonDelete:
+		return PlanStep{Action: "delete", Kind: kind, Name: name}, true
+	}
+	return PlanStep{}, false
+}
+
+func hasKey[T any](m map[string]T, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+func sortedNames[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
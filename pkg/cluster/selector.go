@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// recordedState returns the cluster state that should be stored in the database after a run.
+//
+// Addons that were not selected for this run keep the state of the previous version, so the
+// next run still detects their pending changes. Selected addons record the desired state.
+func recordedState(cluster *types.Cluster, oldVersion *types.Cluster, selector utils.Selector) *types.Cluster {
+	recorded := *cluster
+	var oldAddons map[string]types.AddonConfig
+	var oldCustomAddons map[string]types.CustomAddonConfig
+	if oldVersion != nil {
+		oldAddons = oldVersion.Addons
+		oldCustomAddons = oldVersion.CustomAddons
+	}
+	recorded.Addons = mergeSelectedAddons(cluster.Addons, oldAddons, selector)
+	recorded.CustomAddons = mergeSelectedAddons(cluster.CustomAddons, oldCustomAddons, selector)
+	return &recorded
+}
+
+func mergeSelectedAddons[T any](desired, previous map[string]T, selector utils.Selector) map[string]T {
+	if desired == nil && previous == nil {
+		return nil
+	}
+	merged := make(map[string]T)
+	for name, addon := range desired {
+		if selector.MatchAddon(name) {
+			merged[name] = addon
+		} else if old, ok := previous[name]; ok {
+			merged[name] = old
+		}
+	}
+	for name, old := range previous {
+		if _, ok := desired[name]; !ok && !selector.MatchAddon(name) {
+			merged[name] = old
+		}
+	}
+	return merged
+}
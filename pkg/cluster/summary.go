@@ -0,0 +1,223 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/argon-chat/k3sd/pkg/tracing"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// StepResult is the outcome of a single step of a run.
+//
+// Fields:
+//   - Cluster: Cluster display name.
+//   - Node: Node name, if the step acts on a node.
+//   - Addon: Addon name, if the step acts on an addon.
+//   - Step: "connect", "install", "join", "label", "record", "apply", "delete" or "link", or
+//     the hook phase run, e.g. "preInstall".
+//   - StartedAt: Time the step started.
+//   - Duration: Time the step took.
+//   - Commands: Local and remote commands run by the step.
+//   - Error: Error message of a failed step.
+//   - SpanID: ID of the step's span, if spans are recorded.
+type StepResult struct {
+	Cluster   string        `json:"cluster"`
+	Node      string        `json:"node,omitempty"`
+	Addon     string        `json:"addon,omitempty"`
+	Step      string        `json:"step"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"duration"`
+	Commands  []string      `json:"commands,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	SpanID    string        `json:"spanId,omitempty"`
+
+	err error
+}
+
+// Failed reports whether the step failed.
+func (r StepResult) Failed() bool {
+	return r.err != nil
+}
+
+// Err returns the error of a failed step (a *utils.StepError), or nil.
+func (r StepResult) Err() error {
+	return r.err
+}
+
+// AddonResult is the migration status computed for an addon during a run.
+//
+// Fields:
+//   - Cluster: Cluster display name.
+//   - Name: Addon name.
+//   - Custom: Whether the addon is a custom addon.
+//   - Migration: "apply", "delete" or "noop".
+type AddonResult struct {
+	Cluster   string `json:"cluster"`
+	Name      string `json:"name"`
+	Custom    bool   `json:"custom"`
+	Migration string `json:"migration"`
+}
+
+// Summary collects the outcome of every step of a run, in the order the steps ran.
+//
+// Fields:
+//   - Steps: Outcome of every step.
+//   - Addons: Migration status of every addon considered.
+//   - Versions: Database version recorded per cluster display name.
+//   - TraceID: ID of the run's trace, if spans are recorded.
+type Summary struct {
+	Steps    []StepResult   `json:"steps"`
+	Addons   []AddonResult  `json:"addons"`
+	Versions map[string]int `json:"versions"`
+	TraceID  string         `json:"traceId,omitempty"`
+}
+
+// run runs a step with a context recording its commands and a logger tagged with the step's
+// node, addon and step fields, and records its outcome. The logger is expected to carry the
+// cluster field already. The Progress carried by ctx, if any, is told about the step, and the
+// step runs in a span of its own.
+func (s *Summary) run(ctx context.Context, logger *utils.Logger, cluster, node, addon, step string, fn func(context.Context, *utils.Logger) error) error {
+	info := utils.StepInfo{Cluster: cluster, Node: node, Addon: addon, Step: step}
+	progress := utils.ProgressFrom(ctx)
+	commands := &utils.CommandLog{}
+	if progress != nil {
+		progress.StepStarted(info)
+		commands.OnCommand = func(command string) { progress.StepCommand(info, command) }
+	}
+	ctx, span := tracing.Start(ctx, "step "+step, stepAttributes(info)...)
+	started := time.Now()
+	err := tracing.End(span, fn(utils.WithCommandLog(ctx, commands), stepLogger(logger, node, addon, step)))
+	duration := time.Since(started)
+	if progress != nil {
+		progress.StepFinished(info, duration, err)
+	}
+	return s.add(StepResult{
+		Cluster:   cluster,
+		Node:      node,
+		Addon:     addon,
+		Step:      step,
+		StartedAt: started,
+		Duration:  duration,
+		Commands:  commands.Commands(),
+		SpanID:    tracing.SpanID(ctx),
+	}, err)
+}
+
+// stepAttributes returns the span attributes identifying a step.
+func stepAttributes(info utils.StepInfo) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{tracing.AttrCluster.String(info.Cluster), tracing.AttrStep.String(info.Step)}
+	if info.Node != "" {
+		attrs = append(attrs, tracing.AttrNode.String(info.Node))
+	}
+	if info.Addon != "" {
+		attrs = append(attrs, tracing.AttrAddon.String(info.Addon))
+	}
+	return attrs
+}
+
+// stepLogger returns logger with the non-empty step fields added.
+func stepLogger(logger *utils.Logger, node, addon, step string) *utils.Logger {
+	var args []any
+	if node != "" {
+		args = append(args, utils.FieldNode, node)
+	}
+	if addon != "" {
+		args = append(args, utils.FieldAddon, addon)
+	}
+	args = append(args, utils.FieldStep, step)
+	return logger.With(args...)
+}
+
+// record adds the outcome of a step that ran no commands and returns err wrapped in a
+// *utils.StepError, or nil.
+func (s *Summary) record(cluster, node, addon, step string, err error) error {
+	return s.add(StepResult{Cluster: cluster, Node: node, Addon: addon, Step: step, StartedAt: time.Now()}, err)
+}
+
+func (s *Summary) add(result StepResult, err error) error {
+	if err != nil {
+		result.err = &utils.StepError{Cluster: result.Cluster, Node: result.Node, Addon: result.Addon, Step: result.Step, Err: err}
+		result.Error = utils.Redact(err.Error())
+	}
+	s.Steps = append(s.Steps, result)
+	return result.err
+}
+
+func (s *Summary) addAddon(result AddonResult) {
+	s.Addons = append(s.Addons, result)
+}
+
+func (s *Summary) setVersion(cluster string, version int) {
+	if s.Versions == nil {
+		s.Versions = make(map[string]int)
+	}
+	s.Versions[cluster] = version
+}
+
+// Err returns the errors of all failed steps joined, or nil if every step succeeded.
+func (s *Summary) Err() error {
+	var errs []error
+	for _, step := range s.Steps {
+		errs = append(errs, step.err)
+	}
+	return errors.Join(errs...)
+}
+
+// Failed returns the number of failed steps.
+func (s *Summary) Failed() int {
+	count := 0
+	for _, step := range s.Steps {
+		if step.Failed() {
+			count++
+		}
+	}
+	return count
+}
+
+// RenderSummary writes the outcome of every step as a table grouped by cluster, followed by
+// the total number of failed steps.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	summary: Summary of the run.
+//
+// Returns:
+//
+//	Error if writing fails.
+func RenderSummary(w io.Writer, summary *Summary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tNODE/ADDON\tSTEP\tDURATION\tRESULT")
+	for _, step := range summary.Steps {
+		target := step.Node
+		if step.Addon != "" {
+			target = step.Addon
+		}
+		if target == "" {
+			target = "-"
+		}
+		result := "ok"
+		if step.Failed() {
+			result = "FAILED: " + firstLine(step.Error)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", step.Cluster, target, step.Step, step.Duration.Round(time.Millisecond), result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d steps, %d failed\n", len(summary.Steps), summary.Failed())
+	return err
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -1,6 +1,8 @@
 package cluster
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/argon-chat/k3sd/pkg/clusterutils"
@@ -10,60 +12,130 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func uninstallWorker(client *ssh.Client, worker types.Worker, clusterAddress string, logger *utils.Logger) error {
+func uninstallWorker(ctx context.Context, client *ssh.Client, worker types.Worker, clusterAddress string, logger *utils.Logger) error {
 	cmd := fmt.Sprintf("ssh %s@%s \"k3s-agent-uninstall.sh\"", worker.User, worker.Address)
-	err := clusterutils.ExecuteCommands(client, []string{cmd}, worker.Password, logger)
+	err := clusterutils.ExecuteCommands(ctx, client, []string{cmd}, worker.Password, logger)
 	utils.LogIfError(logger, err, "Error uninstalling worker on %s: %v", clusterAddress)
 	return err
 }
 
-func uninstallMaster(client *ssh.Client, clusterAddress string, logger *utils.Logger) error {
-	err := clusterutils.ExecuteCommands(client, []string{"k3s-uninstall.sh"}, clusterAddress, logger)
-	utils.LogIfError(logger, err, "Error uninstalling master on %s: %v", clusterAddress)
+func uninstallMaster(ctx context.Context, client *ssh.Client, cluster types.Cluster, logger *utils.Logger) error {
+	err := clusterutils.ExecuteCommands(ctx, client, []string{"k3s-uninstall.sh"}, cluster.Password, logger)
+	utils.LogIfError(logger, err, "Error uninstalling master on %s: %v", cluster.Address)
 	return err
 }
 
-// UninstallCluster removes all K3s components from the provided clusters.
-// It connects to each master and worker node, runs uninstall scripts, and updates cluster state.
+// ErrProtected is returned when destroying a cluster that has the protected flag set.
+var ErrProtected = errors.New("cluster is protected")
+
+// CheckDestroyAllowed returns an error if the cluster is protected against destruction.
+//
+// Parameters:
+//
+//	cluster: The cluster to check.
+//
+// Returns:
+//
+//	Error if the cluster has the protected flag set.
+func CheckDestroyAllowed(cluster *types.Cluster) error {
+	if cluster.Protected {
+		return fmt.Errorf("%w: set \"protected\" to false in the config to allow destroying %s", ErrProtected, cluster.DisplayName())
+	}
+	return nil
+}
+
+// UninstallCluster removes all K3s components from the selected clusters.
+// It connects to each master and worker node, runs uninstall scripts, and records the nodes as
+// not installed in the database.
+// Protected clusters are refused before anything is uninstalled.
+//
+// A failure on one cluster or node does not stop the run: a node whose uninstall script fails
+// stays recorded as installed, so the next destroy tries it again, and the recorded versions of
+// a cluster are only deleted once all of its nodes are uninstalled.
 //
 // Parameters:
 //
+//	ctx: Context of the run; cancelling it aborts the running remote command.
+//	store: Database whose recorded versions of the clusters are deleted and whose install state
+//	of their nodes is updated.
 //	clusters: List of clusters to uninstall.
 //	logger: Logger for output.
+//	selector: Restricts the uninstall to specific clusters.
 //
 // Returns:
 //
-//	Updated list of clusters and error if any step fails.
-func UninstallCluster(clusters []types.Cluster, logger *utils.Logger) ([]types.Cluster, error) {
+//	Updated list of clusters and the joined errors of all failed steps (each a
+//	*utils.StepError), joined with ctx.Err() if the run was cancelled.
+func UninstallCluster(ctx context.Context, store *db.Store, clusters []types.Cluster, logger *utils.Logger, selector utils.Selector) ([]types.Cluster, error) {
+	for _, cluster := range clusters {
+		if !selector.MatchCluster(cluster.Context) {
+			continue
+		}
+		if err := CheckDestroyAllowed(&cluster); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
 	for ci, cluster := range clusters {
-		err := db.DeleteClusterRecords(&cluster)
-		if err != nil {
-			return nil, fmt.Errorf("error deleting cluster records for %s: %v", cluster.Address, err)
+		if !selector.MatchCluster(cluster.Context) {
+			continue
 		}
-		client, err := clusterutils.SSHConnect(cluster.User, cluster.Password, cluster.Address)
+		if ctx.Err() != nil {
+			break
+		}
+		name := cluster.DisplayName()
+		client, err := clusterutils.SSHConnect(ctx, cluster.User, cluster.Password, cluster.Address)
 		if err != nil {
-			return nil, fmt.Errorf("error connecting to cluster %s: %v", cluster.Address, err)
+			logger.LogErr("error connecting to cluster %s: %v", cluster.Address, err)
+			errs = append(errs, &utils.StepError{Cluster: name, Node: cluster.NodeName, Step: "connect", Err: err})
+			continue
 		}
 		defer func(client *ssh.Client) {
 			err := client.Close()
 			if err != nil {
 				logger.LogErr("Error closing SSH connection to %s: %v\n", cluster.Address, err)
 			} else {
-				logger.Log("SSH connection to %s closed successfully.\n", cluster.Address)
+				logger.Log("SSH connection to %s closed successfully.", cluster.Address)
 			}
 		}(client)
 
+		uninstalled := true
 		for wi, worker := range cluster.Workers {
-			if worker.Done {
-				_ = uninstallWorker(client, worker, cluster.Address, logger)
-				clusters[ci].Workers[wi].Done = false
+			if !worker.Done {
+				continue
+			}
+			if ctx.Err() != nil {
+				uninstalled = false
+				break
+			}
+			if err := uninstallWorker(ctx, client, worker, cluster.Address, logger); err != nil {
+				errs = append(errs, &utils.StepError{Cluster: name, Node: worker.NodeName, Step: "uninstall", Err: err})
+				uninstalled = false
+				continue
 			}
+			clusters[ci].Workers[wi].Done = false
 		}
 
 		if cluster.Done {
-			_ = uninstallMaster(client, cluster.Address, logger)
-			clusters[ci].Done = false
+			if ctx.Err() != nil {
+				uninstalled = false
+			} else if err := uninstallMaster(ctx, client, cluster, logger); err != nil {
+				errs = append(errs, &utils.StepError{Cluster: name, Node: cluster.NodeName, Step: "uninstall", Err: err})
+				uninstalled = false
+			} else {
+				clusters[ci].Done = false
+			}
+		}
+		// the nodes uninstalled so far are recorded also when ctx was cancelled
+		if err := saveNodeStates(ctx, store, &clusters[ci]); err != nil {
+			errs = append(errs, &utils.StepError{Cluster: name, Step: "record", Err: err})
+			continue
+		}
+		if uninstalled {
+			if err := store.DeleteClusterRecords(ctx, &cluster); err != nil {
+				errs = append(errs, &utils.StepError{Cluster: name, Step: "record", Err: fmt.Errorf("delete recorded versions: %w", err)})
+			}
 		}
 	}
-	return clusters, nil
+	return clusters, errors.Join(append(errs, ctx.Err())...)
 }
@@ -0,0 +1,473 @@
+package clusterstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Configs in the object form can be composed of several files and overlays:
+//
+//   - include: Config files (paths relative to the including file) merged in order, before the
+//     rest of the including file. Included files may include others themselves.
+//   - defaults: Settings merged under every cluster, e.g. the addons all clusters share.
+//   - environments: Named overlays (holding defaults, clusters and includes of their own)
+//     merged onto the rest of the config when the environment is selected, e.g. with --env.
+//
+// Objects are merged key by key, the later value winning; other values, lists included, are
+// replaced. Clusters are merged with the cluster of the same context, if there is one, and
+// workers with the worker of the same nodeName; other clusters and workers are appended.
+
+// Keys of the object form composing a config of other files and overlays.
+const (
+	includeKey      = "include"
+	defaultsKey     = "defaults"
+	environmentsKey = "environments"
+)
+
+// ErrComposed is returned by SaveClusters for a config composed of includes, defaults or
+// environments, which cannot be written back without flattening it.
+var ErrComposed = errors.New("the config is composed of includes, defaults or environments; edit its files instead")
+
+// composer reads the files included by a config.
+//
+// Fields:
+//   - stack: Absolute paths of the files being included, innermost last, to detect cycles.
+type composer struct {
+	stack []string
+}
+
+// compose returns the tree of a config with its includes, the selected environment and the
+// defaults merged into its clusters. The composed tree only holds the clusters and the other
+// keys of the object form ("$schema" and "x-" keys).
+func compose(path string, tree any, env string) (any, error) {
+	obj, ok := tree.(*object)
+	if !ok || !isComposed(obj) {
+		return tree, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &composer{stack: []string{abs}}
+	if obj, err = c.include(path, obj); err != nil {
+		return nil, err
+	}
+	envs, err := environments(obj)
+	if err != nil {
+		return nil, err
+	}
+	defaults := newObject()
+	// configs without environments are the same in every environment
+	if env != "" && len(envs.keys) > 0 {
+		overlay, ok := envs.values[env]
+		if !ok {
+			return nil, fmt.Errorf("no environment %q: the config defines %s", env, strings.Join(envs.keys, ", "))
+		}
+		overlayObj, ok := overlay.(*object)
+		if !ok {
+			return nil, fmt.Errorf("%s.%s: expected an object", environmentsKey, env)
+		}
+		if overlayObj, err = c.include(path, overlayObj); err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", environmentsKey, env, err)
+		}
+		obj = mergeConfigs(obj, overlayObj)
+		// clusters are labelled with their environment unless they set one themselves
+		defaults.set("environment", env)
+	} else if _, ok := obj.values[clustersKey]; !ok && len(envs.keys) > 0 {
+		return nil, fmt.Errorf("the config only defines clusters in %s: select one of %s with --env", environmentsKey, strings.Join(envs.keys, ", "))
+	}
+	if value, ok := obj.values[defaultsKey]; ok && value != nil {
+		if _, ok := value.(*object); !ok {
+			return nil, fmt.Errorf("%s: expected an object", defaultsKey)
+		}
+		defaults = mergeTrees(defaults, value).(*object)
+	}
+	out := newObject()
+	for _, key := range obj.keys {
+		switch key {
+		case defaultsKey, environmentsKey:
+		case clustersKey:
+			out.set(key, applyDefaults(obj.values[key], defaults))
+		default:
+			out.set(key, obj.values[key])
+		}
+	}
+	return out, nil
+}
+
+// isComposed reports whether a config object uses includes, defaults or environments.
+func isComposed(obj *object) bool {
+	for _, key := range []string{includeKey, defaultsKey, environmentsKey} {
+		if _, ok := obj.values[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// include returns a config object with the files it includes merged under it and its include
+// key removed.
+func (c *composer) include(path string, obj *object) (*object, error) {
+	paths, err := includes(path, obj)
+	if err != nil || len(paths) == 0 {
+		return without(obj, includeKey), err
+	}
+	merged := newObject()
+	for _, file := range paths {
+		if i := slices.Index(c.stack, file); i >= 0 {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(c.stack[i:], file), " -> "))
+		}
+		fragment, err := c.fragment(file)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", file, err)
+		}
+		merged = mergeConfigs(merged, fragment)
+	}
+	return mergeConfigs(merged, without(obj, includeKey)), nil
+}
+
+// fragment reads an included config file, with its own includes merged. A list of clusters
+// stands for an object with that list.
+func (c *composer) fragment(path string) (*object, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := codecs[FormatOf(path)].decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", FormatOf(path), err)
+	}
+	if tree, err = decryptLoaded(tree); err != nil {
+		return nil, err
+	}
+	var obj *object
+	switch v := tree.(type) {
+	case *object:
+		obj = v
+	case []any:
+		obj = newObject()
+		obj.set(clustersKey, v)
+	case nil:
+		obj = newObject()
+	default:
+		return nil, fmt.Errorf("expected a list of clusters or an object with a %q list", clustersKey)
+	}
+	c.stack = append(c.stack, path)
+	defer func() { c.stack = c.stack[:len(c.stack)-1] }()
+	return c.include(path, obj)
+}
+
+// includes returns the absolute paths of the files a config object includes, given relative to
+// the config file at path.
+func includes(path string, obj *object) ([]string, error) {
+	value, ok := obj.values[includeKey]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a list of file paths", includeKey)
+	}
+	paths := make([]string, 0, len(list))
+	for i, item := range list {
+		file, ok := stringValue(item)
+		if !ok || file == "" {
+			return nil, fmt.Errorf("%s[%d]: expected a file path", includeKey, i)
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, abs)
+	}
+	return paths, nil
+}
+
+// environments returns the environments object of a config; an empty object if it has none.
+func environments(obj *object) (*object, error) {
+	value, ok := obj.values[environmentsKey]
+	if !ok || value == nil {
+		return newObject(), nil
+	}
+	envs, ok := value.(*object)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an object of environments by name", environmentsKey)
+	}
+	return envs, nil
+}
+
+// ConfigSources returns the files a config is composed of: the config itself and the files it
+// includes, also those included by its environments, in the order they are read. Encrypted
+// files are decrypted, in case their includes are encrypted too.
+//
+// Parameters:
+//
+//	path: Path to the config file.
+//
+// Returns:
+//
+//	The config file and the files it includes, and error if one of them cannot be read.
+func ConfigSources(path string) ([]string, error) {
+	sources := []string{path}
+	seen := make(map[string]bool)
+	if abs, err := filepath.Abs(path); err == nil {
+		seen[abs] = true
+	}
+	var visit func(file string) error
+	visit = func(file string) error {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		tree, err := codecs[FormatOf(file)].decode(data)
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", file, err)
+		}
+		if isEncrypted(tree) {
+			if tree, _, _, err = decryptTree(tree); err != nil {
+				return fmt.Errorf("decrypt %s: %w", file, err)
+			}
+		}
+		obj, ok := tree.(*object)
+		if !ok {
+			return nil
+		}
+		objects := []*object{obj}
+		if envs, err := environments(obj); err == nil {
+			for _, name := range envs.keys {
+				if env, ok := envs.values[name].(*object); ok {
+					objects = append(objects, env)
+				}
+			}
+		}
+		for _, obj := range objects {
+			paths, err := includes(file, obj)
+			if err != nil {
+				return err
+			}
+			for _, included := range paths {
+				if seen[included] {
+					continue
+				}
+				seen[included] = true
+				sources = append(sources, included)
+				if err := visit(included); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := visit(path)
+	return sources, err
+}
+
+// mergeConfigs merges the config object src onto dst: clusters are merged by context and
+// environments by name, other keys with mergeTrees.
+func mergeConfigs(dst, src *object) *object {
+	out := copyObject(dst)
+	for _, key := range src.keys {
+		value := src.values[key]
+		switch key {
+		case clustersKey:
+			out.set(key, mergeList(out.values[key], value, "context", mergeCluster))
+		case environmentsKey:
+			envs, ok := value.(*object)
+			current, isObject := out.values[key].(*object)
+			if !ok || !isObject {
+				out.set(key, value)
+				continue
+			}
+			merged := copyObject(current)
+			for _, name := range envs.keys {
+				dstEnv, ok := merged.values[name].(*object)
+				srcEnv, isObject := envs.values[name].(*object)
+				if ok && isObject {
+					merged.set(name, mergeConfigs(dstEnv, srcEnv))
+					continue
+				}
+				merged.set(name, envs.values[name])
+			}
+			out.set(key, merged)
+		case defaultsKey:
+			out.set(key, mergeCluster(out.values[key], value))
+		default:
+			out.set(key, mergeTrees(out.values[key], value))
+		}
+	}
+	return out
+}
+
+// applyDefaults merges every cluster of a list onto the defaults. The keys of a cluster keep
+// their order, before those only set by the defaults.
+func applyDefaults(clusters any, defaults *object) any {
+	list, ok := clusters.([]any)
+	if !ok || len(defaults.keys) == 0 {
+		return clusters
+	}
+	out := make([]any, len(list))
+	for i, cluster := range list {
+		own, ok := cluster.(*object)
+		if !ok {
+			out[i] = cluster
+			continue
+		}
+		merged := mergeCluster(defaults, own).(*object)
+		ordered := newObject()
+		for _, key := range append(slices.Clone(own.keys), merged.keys...) {
+			ordered.set(key, merged.values[key])
+		}
+		out[i] = ordered
+	}
+	return out
+}
+
+// mergeCluster merges the cluster src onto dst, the workers by nodeName.
+func mergeCluster(dst, src any) any {
+	d, ok := dst.(*object)
+	s, isObject := src.(*object)
+	if !ok || !isObject {
+		return src
+	}
+	out := copyObject(d)
+	for _, key := range s.keys {
+		if key == "workers" {
+			out.set(key, mergeList(out.values[key], s.values[key], "nodeName", mergeTrees))
+			continue
+		}
+		out.set(key, mergeTrees(out.values[key], s.values[key]))
+	}
+	return out
+}
+
+// mergeList merges the items of the list src onto the items of dst with the same value of
+// key, and appends the others. If either is not a list, src replaces dst.
+func mergeList(dst, src any, key string, merge func(dst, src any) any) any {
+	d, ok := dst.([]any)
+	s, isList := src.([]any)
+	if !ok || !isList {
+		return src
+	}
+	out := slices.Clone(d)
+	for _, item := range s {
+		if i := indexOf(out, key, item); i >= 0 {
+			out[i] = merge(out[i], item)
+			continue
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+// indexOf returns the index of the object in list with the same non-empty string value of key
+// as item, or -1.
+func indexOf(list []any, key string, item any) int {
+	obj, ok := item.(*object)
+	if !ok {
+		return -1
+	}
+	value, ok := stringValue(obj.values[key])
+	if !ok || value == "" {
+		return -1
+	}
+	for i, candidate := range list {
+		if c, ok := candidate.(*object); ok {
+			if s, ok := stringValue(c.values[key]); ok && s == value {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// stringValue returns the string of a tree value, decrypted or not.
+func stringValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case decrypted:
+		return string(v), true
+	}
+	return "", false
+}
+
+// mergeTrees merges the tree src onto dst: objects are merged key by key, recursively, and any
+// other value of src replaces that of dst. Neither tree is modified.
+func mergeTrees(dst, src any) any {
+	d, ok := dst.(*object)
+	s, isObject := src.(*object)
+	if !ok || !isObject {
+		return src
+	}
+	out := copyObject(d)
+	for _, key := range s.keys {
+		out.set(key, mergeTrees(out.values[key], s.values[key]))
+	}
+	return out
+}
+
+// copyObject returns a shallow copy of an object.
+func copyObject(obj *object) *object {
+	out := newObject()
+	for _, key := range obj.keys {
+		out.set(key, obj.values[key])
+	}
+	return out
+}
+
+// without returns a shallow copy of an object without a key.
+func without(obj *object, key string) *object {
+	out := newObject()
+	for _, k := range obj.keys {
+		if k != key {
+			out.set(k, obj.values[k])
+		}
+	}
+	return out
+}
+
+// includedFiles returns the absolute paths of the files included by the configs of a list,
+// which are fragments of those configs rather than configs of their own.
+func includedFiles(files []string) map[string]bool {
+	included := make(map[string]bool)
+	for _, file := range files {
+		sources, _ := ConfigSources(file)
+		for _, source := range sources[1:] {
+			included[source] = true
+		}
+	}
+	return included
+}
+
+// redactTree returns a tree with its decrypted values masked, and the secrets registered with
+// utils.RegisterSecret masked in its strings.
+func redactTree(tree any) any {
+	switch v := tree.(type) {
+	case *object:
+		out := newObject()
+		for _, key := range v.keys {
+			out.set(key, redactTree(v.values[key]))
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = redactTree(item)
+		}
+		return out
+	case string:
+		return utils.DefaultRedactor.RedactValues(v)
+	case decrypted:
+		return utils.Redacted
+	}
+	return tree
+}
@@ -0,0 +1,310 @@
+package clusterstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/types"
+)
+
+// Format is the file format of a cluster config.
+type Format string
+
+// Supported config formats.
+const (
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+	FormatTOML Format = "toml"
+)
+
+// extensions maps config file extensions to their format.
+var extensions = map[string]Format{
+	".json": FormatJSON,
+	".yaml": FormatYAML,
+	".yml":  FormatYAML,
+	".toml": FormatTOML,
+}
+
+// FormatOf returns the format of a config file from its extension. Files with another
+// extension are read as JSON.
+//
+// Parameters:
+//
+//	path: Path to the config file.
+//
+// Returns:
+//
+//	Format: the format of the file.
+func FormatOf(path string) Format {
+	if format, ok := extensions[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return FormatJSON
+}
+
+// clustersKey is the key holding the clusters in the object form of a config:
+// {"clusters": [...]}, the only form TOML can express.
+const clustersKey = "clusters"
+
+// object is a decoded mapping that keeps the order of its keys.
+type object struct {
+	keys   []string
+	values map[string]any
+}
+
+func newObject() *object {
+	return &object{values: make(map[string]any)}
+}
+
+func (o *object) set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// lookup returns the value of a key. It may be called on nil.
+func (o *object) lookup(key string) (any, bool) {
+	if o == nil {
+		return nil, false
+	}
+	value, ok := o.values[key]
+	return value, ok
+}
+
+// MarshalJSON encodes the object with its keys in order.
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// toTree converts a value to a tree of *object, []any, string, float64, bool and nil by
+// encoding it as JSON, so that every format shares the JSON field names of pkg/types. Struct
+// fields keep their declaration order.
+func toTree(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	return readTree(dec)
+}
+
+func readTree(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := newObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key.(string), value)
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			value, err := readTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// decodeClusters decodes the clusters of a config tree, given either as a list of clusters
+// or in the object form.
+func decodeClusters(tree any) ([]types.Cluster, error) {
+	if obj, ok := tree.(*object); ok {
+		list, ok := obj.values[clustersKey]
+		if !ok && len(obj.keys) > 0 {
+			return nil, fmt.Errorf("expected a list of clusters or an object with a %q list", clustersKey)
+		}
+		tree = list
+	}
+	if _, ok := tree.([]any); !ok && tree != nil {
+		return nil, fmt.Errorf("expected a list of clusters or an object with a %q list", clustersKey)
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []types.Cluster
+	if err := json.Unmarshal(data, &clusters); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// encodeClusters returns the tree of a config holding clusters, in the form of the existing
+// config old: its other top-level keys are kept. A nil old yields the list form unless
+// objectForm is set.
+func encodeClusters(old any, clusters []types.Cluster, objectForm bool) (any, error) {
+	if clusters == nil {
+		clusters = []types.Cluster{}
+	}
+	list, err := toTree(clusters)
+	if err != nil {
+		return nil, err
+	}
+	if obj, ok := old.(*object); ok {
+		doc := newObject()
+		for _, key := range obj.keys {
+			doc.set(key, obj.values[key])
+		}
+		doc.set(clustersKey, list)
+		return doc, nil
+	}
+	if objectForm {
+		doc := newObject()
+		doc.set(clustersKey, list)
+		return doc, nil
+	}
+	return list, nil
+}
+
+// keepLayout returns the tree new laid out like old, the tree of the config it replaces: the
+// keys of every object are in the order of the same object in old, followed by the keys new
+// adds, and the keys old spells out with zero values are kept. As when a config is edited in
+// place, zero values are not added to the objects of old. List items are matched by position.
+func keepLayout(old, new any) any {
+	switch n := new.(type) {
+	case *object:
+		o, ok := old.(*object)
+		if !ok {
+			return new
+		}
+		merged := newObject()
+		for _, key := range o.keys {
+			prev := o.values[key]
+			value, ok := n.values[key]
+			switch {
+			case isZero(prev) && isZero(value):
+				merged.set(key, prev)
+			case ok:
+				merged.set(key, keepLayout(prev, value))
+			}
+		}
+		for _, key := range n.keys {
+			if _, ok := o.values[key]; !ok && !isZero(n.values[key]) {
+				merged.set(key, n.values[key])
+			}
+		}
+		return merged
+	case []any:
+		o, _ := old.([]any)
+		merged := make([]any, len(n))
+		for i, value := range n {
+			if i < len(o) {
+				value = keepLayout(o[i], value)
+			}
+			merged[i] = value
+		}
+		return merged
+	}
+	return new
+}
+
+// isZero reports whether a tree value equals what an absent key decodes to: null, false, 0,
+// "" or an empty list or object. Such keys are neither added to nor removed from a config
+// being written back, so that the file keeps the user's choice of spelling them out.
+func isZero(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	case *object:
+		return len(v.keys) == 0
+	}
+	return false
+}
+
+// sameTree reports whether two tree values decode to the same clusters: zero values and
+// absent keys are alike, e.g. "labels": {} and a missing "labels".
+func sameTree(a, b any) bool {
+	if isZero(a) && isZero(b) {
+		return true
+	}
+	switch a := a.(type) {
+	case *object:
+		b, ok := b.(*object)
+		if !ok {
+			return false
+		}
+		for _, key := range a.keys {
+			if !sameTree(a.values[key], b.values[key]) {
+				return false
+			}
+		}
+		for _, key := range b.keys {
+			if _, ok := a.values[key]; !ok && !isZero(b.values[key]) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !sameTree(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// isScalar reports whether a tree value is neither a list nor an object.
+func isScalar(v any) bool {
+	switch v.(type) {
+	case *object, []any:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package clusterstore
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// jsonCodec reads and writes JSON configs.
+var jsonCodec = codec{
+	decode: func(data []byte) (any, error) {
+		return readTree(json.NewDecoder(bytes.NewReader(data)))
+	},
+	locate:  locateJSON,
+	literal: jsonLiteral,
+	member: func(key, literal string) string {
+		name, _ := jsonLiteral(key)
+		return name + ": " + literal
+	},
+	item: func(v any, at insertionPoint) (string, bool) {
+		if at.indent == "" {
+			return jsonLiteral(v)
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent(at.indent, "  ")
+		if err := enc.Encode(v); err != nil {
+			return "", false
+		}
+		return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), true
+	},
+	encode: func(_ []byte, tree any) ([]byte, error) {
+		return json.MarshalIndent(tree, "", "  ")
+	},
+}
+
+// jsonLiteral encodes a value as JSON on a single line, without escaping HTML characters.
+func jsonLiteral(v any) (string, bool) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", false
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), true
+}
+
+// locateJSON finds the values and objects of a JSON config in its text.
+func locateJSON(data []byte) (*textLocator, error) {
+	loc := newTextLocator()
+	_, err := loc.scanJSON(data, json.NewDecoder(bytes.NewReader(data)), nil)
+	return loc, err
+}
+
+// scanJSON records the location of the value at path, read next from dec, and of the values
+// inside it. It returns the offset the value ends at.
+func (l *textLocator) scanJSON(data []byte, dec *json.Decoder, path []string) (int, error) {
+	start := skipJSONSeparators(data, int(dec.InputOffset()))
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		first, last := -1, -1
+		for dec.More() {
+			keyStart := skipJSONSeparators(data, int(dec.InputOffset()))
+			key, err := dec.Token()
+			if err != nil {
+				return 0, err
+			}
+			if first < 0 {
+				first = keyStart
+			}
+			if last, err = l.scanJSON(data, dec, appendPath(path, key.(string))); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return 0, err
+		}
+		if first >= 0 {
+			l.insertions[pathKey(path)] = jsonInsertion(data, first, last)
+		}
+		return int(dec.InputOffset()), nil
+	case json.Delim('['):
+		first, last := -1, -1
+		for i := 0; dec.More(); i++ {
+			itemStart := skipJSONSeparators(data, int(dec.InputOffset()))
+			if first < 0 {
+				first = itemStart
+			}
+			if last, err = l.scanJSON(data, dec, indexPath(path, i)); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return 0, err
+		}
+		if first >= 0 {
+			l.appends[pathKey(path)] = jsonInsertion(data, first, last)
+		}
+		return int(dec.InputOffset()), nil
+	}
+	end := int(dec.InputOffset())
+	l.spans[pathKey(path)] = [2]int{start, end}
+	return end, nil
+}
+
+// jsonInsertion returns the insertion point after the last member or item of an object or
+// list, ending at last, whose first member or item starts at first. Members on lines of their
+// own get one more; inline objects and lists get it inline.
+func jsonInsertion(data []byte, first, last int) insertionPoint {
+	indent := data[lineStart(data, first):first]
+	if len(bytes.TrimSpace(indent)) > 0 {
+		return insertionPoint{offset: last, prefix: ", "}
+	}
+	return insertionPoint{offset: last, prefix: ",\n" + string(indent), indent: string(indent)}
+}
+
+// skipJSONSeparators returns the offset of the next token at or after offset.
+func skipJSONSeparators(data []byte, offset int) int {
+	for offset < len(data) && bytes.IndexByte([]byte(" \t\r\n,:"), data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
@@ -0,0 +1,244 @@
+package clusterstore
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A config is written back by editing its text in place where possible, so that the
+// comments, ordering and formatting of the user's file survive: changed scalar values are
+// replaced, new scalar keys (like "protected": true) are appended to their object and new items,
+// like a new worker, to their list. Anything else, like a removed worker, re-encodes the file.
+
+// insertionPoint is where a key is appended to an object, or an item to a list, in the text
+// of a config.
+//
+// Fields:
+//   - offset: Byte offset the key or item is inserted at.
+//   - prefix: Text written before the key or item, e.g. a newline and the indentation of the
+//     object.
+//   - indent: Indentation of the lines of an item after its first.
+//   - header: Key of an array of tables, in TOML.
+type insertionPoint struct {
+	offset int
+	prefix string
+	indent string
+	header []string
+}
+
+// textLocator knows where the values and objects of a parsed config are in its text, by path.
+// Paths are the object keys and list indexes leading to a value.
+//
+// Fields:
+//   - spans: Byte range of every scalar value that can be replaced in place.
+//   - insertions: Insertion point of every object keys can be appended to.
+//   - appends: Insertion point of every list items can be appended to.
+//   - order: Position of every key in the text, recorded for formats whose decoder does not
+//     keep the order of keys.
+type textLocator struct {
+	spans      map[string][2]int
+	insertions map[string]insertionPoint
+	appends    map[string]insertionPoint
+	order      map[string]int
+}
+
+func newTextLocator() *textLocator {
+	return &textLocator{
+		spans:      make(map[string][2]int),
+		insertions: make(map[string]insertionPoint),
+		appends:    make(map[string]insertionPoint),
+		order:      make(map[string]int),
+	}
+}
+
+// see records the position of the key at path, if it was not seen before.
+func (l *textLocator) see(path []string) {
+	if _, ok := l.order[pathKey(path)]; !ok {
+		l.order[pathKey(path)] = len(l.order)
+	}
+}
+
+// pathKey returns the map key of a path.
+func pathKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// appendPath returns path extended by an element, without sharing the backing array.
+func appendPath(path []string, element string) []string {
+	return append(path[:len(path):len(path)], element)
+}
+
+// indexPath returns path extended by a list index.
+func indexPath(path []string, index int) []string {
+	return appendPath(path, strconv.Itoa(index))
+}
+
+// edit replaces the bytes [start, end) of a text; start == end inserts text. depth is the
+// length of the path of the value inserted into.
+type edit struct {
+	start, end int
+	text       string
+	depth      int
+}
+
+// patcher collects the edits turning the text of a config into that of a new tree.
+//
+// Fields:
+//   - loc: Locations of the values of the config.
+//   - literal: Encodes a scalar as it is written in the format, or reports that it cannot be
+//     written on a single line.
+//   - member: Formats a key and its encoded value as an object member.
+//   - item: Encodes a list item appended at an insertion point.
+//   - edits: Edits collected so far.
+type patcher struct {
+	loc     *textLocator
+	literal func(any) (string, bool)
+	member  func(key, literal string) string
+	item    func(v any, at insertionPoint) (string, bool)
+	edits   []edit
+}
+
+// diff collects the edits turning old, the value at path, into new. It returns false if that
+// takes more than replacing scalars, appending scalar keys to objects and items to lists.
+func (p *patcher) diff(path []string, old, new any) bool {
+	if sameTree(old, new) {
+		return true
+	}
+	switch o := old.(type) {
+	case *object:
+		n, ok := new.(*object)
+		if !ok {
+			return false
+		}
+		for _, key := range n.keys {
+			value := n.values[key]
+			if prev, ok := o.values[key]; ok {
+				if !p.diff(appendPath(path, key), prev, value) {
+					return false
+				}
+				continue
+			}
+			if isZero(value) {
+				continue
+			}
+			if !p.insert(path, key, value) {
+				return false
+			}
+		}
+		for _, key := range o.keys {
+			if _, ok := n.values[key]; !ok && !isZero(o.values[key]) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		n, ok := new.([]any)
+		if !ok || len(n) < len(o) {
+			return false
+		}
+		for i := range o {
+			if !p.diff(indexPath(path, i), o[i], n[i]) {
+				return false
+			}
+		}
+		if len(n) == len(o) {
+			return true
+		}
+		point, ok := p.loc.appends[pathKey(path)]
+		if !ok {
+			return false
+		}
+		for _, value := range n[len(o):] {
+			text, ok := p.item(value, point)
+			if !ok {
+				return false
+			}
+			p.edits = append(p.edits, edit{start: point.offset, end: point.offset, text: point.prefix + text, depth: len(path)})
+		}
+		return true
+	}
+	if !isScalar(new) {
+		return false
+	}
+	span, ok := p.loc.spans[pathKey(path)]
+	if !ok {
+		return false
+	}
+	literal, ok := p.literal(new)
+	if !ok {
+		return false
+	}
+	p.edits = append(p.edits, edit{start: span[0], end: span[1], text: literal})
+	return true
+}
+
+// insert appends a scalar key to the object at path.
+func (p *patcher) insert(path []string, key string, value any) bool {
+	if !isScalar(value) {
+		return false
+	}
+	point, ok := p.loc.insertions[pathKey(path)]
+	if !ok {
+		return false
+	}
+	literal, ok := p.literal(value)
+	if !ok {
+		return false
+	}
+	p.edits = append(p.edits, edit{start: point.offset, end: point.offset, text: point.prefix + p.member(key, literal), depth: len(path)})
+	return true
+}
+
+// apply returns data with the edits applied. Of the insertions at the same offset, like keys
+// appended to the last item of a list and to the object holding the list, the innermost go
+// first; the others keep the order they were collected in. It returns false if edits overlap.
+func (p *patcher) apply(data []byte) ([]byte, bool) {
+	edits := append([]edit(nil), p.edits...)
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start < edits[j].start
+		}
+		return edits[i].depth > edits[j].depth
+	})
+	var out strings.Builder
+	pos := 0
+	for _, e := range edits {
+		if e.start < pos {
+			return nil, false
+		}
+		out.Write(data[pos:e.start])
+		out.WriteString(e.text)
+		pos = e.end
+	}
+	out.Write(data[pos:])
+	return []byte(out.String()), true
+}
+
+// lineStart returns the offset of the start of the line holding offset.
+func lineStart(data []byte, offset int) int {
+	for offset > 0 && data[offset-1] != '\n' {
+		offset--
+	}
+	return offset
+}
+
+// lineEnd returns the offset of the newline ending the line holding offset, or len(data).
+func lineEnd(data []byte, offset int) int {
+	for offset < len(data) && data[offset] != '\n' {
+		offset++
+	}
+	if offset < len(data) && offset > 0 && data[offset-1] == '\r' {
+		offset--
+	}
+	return offset
+}
+
+// indentation returns the whitespace a line starts with.
+func indentation(data []byte, start int) string {
+	end := start
+	for end < len(data) && (data[end] == ' ' || data[end] == '\t') {
+		end++
+	}
+	return string(data[start:end])
+}
@@ -0,0 +1,957 @@
+package clusterstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+
+	"github.com/argon-chat/k3sd/pkg/secrets"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Configs can be encrypted in the format of SOPS (https://github.com/getsops/sops) with age
+// keys, so that they can be kept in git: the values of sensitive keys are replaced by
+// ENC[AES256_GCM,...] strings while the keys and the structure stay readable, and the data key
+// encrypting them is stored, encrypted to each age recipient, under the top-level "sops" key.
+// Such configs are decrypted in memory when they are loaded, and can be edited with the sops
+// tool as well. Comments are never encrypted, unlike those sops finds under encrypted keys.
+
+// sopsKey is the top-level key holding the SOPS metadata of an encrypted config.
+const sopsKey = "sops"
+
+// sopsVersion is the SOPS version written to the metadata of configs encrypted by k3sd.
+const sopsVersion = "3.9.0"
+
+// DefaultEncryptedRegex matches the keys whose values `k3sd config encrypt` encrypts by
+// default: passwords, tokens and secrets (but not the secretSubs lists naming them) and
+// Authorization headers. The names of secret substitutions listed in secretSubs are added.
+const DefaultEncryptedRegex = `(?i)password|token|secret([^s]|$)|^authorization$`
+
+// Environment variables of age keys, as read by the sops tool.
+const (
+	// AgeKeyEnv holds age identities (AGE-SECRET-KEY-...), one per line.
+	AgeKeyEnv = "SOPS_AGE_KEY"
+	// AgeKeyFileEnv is the path of a file of age identities.
+	AgeKeyFileEnv = "SOPS_AGE_KEY_FILE"
+	// AgeRecipientsEnv holds the comma-separated age recipients configs are encrypted to.
+	AgeRecipientsEnv = "SOPS_AGE_RECIPIENTS"
+)
+
+// macOnlyEncryptedInit starts the MAC of configs whose MAC only covers the encrypted values,
+// as in sops, so that it differs from the MAC of all values.
+var macOnlyEncryptedInit = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+// sopsValue matches a value encrypted by SOPS.
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsMetadata is the SOPS metadata of an encrypted config. Only age keys are supported.
+//
+// Fields:
+//   - KeyGroups: Shamir key groups (unsupported).
+//   - KMS, GCPKMS, AzureKV, HCVault, PGP: Data key encrypted with other key services (unsupported).
+//   - Age: Data key encrypted to each age recipient.
+//   - LastModified: Time the config was last encrypted, authenticating the MAC.
+//   - MAC: Encrypted SHA-512 of the plaintext values.
+//   - UnencryptedSuffix, EncryptedSuffix, UnencryptedRegex, EncryptedRegex: Rule selecting the
+//     encrypted values by the keys leading to them; at most one is set.
+//   - MACOnlyEncrypted: The MAC only covers the encrypted values.
+//   - Version: SOPS version that wrote the config.
+type sopsMetadata struct {
+	KeyGroups         []any        `json:"key_groups,omitempty"`
+	KMS               []any        `json:"kms,omitempty"`
+	GCPKMS            []any        `json:"gcp_kms,omitempty"`
+	AzureKV           []any        `json:"azure_kv,omitempty"`
+	HCVault           []any        `json:"hc_vault,omitempty"`
+	Age               []sopsAgeKey `json:"age,omitempty"`
+	LastModified      string       `json:"lastmodified"`
+	MAC               string       `json:"mac"`
+	PGP               []any        `json:"pgp,omitempty"`
+	UnencryptedSuffix string       `json:"unencrypted_suffix,omitempty"`
+	EncryptedSuffix   string       `json:"encrypted_suffix,omitempty"`
+	UnencryptedRegex  string       `json:"unencrypted_regex,omitempty"`
+	EncryptedRegex    string       `json:"encrypted_regex,omitempty"`
+	MACOnlyEncrypted  bool         `json:"mac_only_encrypted,omitempty"`
+	Version           string       `json:"version"`
+}
+
+// sopsAgeKey is the data key of a config encrypted to an age recipient.
+//
+// Fields:
+//   - Recipient: The age recipient (age1...).
+//   - Enc: The data key encrypted to the recipient, ASCII-armored.
+type sopsAgeKey struct {
+	Recipient string `json:"recipient"`
+	Enc       string `json:"enc"`
+}
+
+// EncryptOptions configures EncryptConfig.
+//
+// Fields:
+//   - Recipients: Age recipients the config is encrypted to. If empty, those of
+//     $SOPS_AGE_RECIPIENTS, or else those of the age identities k3sd can read.
+//   - EncryptedRegex: Keys whose values are encrypted; DefaultEncryptedRegex and the
+//     secretSubs names of the config if empty.
+type EncryptOptions struct {
+	Recipients     []string
+	EncryptedRegex string
+}
+
+// EncryptConfig encrypts the sensitive values of a JSON or YAML config file in place, in the
+// SOPS format. Only the encrypted values change, so the file keeps its comments, keys and
+// layout, and diffs of it stay readable.
+//
+// Parameters:
+//
+//	path: Path to the config file, which must be in the object form ({"clusters": [...]}).
+//	opts: Recipients and the keys to encrypt.
+//
+// Returns:
+//
+//	Error if the config is already encrypted, cannot be read or written, no recipient is given,
+//	or the encrypted regex matches the includes of the config.
+func EncryptConfig(path string, opts EncryptOptions) error {
+	format := FormatOf(path)
+	if format == FormatTOML {
+		return fmt.Errorf("%s: SOPS encrypts JSON and YAML configs, not TOML", path)
+	}
+	c := codecs[format]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plain, err := c.decode(data)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", format, err)
+	}
+	obj, ok := plain.(*object)
+	if !ok {
+		return fmt.Errorf("%s: SOPS needs a config in the object form: put the list of clusters under a %q key", path, clustersKey)
+	}
+	if _, ok := obj.values[sopsKey]; ok {
+		return fmt.Errorf("%s is already encrypted", path)
+	}
+	recipients, err := ageRecipients(opts.Recipients)
+	if err != nil {
+		return err
+	}
+	pattern := opts.EncryptedRegex
+	if pattern == "" {
+		pattern = defaultEncryptedRegex(obj)
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("invalid encrypted regex: %w", err)
+	}
+	meta := &sopsMetadata{EncryptedRegex: pattern, Version: sopsVersion}
+	rule, err := meta.rule()
+	if err != nil {
+		return err
+	}
+	if key, ok := encryptedInclude(obj, rule); ok {
+		return fmt.Errorf("%s: the encrypted regex %q matches %s: the files a config includes must stay readable", path, pattern, key)
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		enc, err := encryptDataKey(dataKey, recipient)
+		if err != nil {
+			return err
+		}
+		meta.Age = append(meta.Age, sopsAgeKey{Recipient: recipient.String(), Enc: enc})
+	}
+	tree, err := encryptTree(obj, meta, dataKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	out, ok := appendMetadata(format, c, data, plain, tree)
+	if !ok {
+		if out, err = renderTree(c, data, plain, tree); err != nil {
+			return err
+		}
+	}
+	if out, err = resealText(c, out, meta, dataKey); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// DecryptConfig decrypts a config file encrypted in the SOPS format in place and removes its
+// SOPS metadata. Only the decrypted values change.
+//
+// Parameters:
+//
+//	path: Path to the config file.
+//
+// Returns:
+//
+//	Error if the config is not encrypted, cannot be decrypted with the available age
+//	identities, or cannot be read or written.
+func DecryptConfig(path string) error {
+	c := codecs[FormatOf(path)]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	old, err := c.decode(data)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", FormatOf(path), err)
+	}
+	if !isEncrypted(old) {
+		return fmt.Errorf("%s is not encrypted", path)
+	}
+	plain, _, _, err := decryptTree(old)
+	if err != nil {
+		return err
+	}
+	out, ok := cutMetadata(FormatOf(path), c, data, old, plain)
+	if !ok {
+		if out, err = renderTree(c, data, old, plain); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// appendMetadata edits the values of a JSON or YAML config in place and appends the SOPS
+// metadata of tree as the last top-level key, as sops writes it. It returns false if the config
+// cannot be edited this way.
+func appendMetadata(format Format, c codec, data []byte, plain any, tree *object) ([]byte, bool) {
+	body, ok := patchConfig(c, data, plain, withoutMetadata(tree))
+	if !ok {
+		return nil, false
+	}
+	var out []byte
+	switch format {
+	case FormatYAML:
+		meta := newObject()
+		meta.set(sopsKey, tree.values[sopsKey])
+		block, err := c.encode(nil, meta)
+		if err != nil {
+			return nil, false
+		}
+		if len(body) > 0 && !bytes.HasSuffix(body, []byte("\n")) {
+			body = append(body, '\n')
+		}
+		out = append(body, block...)
+	case FormatJSON:
+		end := bytes.LastIndexByte(body, '}')
+		first := bytes.IndexByte(body, '"')
+		if end < 0 || first < 0 || first > end {
+			return nil, false
+		}
+		indent := string(body[lineStart(body, first):first])
+		if strings.TrimSpace(indent) != "" {
+			return nil, false
+		}
+		block, err := json.MarshalIndent(tree.values[sopsKey], indent, indent)
+		if err != nil {
+			return nil, false
+		}
+		last := len(bytes.TrimRight(body[:end], " \t\r\n"))
+		out = fmt.Appendf(nil, "%s,\n%s%q: %s\n%s", body[:last], indent, sopsKey, block, body[end:])
+	default:
+		return nil, false
+	}
+	written, err := c.decode(out)
+	if err != nil || !sameTree(written, tree) {
+		return nil, false
+	}
+	return out, true
+}
+
+// cutMetadata removes the SOPS metadata of a JSON or YAML config, the last top-level key, and
+// edits its values in place to the plaintext ones. It returns false if the config cannot be
+// edited this way.
+func cutMetadata(format Format, c codec, data []byte, old, plain any) ([]byte, bool) {
+	var body []byte
+	switch format {
+	case FormatYAML:
+		at := bytes.LastIndex(data, []byte("\n"+sopsKey+":"))
+		if at < 0 {
+			return nil, false
+		}
+		body = data[:at+1]
+	case FormatJSON:
+		at := bytes.LastIndex(data, []byte(strconv.Quote(sopsKey)))
+		end := bytes.LastIndexByte(data, '}')
+		if at < 0 || end < at {
+			return nil, false
+		}
+		comma := bytes.LastIndexByte(data[:at], ',')
+		if comma < 0 || len(bytes.TrimSpace(data[comma+1:at])) > 0 {
+			return nil, false
+		}
+		// keep the line break and indentation before the closing brace
+		closing := len(bytes.TrimRight(data[:end], " \t\r\n"))
+		body = append(append([]byte{}, data[:comma]...), data[closing:]...)
+	default:
+		return nil, false
+	}
+	encrypted := withoutMetadata(old)
+	written, err := c.decode(body)
+	if err != nil || !sameTree(written, encrypted) {
+		return nil, false
+	}
+	return patchConfig(c, body, encrypted, plain)
+}
+
+// withoutMetadata returns a config tree without its SOPS metadata.
+func withoutMetadata(tree any) any {
+	if obj, ok := tree.(*object); ok {
+		return without(obj, sopsKey)
+	}
+	return tree
+}
+
+// isEncrypted reports whether a config tree holds SOPS metadata.
+func isEncrypted(tree any) bool {
+	obj, ok := tree.(*object)
+	if !ok {
+		return false
+	}
+	_, ok = obj.values[sopsKey]
+	return ok
+}
+
+// decryptTree decrypts a config tree encrypted in the SOPS format and verifies its MAC. It
+// returns the plaintext tree without the metadata, the metadata and the data key.
+func decryptTree(tree any) (any, *sopsMetadata, []byte, error) {
+	obj := tree.(*object)
+	meta, err := readSopsMetadata(obj.values[sopsKey])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dataKey, err := meta.dataKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	plain, mac, err := decryptValues(obj, meta, dataKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stored, err := sopsDecrypt(meta.MAC, dataKey, meta.lastModified())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("decrypt MAC: %w", err)
+	}
+	if stored != mac {
+		return nil, nil, nil, errors.New("MAC mismatch: the encrypted config was modified without its key")
+	}
+	return plain, meta, dataKey, nil
+}
+
+// decrypted is a string of a loaded config tree that was decrypted from an encrypted config.
+// The fields holding one are masked in the recorded versions of their cluster (see
+// types.Cluster.DecryptedFields) and in rendered configs.
+type decrypted string
+
+// decryptLoaded decrypts a config tree being loaded if it is encrypted, with its decrypted
+// strings marked as decrypted. They are masked in all output too.
+func decryptLoaded(tree any) (any, error) {
+	if !isEncrypted(tree) {
+		return tree, nil
+	}
+	plain, meta, _, err := decryptTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := meta.rule()
+	if err != nil {
+		return nil, err
+	}
+	return walkLeaves(plain, nil, func(v any, path []string) (any, error) {
+		s, ok := v.(string)
+		if !ok || !rule(path) {
+			return v, nil
+		}
+		utils.RegisterSecret(s)
+		return decrypted(s), nil
+	})
+}
+
+// decryptedFields returns the paths of the decrypted strings of every cluster of a loaded
+// config tree, in the form of the paths of secrets.Resolver.Seal.
+func decryptedFields(tree any) [][]string {
+	if obj, ok := tree.(*object); ok {
+		tree = obj.values[clustersKey]
+	}
+	list, _ := tree.([]any)
+	fields := make([][]string, len(list))
+	for i, cluster := range list {
+		fields[i] = decryptedPaths(cluster, "", nil)
+	}
+	return fields
+}
+
+// decryptedPaths appends the paths of the decrypted strings of the tree value at path to paths.
+func decryptedPaths(v any, path string, paths []string) []string {
+	switch v := v.(type) {
+	case decrypted:
+		return append(paths, path)
+	case *object:
+		for _, key := range v.keys {
+			paths = decryptedPaths(v.values[key], secrets.JoinPath(path, key), paths)
+		}
+	case []any:
+		for i, item := range v {
+			paths = decryptedPaths(item, fmt.Sprintf("%s[%d]", path, i), paths)
+		}
+	}
+	return paths
+}
+
+// decryptValues decrypts the values of an encrypted config tree. It returns the plaintext tree
+// without the metadata and the MAC of its values.
+func decryptValues(obj *object, meta *sopsMetadata, dataKey []byte) (*object, string, error) {
+	rule, err := meta.rule()
+	if err != nil {
+		return nil, "", err
+	}
+	mac := meta.newMAC()
+	plain := newObject()
+	for _, key := range obj.keys {
+		if key == sopsKey {
+			continue
+		}
+		value, err := walkLeaves(obj.values[key], []string{key}, func(v any, path []string) (any, error) {
+			encrypted := rule(path)
+			if encrypted {
+				s, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: value is not encrypted", strings.Join(path, "."))
+				}
+				var err error
+				if v, err = sopsDecrypt(s, dataKey, sopsPath(path)); err != nil {
+					return nil, fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+				}
+			}
+			if !meta.MACOnlyEncrypted || encrypted {
+				mac.Write(sopsBytes(v))
+			}
+			return v, nil
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("decrypt: %w", err)
+		}
+		plain.set(key, value)
+	}
+	return plain, fmt.Sprintf("%X", mac.Sum(nil)), nil
+}
+
+// resealText recomputes the MAC of the text of an encrypted config. Writing a tree leaves out
+// or keeps zero values (see isZero) the MAC of the tree would differ in, so the MAC has to be
+// taken from the text as written.
+func resealText(c codec, out []byte, meta *sopsMetadata, dataKey []byte) ([]byte, error) {
+	written, err := c.decode(out)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := written.(*object)
+	if !ok {
+		return nil, errors.New("an encrypted config must stay in the object form")
+	}
+	plain, mac, err := decryptValues(obj, meta, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if written, err := readSopsMetadata(obj.values[sopsKey]); err == nil {
+		if stored, err := sopsDecrypt(written.MAC, dataKey, written.lastModified()); err == nil && stored == mac {
+			return out, nil
+		}
+	}
+	tree, err := encryptTree(plain, meta, dataKey, written, plain)
+	if err != nil {
+		return nil, err
+	}
+	return renderTree(c, out, written, tree)
+}
+
+// encryptTree encrypts a plaintext config tree with a data key and adds the SOPS metadata.
+// Values that did not change from prevPlain keep their ciphertext from prevEnc, the tree they
+// were encrypted in, so that re-encrypting a config only changes the values that changed.
+func encryptTree(plain *object, meta *sopsMetadata, dataKey []byte, prevEnc, prevPlain any) (*object, error) {
+	rule, err := meta.rule()
+	if err != nil {
+		return nil, err
+	}
+	mac := meta.newMAC()
+	enc := newObject()
+	for _, key := range plain.keys {
+		if key == sopsKey {
+			continue
+		}
+		value, err := encryptValue(plain.values[key], []string{key}, childOf(prevEnc, key), childOf(prevPlain, key), func(v, prevEnc, prevPlain any, path []string) (any, error) {
+			encrypted := rule(path)
+			if !meta.MACOnlyEncrypted || encrypted {
+				mac.Write(sopsBytes(v))
+			}
+			if !encrypted || v == nil {
+				return v, nil
+			}
+			if s, ok := prevEnc.(string); ok && prevPlain != nil && sameTree(prevPlain, v) && sopsValue.MatchString(s) {
+				return s, nil
+			}
+			return sopsEncrypt(v, dataKey, sopsPath(path))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: %w", err)
+		}
+		enc.set(key, value)
+	}
+	updated := *meta
+	updated.LastModified = time.Now().UTC().Format(time.RFC3339)
+	if updated.MAC, err = sopsEncrypt(fmt.Sprintf("%X", mac.Sum(nil)), dataKey, updated.LastModified); err != nil {
+		return nil, err
+	}
+	metaTree, err := toTree(&updated)
+	if err != nil {
+		return nil, err
+	}
+	enc.set(sopsKey, metaTree)
+	return enc, nil
+}
+
+// walkLeaves calls fn with every scalar of a tree and the keys leading to it (list indexes
+// are not part of SOPS paths), and returns the tree of the values fn returns.
+func walkLeaves(v any, path []string, fn func(v any, path []string) (any, error)) (any, error) {
+	switch v := v.(type) {
+	case *object:
+		obj := newObject()
+		for _, key := range v.keys {
+			value, err := walkLeaves(v.values[key], appendPath(path, key), fn)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key, value)
+		}
+		return obj, nil
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			value, err := walkLeaves(item, path, fn)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	case nil:
+		return nil, nil
+	}
+	return fn(v, path)
+}
+
+// encryptValue is walkLeaves for encryption, also passing fn the value at the same position
+// of the previous encrypted and plaintext trees.
+func encryptValue(v any, path []string, prevEnc, prevPlain any, fn func(v, prevEnc, prevPlain any, path []string) (any, error)) (any, error) {
+	switch v := v.(type) {
+	case *object:
+		obj := newObject()
+		for _, key := range v.keys {
+			value, err := encryptValue(v.values[key], appendPath(path, key), childOf(prevEnc, key), childOf(prevPlain, key), fn)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key, value)
+		}
+		return obj, nil
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			value, err := encryptValue(item, path, itemOf(prevEnc, i), itemOf(prevPlain, i), fn)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	case nil:
+		return nil, nil
+	}
+	return fn(v, prevEnc, prevPlain, path)
+}
+
+func childOf(v any, key string) any {
+	if obj, ok := v.(*object); ok {
+		return obj.values[key]
+	}
+	return nil
+}
+
+func itemOf(v any, i int) any {
+	if list, ok := v.([]any); ok && i < len(list) {
+		return list[i]
+	}
+	return nil
+}
+
+// rule returns whether the value at a path is encrypted, by the rule of the metadata; without
+// a rule every value is.
+func (m *sopsMetadata) rule() (func(path []string) bool, error) {
+	anyMatch := func(path []string, match func(string) bool) bool {
+		for _, key := range path {
+			if match(key) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case m.UnencryptedSuffix != "":
+		return func(path []string) bool {
+			return !anyMatch(path, func(key string) bool { return strings.HasSuffix(key, m.UnencryptedSuffix) })
+		}, nil
+	case m.EncryptedSuffix != "":
+		return func(path []string) bool {
+			return anyMatch(path, func(key string) bool { return strings.HasSuffix(key, m.EncryptedSuffix) })
+		}, nil
+	case m.UnencryptedRegex != "":
+		re, err := regexp.Compile(m.UnencryptedRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unencrypted_regex: %w", err)
+		}
+		return func(path []string) bool { return !anyMatch(path, re.MatchString) }, nil
+	case m.EncryptedRegex != "":
+		re, err := regexp.Compile(m.EncryptedRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted_regex: %w", err)
+		}
+		return func(path []string) bool { return anyMatch(path, re.MatchString) }, nil
+	}
+	return func([]string) bool { return true }, nil
+}
+
+// encryptedInclude returns the path of an include list of a config that would be encrypted by
+// rule, if there is one.
+func encryptedInclude(obj *object, rule func(path []string) bool) (string, bool) {
+	paths := [][]string{{includeKey}}
+	if envs, err := environments(obj); err == nil {
+		for _, name := range envs.keys {
+			paths = append(paths, []string{environmentsKey, name, includeKey})
+		}
+	}
+	for _, path := range paths {
+		if rule(path) {
+			return strings.Join(path, "."), true
+		}
+	}
+	return "", false
+}
+
+// newMAC returns the hash of the MAC of a config.
+func (m *sopsMetadata) newMAC() hash.Hash {
+	mac := sha512.New()
+	if m.MACOnlyEncrypted {
+		mac.Write(macOnlyEncryptedInit)
+	}
+	return mac
+}
+
+// lastModified returns the modification time authenticating the MAC, in the RFC 3339 form
+// sops formats it in.
+func (m *sopsMetadata) lastModified() string {
+	t, err := time.Parse(time.RFC3339, m.LastModified)
+	if err != nil {
+		return m.LastModified
+	}
+	return t.Format(time.RFC3339)
+}
+
+// readSopsMetadata decodes the SOPS metadata of a config.
+func readSopsMetadata(tree any) (*sopsMetadata, error) {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	var meta sopsMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid SOPS metadata: %w", err)
+	}
+	switch {
+	case len(meta.KeyGroups) > 0:
+		return nil, errors.New("SOPS key groups are not supported; encrypt the config to age recipients only")
+	case len(meta.Age) == 0:
+		return nil, errors.New("the config is not encrypted to any age recipient, only age keys are supported")
+	}
+	return &meta, nil
+}
+
+// dataKey decrypts the data key of a config with the age identities k3sd can read.
+func (m *sopsMetadata) dataKey() ([]byte, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identity to decrypt the config with: set %s or %s, or create %s", AgeKeyEnv, AgeKeyFileEnv, defaultAgeKeyFile())
+	}
+	recipients := make([]string, 0, len(m.Age))
+	for _, key := range m.Age {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(key.Enc)), identities...)
+		if err != nil {
+			recipients = append(recipients, key.Recipient)
+			continue
+		}
+		dataKey, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt data key: %w", err)
+		}
+		return dataKey, nil
+	}
+	return nil, fmt.Errorf("none of the age identities can decrypt the config, which is encrypted to %s", strings.Join(recipients, ", "))
+}
+
+// encryptDataKey encrypts a data key to an age recipient, ASCII-armored.
+func encryptDataKey(dataKey []byte, recipient *age.X25519Recipient) (string, error) {
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipient)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ageIdentities reads the age identities of $SOPS_AGE_KEY, $SOPS_AGE_KEY_FILE and the default
+// key file of sops, where they exist.
+func ageIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+	if keys := os.Getenv(AgeKeyEnv); keys != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(keys))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", AgeKeyEnv, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	files := []string{defaultAgeKeyFile()}
+	if file := os.Getenv(AgeKeyFileEnv); file != "" {
+		files = []string{file}
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) && file != os.Getenv(AgeKeyFileEnv) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read age identities: %w", err)
+		}
+		parsed, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	return identities, nil
+}
+
+// defaultAgeKeyFile returns the key file sops reads by default, sops/age/keys.txt in the user
+// config directory (e.g. ~/.config).
+func defaultAgeKeyFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join("~", ".config", "sops", "age", "keys.txt")
+	}
+	return filepath.Join(dir, "sops", "age", "keys.txt")
+}
+
+// ageRecipients parses the recipients a config is encrypted to: those given, or else those of
+// $SOPS_AGE_RECIPIENTS, or else those of the available age identities.
+func ageRecipients(given []string) ([]*age.X25519Recipient, error) {
+	if len(given) == 0 {
+		for _, recipient := range strings.Split(os.Getenv(AgeRecipientsEnv), ",") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				given = append(given, recipient)
+			}
+		}
+	}
+	var recipients []*age.X25519Recipient
+	for _, recipient := range given {
+		parsed, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %w", recipient, err)
+		}
+		recipients = append(recipients, parsed)
+	}
+	if len(recipients) > 0 {
+		return recipients, nil
+	}
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		if x, ok := identity.(*age.X25519Identity); ok {
+			recipients = append(recipients, x.Recipient())
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no age recipient: pass --age-recipient, set %s or create %s", AgeRecipientsEnv, defaultAgeKeyFile())
+	}
+	return recipients, nil
+}
+
+// defaultEncryptedRegex returns DefaultEncryptedRegex extended by the names of the secret
+// substitutions listed in the secretSubs of a config.
+func defaultEncryptedRegex(tree any) string {
+	names := make(map[string]bool)
+	var collect func(v any)
+	collect = func(v any) {
+		switch v := v.(type) {
+		case *object:
+			for _, key := range v.keys {
+				if list, ok := v.values[key].([]any); ok && key == "secretSubs" {
+					for _, name := range list {
+						if s, ok := name.(string); ok && s != "" {
+							names["^"+regexp.QuoteMeta(s)+"$"] = true
+						}
+					}
+					continue
+				}
+				collect(v.values[key])
+			}
+		case []any:
+			for _, item := range v {
+				collect(item)
+			}
+		}
+	}
+	collect(tree)
+	patterns := make([]string, 0, len(names))
+	for name := range names {
+		patterns = append(patterns, name)
+	}
+	sort.Strings(patterns)
+	return strings.Join(append([]string{DefaultEncryptedRegex}, patterns...), "|")
+}
+
+// sopsPath returns the additional data authenticating the value at a path.
+func sopsPath(path []string) string {
+	return strings.Join(path, ":") + ":"
+}
+
+// sopsBytes returns the bytes of a plaintext value covered by the MAC.
+func sopsBytes(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		if v {
+			return []byte("True")
+		}
+		return []byte("False")
+	}
+	return nil
+}
+
+// sopsEncrypt encrypts a scalar with AES-256-GCM. Empty strings stay empty.
+func sopsEncrypt(v any, key []byte, additionalData string) (string, error) {
+	var plaintext, valueType string
+	switch v := v.(type) {
+	case string:
+		if v == "" {
+			return "", nil
+		}
+		plaintext, valueType = v, "str"
+	case float64:
+		plaintext, valueType = strconv.FormatFloat(v, 'f', -1, 64), "float"
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			valueType = "int"
+		}
+	case bool:
+		plaintext, valueType = string(sopsBytes(v)), "bool"
+	default:
+		return "", fmt.Errorf("cannot encrypt %T", v)
+	}
+	gcm, err := sopsCipher(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	out := gcm.Seal(nil, iv, []byte(plaintext), []byte(additionalData))
+	data, tag := out[:len(out)-gcm.Overhead()], out[len(out)-gcm.Overhead():]
+	enc := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", enc(data), enc(iv), enc(tag), valueType), nil
+}
+
+// sopsDecrypt decrypts a value encrypted by sopsEncrypt or sops.
+func sopsDecrypt(s string, key []byte, additionalData string) (any, error) {
+	if s == "" {
+		return "", nil
+	}
+	match := sopsValue.FindStringSubmatch(s)
+	if match == nil {
+		return nil, errors.New("value is not encrypted")
+	}
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(match[i+1]); err != nil {
+			return nil, fmt.Errorf("invalid encrypted value: %w", err)
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, errors.New("cannot decrypt value: wrong key or modified value")
+	}
+	switch valueType := match[4]; valueType {
+	case "str", "bytes", "comment":
+		return string(plaintext), nil
+	case "int", "float":
+		return strconv.ParseFloat(string(plaintext), 64)
+	case "bool":
+		return strconv.ParseBool(string(plaintext))
+	default:
+		return nil, fmt.Errorf("unknown encrypted value type %q", valueType)
+	}
+}
+
+// sopsCipher returns the AES-256-GCM cipher of SOPS, which uses 32-byte nonces.
+func sopsCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, 32)
+}
@@ -0,0 +1,408 @@
+package clusterstore
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/argon-chat/k3sd/pkg/db"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// testRecipient is the recipient of the test-only age key in testdata/sops/age.txt, which the
+// sops-encrypted fixtures next to it are encrypted to.
+const testRecipient = "age1t0u46pfrccc4mkje5rvw2k3pg7stn34k97cqedfvl7nmzu6r2vcst648p6"
+
+// encPattern matches the encrypted values of a SOPS config.
+var encPattern = regexp.MustCompile(`ENC\[[^\]]*\]`)
+
+// useTestKey makes the test age key the only one k3sd and sops can read.
+func useTestKey(t *testing.T) {
+	t.Helper()
+	keyFile, err := filepath.Abs(filepath.Join("testdata", "sops", "age.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	for _, env := range []string{AgeKeyEnv, AgeRecipientsEnv} {
+		// sops reads a set but empty variable as an empty key list, so unset them
+		t.Setenv(env, "")
+		if err := os.Unsetenv(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv(AgeKeyFileEnv, keyFile)
+}
+
+// copyFile copies a file into a temporary directory and returns the path of the copy.
+func copyFile(t *testing.T, src string) string {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, filepath.Base(src), string(data))
+}
+
+func writeFile(t *testing.T, name, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// sopsDecrypted decrypts a config with the sops binary, if it is installed, and returns the
+// clusters it holds.
+func sopsDecrypted(t *testing.T, path string) ([]types.Cluster, bool) {
+	t.Helper()
+	if _, err := exec.LookPath("sops"); err != nil {
+		return nil, false
+	}
+	cmd := exec.Command("sops", "--decrypt", path)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("sops --decrypt %s: %v: %s", path, err, stderr.String())
+	}
+	clusters, err := LoadClusters(writeFile(t, "decrypted"+filepath.Ext(path), string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clusters, true
+}
+
+// sameValues reports whether two lists of clusters hold the same values, whether they were
+// decrypted or not.
+func sameValues(a, b []types.Cluster) bool {
+	plain := func(clusters []types.Cluster) []types.Cluster {
+		out := slices.Clone(clusters)
+		for ci := range out {
+			out[ci].SetDecryptedFields(nil)
+		}
+		return out
+	}
+	return reflect.DeepEqual(plain(a), plain(b))
+}
+
+// TestLoadSopsFixtures checks that configs encrypted by the sops binary are decrypted,
+// booleans included.
+func TestLoadSopsFixtures(t *testing.T) {
+	useTestKey(t)
+	clusters, err := LoadClusters(filepath.Join("testdata", "sops", "sops-encrypted.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := clusters[0]
+	for _, check := range []struct{ field, got, want string }{
+		{"password", cluster.Password, "master-password"},
+		{"workers[0].password", cluster.Workers[0].Password, "worker-password"},
+		{"subs", cluster.Addons["gitea"].Subs["${POSTGRES_PASSWORD}"], "postgres-password"},
+		{"webhooks[0].secret", cluster.Webhooks[0].Secret, "webhook-secret"},
+		{"user", cluster.User, "root"},
+	} {
+		if check.got != check.want {
+			t.Errorf("%s = %q, want %q", check.field, check.got, check.want)
+		}
+	}
+	wantFields := []string{"password", "workers[0].password", "addons.gitea.subs.${POSTGRES_PASSWORD}", "webhooks[0].secret"}
+	if got := cluster.DecryptedFields(); !reflect.DeepEqual(got, wantFields) {
+		t.Errorf("decrypted fields %q, want %q", got, wantFields)
+	}
+
+	clusters, err = LoadClusters(filepath.Join("testdata", "sops", "sops-encrypted.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusters[0].Password != "master-password" || !clusters[0].Protected {
+		t.Errorf("decrypted %+v", clusters[0])
+	}
+}
+
+// TestRecordDecryptedFields checks that the recorded versions of a cluster loaded from an
+// encrypted config mask its decrypted fields, and only those.
+func TestRecordDecryptedFields(t *testing.T) {
+	useTestKey(t)
+	clusters, err := LoadClusters(filepath.Join("testdata", "sops", "sops-encrypted.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a plaintext field holding the same value as a decrypted one
+	clusters[0].Workers[0].User = "master-password"
+
+	store, err := db.Open(filepath.Join(t.TempDir(), "k3sd.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	if _, err := store.InsertCluster(ctx, &clusters[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := store.GetLatestClusterVersion(ctx, &clusters[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []struct{ field, got, want string }{
+		{"password", recorded.Password, utils.Redacted},
+		{"workers[0].password", recorded.Workers[0].Password, utils.Redacted},
+		{"webhooks[0].secret", recorded.Webhooks[0].Secret, utils.Redacted},
+		{"workers[0].user", recorded.Workers[0].User, "master-password"},
+		{"address", recorded.Address, "10.0.0.1"},
+		{"context", recorded.Context, "lab"},
+	} {
+		if check.got != check.want {
+			t.Errorf("recorded %s = %q, want %q", check.field, check.got, check.want)
+		}
+	}
+}
+
+// TestSopsMACMismatch checks that a config modified without its key is rejected.
+func TestSopsMACMismatch(t *testing.T) {
+	useTestKey(t)
+	fixture := readFile(t, filepath.Join("testdata", "sops", "sops-encrypted.yaml"))
+
+	// a plaintext value is covered by the MAC too
+	path := writeFile(t, "clusters.yaml", strings.Replace(fixture, "user: root", "user: admin", 1))
+	if _, err := LoadClusters(path); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+		t.Errorf("modified plaintext value: error %v, want a MAC mismatch", err)
+	}
+
+	// an encrypted value moved to another key does not decrypt there
+	values := encPattern.FindAllString(fixture, -1)
+	swapped := strings.Replace(fixture, values[0], "SWAP", 1)
+	swapped = strings.Replace(swapped, values[1], values[0], 1)
+	swapped = strings.Replace(swapped, "SWAP", values[1], 1)
+	if _, err := LoadClusters(writeFile(t, "clusters.yaml", swapped)); err == nil {
+		t.Error("swapped encrypted values were accepted")
+	}
+}
+
+// TestSaveSopsFixture checks that saving a config encrypted by the sops binary only
+// re-encrypts the values that changed, and that the result is still a valid SOPS file.
+func TestSaveSopsFixture(t *testing.T) {
+	useTestKey(t)
+	path := copyFile(t, filepath.Join("testdata", "sops", "sops-encrypted.yaml"))
+	before := encPattern.FindAllString(readFile(t, path), -1)
+
+	clusters, err := LoadClusters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveClusters(path, clusters); err != nil {
+		t.Fatal(err)
+	}
+	if got := encPattern.FindAllString(readFile(t, path), -1); !reflect.DeepEqual(got, before) {
+		t.Error("saving an unchanged config re-encrypted it")
+	}
+
+	clusters[0].Workers[0].Password = "new-worker-password"
+	clusters[0].Labels = map[string]string{"zone": "a"}
+	if err := SaveClusters(path, clusters); err != nil {
+		t.Fatal(err)
+	}
+	text := readFile(t, path)
+	if strings.Contains(text, "new-worker-password") {
+		t.Fatalf("new password written in plaintext:\n%s", text)
+	}
+	after := encPattern.FindAllString(text, -1)
+	if len(after) != len(before) {
+		t.Fatalf("%d encrypted values, want %d:\n%s", len(after), len(before), text)
+	}
+	// the values are master, worker and postgres passwords, the webhook secret and the MAC
+	for i, changed := range []bool{false, true, false, false, true} {
+		if (after[i] != before[i]) != changed {
+			t.Errorf("encrypted value %d changed: %t, want %t", i, after[i] != before[i], changed)
+		}
+	}
+
+	saved, err := LoadClusters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, clusters) {
+		t.Errorf("read back %+v, want %+v", saved, clusters)
+	}
+	if decrypted, ok := sopsDecrypted(t, path); ok && !sameValues(decrypted, clusters) {
+		t.Errorf("sops decrypted %+v, want %+v", decrypted, clusters)
+	}
+}
+
+// plainConfigs are configs to encrypt, with secrets in every kind of place.
+var plainConfigs = map[Format]string{
+	FormatJSON: `{
+  "clusters": [
+    {
+      "address": "10.0.0.1",
+      "user": "root",
+      "password": "master-password",
+      "nodeName": "master",
+      "context": "lab",
+      "workers": [
+        {"address": "10.0.0.2", "user": "root", "password": "worker-password", "nodeName": "worker"}
+      ],
+      "addons": {
+        "gitea": {"enabled": true, "subs": {"${POSTGRES_USER}": "gitea", "${POSTGRES_PASSWORD}": "postgres-password"}}
+      },
+      "webhooks": [
+        {"url": "https://hooks.example.com/k3sd", "secret": "webhook-secret", "headers": {"Authorization": "Bearer webhook-token"}}
+      ]
+    }
+  ]
+}
+`,
+	FormatYAML: `# clusters of the lab
+clusters:
+  - address: 10.0.0.1
+    user: root
+    password: master-password # the root password
+    nodeName: master
+    context: lab
+    workers:
+      - address: 10.0.0.2
+        user: root
+        password: worker-password
+        nodeName: worker
+    addons:
+      gitea:
+        enabled: true
+        subs:
+          ${POSTGRES_USER}: gitea
+          ${POSTGRES_PASSWORD}: postgres-password
+    webhooks:
+      - url: https://hooks.example.com/k3sd
+        secret: webhook-secret
+        headers:
+          Authorization: Bearer webhook-token
+`,
+}
+
+// TestEncryptRoundTrip checks that encrypting a config hides its secrets only, that it loads
+// and saves like the plaintext config, and that decrypting it restores the original text.
+func TestEncryptRoundTrip(t *testing.T) {
+	useTestKey(t)
+	secrets := []string{"master-password", "worker-password", "postgres-password", "webhook-secret", "webhook-token"}
+	for format, text := range plainConfigs {
+		t.Run(string(format), func(t *testing.T) {
+			plainPath := writeFile(t, "plain."+string(format), text)
+			want, err := LoadClusters(plainPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := writeFile(t, "clusters."+string(format), text)
+			if err := EncryptConfig(path, EncryptOptions{Recipients: []string{testRecipient}}); err != nil {
+				t.Fatal(err)
+			}
+			encrypted := readFile(t, path)
+			for _, secret := range secrets {
+				if strings.Contains(encrypted, secret) {
+					t.Errorf("%q not encrypted:\n%s", secret, encrypted)
+				}
+			}
+			for _, plain := range []string{"10.0.0.1", "gitea", "https://hooks.example.com/k3sd"} {
+				if !strings.Contains(encrypted, plain) {
+					t.Errorf("%q encrypted too:\n%s", plain, encrypted)
+				}
+			}
+
+			got, err := LoadClusters(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameValues(got, want) {
+				t.Errorf("read back %+v, want %+v", got, want)
+			}
+			if decrypted, ok := sopsDecrypted(t, path); ok && !sameValues(decrypted, want) {
+				t.Errorf("sops decrypted %+v, want %+v", decrypted, want)
+			}
+
+			// a partial change keeps the ciphertext of the other values
+			before := encPattern.FindAllString(encrypted, -1)
+			got[0].Addons["gitea"].Subs["${POSTGRES_PASSWORD}"] = "new-postgres-password"
+			if err := SaveClusters(path, got); err != nil {
+				t.Fatal(err)
+			}
+			after := encPattern.FindAllString(readFile(t, path), -1)
+			changed := 0
+			for i := range before {
+				if i < len(after) && after[i] != before[i] {
+					changed++
+				}
+			}
+			// the postgres password and the MAC
+			if len(after) != len(before) || changed != 2 {
+				t.Errorf("%d of %d encrypted values changed, want 2", changed, len(before))
+			}
+			if saved, err := LoadClusters(path); err != nil || !reflect.DeepEqual(saved, got) {
+				t.Errorf("read back %+v, %v, want %+v", saved, err, got)
+			}
+
+			if err := DecryptConfig(path); err != nil {
+				t.Fatal(err)
+			}
+			if decrypted := readFile(t, path); decrypted != strings.Replace(text, "postgres-password", "new-postgres-password", 1) {
+				t.Errorf("decrypted config:\n%s\nwant the original text with the new password:\n%s", decrypted, text)
+			}
+		})
+	}
+}
+
+// TestEncryptRefusesTOML checks that TOML configs, which SOPS cannot hold, are refused and left
+// as they are.
+func TestEncryptRefusesTOML(t *testing.T) {
+	useTestKey(t)
+	text := layoutConfigs[FormatTOML]
+	path := writeFile(t, "clusters.toml", text)
+	if err := EncryptConfig(path, EncryptOptions{Recipients: []string{testRecipient}}); err == nil {
+		t.Error("a TOML config was encrypted")
+	}
+	if got := readFile(t, path); got != text {
+		t.Errorf("refused config was changed:\n%s", got)
+	}
+}
+
+// TestEncryptRefusesIncludes checks that a rule encrypting the include lists of a config,
+// which must stay readable to find the files of the config, is refused.
+func TestEncryptRefusesIncludes(t *testing.T) {
+	useTestKey(t)
+	for name, test := range map[string]struct{ text, regex string }{
+		"include": {
+			text:  `{"include": ["shared.json"], "clusters": []}`,
+			regex: "(?i)password|include",
+		},
+		"environment": {
+			// the default regex matches the name of the environment, and so all of its keys
+			text: `{"environments": {"secret-prod": {"include": ["prod.json"]}}}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeFile(t, "clusters.json", test.text)
+			err := EncryptConfig(path, EncryptOptions{Recipients: []string{testRecipient}, EncryptedRegex: test.regex})
+			if err == nil || !strings.Contains(err.Error(), "include") {
+				t.Errorf("error %v, want a refusal naming the include list", err)
+			}
+			if got := readFile(t, path); got != test.text {
+				t.Errorf("refused config was changed:\n%s", got)
+			}
+		})
+	}
+}
@@ -1,51 +1,333 @@
 package clusterstore
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+	"github.com/argon-chat/k3sd/pkg/validate"
 )
 
-// LoadClusters loads a list of clusters from the specified JSON file.
+// codec reads and writes the configs of a format.
+//
+// Fields:
+//   - decode: Parses a config into a tree.
+//   - locate: Finds the values of a config in its text, to edit it in place.
+//   - literal: Encodes a scalar on a single line.
+//   - member: Formats a key and its encoded value as an object member.
+//   - item: Encodes a list item appended at an insertion point.
+//   - encode: Writes a tree as a whole, given the config it replaces (nil for a new file).
+type codec struct {
+	decode  func(data []byte) (any, error)
+	locate  func(data []byte) (*textLocator, error)
+	literal func(v any) (string, bool)
+	member  func(key, literal string) string
+	item    func(v any, at insertionPoint) (string, bool)
+	encode  func(data []byte, tree any) ([]byte, error)
+}
+
+// codecs holds the codec of every format.
+var codecs = map[Format]codec{
+	FormatJSON: jsonCodec,
+	FormatYAML: yamlCodec,
+	FormatTOML: tomlCodec,
+}
+
+// LoadClusters loads a list of clusters from the specified config file. The format (JSON,
+// YAML or TOML) is detected from the file extension; the config is either a list of clusters
+// or an object with a "clusters" list, which TOML writes as [[clusters]] tables. Every format
+// uses the JSON field names. Configs encrypted with SOPS and age keys are decrypted in memory
+// (see EncryptConfig). The config is validated (see pkg/validate): unknown fields, values
+// of the wrong type and invalid values are all reported in one *validate.Error.
 //
 // Parameters:
 //
-//	path: Path to the clusters.json file.
+//	path: Path to the config file.
 //
 // Returns:
 //
-//	Slice of Cluster objects and error if loading or decoding fails.
+//	Slice of Cluster objects and a *utils.ConfigError if loading, decoding or validation fails.
 func LoadClusters(path string) ([]types.Cluster, error) {
-	file, err := os.Open(path)
+	return LoadEnvironment(path, "")
+}
+
+// LoadEnvironment loads the clusters of a config file like LoadClusters, in an environment.
+// The config is composed first: the files it includes, the overlay of the environment and its
+// defaults are merged into its clusters (see ConfigSources). Configs without environments
+// are the same in every environment.
+//
+// Parameters:
+//
+//	path: Path to the config file.
+//	env: Name of the environment; empty for the config without any environment overlay.
+//
+// Returns:
+//
+//	Slice of Cluster objects and a *utils.ConfigError if loading, composing, decoding or
+//	validation fails.
+func LoadEnvironment(path, env string) ([]types.Cluster, error) {
+	clusters, _, err := load(path, env)
+	return clusters, err
+}
+
+// RenderEnvironment returns a config file composed for an environment, with its includes,
+// environment overlay and defaults merged into its clusters, in the given format. The config
+// is validated like by LoadEnvironment. Its secret references are not resolved and the values
+// decrypted from encrypted configs are masked; keys with zero values are left out, as they
+// are alike absent keys.
+//
+// Parameters:
+//
+//	path: Path to the config file.
+//	env: Name of the environment; empty for the config without any environment overlay.
+//	format: Format of the rendered config.
+//
+// Returns:
+//
+//	The rendered config in the object form, and a *utils.ConfigError if loading, composing,
+//	decoding or validation fails.
+func RenderEnvironment(path, env string, format Format) ([]byte, error) {
+	_, tree, err := load(path, env)
 	if err != nil {
-		return nil, fmt.Errorf("open cluster config: %w", err)
+		return nil, err
 	}
-	defer func() { _ = file.Close() }()
+	if _, ok := tree.([]any); ok || tree == nil {
+		doc := newObject()
+		doc.set(clustersKey, tree)
+		tree = doc
+	}
+	return codecs[format].encode(nil, redactTree(tree))
+}
 
-	var clusters []types.Cluster
-	err = json.NewDecoder(file).Decode(&clusters)
+// load loads the clusters of a config file in an environment, and returns them with the
+// composed tree they were decoded from.
+func load(path, env string) ([]types.Cluster, any, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("decode cluster config: %w", err)
+		return nil, nil, &utils.ConfigError{Source: path, Err: err}
 	}
-	return clusters, nil
+	format := FormatOf(path)
+	tree, err := codecs[format].decode(data)
+	if err != nil {
+		return nil, nil, &utils.ConfigError{Source: path, Err: fmt.Errorf("decode %s: %w", format, err)}
+	}
+	if tree, err = decryptLoaded(tree); err != nil {
+		return nil, nil, &utils.ConfigError{Source: path, Err: err}
+	}
+	if tree, err = compose(path, tree, env); err != nil {
+		return nil, nil, &utils.ConfigError{Source: path, Err: err}
+	}
+	// report every problem of the config at once, before any of it is used
+	problems, checked, err := checkStructure(tree)
+	if err != nil {
+		return nil, nil, &utils.ConfigError{Source: path, Err: err}
+	}
+	clusters, err := decodeClusters(checked)
+	if err != nil {
+		if len(problems) > 0 {
+			return nil, nil, &utils.ConfigError{Source: path, Err: &validate.Error{Problems: problems}}
+		}
+		return nil, nil, &utils.ConfigError{Source: path, Err: fmt.Errorf("decode: %w", err)}
+	}
+	problems = append(problems, validate.Clusters(clusters)...)
+	if len(problems) > 0 {
+		return nil, nil, &utils.ConfigError{Source: path, Err: &validate.Error{Problems: problems}}
+	}
+	for ci, fields := range decryptedFields(checked) {
+		if ci < len(clusters) && len(fields) > 0 {
+			clusters[ci].SetDecryptedFields(fields)
+		}
+	}
+	return clusters, tree, nil
+}
+
+// checkStructure checks a config tree against the schema of cluster configs. It returns the
+// problems found and the tree without the values that have problems.
+func checkStructure(tree any) ([]validate.Problem, any, error) {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	problems := validate.Document(doc)
+	if len(problems) == 0 {
+		return nil, tree, nil
+	}
+	tree, err = toTree(doc)
+	return problems, tree, err
 }
 
-// SaveClusters saves the list of clusters to the specified JSON file.
+// SaveClusters saves the list of clusters to the specified config file, in the format of its
+// extension.
+//
+// An existing file is edited in place where possible, keeping its comments, key order and
+// layout: changed values are replaced and new keys, like the labels of a node, are
+// appended to their object. Other changes rewrite the file in the form it had (a list or an
+// object with a "clusters" list, keeping its other top-level keys), with the key order of the
+// file and the keys it spells out with zero values, like "done": false; YAML files keep their
+// comments then, TOML files do not. The file is not touched if nothing changed. Configs
+// encrypted with SOPS stay encrypted, with new ciphertext only for the values that changed.
+// Configs composed of includes, defaults or environments are not written (ErrComposed).
 //
 // Parameters:
 //
-//	path: Path to the clusters.json file.
+//	path: Path to the config file.
 //	clusters: Slice of Cluster objects to save.
 //
 // Returns:
 //
 //	Error if marshalling or writing fails.
 func SaveClusters(path string, clusters []types.Cluster) error {
-	data, err := json.MarshalIndent(clusters, "", "  ")
+	format := FormatOf(path)
+	c := codecs[format]
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read cluster config: %w", err)
+	}
+	var old any
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = nil
+	} else if old, err = c.decode(data); err != nil {
+		return fmt.Errorf("decode cluster config: %w", err)
+	}
+	if obj, ok := old.(*object); ok && isComposed(obj) {
+		return fmt.Errorf("%s: %w", path, ErrComposed)
+	}
+	if isEncrypted(old) {
+		return saveEncrypted(path, c, data, old, clusters)
+	}
+	tree, err := encodeClusters(old, clusters, format == FormatTOML)
+	if err != nil {
+		return fmt.Errorf("marshal cluster config: %w", err)
+	}
+	out, err := renderTree(c, data, old, tree)
+	if err != nil {
+		return fmt.Errorf("marshal cluster config: %w", err)
+	}
+	if data != nil && bytes.Equal(out, data) {
+		return nil
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// saveEncrypted saves clusters to a config encrypted with SOPS, re-encrypting it with its data
+// key and rules.
+func saveEncrypted(path string, c codec, data []byte, old any, clusters []types.Cluster) error {
+	oldPlain, meta, dataKey, err := decryptTree(old)
+	if err != nil {
+		return fmt.Errorf("decrypt cluster config: %w", err)
+	}
+	tree, err := encodeClusters(oldPlain, clusters, false)
 	if err != nil {
 		return fmt.Errorf("marshal cluster config: %w", err)
 	}
-	return os.WriteFile(path, data, 0644)
+	// re-encrypting would change the MAC even if nothing else changed
+	if sameTree(oldPlain, tree) {
+		return nil
+	}
+	obj, ok := tree.(*object)
+	if !ok {
+		return errors.New("encrypt cluster config: an encrypted config must stay in the object form")
+	}
+	enc, err := encryptTree(obj, meta, dataKey, old, oldPlain)
+	if err != nil {
+		return fmt.Errorf("encrypt cluster config: %w", err)
+	}
+	out, err := renderTree(c, data, old, enc)
+	if err != nil {
+		return fmt.Errorf("marshal cluster config: %w", err)
+	}
+	if out, err = resealText(c, out, meta, dataKey); err != nil {
+		return fmt.Errorf("encrypt cluster config: %w", err)
+	}
+	return os.WriteFile(path, out, 0644)
+}
+
+// renderTree returns the text of a config holding a new tree, editing the text of the config
+// in place where possible. Otherwise the tree is encoded with the key order of old and the keys
+// old spells out with zero values.
+func renderTree(c codec, data []byte, old, tree any) ([]byte, error) {
+	if out, ok := patchConfig(c, data, old, tree); ok {
+		return out, nil
+	}
+	return c.encode(data, keepLayout(old, tree))
+}
+
+// patchConfig edits the text of a config to hold a new tree. It returns false if the config
+// cannot be edited in place, or if the edited text would not decode to the new tree.
+func patchConfig(c codec, data []byte, old, tree any) ([]byte, bool) {
+	if data == nil {
+		return nil, false
+	}
+	loc, err := c.locate(data)
+	if err != nil {
+		return nil, false
+	}
+	p := &patcher{loc: loc, literal: c.literal, member: c.member, item: c.item}
+	if !p.diff(nil, old, tree) {
+		return nil, false
+	}
+	out, ok := p.apply(data)
+	if !ok {
+		return nil, false
+	}
+	written, err := c.decode(out)
+	if err != nil || !sameTree(written, tree) {
+		return nil, false
+	}
+	return out, true
+}
+
+// ListConfigFiles returns the cluster config files found at the given path.
+//
+// If path is a directory, all config files directly inside it (*.json, *.yaml, *.yml and
+// *.toml) are returned in lexical order, except those included by the others, which are
+// fragments of those configs.
+// Otherwise path itself is returned.
+//
+// Parameters:
+//
+//	path: Path to a config file or a directory of config files.
+//
+// Returns:
+//
+//	Config file paths and error if the path cannot be read.
+func ListConfigFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat cluster config: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("list cluster configs: %w", err)
+	}
+	var matches []string
+	for _, entry := range entries {
+		if _, ok := extensions[strings.ToLower(filepath.Ext(entry.Name()))]; ok && !entry.IsDir() {
+			matches = append(matches, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(matches)
+	included := includedFiles(matches)
+	configs := matches[:0]
+	for _, file := range matches {
+		if abs, err := filepath.Abs(file); err != nil || !included[abs] {
+			configs = append(configs, file)
+		}
+	}
+	return configs, nil
 }
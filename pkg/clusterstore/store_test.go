@@ -0,0 +1,211 @@
+package clusterstore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/argon-chat/k3sd/pkg/types"
+)
+
+// layoutConfigs are the same config in every format, laid out the way the format is written
+// when a config cannot be edited in place: addons out of alphabetical order and keys spelled
+// out with zero values. Each holds a "zone" label that the tests change or remove.
+var layoutConfigs = map[Format]string{
+	FormatJSON: `{
+  "clusters": [
+    {
+      "address": "10.0.0.1",
+      "user": "root",
+      "password": "secret-password",
+      "nodeName": "master",
+      "labels": {
+        "zone": "a",
+        "tier": "control"
+      },
+      "done": false,
+      "context": "lab",
+      "workers": [],
+      "addons": {
+        "traefik": {
+          "enabled": false,
+          "subs": {}
+        },
+        "cert-manager": {
+          "enabled": true
+        }
+      }
+    }
+  ]
+}`,
+	FormatYAML: `# clusters of the lab
+clusters:
+  - address: 10.0.0.1
+    user: root
+    password: secret-password
+    nodeName: master
+    labels:
+      zone: a
+      tier: control
+    done: false
+    context: lab
+    workers: []
+    addons:
+      traefik:
+        enabled: false
+        subs: {}
+      cert-manager:
+        enabled: true
+`,
+	FormatTOML: `[[clusters]]
+address = "10.0.0.1"
+user = "root"
+password = "secret-password"
+nodeName = "master"
+done = false
+context = "lab"
+workers = []
+
+[clusters.labels]
+zone = "a"
+tier = "control"
+
+[clusters.addons.traefik]
+enabled = false
+subs = {}
+
+[clusters.addons.cert-manager]
+enabled = true
+`,
+}
+
+// zoneLines are the lines of the "zone" label in layoutConfigs.
+var zoneLines = map[Format]string{
+	FormatJSON: `        "zone": "a",` + "\n",
+	FormatYAML: "      zone: a\n",
+	FormatTOML: `zone = "a"` + "\n",
+}
+
+func writeConfig(t *testing.T, format Format, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clusters."+string(format))
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// saveAndCompare saves clusters to path and checks the text and the clusters read back.
+func saveAndCompare(t *testing.T, path string, clusters []types.Cluster, want string) {
+	t.Helper()
+	if err := SaveClusters(path, clusters); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("saved config:\n%s\nwant:\n%s", got, want)
+	}
+	saved, err := LoadClusters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, clusters) {
+		t.Errorf("read back %+v, want %+v", saved, clusters)
+	}
+}
+
+// TestSaveClustersPatches checks that a changed value is replaced in the text, leaving the
+// rest of the config, comments included, as it was.
+func TestSaveClustersPatches(t *testing.T) {
+	for format, text := range layoutConfigs {
+		t.Run(string(format), func(t *testing.T) {
+			path := writeConfig(t, format, text)
+			clusters, err := LoadClusters(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clusters[0].Labels["zone"] = "b"
+			want := strings.Replace(text, zoneLines[format], strings.Replace(zoneLines[format], `a`, `b`, 1), 1)
+			saveAndCompare(t, path, clusters, want)
+		})
+	}
+}
+
+// TestSaveClustersRewrites checks that a config that cannot be edited in place, here because
+// a key is removed, is rewritten with its key order and its zero values.
+func TestSaveClustersRewrites(t *testing.T) {
+	for format, text := range layoutConfigs {
+		t.Run(string(format), func(t *testing.T) {
+			path := writeConfig(t, format, text)
+			clusters, err := LoadClusters(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delete(clusters[0].Labels, "zone")
+			saveAndCompare(t, path, clusters, strings.Replace(text, zoneLines[format], "", 1))
+		})
+	}
+}
+
+// TestSaveClustersRewritesWithoutComments checks that a rewritten TOML config loses its
+// comments but keeps its layout otherwise, while a YAML config keeps them.
+func TestSaveClustersRewritesWithoutComments(t *testing.T) {
+	const comment = "# clusters of the lab\n"
+	for _, format := range []Format{FormatYAML, FormatTOML} {
+		t.Run(string(format), func(t *testing.T) {
+			text := strings.TrimPrefix(layoutConfigs[format], comment)
+			path := writeConfig(t, format, comment+text)
+			clusters, err := LoadClusters(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delete(clusters[0].Labels, "zone")
+			want := strings.Replace(text, zoneLines[format], "", 1)
+			if format == FormatYAML {
+				want = comment + want
+			}
+			saveAndCompare(t, path, clusters, want)
+		})
+	}
+}
+
+// TestSaveClustersAddsCluster checks that a cluster added to a config is appended without
+// rewriting the clusters before it.
+func TestSaveClustersAddsCluster(t *testing.T) {
+	for format, text := range layoutConfigs {
+		t.Run(string(format), func(t *testing.T) {
+			path := writeConfig(t, format, text)
+			clusters, err := LoadClusters(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clusters = append(clusters, types.Cluster{
+				Worker:  types.Worker{Address: "10.0.1.1", User: "root", NodeName: "master"},
+				Context: "lab2",
+			})
+			if err := SaveClusters(path, clusters); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefix := strings.TrimRight(text, "\n ]}")
+			if !strings.HasPrefix(string(got), prefix) {
+				t.Errorf("saved config:\n%s\ndoes not start with the original clusters", got)
+			}
+			saved, err := LoadClusters(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved) != 2 || saved[1].Context != "lab2" {
+				t.Errorf("read back %+v", saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package clusterstore
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// tomlCodec reads and writes TOML configs, which hold their clusters in [[clusters]] tables.
+// When a config cannot be edited in place it is re-encoded, which loses its comments.
+var tomlCodec = codec{
+	decode:  decodeTOML,
+	locate:  locateTOML,
+	literal: tomlLiteral,
+	member: func(key, literal string) string {
+		return tomlKey(key) + " = " + literal
+	},
+	item: func(v any, at insertionPoint) (string, bool) {
+		obj, ok := v.(*object)
+		if !ok || at.header == nil {
+			return "", false
+		}
+		var buf bytes.Buffer
+		writeTOMLHeader(&buf, "[["+tomlHeader(at.header)+"]]")
+		if err := writeTOMLTable(&buf, at.header, obj, nil); err != nil {
+			return "", false
+		}
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		for i, line := range lines {
+			if line != "" {
+				lines[i] = at.indent + line
+			}
+		}
+		return strings.Join(lines, "\n"), true
+	},
+	encode: func(data []byte, tree any) ([]byte, error) {
+		obj, ok := tree.(*object)
+		if !ok {
+			return nil, errors.New("a TOML config must be a table")
+		}
+		// the zero values the config being rewritten spells out are kept
+		var old any
+		if data != nil {
+			old, _ = decodeTOML(data)
+		}
+		var buf bytes.Buffer
+		if err := writeTOMLTable(&buf, nil, obj, old); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+}
+
+// decodeTOML decodes a TOML config, with the keys of its tables in the order of the text.
+func decodeTOML(data []byte) (any, error) {
+	var doc map[string]any
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	tree, err := toTree(doc)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := locateTOML(data)
+	if err != nil {
+		return nil, err
+	}
+	sortKeys(tree, nil, loc.order)
+	return tree, nil
+}
+
+// sortKeys orders the keys of the objects of the tree at path by their position in order.
+func sortKeys(tree any, path []string, order map[string]int) {
+	switch v := tree.(type) {
+	case *object:
+		position := func(key string) int {
+			if n, ok := order[pathKey(appendPath(path, key))]; ok {
+				return n
+			}
+			return len(order)
+		}
+		sort.SliceStable(v.keys, func(i, j int) bool { return position(v.keys[i]) < position(v.keys[j]) })
+		for _, key := range v.keys {
+			sortKeys(v.values[key], appendPath(path, key), order)
+		}
+	case []any:
+		for i, item := range v {
+			sortKeys(item, indexPath(path, i), order)
+		}
+	}
+}
+
+// bareKey matches the keys TOML allows without quotes.
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tomlKey returns a key as written in TOML, quoted where needed.
+func tomlKey(key string) string {
+	if bareKey.MatchString(key) {
+		return key
+	}
+	quoted, _ := jsonLiteral(key)
+	return quoted
+}
+
+// tomlHeader returns the dotted key of a table header.
+func tomlHeader(keys []string) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = tomlKey(key)
+	}
+	return strings.Join(parts, ".")
+}
+
+// tomlLiteral encodes a scalar as TOML. TOML has no null.
+func tomlLiteral(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		// JSON escapes are valid in TOML basic strings
+		return jsonLiteral(v)
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		if v == float64(int64(v)) {
+			return strconv.FormatInt(int64(v), 10), true
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// tomlTable is a table with a header in the text of a TOML config.
+//
+// Fields:
+//   - path: Path of the table.
+//   - start: Offset of the start of its header line, or 0 for the root table.
+//   - indent: Indentation of its first key, or of its header if it has no keys.
+//   - keyed: Whether a key of the table was seen.
+type tomlTable struct {
+	path   []string
+	start  int
+	indent string
+	keyed  bool
+}
+
+// locateTOML finds the values and tables of a TOML config in its text. Keys are only
+// appended to the root table and to tables with a header, and items only to arrays of tables.
+func locateTOML(data []byte) (*textLocator, error) {
+	loc := newTextLocator()
+	p := unstable.Parser{}
+	p.Reset(data)
+	tables := []*tomlTable{{}}
+	arrays := make(map[string]int)
+	headers := make(map[string][]string)
+	var current []string
+	for p.NextExpression() {
+		expr := p.Expression()
+		switch expr.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			keys, start := tomlKeyPath(expr.Key())
+			current = nil
+			for i, key := range keys {
+				current = appendPath(current, key)
+				loc.see(current)
+				if i == len(keys)-1 && expr.Kind == unstable.ArrayTable {
+					headers[pathKey(current)] = keys
+					n := arrays[pathKey(current)]
+					arrays[pathKey(current)] = n + 1
+					current = indexPath(current, n)
+				} else if n, ok := arrays[pathKey(current)]; ok {
+					current = indexPath(current, n-1)
+				}
+			}
+			line := lineStart(data, start)
+			tables = append(tables, &tomlTable{path: current, start: line, indent: indentation(data, line)})
+		case unstable.KeyValue:
+			keys, start := tomlKeyPath(expr.Key())
+			path := current
+			for _, key := range keys {
+				path = appendPath(path, key)
+				loc.see(path)
+			}
+			if table := tables[len(tables)-1]; !table.keyed {
+				table.indent = indentation(data, lineStart(data, start))
+				table.keyed = true
+			}
+			loc.scanTOML(&p, expr.Value(), path)
+		}
+	}
+	if err := p.Error(); err != nil {
+		return nil, err
+	}
+	tableEnd := func(i int) int {
+		if i+1 < len(tables) {
+			return tables[i+1].start
+		}
+		return len(data)
+	}
+	for i, table := range tables {
+		if offset, ok := lastContentLine(data, table.start, tableEnd(i)); ok {
+			loc.insertions[pathKey(table.path)] = insertionPoint{offset: offset, prefix: "\n" + table.indent}
+		}
+	}
+	// items of an array of tables go after the last table of its last item
+	for key, keys := range headers {
+		last := pathKey(indexPath(strings.Split(key, "\x00"), arrays[key]-1))
+		for i := len(tables) - 1; i > 0; i-- {
+			if tablePath := pathKey(tables[i].path); tablePath != last && !strings.HasPrefix(tablePath, last+"\x00") {
+				continue
+			}
+			if offset, ok := lastContentLine(data, tables[i].start, tableEnd(i)); ok {
+				indent := indentation(data, tables[i].start)
+				loc.appends[key] = insertionPoint{offset: offset, prefix: "\n\n", indent: indent, header: keys}
+			}
+			break
+		}
+	}
+	return loc, nil
+}
+
+// tomlKeyPath returns the parts of a dotted key and the offset it starts at.
+func tomlKeyPath(it unstable.Iterator) ([]string, int) {
+	var keys []string
+	start := -1
+	for it.Next() {
+		node := it.Node()
+		if start < 0 {
+			start = int(node.Raw.Offset)
+		}
+		keys = append(keys, string(node.Data))
+	}
+	return keys, start
+}
+
+// scanTOML records the location of a value at path and of the values inside it.
+func (l *textLocator) scanTOML(p *unstable.Parser, node *unstable.Node, path []string) {
+	switch node.Kind {
+	case unstable.Array:
+		it := node.Children()
+		for i := 0; it.Next(); i++ {
+			l.scanTOML(p, it.Node(), indexPath(path, i))
+		}
+	case unstable.InlineTable:
+		it := node.Children()
+		for it.Next() {
+			kv := it.Node()
+			keys, _ := tomlKeyPath(kv.Key())
+			child := path
+			for _, key := range keys {
+				child = appendPath(child, key)
+				l.see(child)
+			}
+			l.scanTOML(p, kv.Value(), child)
+		}
+	case unstable.String:
+		l.spans[pathKey(path)] = [2]int{int(node.Raw.Offset), int(node.Raw.Offset + node.Raw.Length)}
+	case unstable.Bool, unstable.Integer, unstable.Float:
+		// their data is a slice of the document
+		r := p.Range(node.Data)
+		l.spans[pathKey(path)] = [2]int{int(r.Offset), int(r.Offset + r.Length)}
+	}
+}
+
+// lastContentLine returns the end of the last line in [start, end) that is neither blank nor
+// a comment: keys appended to a table go after it, before the comments introducing the next
+// table. It returns false if there is no such line.
+func lastContentLine(data []byte, start, end int) (int, bool) {
+	last := -1
+	for offset := start; offset < end; {
+		next := lineEnd(data, offset)
+		line := strings.TrimSpace(string(data[offset:next]))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			last = next
+		}
+		for next < len(data) && data[next] != '\n' {
+			next++
+		}
+		offset = next + 1
+	}
+	return last, last >= 0
+}
+
+// writeTOMLTable writes the keys of a table, then its subtables and arrays of tables, in the
+// order of their keys. Keys with zero values are left out, unless old, the same table in the
+// config being rewritten, has them too. TOML has no null, so null values are always left out.
+func writeTOMLTable(buf *bytes.Buffer, path []string, obj *object, old any) error {
+	prev, _ := old.(*object)
+	for _, key := range obj.keys {
+		value := obj.values[key]
+		if isTOMLTable(value) || isTOMLTableArray(value) || value == nil {
+			continue
+		}
+		if _, kept := prev.lookup(key); isZero(value) && !kept {
+			continue
+		}
+		literal, err := tomlInline(value)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(tomlKey(key) + " = " + literal + "\n")
+	}
+	for _, key := range obj.keys {
+		value := obj.values[key]
+		child := appendPath(path, key)
+		switch {
+		case isTOMLTable(value):
+			// a table holding nothing but tables is defined by theirs
+			if !onlyTOMLTables(value.(*object)) {
+				writeTOMLHeader(buf, "["+tomlHeader(child)+"]")
+			}
+			prevValue, _ := prev.lookup(key)
+			if err := writeTOMLTable(buf, child, value.(*object), prevValue); err != nil {
+				return err
+			}
+		case isTOMLTableArray(value):
+			prevValue, _ := prev.lookup(key)
+			prevItems, _ := prevValue.([]any)
+			for i, item := range value.([]any) {
+				var prevItem any
+				if i < len(prevItems) {
+					prevItem = prevItems[i]
+				}
+				writeTOMLHeader(buf, "[["+tomlHeader(child)+"]]")
+				if err := writeTOMLTable(buf, child, item.(*object), prevItem); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeTOMLHeader(buf *bytes.Buffer, header string) {
+	if buf.Len() > 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString(header + "\n")
+}
+
+// isTOMLTable reports whether a value is written as a table with a header.
+func isTOMLTable(v any) bool {
+	obj, ok := v.(*object)
+	return ok && len(obj.keys) > 0
+}
+
+// onlyTOMLTables reports whether a table holds tables or arrays of tables and no other
+// non-zero keys.
+func onlyTOMLTables(obj *object) bool {
+	tables := false
+	for _, key := range obj.keys {
+		switch value := obj.values[key]; {
+		case isTOMLTable(value) || isTOMLTableArray(value):
+			tables = true
+		case !isZero(value):
+			return false
+		}
+	}
+	return tables
+}
+
+// isTOMLTableArray reports whether a value is written as an array of tables.
+func isTOMLTableArray(v any) bool {
+	list, ok := v.([]any)
+	if !ok || len(list) == 0 {
+		return false
+	}
+	for _, item := range list {
+		if _, ok := item.(*object); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// tomlInline encodes a value on a single line, with inline arrays and tables.
+func tomlInline(v any) (string, error) {
+	switch v := v.(type) {
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			literal, err := tomlInline(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, literal)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case *object:
+		members := make([]string, 0, len(v.keys))
+		for _, key := range v.keys {
+			if isZero(v.values[key]) {
+				continue
+			}
+			literal, err := tomlInline(v.values[key])
+			if err != nil {
+				return "", err
+			}
+			members = append(members, tomlKey(key)+" = "+literal)
+		}
+		if len(members) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(members, ", ") + " }", nil
+	}
+	literal, ok := tomlLiteral(v)
+	if !ok {
+		return "", errors.New("TOML cannot hold null in a list")
+	}
+	return literal, nil
+}
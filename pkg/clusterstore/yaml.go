@@ -0,0 +1,510 @@
+package clusterstore
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlCodec reads and writes YAML configs. When a config cannot be edited in place it is
+// merged into the parsed document, which keeps its comments and key order but not its blank
+// lines.
+var yamlCodec = codec{
+	decode: func(data []byte) (any, error) {
+		doc, err := parseYAML(data)
+		if err != nil {
+			return nil, err
+		}
+		return yamlTree(doc)
+	},
+	locate:  locateYAML,
+	literal: yamlLiteral,
+	member: func(key, literal string) string {
+		name, _ := yamlLiteral(key)
+		return name + ": " + literal
+	},
+	item:   yamlItem,
+	encode: encodeYAML,
+}
+
+// parseYAML parses the first document of a YAML config.
+func parseYAML(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// yamlTree converts a YAML node to a tree, resolving aliases and merge keys.
+func yamlTree(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case 0:
+		return nil, nil
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlTree(node.Content[0])
+	case yaml.AliasNode:
+		return yamlTree(node.Alias)
+	case yaml.SequenceNode:
+		list := []any{}
+		for _, item := range node.Content {
+			value, err := yamlTree(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		obj := newObject()
+		var merged []*object
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			tree, err := yamlTree(value)
+			if err != nil {
+				return nil, err
+			}
+			if key.ShortTag() == "!!merge" {
+				merged = append(merged, mergeSources(tree)...)
+				continue
+			}
+			obj.set(key.Value, tree)
+		}
+		// explicit keys win over merged ones, whatever their order
+		for _, source := range merged {
+			for _, key := range source.keys {
+				if _, ok := obj.values[key]; !ok {
+					obj.set(key, source.values[key])
+				}
+			}
+		}
+		return obj, nil
+	}
+	switch node.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		err := node.Decode(&b)
+		return b, err
+	case "!!int", "!!float":
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return nil, fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		return f, nil
+	}
+	return node.Value, nil
+}
+
+// mergeSources returns the mappings merged by a "<<" key.
+func mergeSources(tree any) []*object {
+	switch v := tree.(type) {
+	case *object:
+		return []*object{v}
+	case []any:
+		var sources []*object
+		for _, item := range v {
+			if obj, ok := item.(*object); ok {
+				sources = append(sources, obj)
+			}
+		}
+		return sources
+	}
+	return nil
+}
+
+// yamlLiteral encodes a scalar as YAML, quoted where needed. Strings spanning lines are not
+// written in place.
+func yamlLiteral(v any) (string, bool) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	literal := strings.TrimSuffix(string(data), "\n")
+	if strings.Contains(literal, "\n") {
+		return "", false
+	}
+	return literal, true
+}
+
+// yamlItem encodes an item appended to a block sequence.
+func yamlItem(v any, at insertionPoint) (string, bool) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(yamlNode(v)); err != nil {
+		return "", false
+	}
+	if err := enc.Close(); err != nil {
+		return "", false
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	return "- " + strings.Join(lines, "\n"+at.indent+"  "), true
+}
+
+// locateYAML finds the values and block mappings of a YAML config in its text.
+func locateYAML(data []byte) (*textLocator, error) {
+	doc, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	loc := newTextLocator()
+	if len(doc.Content) > 0 {
+		y := &yamlLocator{textLocator: loc, data: data, lines: lineOffsets(data)}
+		y.scan(doc.Content[0], nil, true)
+	}
+	return loc, nil
+}
+
+// yamlLocator records the locations of the nodes of a YAML document.
+type yamlLocator struct {
+	*textLocator
+	data  []byte
+	lines []int
+}
+
+// lineOffsets returns the offset of the start of every line.
+func lineOffsets(data []byte) []int {
+	offsets := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			offsets = append(offsets, i+1)
+		}
+	}
+	return offsets
+}
+
+// offset returns the byte offset of a node, whose column counts characters.
+func (y *yamlLocator) offset(node *yaml.Node) (int, bool) {
+	if node.Line < 1 || node.Line > len(y.lines) {
+		return 0, false
+	}
+	offset := y.lines[node.Line-1]
+	for column := 1; column < node.Column; column++ {
+		if offset >= len(y.data) || y.data[offset] == '\n' {
+			return 0, false
+		}
+		_, size := utf8.DecodeRune(y.data[offset:])
+		offset += size
+	}
+	return offset, true
+}
+
+// scan records the node at path and the nodes inside it, unless record is false as for the
+// nodes merged by "<<". It returns the offset of the end of the node's last line of content,
+// or false if that is unknown, as for block scalars.
+func (y *yamlLocator) scan(node *yaml.Node, path []string, record bool) (int, bool) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		start, ok := y.offset(node)
+		return lineEnd(y.data, start), ok
+	case yaml.ScalarNode:
+		start, ok := y.offset(node)
+		if !ok {
+			return 0, false
+		}
+		if node.Style == 0 && node.Value == "" {
+			// an empty value has no text to replace
+			return lineEnd(y.data, start), true
+		}
+		end, ok := y.scalarEnd(node, start)
+		if !ok {
+			return 0, false
+		}
+		if record {
+			y.spans[pathKey(path)] = [2]int{start, end}
+		}
+		return lineEnd(y.data, end), true
+	}
+	end, known := 0, true
+	for i := 0; i < len(node.Content); i++ {
+		child := node.Content[i]
+		childPath, childRecord := indexPath(path, i), record
+		if node.Kind == yaml.MappingNode {
+			key := child
+			i++
+			child = node.Content[i]
+			childPath = appendPath(path, key.Value)
+			childRecord = record && key.ShortTag() != "!!merge"
+		}
+		childEnd, ok := y.scan(child, childPath, childRecord)
+		known = known && ok
+		end = max(end, childEnd)
+	}
+	if node.Style&yaml.FlowStyle != 0 {
+		start, ok := y.offset(node)
+		if !ok {
+			return 0, false
+		}
+		closing, ok := flowEnd(y.data, start)
+		return lineEnd(y.data, closing), ok
+	}
+	if node.Kind == yaml.SequenceNode && record && known && len(node.Content) > 0 {
+		// new items line up with the "-" of the first one
+		if start, ok := y.offset(node); ok {
+			indent := strings.Repeat(" ", utf8.RuneCount(y.data[lineStart(y.data, start):start]))
+			y.appends[pathKey(path)] = insertionPoint{offset: end, prefix: "\n" + indent, indent: indent}
+		}
+	}
+	if node.Kind == yaml.MappingNode && record && known && len(node.Content) > 0 {
+		// new keys line up with the first one, which may follow the "- " of a list item
+		if start, ok := y.offset(node.Content[0]); ok {
+			column := utf8.RuneCount(y.data[lineStart(y.data, start):start])
+			y.insertions[pathKey(path)] = insertionPoint{offset: end, prefix: "\n" + strings.Repeat(" ", column)}
+		}
+	}
+	return end, known
+}
+
+// scalarEnd returns the offset a single-line plain or quoted scalar ends at.
+func (y *yamlLocator) scalarEnd(node *yaml.Node, start int) (int, bool) {
+	switch node.Style {
+	case 0:
+		end := start + len(node.Value)
+		if end > len(y.data) || string(y.data[start:end]) != node.Value {
+			return 0, false
+		}
+		return end, true
+	case yaml.SingleQuotedStyle, yaml.DoubleQuotedStyle:
+		quote := y.data[start]
+		for i := start + 1; i < len(y.data); i++ {
+			switch {
+			case y.data[i] == '\n':
+				return 0, false
+			case quote == '"' && y.data[i] == '\\':
+				i++
+			case y.data[i] == quote && quote == '\'' && i+1 < len(y.data) && y.data[i+1] == '\'':
+				i++
+			case y.data[i] == quote:
+				return i + 1, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// flowEnd returns the offset of the bracket closing the flow collection at start.
+func flowEnd(data []byte, start int) (int, bool) {
+	depth := 0
+	var quote byte
+	for i := start; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && i > 0 && (data[i-1] == ' ' || data[i-1] == '\t'):
+			i = lineEnd(data, i) - 1
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// encodeYAML writes a config tree as YAML. The tree is merged into the existing config data,
+// if any, keeping the comments and key order of its nodes.
+func encodeYAML(data []byte, tree any) ([]byte, error) {
+	indent := 2
+	var doc *yaml.Node
+	if data != nil {
+		var err error
+		if doc, err = parseYAML(data); err != nil {
+			return nil, err
+		}
+		indent = yamlIndent(data)
+	}
+	if doc == nil || len(doc.Content) == 0 {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{yamlNode(tree)}}
+	} else {
+		root, err := mergeYAML(doc.Content[0], tree)
+		if err != nil {
+			return nil, err
+		}
+		doc.Content[0] = root
+	}
+	untagMergeKeys(doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(indent)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// untagMergeKeys clears the resolved tag of "<<" keys, which the encoder would otherwise
+// write out as "!!merge <<".
+func untagMergeKeys(node *yaml.Node) {
+	for i, child := range node.Content {
+		if node.Kind == yaml.MappingNode && i%2 == 0 && child.ShortTag() == "!!merge" {
+			child.Tag = ""
+		}
+		untagMergeKeys(child)
+	}
+}
+
+// yamlIndent guesses the indentation width of a YAML config from its first indented line.
+func yamlIndent(data []byte) int {
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == line || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if n := len(line) - len(trimmed); n >= 2 && n <= 8 {
+			return n
+		}
+		break
+	}
+	return 2
+}
+
+// mergeYAML updates a node to hold a tree value and returns it, or the node replacing it.
+// Unchanged nodes are left alone, mappings and sequences are updated in place and replaced
+// scalars keep their comments and, for strings, their quoting style.
+func mergeYAML(node *yaml.Node, tree any) (*yaml.Node, error) {
+	current, err := yamlTree(node)
+	if err != nil {
+		return nil, err
+	}
+	if sameTree(current, tree) {
+		return node, nil
+	}
+	switch v := tree.(type) {
+	case *object:
+		if node.Kind == yaml.MappingNode {
+			return node, mergeYAMLMapping(node, v)
+		}
+	case []any:
+		if node.Kind == yaml.SequenceNode {
+			for i, item := range v {
+				if i < len(node.Content) {
+					if node.Content[i], err = mergeYAML(node.Content[i], item); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				node.Content = append(node.Content, yamlNode(item))
+			}
+			node.Content = node.Content[:len(v)]
+			return node, nil
+		}
+	}
+	replacement := yamlNode(tree)
+	replacement.Anchor = node.Anchor
+	replacement.HeadComment, replacement.LineComment, replacement.FootComment = node.HeadComment, node.LineComment, node.FootComment
+	if node.Kind == yaml.ScalarNode && replacement.Kind == yaml.ScalarNode && node.ShortTag() == "!!str" && replacement.Tag == "!!str" && !strings.Contains(replacement.Value, "\n") {
+		replacement.Style = node.Style &^ (yaml.LiteralStyle | yaml.FoldedStyle)
+	}
+	return replacement, nil
+}
+
+// mergeYAMLMapping updates the keys of a mapping to those of obj. Keys missing from obj are
+// removed unless they hold a zero value; zero keys of obj are not added.
+func mergeYAMLMapping(node *yaml.Node, obj *object) error {
+	index := make(map[string]int)
+	var merged []*object
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].ShortTag() == "!!merge" {
+			tree, err := yamlTree(node.Content[i+1])
+			if err != nil {
+				return err
+			}
+			merged = append(merged, mergeSources(tree)...)
+			continue
+		}
+		index[node.Content[i].Value] = i + 1
+	}
+	for _, key := range obj.keys {
+		value := obj.values[key]
+		if i, ok := index[key]; ok {
+			var err error
+			if node.Content[i], err = mergeYAML(node.Content[i], value); err != nil {
+				return err
+			}
+			continue
+		}
+		if isZero(value) || inherited(merged, key, value) {
+			continue
+		}
+		node.Content = append(node.Content, yamlNode(key), yamlNode(value))
+	}
+	content := node.Content[:0]
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if _, ok := obj.values[key.Value]; !ok && key.ShortTag() != "!!merge" {
+			tree, err := yamlTree(value)
+			if err != nil {
+				return err
+			}
+			if !isZero(tree) {
+				continue
+			}
+		}
+		content = append(content, key, value)
+	}
+	node.Content = content
+	return nil
+}
+
+// inherited reports whether a key with the given value is merged into a mapping by "<<".
+func inherited(merged []*object, key string, value any) bool {
+	for _, source := range merged {
+		if prev, ok := source.values[key]; ok {
+			return sameTree(prev, value)
+		}
+	}
+	return false
+}
+
+// yamlNode builds the YAML node of a tree value. Keys with zero values are left out.
+func yamlNode(tree any) *yaml.Node {
+	switch v := tree.(type) {
+	case *object:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, key := range v.keys {
+			if isZero(v.values[key]) {
+				continue
+			}
+			node.Content = append(node.Content, yamlNode(key), yamlNode(v.values[key]))
+		}
+		return node
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			node.Content = append(node.Content, yamlNode(item))
+		}
+		return node
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	case float64:
+		if v == float64(int64(v)) {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(int64(v), 10)}
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(v, 'g', -1, 64)}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+}
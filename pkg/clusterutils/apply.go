@@ -1,6 +1,9 @@
 package clusterutils
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
 
@@ -9,14 +12,21 @@ import (
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	component: Name of the component being applied.
 //	kubeconfigPath: Path to the kubeconfig file.
 //	manifest: Path or URL to the manifest YAML.
 //	logger: Logger for output.
 //	substitutions: Map of string substitutions to apply to the manifest.
-func ApplyComponentYAML(component, kubeconfigPath, manifest string, logger *utils.Logger, substitutions map[string]string) {
+//
+// Returns:
+//
+//	Error if the manifest cannot be applied.
+func ApplyComponentYAML(ctx context.Context, component, kubeconfigPath, manifest string, logger *utils.Logger, substitutions map[string]string) error {
 	logger.Log("Applying %s...", component)
-	if err := ApplyYAMLManifest(kubeconfigPath, manifest, logger, substitutions); err != nil {
+	if err := ApplyYAMLManifest(ctx, kubeconfigPath, manifest, logger, substitutions); err != nil {
 		logger.Log("%s error: %v", component, err)
+		return fmt.Errorf("apply %s: %w", component, err)
 	}
+	return nil
 }
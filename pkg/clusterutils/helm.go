@@ -1,10 +1,13 @@
 package clusterutils
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"os/exec"
+	"strconv"
 	"strings"
 
+	"github.com/argon-chat/k3sd/pkg/tracing"
 	utils "github.com/argon-chat/k3sd/pkg/utils"
 )
 
@@ -17,6 +20,7 @@ func isHelmRepoAlreadyExists(output string) bool {
 //
 // Parameters:
 //
+//	ctx: Context of the operation; also carries the HelmAtomic option.
 //	kubeconfigPath: Path to the kubeconfig file.
 //	releaseName: Name of the Helm release.
 //	namespace: Kubernetes namespace for the release.
@@ -30,19 +34,24 @@ func isHelmRepoAlreadyExists(output string) bool {
 // Returns:
 //
 //	Error if any Helm operation fails.
-func InstallHelmChart(kubeconfigPath, releaseName, namespace, repoName, repoURL, chartName, chartVersion, valuesFile string, logger *utils.Logger) error {
-	if err := helmRepoAdd(repoName, repoURL, logger); err != nil {
+func InstallHelmChart(ctx context.Context, kubeconfigPath, releaseName, namespace, repoName, repoURL, chartName, chartVersion, valuesFile string, logger *utils.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "InstallHelmChart",
+		tracing.AttrRelease.String(releaseName),
+		tracing.AttrChart.String(repoName+"/"+chartName+"@"+chartVersion),
+		tracing.AttrNamespace.String(namespace))
+	defer func() { tracing.End(span, err) }()
+	if err := helmRepoAdd(ctx, repoName, repoURL, logger); err != nil {
 		return err
 	}
-	if err := helmRepoUpdate(logger); err != nil {
+	if err := helmRepoUpdate(ctx, logger); err != nil {
 		return err
 	}
-	args := buildHelmArgs(kubeconfigPath, releaseName, namespace, repoName, chartName, chartVersion, valuesFile)
-	return helmUpgradeInstall(args, logger)
+	args := buildHelmArgs(ctx, kubeconfigPath, releaseName, namespace, repoName, chartName, chartVersion, valuesFile)
+	return helmUpgradeInstall(ctx, args, logger)
 }
 
-func helmRepoAdd(repoName, repoURL string, logger *utils.Logger) error {
-	cmd := exec.Command("helm", "repo", "add", repoName, repoURL)
+func helmRepoAdd(ctx context.Context, repoName, repoURL string, logger *utils.Logger) error {
+	cmd := utils.ExecCommand(ctx, "helm", "repo", "add", repoName, repoURL)
 	out, err := cmd.CombinedOutput()
 	if err != nil && !isHelmRepoAlreadyExists(string(out)) {
 		logger.LogErr("Helm repo add failed: %v\nOutput: %s", err, string(out))
@@ -52,8 +61,8 @@ func helmRepoAdd(repoName, repoURL string, logger *utils.Logger) error {
 	return nil
 }
 
-func helmRepoUpdate(logger *utils.Logger) error {
-	cmd := exec.Command("helm", "repo", "update")
+func helmRepoUpdate(ctx context.Context, logger *utils.Logger) error {
+	cmd := utils.ExecCommand(ctx, "helm", "repo", "update")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		logger.LogErr("Helm repo update failed: %v\nOutput: %s", err, string(out))
@@ -63,10 +72,10 @@ func helmRepoUpdate(logger *utils.Logger) error {
 	return nil
 }
 
-func buildHelmArgs(kubeconfigPath, releaseName, namespace, repoName, chartName, chartVersion, valuesFile string) []string {
+func buildHelmArgs(ctx context.Context, kubeconfigPath, releaseName, namespace, repoName, chartName, chartVersion, valuesFile string) []string {
 	chartRef := fmt.Sprintf("%s/%s", repoName, chartName)
 	baseArgs := []string{"--kubeconfig", kubeconfigPath, "--namespace", namespace, "--version", chartVersion, "--create-namespace", "--wait", "--timeout", "600s"}
-	if utils.HelmAtomic {
+	if utils.OptionsFrom(ctx).HelmAtomic {
 		baseArgs = append(baseArgs, "--atomic")
 	}
 	if valuesFile != "" {
@@ -75,8 +84,8 @@ func buildHelmArgs(kubeconfigPath, releaseName, namespace, repoName, chartName,
 	return append([]string{"upgrade", "--install", releaseName, chartRef}, baseArgs...)
 }
 
-func helmUpgradeInstall(args []string, logger *utils.Logger) error {
-	cmd := exec.Command("helm", args...)
+func helmUpgradeInstall(ctx context.Context, args []string, logger *utils.Logger) error {
+	cmd := utils.ExecCommand(ctx, "helm", args...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		logger.LogErr("Helm upgrade/install failed: %v\nOutput: %s", err, string(out))
@@ -90,6 +99,7 @@ func helmUpgradeInstall(args []string, logger *utils.Logger) error {
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	kubeconfigPath: Path to the kubeconfig file.
 //	releaseName: Name of the Helm release to uninstall.
 //	namespace: Kubernetes namespace of the release.
@@ -98,8 +108,8 @@ func helmUpgradeInstall(args []string, logger *utils.Logger) error {
 // Returns:
 //
 //	Error if the Helm uninstall command fails.
-func UninstallHelmRelease(kubeconfigPath, releaseName, namespace string, logger *utils.Logger) error {
-	cmd := exec.Command("helm", "uninstall", releaseName, "--namespace", namespace, "--kubeconfig", kubeconfigPath)
+func UninstallHelmRelease(ctx context.Context, kubeconfigPath, releaseName, namespace string, logger *utils.Logger) error {
+	cmd := utils.ExecCommand(ctx, "helm", "uninstall", releaseName, "--namespace", namespace, "--kubeconfig", kubeconfigPath)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		logger.LogErr("Helm uninstall failed: %v\nOutput: %s", err, string(out))
@@ -108,3 +118,96 @@ func UninstallHelmRelease(kubeconfigPath, releaseName, namespace string, logger
 	logger.Log("Helm uninstall output: %s", string(out))
 	return nil
 }
+
+// HelmReleaseInfo describes the state of an installed Helm release.
+//
+// Fields:
+//   - Name: Release name.
+//   - Namespace: Release namespace.
+//   - Status: Release status as reported by Helm (e.g. "deployed", "failed").
+//   - Revision: Current release revision.
+//   - Chart: Chart name and version, if known.
+type HelmReleaseInfo struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Status    string `json:"status"`
+	Revision  int    `json:"revision"`
+	Chart     string `json:"chart,omitempty"`
+}
+
+// GetHelmReleaseStatus returns the state of a Helm release.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	kubeconfigPath: Path to the kubeconfig file.
+//	releaseName: Name of the Helm release.
+//	namespace: Kubernetes namespace of the release.
+//
+// Returns:
+//
+//	Release state and error if the release cannot be found or the output cannot be decoded.
+func GetHelmReleaseStatus(ctx context.Context, kubeconfigPath, releaseName, namespace string) (*HelmReleaseInfo, error) {
+	cmd := utils.ExecCommand(ctx, "helm", "status", releaseName, "--namespace", namespace, "--kubeconfig", kubeconfigPath, "-o", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("helm status %s: %w%s", releaseName, err, exitErrorOutput(err))
+	}
+	var status struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		Version   int    `json:"version"`
+		Info      struct {
+			Status string `json:"status"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return nil, fmt.Errorf("decode helm status %s: %w", releaseName, err)
+	}
+	return &HelmReleaseInfo{
+		Name:      status.Name,
+		Namespace: status.Namespace,
+		Status:    status.Info.Status,
+		Revision:  status.Version,
+	}, nil
+}
+
+// ListHelmReleases lists all Helm releases in all namespaces of the cluster.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	kubeconfigPath: Path to the kubeconfig file.
+//
+// Returns:
+//
+//	Releases and error if Helm fails or its output cannot be decoded.
+func ListHelmReleases(ctx context.Context, kubeconfigPath string) ([]HelmReleaseInfo, error) {
+	cmd := utils.ExecCommand(ctx, "helm", "list", "--all-namespaces", "--all", "--kubeconfig", kubeconfigPath, "-o", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("helm list: %w%s", err, exitErrorOutput(err))
+	}
+	var list []struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		Revision  string `json:"revision"`
+		Status    string `json:"status"`
+		Chart     string `json:"chart"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("decode helm list output: %w", err)
+	}
+	releases := make([]HelmReleaseInfo, 0, len(list))
+	for _, r := range list {
+		revision, _ := strconv.Atoi(r.Revision)
+		releases = append(releases, HelmReleaseInfo{
+			Name:      r.Name,
+			Namespace: r.Namespace,
+			Status:    r.Status,
+			Revision:  revision,
+			Chart:     r.Chart,
+		})
+	}
+	return releases, nil
+}
@@ -1,42 +1,65 @@
 package clusterutils
 
 import (
+	"context"
+	"fmt"
 	"os"
-	"os/exec"
 	"path"
 	"time"
 
+	"github.com/argon-chat/k3sd/pkg/tracing"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
 
+// deploymentWaitTimeout bounds how long WaitForDeploymentReady waits for a deployment to appear.
+const deploymentWaitTimeout = 10 * time.Minute
+
 // WaitForDeploymentReady waits until the specified deployment exists and is ready in the given namespace.
 // It checks for deployment existence, then waits for rollout status.
 //
 // Parameters:
 //
+//	ctx: Context of the operation; cancelling it stops waiting.
 //	kubeconfigPath: Path to the kubeconfig file.
 //	deployment: Name of the deployment to check.
 //	namespace: Kubernetes namespace.
 //	logger: Logger for output.
-func WaitForDeploymentReady(kubeconfigPath, deployment, namespace string, logger *utils.Logger) {
+//
+// Returns:
+//
+//	Error if the deployment does not appear in time, its rollout fails or ctx is cancelled.
+func WaitForDeploymentReady(ctx context.Context, kubeconfigPath, deployment, namespace string, logger *utils.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "WaitForDeploymentReady",
+		tracing.AttrDeployment.String(deployment),
+		tracing.AttrNamespace.String(namespace))
+	defer func() { tracing.End(span, err) }()
+	deadline := time.Now().Add(deploymentWaitTimeout)
 	for {
-		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfigPath, "-n", namespace, "get", "deployment", deployment)
-		if out, err := cmd.CombinedOutput(); err == nil {
+		cmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfigPath, "-n", namespace, "get", "deployment", deployment)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
 			logger.Log("Deployment %s exists. Output: %s", deployment, string(out))
 			break
-		} else {
-			logger.Log("Waiting for deployment %s to exist...", deployment)
-			time.Sleep(5 * time.Second)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("deployment %s/%s did not appear within %s", namespace, deployment, deploymentWaitTimeout)
+		}
+		logger.Log("Waiting for deployment %s to exist...", deployment)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
 		}
 	}
-	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfigPath, "-n", namespace, "rollout", "status", "deployment/"+deployment, "--timeout=120s")
+	cmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfigPath, "-n", namespace, "rollout", "status", "deployment/"+deployment, "--timeout=120s")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		logger.LogErr("Waiting for deployment %s failed: %v\nOutput: %s", deployment, err, string(out))
-	} else {
-		logger.Log("Deployment %s is ready. Output: %s", deployment, string(out))
+		return fmt.Errorf("rollout of deployment %s/%s: %w", namespace, deployment, err)
 	}
+	logger.Log("Deployment %s is ready. Output: %s", deployment, string(out))
+	return nil
 }
 
 func ForEachWorker(workers []types.Worker, fn func(*types.Worker) error) error {
@@ -48,9 +71,9 @@ func ForEachWorker(workers []types.Worker, fn func(*types.Worker) error) error {
 	return nil
 }
 
-func EnsureNamespace(kubeconfigPath, namespace string, logger *utils.Logger) {
+func EnsureNamespace(ctx context.Context, kubeconfigPath, namespace string, logger *utils.Logger) {
 	if namespace != "default" && namespace != "kube-system" {
-		cmd := exec.Command("kubectl", "--kubeconfig", kubeconfigPath, "create", "namespace", namespace)
+		cmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfigPath, "create", "namespace", namespace)
 		_ = cmd.Run()
 		logger.Log("Ensured namespace %s exists", namespace)
 	}
@@ -63,9 +86,12 @@ func BuildSubstitutions(pairs ...string) map[string]string {
 	}
 	return subs
 }
-func ResolveYamlPath(filename string) string {
-	if utils.YamlsPath != "" {
-		return path.Join(utils.YamlsPath, filename)
+
+// ResolveYamlPath returns the path of a built-in addon YAML: below the YamlsPath option of ctx if
+// set, otherwise in ./yamls or ~/.k3sd/yamls.
+func ResolveYamlPath(ctx context.Context, filename string) string {
+	if yamlsPath := utils.OptionsFrom(ctx).YamlsPath; yamlsPath != "" {
+		return path.Join(yamlsPath, filename)
 	}
 	if _, err := os.Stat("yamls/" + filename); err == nil {
 		return "yamls/" + filename
@@ -80,12 +106,12 @@ func ResolveYamlPath(filename string) string {
 	return filename
 }
 
-func RenameKubeconfigContext(kubeconfigPath, oldContext, newContext string, logger *utils.Logger) {
+func RenameKubeconfigContext(ctx context.Context, kubeconfigPath, oldContext, newContext string, logger *utils.Logger) {
 	if oldContext == "" || newContext == "" || oldContext == newContext {
 		return
 	}
-	cmd := exec.Command("kubectl", "config", "--kubeconfig", kubeconfigPath, "rename-context", oldContext, newContext)
+	cmd := utils.ExecCommand(ctx, "kubectl", "config", "--kubeconfig", kubeconfigPath, "rename-context", oldContext, newContext)
 	if out, err := cmd.CombinedOutput(); err != nil {
-		logger.Log("Failed to rename kubeconfig context: %v, output: %s", err, string(out))
+		logger.Warn("Failed to rename kubeconfig context: %v, output: %s", err, string(out))
 	}
 }
@@ -0,0 +1,175 @@
+package clusterutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// NodeInfo describes a node as reported by the Kubernetes API.
+//
+// Fields:
+//   - Name: Node name.
+//   - Version: Kubelet (k3s) version running on the node.
+//   - Ready: Whether the node's Ready condition is True.
+//   - Labels: Labels currently set on the node.
+type NodeInfo struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version"`
+	Ready   bool              `json:"ready"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// DeploymentInfo describes the rollout state of a deployment.
+//
+// Fields:
+//   - Name: Deployment name.
+//   - Namespace: Deployment namespace.
+//   - Desired: Number of desired replicas.
+//   - Ready: Number of ready replicas.
+type DeploymentInfo struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Desired   int    `json:"desired"`
+	Ready     int    `json:"ready"`
+}
+
+// KubectlJSON runs a kubectl command with -o json against the given kubeconfig and decodes its output.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	kubeconfigPath: Path to the kubeconfig file.
+//	out: Value to decode the JSON output into.
+//	args: kubectl arguments (without --kubeconfig and -o json).
+//
+// Returns:
+//
+//	Error if kubectl fails or its output cannot be decoded.
+func KubectlJSON(ctx context.Context, kubeconfigPath string, out interface{}, args ...string) error {
+	cmdArgs := append([]string{"--kubeconfig", kubeconfigPath, "--request-timeout=15s"}, args...)
+	cmdArgs = append(cmdArgs, "-o", "json")
+	cmd := utils.ExecCommand(ctx, "kubectl", cmdArgs...)
+	data, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("kubectl %s: %w%s", strings.Join(args, " "), err, exitErrorOutput(err))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decode kubectl %s output: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// CheckAPIReachable checks that the Kubernetes API server behind the kubeconfig is reachable and ready.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	kubeconfigPath: Path to the kubeconfig file.
+//
+// Returns:
+//
+//	Error if the API server does not answer its readiness endpoint.
+func CheckAPIReachable(ctx context.Context, kubeconfigPath string) error {
+	cmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfigPath, "--request-timeout=10s", "get", "--raw", "/readyz")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// GetNodes lists the nodes of the cluster behind the kubeconfig.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	kubeconfigPath: Path to the kubeconfig file.
+//
+// Returns:
+//
+//	Nodes and error if they cannot be listed.
+func GetNodes(ctx context.Context, kubeconfigPath string) ([]NodeInfo, error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Status struct {
+				NodeInfo struct {
+					KubeletVersion string `json:"kubeletVersion"`
+				} `json:"nodeInfo"`
+				Conditions []struct {
+					Type   string `json:"type"`
+					Status string `json:"status"`
+				} `json:"conditions"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := KubectlJSON(ctx, kubeconfigPath, &list, "get", "nodes"); err != nil {
+		return nil, err
+	}
+	nodes := make([]NodeInfo, 0, len(list.Items))
+	for _, item := range list.Items {
+		node := NodeInfo{
+			Name:    item.Metadata.Name,
+			Version: item.Status.NodeInfo.KubeletVersion,
+			Labels:  item.Metadata.Labels,
+		}
+		for _, cond := range item.Status.Conditions {
+			if cond.Type == "Ready" {
+				node.Ready = cond.Status == "True"
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// GetDeployment returns the rollout state of a deployment.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	kubeconfigPath: Path to the kubeconfig file.
+//	name: Deployment name.
+//	namespace: Deployment namespace.
+//
+// Returns:
+//
+//	Deployment state and error if the deployment cannot be read (e.g. it does not exist).
+func GetDeployment(ctx context.Context, kubeconfigPath, name, namespace string) (*DeploymentInfo, error) {
+	var deployment struct {
+		Spec struct {
+			Replicas *int `json:"replicas"`
+		} `json:"spec"`
+		Status struct {
+			ReadyReplicas int `json:"readyReplicas"`
+		} `json:"status"`
+	}
+	if err := KubectlJSON(ctx, kubeconfigPath, &deployment, "-n", namespace, "get", "deployment", name); err != nil {
+		return nil, err
+	}
+	desired := 1
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	return &DeploymentInfo{
+		Name:      name,
+		Namespace: namespace,
+		Desired:   desired,
+		Ready:     deployment.Status.ReadyReplicas,
+	}, nil
+}
+
+func exitErrorOutput(err error) string {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return ": " + strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ""
+}
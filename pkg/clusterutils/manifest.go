@@ -2,6 +2,7 @@ package clusterutils
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"path"
 	"strings"
 
+	"github.com/argon-chat/k3sd/pkg/tracing"
 	"github.com/argon-chat/k3sd/pkg/types"
 	"github.com/argon-chat/k3sd/pkg/utils"
 )
@@ -28,40 +30,65 @@ func KubeConfigPath(cluster *types.Cluster, logger *utils.Logger) string {
 	return path.Join("./kubeconfigs", logger.Id, fmt.Sprintf("%s.yaml", cluster.NodeName))
 }
 
-func PipeAndLog(cmd *exec.Cmd, logger *utils.Logger) {
+// PipeAndLog runs cmd and streams its stdout and stderr to the logger.
+func PipeAndLog(cmd *exec.Cmd, logger *utils.Logger) error {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
-	_ = cmd.Start()
-	go StreamOutput(stdout, false, logger)
-	go StreamOutput(stderr, true, logger)
-	_ = cmd.Wait()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{}, 2)
+	go func() { StreamOutput(stdout, false, logger); done <- struct{}{} }()
+	go func() { StreamOutput(stderr, true, logger); done <- struct{}{} }()
+	<-done
+	<-done
+	return cmd.Wait()
 }
 
-func PipeAndApply(cmd *exec.Cmd, kubeconfig string, logger *utils.Logger) {
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
-	_ = cmd.Start()
-
-	var yaml strings.Builder
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		yaml.WriteString(scanner.Text() + "\n")
+// PipeAndApply runs cmd and applies the manifests it prints with 'kubectl apply -f -'.
+func PipeAndApply(ctx context.Context, cmd *exec.Cmd, kubeconfig string, logger *utils.Logger) error {
+	yaml, err := captureOutput(cmd, logger)
+	if err != nil {
+		logger.LogErr("%s failed: %v", cmd.String(), err)
+		return fmt.Errorf("%s: %w", cmd.String(), err)
 	}
-	go StreamOutput(stderr, true, logger)
-	_ = cmd.Wait()
 
-	apply := exec.Command("kubectl", "--kubeconfig", kubeconfig, "apply", "-f", "-")
-	apply.Stdin = strings.NewReader(yaml.String())
+	apply := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfig, "apply", "-f", "-")
+	apply.Stdin = strings.NewReader(yaml)
 	out, err := apply.CombinedOutput()
 	if err != nil {
 		commandExecStr := cmd.String()
 		logger.LogErr("apply failed: %v\n%s\n%s yielded no result", err, string(out), commandExecStr)
-		return
+		return fmt.Errorf("apply output of %s: %w", commandExecStr, err)
 	}
 	logger.Log("Apply output:\n%s", string(out))
+	return nil
 }
 
-func LabelNode(kubeconfigPath, nodeName string, labels string, logger *utils.Logger) error {
+// captureOutput runs cmd, returning its stdout and streaming its stderr to the logger.
+func captureOutput(cmd *exec.Cmd, logger *utils.Logger) (string, error) {
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	streamed := make(chan struct{})
+	go func() {
+		StreamOutput(stderr, true, logger)
+		close(streamed)
+	}()
+
+	var yaml strings.Builder
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		yaml.WriteString(scanner.Text() + "\n")
+	}
+	<-streamed
+	return yaml.String(), cmd.Wait()
+}
+
+func LabelNode(ctx context.Context, kubeconfigPath, nodeName string, labels string, logger *utils.Logger) error {
 	if labels == "" {
 		logger.Log("No labels provided for node %s", nodeName)
 		return nil
@@ -72,25 +99,33 @@ func LabelNode(kubeconfigPath, nodeName string, labels string, logger *utils.Log
 			labelArgs = append(labelArgs, label)
 		}
 	}
-	cmd := exec.Command("kubectl", append([]string{"--kubeconfig", kubeconfigPath}, labelArgs...)...)
+	labelArgs = append(labelArgs, "--overwrite")
+	cmd := utils.ExecCommand(ctx, "kubectl", append([]string{"--kubeconfig", kubeconfigPath}, labelArgs...)...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		logger.Log("Failed to label node %s: %v\nOutput: %s", nodeName, err, string(out))
+		logger.Warn("Failed to label node %s: %v\nOutput: %s", nodeName, err, string(out))
 		return err
 	}
 	logger.Log("Labeled node %s successfully. Output: %s", nodeName, string(out))
 	return nil
 }
 
-func GetManifestData(manifestPathOrURL string) ([]byte, error) {
+func GetManifestData(ctx context.Context, manifestPathOrURL string) ([]byte, error) {
 	if strings.HasPrefix(manifestPathOrURL, "http://") || strings.HasPrefix(manifestPathOrURL, "https://") {
-		resp, err := http.Get(manifestPathOrURL)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestPathOrURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return nil, err
 		}
 		defer func() {
 			_ = resp.Body.Close()
 		}()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("download %s: %s", manifestPathOrURL, resp.Status)
+		}
 		return io.ReadAll(resp.Body)
 	}
 	return os.ReadFile(manifestPathOrURL)
@@ -130,30 +165,44 @@ func SplitYAMLDocs(data []byte) []string {
 	}
 	return docs
 }
-func ApplyYAMLManifest(kubeconfigPath, manifestPathOrURL string, logger *utils.Logger, substitutions map[string]string) error {
-	data, err := GetManifestData(manifestPathOrURL)
+func ApplyYAMLManifest(ctx context.Context, kubeconfigPath, manifestPathOrURL string, logger *utils.Logger, substitutions map[string]string) (err error) {
+	ctx, span := tracing.Start(ctx, "ApplyYAMLManifest", tracing.AttrManifest.String(manifestPathOrURL))
+	defer func() { tracing.End(span, err) }()
+	manifestPath, cleanup, err := writeTempManifest(ctx, manifestPathOrURL, substitutions, logger)
 	if err != nil {
-		logger.LogErr("Failed to read manifest from %s: %v\n", manifestPathOrURL, err)
 		return err
 	}
+	defer cleanup()
+	return applyManifestWithKubectl(ctx, kubeconfigPath, manifestPath, logger)
+}
+
+// writeTempManifest reads a manifest, applies substitutions and writes it to a temporary file.
+// The returned cleanup function closes and removes the file.
+func writeTempManifest(ctx context.Context, manifestPathOrURL string, substitutions map[string]string, logger *utils.Logger) (string, func(), error) {
+	data, err := GetManifestData(ctx, manifestPathOrURL)
+	if err != nil {
+		logger.LogErr("Failed to read manifest from %s: %v\n", manifestPathOrURL, err)
+		return "", nil, err
+	}
 	data = ApplySubstitutions(data, substitutions)
 	tmpFile, err := os.CreateTemp("", "k3sd-manifest-*.yaml")
 	if err != nil {
 		logger.LogErr("Failed to create temp file for manifest: %v", err)
-		return err
+		return "", nil, err
 	}
-	defer func() {
+	cleanup := func() {
 		if err := tmpFile.Close(); err != nil {
 			logger.LogErr("Failed to close temp manifest file: %v", err)
 		}
 		if err := os.Remove(tmpFile.Name()); err != nil {
 			logger.LogErr("Failed to remove temp manifest file: %v", err)
 		}
-	}()
+	}
 	if err := writeManifestData(tmpFile, data, logger); err != nil {
-		return err
+		cleanup()
+		return "", nil, err
 	}
-	return applyManifestWithKubectl(kubeconfigPath, tmpFile.Name(), logger)
+	return tmpFile.Name(), cleanup, nil
 }
 
 func writeManifestData(tmpFile *os.File, data []byte, logger *utils.Logger) error {
@@ -168,8 +217,8 @@ func writeManifestData(tmpFile *os.File, data []byte, logger *utils.Logger) erro
 	return nil
 }
 
-func applyManifestWithKubectl(kubeconfigPath, manifestPath string, logger *utils.Logger) error {
-	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfigPath, "apply", "-f", manifestPath)
+func applyManifestWithKubectl(ctx context.Context, kubeconfigPath, manifestPath string, logger *utils.Logger) error {
+	cmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfigPath, "apply", "-f", manifestPath)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		logger.LogErr("kubectl apply failed: %v\nOutput: %s", err, string(out))
@@ -181,43 +230,23 @@ func applyManifestWithKubectl(kubeconfigPath, manifestPath string, logger *utils
 
 // DeleteComponentYAML deletes a YAML manifest for a given component from the cluster.
 // It logs the operation and any errors encountered.
-func DeleteComponentYAML(component, kubeconfigPath, manifest string, logger *utils.Logger, substitutions map[string]string) {
+func DeleteComponentYAML(ctx context.Context, component, kubeconfigPath, manifest string, logger *utils.Logger, substitutions map[string]string) error {
 	logger.Log("Deleting %s...", component)
-	if err := DeleteYAMLManifest(kubeconfigPath, manifest, logger, substitutions); err != nil {
+	if err := DeleteYAMLManifest(ctx, kubeconfigPath, manifest, logger, substitutions); err != nil {
 		logger.Log("%s delete error: %v", component, err)
+		return fmt.Errorf("delete %s: %w", component, err)
 	}
+	return nil
 }
 
 // DeleteYAMLManifest deletes the resources defined in a manifest from the cluster using kubectl delete -f.
-func DeleteYAMLManifest(kubeconfigPath, manifestPathOrURL string, logger *utils.Logger, substitutions map[string]string) error {
-	data, err := GetManifestData(manifestPathOrURL)
-	if err != nil {
-		logger.LogErr("Failed to read manifest from %s: %v\n", manifestPathOrURL, err)
-		return err
-	}
-	data = ApplySubstitutions(data, substitutions)
-	tmpFile, err := os.CreateTemp("", "k3sd-manifest-*.yaml")
+func DeleteYAMLManifest(ctx context.Context, kubeconfigPath, manifestPathOrURL string, logger *utils.Logger, substitutions map[string]string) error {
+	manifestPath, cleanup, err := writeTempManifest(ctx, manifestPathOrURL, substitutions, logger)
 	if err != nil {
-		logger.LogErr("Failed to create temp file for manifest: %v", err)
 		return err
 	}
-	defer func() {
-		if err := tmpFile.Close(); err != nil {
-			logger.LogErr("Failed to close temp manifest file: %v", err)
-		}
-		if err := os.Remove(tmpFile.Name()); err != nil {
-			logger.LogErr("Failed to remove temp manifest file: %v", err)
-		}
-	}()
-	if _, err := tmpFile.Write(data); err != nil {
-		logger.LogErr("Failed to write manifest to temp file: %v", err)
-		return err
-	}
-	if err := tmpFile.Sync(); err != nil {
-		logger.LogErr("Failed to sync temp manifest file: %v", err)
-		return err
-	}
-	cmd := exec.Command("kubectl", "--kubeconfig", kubeconfigPath, "delete", "-f", tmpFile.Name())
+	defer cleanup()
+	cmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfigPath, "delete", "-f", manifestPath)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		logger.LogErr("kubectl delete failed: %v\nOutput: %s", err, string(out))
@@ -227,27 +256,53 @@ func DeleteYAMLManifest(kubeconfigPath, manifestPathOrURL string, logger *utils.
 	return nil
 }
 
+// DiffYAMLManifest compares the resources defined in a manifest with the live cluster using kubectl diff.
+//
+// Parameters:
+//
+//	ctx: Context of the operation.
+//	kubeconfigPath: Path to the kubeconfig file.
+//	manifestPathOrURL: Path or URL of the manifest.
+//	logger: Logger for output.
+//	substitutions: Map of string substitutions to apply to the manifest.
+//
+// Returns:
+//
+//	The diff (empty if the live objects match the manifest) and error if the diff cannot be computed.
+func DiffYAMLManifest(ctx context.Context, kubeconfigPath, manifestPathOrURL string, logger *utils.Logger, substitutions map[string]string) (string, error) {
+	manifestPath, cleanup, err := writeTempManifest(ctx, manifestPathOrURL, substitutions, logger)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	cmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfigPath, "diff", "-f", manifestPath)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return "", nil
+	}
+	// kubectl diff exits with 1 when differences were found and >1 when it failed.
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return string(out), nil
+	}
+	return "", fmt.Errorf("kubectl diff failed: %w\nOutput: %s", err, string(out))
+}
+
 // PipeAndDelete pipes the output of a command to 'kubectl delete -f -' using the given kubeconfig.
 // Used for uninstalling resources generated by CLI tools like linkerd.
-func PipeAndDelete(cmd *exec.Cmd, kubeconfig string, logger *utils.Logger) {
-	stdout, _ := cmd.StdoutPipe()
-	stderr, _ := cmd.StderrPipe()
-	_ = cmd.Start()
-
-	var yaml strings.Builder
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		yaml.WriteString(scanner.Text() + "\n")
+func PipeAndDelete(ctx context.Context, cmd *exec.Cmd, kubeconfig string, logger *utils.Logger) error {
+	yaml, err := captureOutput(cmd, logger)
+	if err != nil {
+		logger.LogErr("%s failed: %v", cmd.String(), err)
+		return fmt.Errorf("%s: %w", cmd.String(), err)
 	}
-	go StreamOutput(stderr, true, logger)
-	_ = cmd.Wait()
 
-	deleteCmd := exec.Command("kubectl", "--kubeconfig", kubeconfig, "delete", "-f", "-")
-	deleteCmd.Stdin = strings.NewReader(yaml.String())
+	deleteCmd := utils.ExecCommand(ctx, "kubectl", "--kubeconfig", kubeconfig, "delete", "-f", "-")
+	deleteCmd.Stdin = strings.NewReader(yaml)
 	out, err := deleteCmd.CombinedOutput()
 	if err != nil {
 		logger.LogErr("delete failed: %v\n%s", err, string(out))
-		return
+		return fmt.Errorf("delete output of %s: %w", cmd.String(), err)
 	}
 	logger.Log("Delete output:\n%s", string(out))
+	return nil
 }
@@ -3,14 +3,21 @@ package clusterutils
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/argon-chat/k3sd/pkg/tracing"
 	"github.com/argon-chat/k3sd/pkg/utils"
 	"golang.org/x/crypto/ssh"
 )
@@ -19,6 +26,7 @@ import (
 //
 // Parameters:
 //
+//	ctx: Context bounding the connection attempt.
 //	userName: SSH username.
 //	password: SSH password (optional if key is available).
 //	host: Hostname or IP address.
@@ -26,7 +34,7 @@ import (
 // Returns:
 //
 //	SSH client and error if connection fails.
-func SSHConnect(userName, password, host string) (*ssh.Client, error) {
+func SSHConnect(ctx context.Context, userName, password, host string) (*ssh.Client, error) {
 	var authMethods []ssh.AuthMethod
 
 	usr, err := user.Current()
@@ -59,22 +67,38 @@ func SSHConnect(userName, password, host string) (*ssh.Client, error) {
 	}
 
 	if len(authMethods) == 0 {
-		return nil, fmt.Errorf("no usable SSH authentication methods found")
+		return nil, &utils.ConfigError{Source: "node " + host, Err: errors.New("no password and no usable SSH key found")}
 	}
 
 	cfg := &ssh.ClientConfig{
 		User:            userName,
 		Auth:            authMethods,
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         sshConnectTimeout,
 	}
 
-	return ssh.Dial("tcp", host+":22", cfg)
+	addr := net.JoinHostPort(host, "22")
+	dialer := net.Dialer{Timeout: sshConnectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, &utils.ConnectionError{Host: host, Err: err}
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, &utils.ConnectionError{Host: host, Err: err}
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
+// sshConnectTimeout bounds establishing an SSH connection, including the handshake.
+const sshConnectTimeout = 30 * time.Second
+
 // ExecuteCommands runs a list of shell commands on the remote host via SSH.
 //
 // Parameters:
 //
+//	ctx: Context of the operation; cancelling it aborts the running command.
 //	client: SSH client.
 //	commands: List of shell commands to execute.
 //	password: Password for sudo commands (optional).
@@ -83,16 +107,23 @@ func SSHConnect(userName, password, host string) (*ssh.Client, error) {
 // Returns:
 //
 //	Error if any command fails.
-func ExecuteCommands(client *ssh.Client, commands []string, password string, logger *utils.Logger) error {
+func ExecuteCommands(ctx context.Context, client *ssh.Client, commands []string, password string, logger *utils.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "ExecuteCommands")
+	defer func() { tracing.End(span, err) }()
 	for _, cmd := range commands {
-		if err := runCommandWithSudoPassword(client, cmd, password, logger); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := runCommandWithSudoPassword(ctx, client, cmd, password, logger); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func runCommandWithSudoPassword(client *ssh.Client, cmd string, password string, logger *utils.Logger) error {
+func runCommandWithSudoPassword(ctx context.Context, client *ssh.Client, cmd string, password string, logger *utils.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "ssh.command", tracing.AttrCommand.String(utils.Redact(cmd)))
+	defer func() { tracing.End(span, err) }()
 	session, err := client.NewSession()
 	utils.LogIfError(logger, err, "failed to create session: %v")
 	if err != nil {
@@ -108,6 +139,7 @@ func runCommandWithSudoPassword(client *ssh.Client, cmd string, password string,
 	go StreamOutput(stderr, true, logger)
 
 	logger.LogCmd("%s", cmd)
+	utils.RecordCommand(ctx, cmd)
 
 	words := strings.Fields(cmd)
 	hasSudo := false
@@ -122,14 +154,36 @@ func runCommandWithSudoPassword(client *ssh.Client, cmd string, password string,
 	}
 	if hasSudo {
 		cmd = strings.Join(words, " ")
-		if err := session.Start(cmd); err != nil {
-			return err
-		}
+	}
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+	if hasSudo {
 		fmt.Fprintln(stdin, password)
-		return session.Wait()
-	} else {
-		return session.Run(cmd)
 	}
+	return waitSession(ctx, session)
+}
+
+// remoteAbortGrace is how long a remote command may take to exit after it was sent SIGTERM.
+const remoteAbortGrace = 10 * time.Second
+
+// waitSession waits for the remote command to exit. If ctx is cancelled first, the command is
+// sent SIGTERM and given remoteAbortGrace to exit before the session is closed.
+func waitSession(ctx context.Context, session *ssh.Session) error {
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	_ = session.Signal(ssh.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(remoteAbortGrace):
+	}
+	_ = session.Close()
+	return ctx.Err()
 }
 
 func closeSSHSession(session *ssh.Session, logger *utils.Logger) {
@@ -153,6 +207,7 @@ func StreamOutput(r io.Reader, isErr bool, logger *utils.Logger) {
 //
 // Parameters:
 //
+//	ctx: Context of the operation; cancelling it aborts the script.
 //	client: SSH client.
 //	script: Shell script to execute.
 //	logger: Logger for output.
@@ -160,7 +215,9 @@ func StreamOutput(r io.Reader, isErr bool, logger *utils.Logger) {
 // Returns:
 //
 //	Output string and error if execution fails.
-func ExecuteRemoteScript(client *ssh.Client, script string, logger *utils.Logger) (string, error) {
+func ExecuteRemoteScript(ctx context.Context, client *ssh.Client, script string, logger *utils.Logger) (output string, err error) {
+	ctx, span := tracing.Start(ctx, "ssh.script", tracing.AttrCommand.String(utils.Redact(script)))
+	defer func() { tracing.End(span, err) }()
 	session, err := client.NewSession()
 	utils.LogIfError(logger, err, "failed to create session: %v")
 	if err != nil {
@@ -174,8 +231,12 @@ func ExecuteRemoteScript(client *ssh.Client, script string, logger *utils.Logger
 
 	command := buildBashCommand(script)
 	logger.LogCmd("%s", command)
-	if err := session.Run(command); err != nil {
-		return "", fmt.Errorf("error executing script: %v, stderr: %s", err, stderr.String())
+	utils.RecordCommand(ctx, command)
+	if err := session.Start(command); err != nil {
+		return "", fmt.Errorf("error executing script: %v", err)
+	}
+	if err := waitSession(ctx, session); err != nil {
+		return "", fmt.Errorf("error executing script: %w, stderr: %s", err, stderr.String())
 	}
 
 	return stdout.String(), nil
@@ -184,3 +245,99 @@ func ExecuteRemoteScript(client *ssh.Client, script string, logger *utils.Logger
 func buildBashCommand(script string) string {
 	return fmt.Sprintf("bash -c '%s'", script)
 }
+
+// RunScript runs a shell script with bash on a remote host, with the given environment
+// variables, and returns its combined stdout and stderr. Unlike ExecuteRemoteScript, the script
+// may contain any quotes.
+//
+// Parameters:
+//
+//	ctx: Context of the operation; cancelling it aborts the script.
+//	client: SSH client.
+//	script: Shell script to execute.
+//	env: Environment variables exported before the script runs.
+//	sudo: Run the script as root; password is passed to sudo on stdin.
+//	password: Password of the SSH user for sudo.
+//	jump: "user@host" to run the script on through ssh from the client's host, or "" to run
+//	it on the client's host itself.
+//	logger: Logger for output.
+//
+// Returns:
+//
+//	Combined output and error if the script fails.
+func RunScript(ctx context.Context, client *ssh.Client, script string, env map[string]string, sudo bool, password, jump string, logger *utils.Logger) (output string, err error) {
+	ctx, span := tracing.Start(ctx, "ssh.script", tracing.AttrCommand.String(utils.Redact(script)))
+	defer func() { tracing.End(span, err) }()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %v", err)
+	}
+	defer closeSSHSession(session, logger)
+
+	var combined lockedBuffer
+	session.Stdout = &combined
+	session.Stderr = &combined
+	if sudo {
+		session.Stdin = strings.NewReader(password + "\n")
+	}
+
+	command := "bash -c " + ShellQuote(exportEnv(env)+script)
+	if sudo {
+		command = "sudo -S -p '' " + command
+	}
+	if jump != "" {
+		command = "ssh " + jump + " " + ShellQuote(command)
+	}
+	logger.LogCmd("%s", command)
+	utils.RecordCommand(ctx, command)
+	if err := session.Start(command); err != nil {
+		return "", err
+	}
+	err = waitSession(ctx, session)
+	return combined.String(), err
+}
+
+// ShellQuote quotes a string as a single POSIX shell word.
+//
+// Parameters:
+//
+//	s: The string.
+//
+// Returns:
+//
+//	The quoted string.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// exportEnv returns shell statements exporting the variables, in a stable order.
+func exportEnv(env map[string]string) string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "export %s=%s\n", key, ShellQuote(env[key]))
+	}
+	return b.String()
+}
+
+// lockedBuffer is a bytes.Buffer safe for the concurrent writes of a session's stdout and stderr.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
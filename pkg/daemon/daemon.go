@@ -0,0 +1,445 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/clusterstore"
+	"github.com/argon-chat/k3sd/pkg/drift"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/lock"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Options configures the reconcile daemon.
+//
+// Fields:
+//   - ConfigPath: Path to a cluster config file or a directory of config files.
+//   - Environment: Environment of the configs composed of environments.
+//   - Listen: Address of the local HTTP endpoint serving health and status.
+//   - WatchInterval: How often config files are checked for changes.
+//   - DriftInterval: How often the live clusters are checked for drift.
+//   - MinApplyInterval: Minimum time between two applies or reconciles of the same cluster.
+//   - Selector: Restricts the daemon to specific clusters, nodes and addons.
+type Options struct {
+	ConfigPath       string
+	Environment      string
+	Listen           string
+	WatchInterval    time.Duration
+	DriftInterval    time.Duration
+	MinApplyInterval time.Duration
+	Selector         utils.Selector
+}
+
+// ClusterState is the daemon's view of a single cluster.
+//
+// Fields:
+//   - Config: Config file the cluster is defined in.
+//   - LastApply: Time the cluster config was last applied or drift reconciled.
+//   - LastDriftCheck: Time drift was last checked.
+//   - DriftItems: Number of drift items found by the last check.
+//   - LastResult: Outcome of the last action on the cluster.
+//   - LastError: Error of the last action, if it failed.
+type ClusterState struct {
+	Config         string     `json:"config"`
+	LastApply      *time.Time `json:"lastApply,omitempty"`
+	LastDriftCheck *time.Time `json:"lastDriftCheck,omitempty"`
+	DriftItems     int        `json:"driftItems"`
+	LastResult     string     `json:"lastResult"`
+	LastError      string     `json:"lastError,omitempty"`
+}
+
+// Status is the daemon status served over HTTP.
+//
+// Fields:
+//   - StartedAt: Time the daemon started.
+//   - LastLoop: Time the event loop last finished an iteration.
+//   - Busy: Whether an apply or reconcile is in progress.
+//   - PendingConfigs: Changed config files that have not been applied yet.
+//   - ConfigErrors: Config files that could not be loaded, with their error.
+//   - Clusters: Per-cluster state keyed by cluster name.
+type Status struct {
+	StartedAt      time.Time                `json:"startedAt"`
+	LastLoop       time.Time                `json:"lastLoop"`
+	Busy           bool                     `json:"busy"`
+	PendingConfigs []string                 `json:"pendingConfigs,omitempty"`
+	ConfigErrors   map[string]string        `json:"configErrors,omitempty"`
+	Clusters       map[string]*ClusterState `json:"clusters"`
+}
+
+// Daemon watches cluster configs, applies changes and reconciles drift until it is cancelled.
+type Daemon struct {
+	opts   Options
+	engine *k3sd.Engine
+	logger *utils.Logger
+
+	// reconcileMu ensures only one apply or reconcile runs at a time.
+	reconcileMu sync.Mutex
+	trigger     chan struct{}
+
+	mu       sync.Mutex
+	status   Status
+	modTimes map[string]time.Time
+	pending  map[string]bool
+}
+
+// New creates a daemon with the given options.
+//
+// Parameters:
+//
+//	opts: Daemon options.
+//	engine: Engine running the applies and reconciles; its logger is used for output.
+//
+// Returns:
+//
+//	*Daemon: the daemon, ready to Run.
+func New(opts Options, engine *k3sd.Engine) *Daemon {
+	return &Daemon{
+		opts:     opts,
+		engine:   engine,
+		logger:   engine.Logger(),
+		trigger:  make(chan struct{}, 1),
+		modTimes: make(map[string]time.Time),
+		pending:  make(map[string]bool),
+		status: Status{
+			ConfigErrors: make(map[string]string),
+			Clusters:     make(map[string]*ClusterState),
+		},
+	}
+}
+
+// Run starts the HTTP endpoint and the event loop and blocks until ctx is cancelled.
+//
+// An apply or reconcile in progress when ctx is cancelled is allowed to finish; no new
+// action is started afterwards.
+//
+// Parameters:
+//
+//	ctx: Context whose cancellation stops the daemon.
+//
+// Returns:
+//
+//	Error if the HTTP endpoint fails.
+func (d *Daemon) Run(ctx context.Context) error {
+	d.mu.Lock()
+	d.status.StartedAt = time.Now()
+	d.status.LastLoop = d.status.StartedAt
+	d.mu.Unlock()
+
+	server := &http.Server{Addr: d.opts.Listen, Handler: d.handler()}
+	serverErr := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	d.logger.Log("k3sd daemon watching %s, status on http://%s", d.opts.ConfigPath, d.opts.Listen)
+
+	watchTicker := time.NewTicker(d.opts.WatchInterval)
+	defer watchTicker.Stop()
+	driftTicker := time.NewTicker(d.opts.DriftInterval)
+	defer driftTicker.Stop()
+
+	d.scanConfigs()
+	d.applyPending(ctx)
+	for {
+		d.markLoop()
+		select {
+		case <-ctx.Done():
+			d.logger.Log("k3sd daemon stopping")
+			return nil
+		case err := <-serverErr:
+			return fmt.Errorf("status endpoint: %w", err)
+		case <-watchTicker.C:
+			d.scanConfigs()
+			d.applyPending(ctx)
+		case <-driftTicker.C:
+			d.checkDrift(ctx)
+		case <-d.trigger:
+			d.checkDrift(ctx)
+		}
+	}
+}
+
+// scanConfigs marks config files whose modification time, or that of a file they include,
+// changed as pending.
+func (d *Daemon) scanConfigs() {
+	files, err := clusterstore.ListConfigFiles(d.opts.ConfigPath)
+	if err != nil {
+		d.logger.LogErr("error listing configs in %s: %v", d.opts.ConfigPath, err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, file := range files {
+		seen[file] = true
+		modTime, err := sourcesModTime(file)
+		if err != nil {
+			continue
+		}
+		if last, ok := d.modTimes[file]; !ok || !last.Equal(modTime) {
+			d.modTimes[file] = modTime
+			d.pending[file] = true
+		}
+	}
+	for file := range d.modTimes {
+		if !seen[file] {
+			delete(d.modTimes, file)
+			delete(d.pending, file)
+			delete(d.status.ConfigErrors, file)
+		}
+	}
+}
+
+// sourcesModTime returns the latest modification time of a config file and the files it
+// includes. Files included by a config that cannot be read are ignored; loading the config
+// reports them.
+func sourcesModTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := info.ModTime()
+	sources, _ := clusterstore.ConfigSources(file)
+	for _, source := range sources {
+		if info, err := os.Stat(source); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// applyPending applies every pending config file whose clusters are not rate limited.
+func (d *Daemon) applyPending(ctx context.Context) {
+	for _, file := range d.pendingFiles() {
+		if ctx.Err() != nil {
+			return
+		}
+		clusters, err := clusterstore.LoadEnvironment(file, d.opts.Environment)
+		if err != nil {
+			d.logger.LogErr("error loading %s: %v", file, err)
+			d.setConfigError(file, err)
+			d.clearPending(file)
+			continue
+		}
+		d.setConfigError(file, nil)
+		if name, limited := d.rateLimited(clusters); limited {
+			d.logger.Log("Postponing apply of %s: cluster %s was applied less than %s ago", file, name, d.opts.MinApplyInterval)
+			continue
+		}
+		d.apply(ctx, file, clusters)
+	}
+}
+
+// apply applies a config file. The apply is not interrupted when ctx is cancelled.
+func (d *Daemon) apply(ctx context.Context, file string, clusters []types.Cluster) {
+	d.setBusy(true)
+	d.reconcileMu.Lock()
+	defer func() {
+		d.reconcileMu.Unlock()
+		d.setBusy(false)
+	}()
+
+	// a config or cluster locked by another run stays pending and is retried on the next scan
+	held, stale, err := lock.File(file)
+	if err != nil {
+		d.logger.LogErr("not applying %s: %v", file, err)
+		return
+	}
+	defer held.Release()
+	if stale != nil {
+		d.logger.Warn("taking over stale lock on %s", stale)
+	}
+
+	d.logger.Log("Applying %s", file)
+	clusters, _, err = d.engine.Apply(context.WithoutCancel(ctx), clusters, d.opts.Selector)
+	var locked *lock.LockedError
+	if errors.As(err, &locked) {
+		d.logger.LogErr("not applying %s: %v", file, err)
+		return
+	}
+	if err != nil {
+		d.logger.LogErr("error applying %s: %v", file, err)
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// a failed apply stays pending and is retried on a later scan, once the rate limit allows
+	if err == nil {
+		delete(d.pending, file)
+	}
+	for ci := range clusters {
+		if !d.opts.Selector.MatchCluster(clusters[ci].Context) {
+			continue
+		}
+		state := d.clusterState(file, &clusters[ci])
+		state.LastApply = &now
+		state.LastResult = "config applied"
+		if err != nil {
+			state.LastResult = "config applied with errors"
+		}
+		state.LastError = ""
+		if err != nil {
+			state.LastError = err.Error()
+		}
+	}
+}
+
+// checkDrift checks every config's clusters for drift and reconciles those not rate limited.
+func (d *Daemon) checkDrift(ctx context.Context) {
+	files, err := clusterstore.ListConfigFiles(d.opts.ConfigPath)
+	if err != nil {
+		d.logger.LogErr("error listing configs in %s: %v", d.opts.ConfigPath, err)
+		return
+	}
+	for _, file := range files {
+		clusters, err := clusterstore.LoadEnvironment(file, d.opts.Environment)
+		if err != nil {
+			d.setConfigError(file, err)
+			continue
+		}
+		if err := d.engine.ResolveSecrets(ctx, clusters); err != nil {
+			d.logger.LogErr("error resolving the secrets of %s: %v", file, err)
+			d.setConfigError(file, err)
+			continue
+		}
+		for ci := range clusters {
+			if ctx.Err() != nil {
+				return
+			}
+			if !d.opts.Selector.MatchCluster(clusters[ci].Context) {
+				continue
+			}
+			d.reconcileCluster(ctx, file, clusters, ci)
+		}
+	}
+}
+
+// reconcileCluster checks a cluster for drift and reconciles it. The reconcile is not interrupted
+// when ctx is cancelled.
+func (d *Daemon) reconcileCluster(ctx context.Context, file string, clusters []types.Cluster, ci int) {
+	ctx = context.WithoutCancel(ctx)
+	d.setBusy(true)
+	d.reconcileMu.Lock()
+	defer func() {
+		d.reconcileMu.Unlock()
+		d.setBusy(false)
+	}()
+
+	target := &clusters[ci]
+	selector := d.opts.Selector
+	selector.Clusters = []string{target.Context}
+	items := d.engine.Drift(ctx, clusters, selector)
+	now := time.Now()
+
+	_, limited := d.rateLimited([]types.Cluster{*target})
+	reconciled := false
+	if len(items) > 0 && !limited {
+		d.logger.Log("Reconciling %d drift items on %s", len(items), target.DisplayName())
+		items = d.engine.Reconcile(ctx, items, clusters)
+		reconciled = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := d.clusterState(file, target)
+	state.LastDriftCheck = &now
+	state.DriftItems = len(items)
+	state.LastError = ""
+	switch {
+	case len(items) == 0:
+		state.LastResult = "no drift"
+	case reconciled:
+		state.LastApply = &now
+		state.LastResult = fmt.Sprintf("reconciled %d of %d drift items", len(items)-drift.Pending(items), len(items))
+		for _, item := range items {
+			if item.Error != "" {
+				state.LastError = item.Error
+			}
+		}
+	default:
+		state.LastResult = "drift detected, reconcile postponed by rate limit"
+	}
+}
+
+// rateLimited reports the first selected cluster applied less than MinApplyInterval ago.
+func (d *Daemon) rateLimited(clusters []types.Cluster) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ci := range clusters {
+		if !d.opts.Selector.MatchCluster(clusters[ci].Context) {
+			continue
+		}
+		name := clusters[ci].DisplayName()
+		state, ok := d.status.Clusters[name]
+		if ok && state.LastApply != nil && time.Since(*state.LastApply) < d.opts.MinApplyInterval {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// clusterState returns the state entry of a cluster, creating it if needed. d.mu must be held.
+func (d *Daemon) clusterState(file string, c *types.Cluster) *ClusterState {
+	name := c.DisplayName()
+	state, ok := d.status.Clusters[name]
+	if !ok {
+		state = &ClusterState{}
+		d.status.Clusters[name] = state
+	}
+	state.Config = file
+	return state
+}
+
+func (d *Daemon) pendingFiles() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := make([]string, 0, len(d.pending))
+	for file := range d.pending {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (d *Daemon) clearPending(file string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, file)
+}
+
+func (d *Daemon) setConfigError(file string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		delete(d.status.ConfigErrors, file)
+		return
+	}
+	d.status.ConfigErrors[file] = err.Error()
+}
+
+func (d *Daemon) setBusy(busy bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.Busy = busy
+}
+
+func (d *Daemon) markLoop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status.LastLoop = time.Now()
+}
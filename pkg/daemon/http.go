@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+func (d *Daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", d.handleHealth)
+	mux.HandleFunc("GET /status", d.handleStatus)
+	mux.HandleFunc("POST /reconcile", d.handleReconcile)
+	if m := d.engine.Metrics(); m != nil {
+		mux.Handle("GET /metrics", m.Handler())
+	}
+	return mux
+}
+
+// handleHealth reports whether the event loop is alive. The loop is considered stuck if it
+// has not completed an iteration for three watch intervals while no action is running.
+func (d *Daemon) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	status := d.Snapshot()
+	if !status.Busy && time.Since(status.LastLoop) > 3*d.opts.WatchInterval {
+		http.Error(w, "event loop stalled", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (d *Daemon) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(d.Snapshot())
+}
+
+// handleReconcile requests an immediate drift check. It is refused while an action is running.
+func (d *Daemon) handleReconcile(w http.ResponseWriter, _ *http.Request) {
+	if !d.reconcileMu.TryLock() {
+		http.Error(w, "a reconcile is already in progress", http.StatusConflict)
+		return
+	}
+	d.reconcileMu.Unlock()
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("reconcile scheduled\n"))
+}
+
+// Snapshot returns a copy of the daemon status.
+func (d *Daemon) Snapshot() Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := d.status
+	status.ConfigErrors = make(map[string]string, len(d.status.ConfigErrors))
+	for k, v := range d.status.ConfigErrors {
+		status.ConfigErrors[k] = v
+	}
+	status.Clusters = make(map[string]*ClusterState, len(d.status.Clusters))
+	for k, v := range d.status.Clusters {
+		state := *v
+		status.Clusters[k] = &state
+	}
+	status.PendingConfigs = nil
+	for file := range d.pending {
+		status.PendingConfigs = append(status.PendingConfigs, file)
+	}
+	return status
+}
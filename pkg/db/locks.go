@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrLockHeld is returned by AcquireLock when the lock is held by someone else.
+var ErrLockHeld = errors.New("lock is held")
+
+// Lock is an advisory lock row.
+//
+// Fields:
+//   - Key: Locked resource, e.g. "cluster/<address>/<node name>".
+//   - Token: Random token identifying the acquisition; only its holder refreshes or releases it.
+//   - Owner: User holding the lock.
+//   - Host: Host the holder runs on.
+//   - PID: Process ID of the holder.
+//   - AcquiredAt: Time the lock was acquired.
+//   - HeartbeatAt: Time the holder last refreshed the lock.
+type Lock struct {
+	Key         string    `gorm:"primaryKey" json:"key"`
+	Token       string    `json:"-"`
+	Owner       string    `json:"owner"`
+	Host        string    `json:"host"`
+	PID         int       `gorm:"column:pid" json:"pid"`
+	AcquiredAt  time.Time `json:"acquiredAt"`
+	HeartbeatAt time.Time `json:"heartbeatAt"`
+}
+
+// AcquireLock inserts a lock row. A row whose heartbeat is older than staleAfter is considered
+// abandoned and is replaced.
+//
+// Parameters:
+//   - ctx: Context of the queries.
+//   - lock: The lock to acquire; Key, Token, Owner, Host and PID must be set.
+//   - staleAfter: Age of the last heartbeat after which a lock is abandoned.
+//
+// Returns:
+//   - *Lock: The current holder with ErrLockHeld, the replaced stale lock, or nil if the lock was free.
+//   - error: ErrLockHeld if the lock is held, or the query error.
+func (s *Store) AcquireLock(ctx context.Context, lock *Lock, staleAfter time.Duration) (*Lock, error) {
+	now := time.Now()
+	lock.AcquiredAt = now
+	lock.HeartbeatAt = now
+	var stale *Lock
+	for attempt := 0; attempt < 3; attempt++ {
+		result := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(lock)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return stale, nil
+		}
+		var held Lock
+		err := s.db.WithContext(ctx).First(&held, "key = ?", lock.Key).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(held.HeartbeatAt) < staleAfter {
+			return &held, ErrLockHeld
+		}
+		// replace the stale lock unless its holder refreshed it in the meantime
+		err = s.db.WithContext(ctx).
+			Where("key = ? AND token = ? AND heartbeat_at = ?", held.Key, held.Token, held.HeartbeatAt).
+			Delete(&Lock{}).Error
+		if err != nil {
+			return nil, err
+		}
+		stale = &held
+	}
+	return nil, ErrLockHeld
+}
+
+// RefreshLock updates the heartbeat of a lock held with the given token.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - key: Locked resource.
+//   - token: Token of the acquisition.
+//
+// Returns:
+//   - error: Error if the query fails, or ErrLockHeld if the lock was taken over.
+func (s *Store) RefreshLock(ctx context.Context, key, token string) error {
+	result := s.db.WithContext(ctx).Model(&Lock{}).
+		Where("key = ? AND token = ?", key, token).
+		Update("heartbeat_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLockHeld
+	}
+	return nil
+}
+
+// ReleaseLock deletes a lock held with the given token. Releasing a lock that was taken over
+// is a no-op.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - key: Locked resource.
+//   - token: Token of the acquisition.
+//
+// Returns:
+//   - error: Error if the query fails.
+func (s *Store) ReleaseLock(ctx context.Context, key, token string) error {
+	return s.db.WithContext(ctx).Where("key = ? AND token = ?", key, token).Delete(&Lock{}).Error
+}
+
+// DeleteLocks deletes the locks on the given resources regardless of their holder.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - keys: Locked resources.
+//
+// Returns:
+//   - []Lock: The deleted locks.
+//   - error: Error if the query fails.
+func (s *Store) DeleteLocks(ctx context.Context, keys []string) ([]Lock, error) {
+	var locks []Lock
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if err := s.db.WithContext(ctx).Where("key IN ?", keys).Find(&locks).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.WithContext(ctx).Where("key IN ?", keys).Delete(&Lock{}).Error; err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
@@ -1,87 +1,120 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	_ "modernc.org/sqlite"
 
+	"github.com/argon-chat/k3sd/pkg/secrets"
 	"github.com/argon-chat/k3sd/pkg/types"
 )
 
-// DbCtx is the global GORM database context for k3sd.
-var DbCtx *gorm.DB
+// Store is the k3sd database holding the versioned cluster records and the install state of
+// their nodes.
+type Store struct {
+	db *gorm.DB
+}
 
-// OpenGormDB opens a GORM database connection to the specified path.
+// Open opens the k3sd database at the specified path.
 //
 // If the path is empty, it uses the default path from GetDBPath().
-// The function also auto-migrates the ClusterRecord schema.
+// The function also auto-migrates the ClusterRecord, NodeState and Lock schemas.
 //
 // Parameters:
 //   - path: Path to the SQLite database file.
 //
 // Returns:
-//   - *gorm.DB: The opened GORM database instance.
+//   - *Store: The opened database.
 //   - error: Error if opening or migrating fails.
-func OpenGormDB(path string) (*gorm.DB, error) {
-	if path == "" {
-		path = GetDBPath()
+func Open(path string) (*Store, error) {
+	path, err := GetDBPath(path)
+	if err != nil {
+		return nil, err
 	}
 	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
-	err = db.AutoMigrate(&ClusterRecord{})
+	err = db.AutoMigrate(&ClusterRecord{}, &NodeState{}, &Lock{})
 	if err != nil {
 		return nil, err
 	}
-	return db, nil
+	return &Store{db: db}, nil
+}
+
+// Close closes the database connection.
+//
+// Returns:
+//   - error: Error if closing fails.
+func (s *Store) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
 }
 
 // InsertCluster inserts a new cluster record into the database, incrementing the version.
+// The secret references resolver resolved in the cluster are recorded as the references, and
+// values decrypted from encrypted configs masked (see secrets.Resolver.Seal).
 //
 // Parameters:
+//   - ctx: Context of the query.
 //   - cluster: Pointer to the Cluster object to insert.
+//   - resolver: The resolver that resolved the secret references of the cluster; nil if they
+//     were not resolved.
 //
 // Returns:
 //   - int: The previous maximum version for the cluster.
 //   - error: Error if marshalling or database insertion fails.
-func InsertCluster(cluster *types.Cluster) (int, error) {
+func (s *Store) InsertCluster(ctx context.Context, cluster *types.Cluster, resolver *secrets.Resolver) (int, error) {
 	var maxVersion int
-	DbCtx.Model(&ClusterRecord{}).
+	err := s.db.WithContext(ctx).Model(&ClusterRecord{}).
 		Where("address = ? AND node_name = ?", cluster.Address, cluster.NodeName).
 		Select("COALESCE(MAX(version), 0)").
-		Scan(&maxVersion)
+		Scan(&maxVersion).Error
+	if err != nil {
+		return 0, err
+	}
 
 	b, err := json.Marshal(cluster)
 	if err != nil {
 		return 0, err
 	}
+	// record the secret references of the config instead of the values they were resolved to,
+	// and no value decrypted from an encrypted config
+	if b, err = resolver.Seal(secrets.ClusterKey(cluster), b, cluster.DecryptedFields()...); err != nil {
+		return 0, err
+	}
 	rec := &ClusterRecord{
 		Address:  cluster.Address,
 		NodeName: cluster.NodeName,
 		Version:  maxVersion + 1,
 		Cluster:  string(b),
 	}
-	return maxVersion, DbCtx.Create(rec).Error
+	return maxVersion, s.db.WithContext(ctx).Create(rec).Error
 }
 
 // GetClusterVersion retrieves a specific version of a cluster from the database.
 //
 // Parameters:
+//   - ctx: Context of the query.
 //   - cluster: Pointer to the Cluster object (address and node name used for lookup).
 //   - version: The version number to retrieve.
 //
 // Returns:
 //   - *types.Cluster: The cluster object for the specified version, or nil if not found.
 //   - error: Error if retrieval or unmarshalling fails.
-func GetClusterVersion(cluster *types.Cluster, version int) (*types.Cluster, error) {
+func (s *Store) GetClusterVersion(ctx context.Context, cluster *types.Cluster, version int) (*types.Cluster, error) {
 	if version < 1 {
 		return nil, nil
 	}
 	var record ClusterRecord
-	err := DbCtx.Where("address = ? AND node_name = ? AND version = ?", cluster.Address, cluster.NodeName, version).
+	err := s.db.WithContext(ctx).Where("address = ? AND node_name = ? AND version = ?", cluster.Address, cluster.NodeName, version).
 		First(&record).Error
 	if err != nil {
 		return nil, err
@@ -95,8 +128,75 @@ func GetClusterVersion(cluster *types.Cluster, version int) (*types.Cluster, err
 	return &result, nil
 }
 
-func DeleteClusterRecords(cluster *types.Cluster) error {
-	return DbCtx.Where("address = ? AND node_name = ?", cluster.Address, cluster.NodeName).Delete(&ClusterRecord{}).Error
+// GetLatestClusterVersion retrieves the most recently recorded version of a cluster from the database.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - cluster: Pointer to the Cluster object (address and node name used for lookup).
+//
+// Returns:
+//   - *types.Cluster: The latest recorded cluster object, or nil if the cluster was never recorded.
+//   - error: Error if retrieval or unmarshalling fails.
+func (s *Store) GetLatestClusterVersion(ctx context.Context, cluster *types.Cluster) (*types.Cluster, error) {
+	var maxVersion int
+	err := s.db.WithContext(ctx).Model(&ClusterRecord{}).
+		Where("address = ? AND node_name = ?", cluster.Address, cluster.NodeName).
+		Select("COALESCE(MAX(version), 0)").
+		Scan(&maxVersion).Error
+	if err != nil {
+		return nil, err
+	}
+	return s.GetClusterVersion(ctx, cluster, maxVersion)
+}
+
+// GetLatestClusterRecord retrieves the most recent database record of a cluster.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - cluster: Pointer to the Cluster object (address and node name used for lookup).
+//
+// Returns:
+//   - *ClusterRecord: The latest record, or nil if the cluster was never recorded.
+//   - error: Error if retrieval fails.
+func (s *Store) GetLatestClusterRecord(ctx context.Context, cluster *types.Cluster) (*ClusterRecord, error) {
+	var records []ClusterRecord
+	err := s.db.WithContext(ctx).Where("address = ? AND node_name = ?", cluster.Address, cluster.NodeName).
+		Order("version DESC").
+		Limit(1).
+		Find(&records).Error
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[0], nil
+}
+
+// ListClusterRecords retrieves all recorded versions of a cluster, newest first.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - cluster: Pointer to the Cluster object (address and node name used for lookup).
+//
+// Returns:
+//   - []ClusterRecord: The records of the cluster, empty if it was never recorded.
+//   - error: Error if retrieval fails.
+func (s *Store) ListClusterRecords(ctx context.Context, cluster *types.Cluster) ([]ClusterRecord, error) {
+	var records []ClusterRecord
+	err := s.db.WithContext(ctx).Where("address = ? AND node_name = ?", cluster.Address, cluster.NodeName).
+		Order("version DESC").
+		Find(&records).Error
+	return records, err
+}
+
+// DeleteClusterRecords deletes all recorded versions of a cluster.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - cluster: Pointer to the Cluster object (address and node name used for lookup).
+//
+// Returns:
+//   - error: Error if deletion fails.
+func (s *Store) DeleteClusterRecords(ctx context.Context, cluster *types.Cluster) error {
+	return s.db.WithContext(ctx).Where("address = ? AND node_name = ?", cluster.Address, cluster.NodeName).Delete(&ClusterRecord{}).Error
 }
 
 // ClusterRecord represents a versioned cluster record stored in the database.
@@ -107,26 +207,14 @@ func DeleteClusterRecords(cluster *types.Cluster) error {
 //   - NodeName: Node name (indexed).
 //   - Version: Version number (indexed).
 //   - Cluster: JSON-encoded cluster data.
+//   - CreatedAt: Time the version was recorded (nil for records created before it was tracked).
 type ClusterRecord struct {
-	ID       uint   `gorm:"primaryKey" json:"id"`
-	Address  string `gorm:"index:idx_address" json:"address"`
-	NodeName string `gorm:"index:idx_nodename" json:"node_name"`
-	Version  int    `gorm:"index:idx_version" json:"version"`
-	Cluster  string `gorm:"type:json" json:"cluster"`
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Address   string     `gorm:"index:idx_address" json:"address"`
+	NodeName  string     `gorm:"index:idx_nodename" json:"node_name"`
+	Version   int        `gorm:"index:idx_version" json:"version"`
+	Cluster   string     `gorm:"type:json" json:"cluster"`
+	CreatedAt *time.Time `gorm:"autoCreateTime" json:"created_at,omitempty"`
 }
 
 // TODO: create a function to retrieve the calculated latest cluster record for a given address and node name
-func deepMerge(dst, src map[string]interface{}) map[string]interface{} {
-	for k, v := range src {
-		if vMap, ok := v.(map[string]interface{}); ok {
-			if dstMap, ok := dst[k].(map[string]interface{}); ok {
-				dst[k] = deepMerge(dstMap, vMap)
-			} else {
-				dst[k] = deepMerge(make(map[string]interface{}), vMap)
-			}
-		} else {
-			dst[k] = v
-		}
-	}
-	return dst
-}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm/clause"
+
+	"github.com/argon-chat/k3sd/pkg/types"
+)
+
+// NodeState is the install state of a node of a cluster. The user's config only holds the
+// desired state of the clusters; whether their nodes were installed is kept here.
+//
+// Fields:
+//   - Address: Master address of the cluster the node belongs to.
+//   - ClusterNode: Master node name of the cluster the node belongs to.
+//   - NodeName: Name of the node; the master's for the master itself.
+//   - NodeAddress: Address of the node when its state was recorded.
+//   - Done: Whether k3s was installed on the master or the worker joined.
+//   - UpdatedAt: Time the state was last recorded.
+type NodeState struct {
+	Address     string    `gorm:"primaryKey" json:"address"`
+	ClusterNode string    `gorm:"primaryKey" json:"cluster_node"`
+	NodeName    string    `gorm:"primaryKey" json:"node_name"`
+	NodeAddress string    `json:"node_address"`
+	Done        bool      `json:"done"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// HasNodeStates reports whether the install state of any node of a cluster was recorded.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - cluster: Pointer to the Cluster object (address and node name used for lookup).
+//
+// Returns:
+//   - bool: True if a state of the cluster was recorded.
+//   - error: Error if the query fails.
+func (s *Store) HasNodeStates(ctx context.Context, cluster *types.Cluster) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Model(&NodeState{}).
+		Where("address = ? AND cluster_node = ?", cluster.Address, cluster.NodeName).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// LoadNodeStates sets the Done flags of the master and the workers of a cluster from their
+// recorded state. Nodes without a recorded state are not done.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - cluster: Pointer to the Cluster object whose flags are set.
+//
+// Returns:
+//   - error: Error if retrieval fails.
+func (s *Store) LoadNodeStates(ctx context.Context, cluster *types.Cluster) error {
+	var states []NodeState
+	err := s.db.WithContext(ctx).Where("address = ? AND cluster_node = ?", cluster.Address, cluster.NodeName).
+		Find(&states).Error
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool, len(states))
+	for _, state := range states {
+		done[state.NodeName] = state.Done
+	}
+	cluster.Done = done[cluster.NodeName]
+	for wi := range cluster.Workers {
+		cluster.Workers[wi].Done = done[cluster.Workers[wi].NodeName]
+	}
+	return nil
+}
+
+// SaveNodeStates records the Done flags of the master and the workers of a cluster.
+//
+// Parameters:
+//   - ctx: Context of the query.
+//   - cluster: Pointer to the Cluster object whose flags are recorded.
+//
+// Returns:
+//   - error: Error if the upsert fails.
+func (s *Store) SaveNodeStates(ctx context.Context, cluster *types.Cluster) error {
+	states := []NodeState{{
+		Address:     cluster.Address,
+		ClusterNode: cluster.NodeName,
+		NodeName:    cluster.NodeName,
+		NodeAddress: cluster.Address,
+		Done:        cluster.Done,
+	}}
+	for _, worker := range cluster.Workers {
+		states = append(states, NodeState{
+			Address:     cluster.Address,
+			ClusterNode: cluster.NodeName,
+			NodeName:    worker.NodeName,
+			NodeAddress: worker.Address,
+			Done:        worker.Done,
+		})
+	}
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "address"}, {Name: "cluster_node"}, {Name: "node_name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"node_address", "done", "updated_at"}),
+	}).Create(&states).Error
+}
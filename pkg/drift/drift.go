@@ -0,0 +1,336 @@
+package drift
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/addons"
+	"github.com/argon-chat/k3sd/pkg/clusterutils"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Kind classifies a drift item.
+type Kind string
+
+const (
+	// KindAPI means the cluster API could not be reached, so drift could not be checked.
+	KindAPI Kind = "api"
+	// KindAddon means an addon's Helm release or deployments do not match the desired state.
+	KindAddon Kind = "addon"
+	// KindManifest means live objects differ from a manifest applied by an addon.
+	KindManifest Kind = "manifest"
+	// KindNode means a configured node is not part of the cluster.
+	KindNode Kind = "node"
+	// KindLabel means a node label differs from the config.
+	KindLabel Kind = "label"
+	// KindLink means a Linkerd multicluster link differs from the config.
+	KindLink Kind = "link"
+)
+
+// Item is a single difference between the desired state and the live cluster.
+//
+// Fields:
+//   - Cluster: Cluster display name.
+//   - Kind: Kind of drift.
+//   - Name: Addon, node, label or link the drift refers to.
+//   - Expected: Desired state.
+//   - Actual: Live state.
+//   - Detail: Additional information, such as the kubectl diff of a manifest.
+//   - Reconciled: Whether the drift was reconciled.
+//   - Error: Error raised while reconciling, or why the item cannot be reconciled.
+type Item struct {
+	Cluster    string `json:"cluster"`
+	Kind       Kind   `json:"kind"`
+	Name       string `json:"name"`
+	Expected   string `json:"expected"`
+	Actual     string `json:"actual"`
+	Detail     string `json:"detail,omitempty"`
+	Reconciled bool   `json:"reconciled"`
+	Error      string `json:"error,omitempty"`
+
+	cluster *types.Cluster
+	addon   string
+	custom  bool
+	desired bool
+	node    string
+	label   string
+}
+
+// Detect compares the desired state of the selected clusters with the live clusters.
+//
+// It inspects Helm releases, deployments and manifest objects of the addons, node membership
+// and labels, and Linkerd multicluster links.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	clusters: Clusters from the config (desired state).
+//	logger: Logger for output.
+//	selector: Restricts the check to specific clusters, nodes and addons.
+//
+// Returns:
+//
+//	Drift items found across all selected clusters.
+func Detect(ctx context.Context, clusters []types.Cluster, logger *utils.Logger, selector utils.Selector) []Item {
+	var items []Item
+	for ci := range clusters {
+		if !selector.MatchCluster(clusters[ci].Context) {
+			continue
+		}
+		items = append(items, detectCluster(ctx, &clusters[ci], logger, selector)...)
+	}
+	return items
+}
+
+func detectCluster(ctx context.Context, cluster *types.Cluster, logger *utils.Logger, selector utils.Selector) []Item {
+	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
+	if err := clusterutils.CheckAPIReachable(ctx, kubeconfig); err != nil {
+		return []Item{{
+			Cluster:  cluster.DisplayName(),
+			Kind:     KindAPI,
+			Name:     cluster.Address,
+			Expected: "reachable",
+			Actual:   "unreachable",
+			Error:    err.Error(),
+			cluster:  cluster,
+		}}
+	}
+	var items []Item
+	if !selector.SkipAddons {
+		items = append(items, detectAddons(ctx, cluster, kubeconfig, logger, selector)...)
+	}
+	items = append(items, detectNodes(ctx, cluster, kubeconfig, logger, selector)...)
+	if matchAddon(selector, "linkerd-mc") {
+		items = append(items, detectLinks(ctx, cluster, logger)...)
+	}
+	return items
+}
+
+func detectAddons(ctx context.Context, cluster *types.Cluster, kubeconfig string, logger *utils.Logger, selector utils.Selector) []Item {
+	releases := make(map[string]clusterutils.HelmReleaseInfo)
+	list, err := clusterutils.ListHelmReleases(ctx, kubeconfig)
+	if err != nil {
+		logger.LogErr("error listing Helm releases of %s: %v", cluster.Address, err)
+	}
+	for _, r := range list {
+		releases[r.Namespace+"/"+r.Name] = r
+	}
+
+	var items []Item
+	for _, name := range sortedKeys(addons.AddonRegistry) {
+		addon, configured := cluster.Addons[name]
+		if !configured || !matchAddon(selector, name) {
+			continue
+		}
+		desired := addon.Enabled
+		if name == "linkerd" {
+			if linkerdMC, ok := cluster.Addons["linkerd-mc"]; ok && linkerdMC.Enabled {
+				desired = true
+			}
+		}
+		migration := addons.AddonRegistry[name]
+		base := Item{Cluster: cluster.DisplayName(), cluster: cluster, addon: name, desired: desired}
+		var manifests []addons.Manifest
+		if migration.Manifests != nil {
+			manifests = migration.Manifests(ctx, cluster)
+		}
+		items = append(items, checkAddon(ctx, base, migration.Release, migration.Deployments, manifests, releases, kubeconfig, logger)...)
+	}
+	for _, name := range sortedKeys(cluster.CustomAddons) {
+		if !matchAddon(selector, name) {
+			continue
+		}
+		addon := cluster.CustomAddons[name]
+		base := Item{Cluster: cluster.DisplayName(), cluster: cluster, addon: name, custom: true, desired: addon.Enabled}
+		var release *addons.Workload
+		if addon.Helm != nil {
+			namespace := addon.Helm.Namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			release = &addons.Workload{Name: name, Namespace: namespace}
+		}
+		var manifests []addons.Manifest
+		if addon.Manifest != nil && addon.Manifest.Path != "" {
+			manifests = []addons.Manifest{{Name: name, Path: addon.Manifest.Path, Subs: addon.Manifest.Subs}}
+		}
+		items = append(items, checkAddon(ctx, base, release, nil, manifests, releases, kubeconfig, logger)...)
+	}
+	return items
+}
+
+func checkAddon(ctx context.Context, base Item, release *addons.Workload, deployments []addons.Workload, manifests []addons.Manifest, releases map[string]clusterutils.HelmReleaseInfo, kubeconfig string, logger *utils.Logger) []Item {
+	var items []Item
+	addItem := func(kind Kind, name, expected, actual, detail string) {
+		item := base
+		item.Kind, item.Name, item.Expected, item.Actual, item.Detail = kind, name, expected, actual, detail
+		items = append(items, item)
+	}
+
+	if release != nil {
+		live, found := releases[release.Namespace+"/"+release.Name]
+		switch {
+		case base.desired && !found:
+			addItem(KindAddon, base.addon, "release deployed", "release missing", release.Namespace+"/"+release.Name)
+		case base.desired && live.Status != "deployed":
+			addItem(KindAddon, base.addon, "release deployed", "release "+live.Status, release.Namespace+"/"+release.Name)
+		case !base.desired && found:
+			addItem(KindAddon, base.addon, "release absent", "release "+live.Status, release.Namespace+"/"+release.Name)
+		}
+	}
+
+	for _, d := range deployments {
+		_, err := clusterutils.GetDeployment(ctx, kubeconfig, d.Name, d.Namespace)
+		switch {
+		case base.desired && err != nil:
+			addItem(KindAddon, base.addon, "deployment present", "deployment missing", d.Namespace+"/"+d.Name)
+		case !base.desired && err == nil:
+			addItem(KindAddon, base.addon, "deployment absent", "deployment present", d.Namespace+"/"+d.Name)
+		}
+	}
+
+	if !base.desired {
+		return items
+	}
+	for _, m := range manifests {
+		diff, err := clusterutils.DiffYAMLManifest(ctx, kubeconfig, m.Path, logger, m.Subs)
+		switch {
+		case err != nil:
+			addItem(KindManifest, m.Name, "objects match manifest", "diff failed", err.Error())
+		case diff != "":
+			addItem(KindManifest, m.Name, "objects match manifest", fmt.Sprintf("%d changed lines", countChangedLines(diff)), diff)
+		}
+	}
+	return items
+}
+
+func detectNodes(ctx context.Context, cluster *types.Cluster, kubeconfig string, logger *utils.Logger, selector utils.Selector) []Item {
+	nodes, err := clusterutils.GetNodes(ctx, kubeconfig)
+	if err != nil {
+		logger.LogErr("error listing nodes of %s: %v", cluster.Address, err)
+		return nil
+	}
+	live := make(map[string]clusterutils.NodeInfo)
+	for _, node := range nodes {
+		live[node.Name] = node
+	}
+
+	configured := append([]types.Worker{cluster.Worker}, cluster.Workers...)
+	var items []Item
+	for _, worker := range configured {
+		if len(selector.Nodes) > 0 && !selector.MatchNode(worker.NodeName) {
+			continue
+		}
+		node, ok := live[worker.NodeName]
+		if !ok {
+			items = append(items, Item{
+				Cluster:  cluster.DisplayName(),
+				Kind:     KindNode,
+				Name:     worker.NodeName,
+				Expected: "joined",
+				Actual:   "missing",
+				cluster:  cluster,
+				node:     worker.NodeName,
+			})
+			continue
+		}
+		for _, key := range sortedKeys(worker.Labels) {
+			want := worker.Labels[key]
+			got, set := node.Labels[key]
+			if set && got == want {
+				continue
+			}
+			if !set {
+				got = "<unset>"
+			}
+			items = append(items, Item{
+				Cluster:  cluster.DisplayName(),
+				Kind:     KindLabel,
+				Name:     worker.NodeName + ":" + key,
+				Expected: want,
+				Actual:   got,
+				cluster:  cluster,
+				node:     worker.NodeName,
+				label:    key + "=" + want,
+			})
+		}
+	}
+	return items
+}
+
+func detectLinks(ctx context.Context, cluster *types.Cluster, logger *utils.Logger) []Item {
+	linkerdMC, ok := cluster.Addons["linkerd-mc"]
+	if !ok || !linkerdMC.Enabled {
+		return nil
+	}
+	gateways, err := addons.GetLinkerdGateways(ctx, cluster, logger)
+	if err != nil {
+		logger.LogErr("error listing Linkerd gateways of %s: %v", cluster.Address, err)
+		return nil
+	}
+	linked := make(map[string]bool)
+	for _, gw := range gateways {
+		linked[gw.ClusterName] = true
+	}
+	wanted := make(map[string]bool)
+	var items []Item
+	for _, link := range cluster.LinksTo {
+		wanted[link] = true
+		if !linked[link] {
+			items = append(items, Item{
+				Cluster:  cluster.DisplayName(),
+				Kind:     KindLink,
+				Name:     link,
+				Expected: "linked",
+				Actual:   "not linked",
+				cluster:  cluster,
+				desired:  true,
+			})
+		}
+	}
+	for _, gw := range gateways {
+		if !wanted[gw.ClusterName] {
+			items = append(items, Item{
+				Cluster:  cluster.DisplayName(),
+				Kind:     KindLink,
+				Name:     gw.ClusterName,
+				Expected: "not linked",
+				Actual:   "linked",
+				cluster:  cluster,
+			})
+		}
+	}
+	return items
+}
+
+// matchAddon reports whether the addon is checked. Unlike a run, a node selection alone does
+// not exclude addons from the check.
+func matchAddon(selector utils.Selector, name string) bool {
+	if selector.SkipAddons {
+		return false
+	}
+	return len(selector.Addons) == 0 || selector.MatchAddon(name)
+}
+
+func countChangedLines(diff string) int {
+	count := 0
+	for _, line := range strings.Split(diff, "\n") {
+		if (strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-")) &&
+			!strings.HasPrefix(line, "+++") && !strings.HasPrefix(line, "---") {
+			count++
+		}
+	}
+	return count
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
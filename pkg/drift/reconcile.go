@@ -0,0 +1,106 @@
+package drift
+
+import (
+	"context"
+
+	"github.com/argon-chat/k3sd/pkg/addons"
+	"github.com/argon-chat/k3sd/pkg/clusterutils"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Reconcile brings the live clusters back to the desired state for the given drift items.
+//
+// Drifted addons are re-applied (or deleted if they are disabled), node labels are overwritten
+// and Linkerd links are created or removed. Each addon and each cluster's links are reconciled
+// once, however many items refer to them. Missing nodes and unreachable clusters cannot be
+// reconciled and are left untouched.
+//
+// Parameters:
+//
+//	ctx: Context of the reconcile.
+//	items: Drift items returned by Detect.
+//	clusters: Clusters from the config (used to resolve Linkerd links).
+//	logger: Logger for output.
+//
+// Returns:
+//
+//	The items with their Reconciled and Error fields updated.
+func Reconcile(ctx context.Context, items []Item, clusters []types.Cluster, logger *utils.Logger) []Item {
+	addonsDone := make(map[string]string)
+	linksDone := make(map[*types.Cluster]string)
+	for i := range items {
+		item := &items[i]
+		switch item.Kind {
+		case KindAddon, KindManifest:
+			key := item.Cluster + "/" + item.addon
+			result, done := addonsDone[key]
+			if !done {
+				result = errString(reconcileAddon(ctx, item, logger))
+				addonsDone[key] = result
+			}
+			item.Error = result
+			item.Reconciled = result == ""
+		case KindLabel:
+			kubeconfig := clusterutils.KubeConfigPath(item.cluster, logger)
+			if err := clusterutils.LabelNode(ctx, kubeconfig, item.node, item.label, logger); err != nil {
+				item.Error = err.Error()
+				continue
+			}
+			item.Reconciled = true
+		case KindLink:
+			if item.desired {
+				result, done := linksDone[item.cluster]
+				if !done {
+					logger.Log("Reconciling Linkerd links of %s", item.Cluster)
+					result = errString(addons.LinkClusters(ctx, item.cluster, &clusters, logger))
+					linksDone[item.cluster] = result
+				}
+				item.Error = result
+			} else {
+				item.Error = errString(addons.UnlinkLinkerdGateway(ctx, item.cluster, item.Name, logger))
+			}
+			item.Reconciled = item.Error == ""
+		case KindNode:
+			item.Error = "missing nodes are not joined by reconcile; run k3sd with --node " + item.node
+		case KindAPI:
+			// nothing can be reconciled on an unreachable cluster
+		}
+	}
+	return items
+}
+
+func reconcileAddon(ctx context.Context, item *Item, logger *utils.Logger) error {
+	switch {
+	case item.custom && item.desired:
+		logger.Log("Reconciling custom addon %s on %s: re-applying", item.addon, item.Cluster)
+		return addons.ApplyCustomAddon(ctx, item.addon, item.cluster, logger)
+	case item.custom:
+		logger.Log("Reconciling custom addon %s on %s: deleting", item.addon, item.Cluster)
+		return addons.DeleteCustomAddon(ctx, item.addon, item.cluster, logger)
+	case item.desired:
+		logger.Log("Reconciling addon %s on %s: re-applying", item.addon, item.Cluster)
+		return addons.AddonRegistry[item.addon].Up(ctx, item.cluster, logger)
+	default:
+		logger.Log("Reconciling addon %s on %s: deleting", item.addon, item.Cluster)
+		return addons.AddonRegistry[item.addon].Down(ctx, item.cluster, logger)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Pending returns the number of items that were not reconciled.
+func Pending(items []Item) int {
+	count := 0
+	for _, item := range items {
+		if !item.Reconciled {
+			count++
+		}
+	}
+	return count
+}
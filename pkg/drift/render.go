@@ -0,0 +1,61 @@
+package drift
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// RenderJSON writes the drift items as indented JSON.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	items: Drift items to render.
+//
+// Returns:
+//
+//	Error if encoding or writing fails.
+func RenderJSON(w io.Writer, items []Item) error {
+	if items == nil {
+		items = []Item{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(items)
+}
+
+// RenderTable writes the drift items as a human-readable table.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	items: Drift items to render.
+//
+// Returns:
+//
+//	Error if writing fails.
+func RenderTable(w io.Writer, items []Item) error {
+	if len(items) == 0 {
+		_, err := fmt.Fprintln(w, "No drift detected.")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tKIND\tNAME\tEXPECTED\tACTUAL\tSTATUS")
+	for _, item := range items {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", item.Cluster, item.Kind, item.Name, item.Expected, item.Actual, itemStatus(item))
+	}
+	return tw.Flush()
+}
+
+func itemStatus(item Item) string {
+	switch {
+	case item.Reconciled:
+		return "reconciled"
+	case item.Error != "":
+		return "drifted: " + item.Error
+	default:
+		return "drifted"
+	}
+}
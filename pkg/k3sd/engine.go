@@ -0,0 +1,511 @@
+// Package k3sd is the library API of k3sd. An Engine holds the database, the logger and the
+// install options, and runs the same operations as the command-line tool on clusters loaded
+// by the caller.
+package k3sd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/cluster"
+	"github.com/argon-chat/k3sd/pkg/db"
+	"github.com/argon-chat/k3sd/pkg/drift"
+	"github.com/argon-chat/k3sd/pkg/lock"
+	"github.com/argon-chat/k3sd/pkg/metrics"
+	"github.com/argon-chat/k3sd/pkg/notify"
+	"github.com/argon-chat/k3sd/pkg/secrets"
+	"github.com/argon-chat/k3sd/pkg/status"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// notifyCloseTimeout is how long Apply waits for the events of a run to reach the webhooks.
+const notifyCloseTimeout = 30 * time.Second
+
+// webhooksKey is the key the global webhooks are resolved with, unlike that of any cluster (see
+// secrets.ClusterKey).
+const webhooksKey = "webhooks"
+
+// ErrClusterNotFound is returned when an operation refers to a cluster that is not in the given list.
+var ErrClusterNotFound = errors.New("cluster not found")
+
+// ErrProtected is returned by Destroy when a selected cluster is protected.
+var ErrProtected = cluster.ErrProtected
+
+// Config configures an Engine.
+//
+// Fields:
+//   - DBPath: Path to the SQLite database. Ignored if Store is set; defaults to ~/.k3sd/k3sd.db.
+//   - Store: An already opened database. The Engine does not close it.
+//   - Logger: Logger receiving the output of the operations. If nil, the output is discarded.
+//   - HelmAtomic: Pass --atomic to all Helm operations (rollback on failure).
+//   - YamlsPath: Prefix path to the YAMLs of the built-in addons.
+//   - LogKubeconfigs: Log the content of fetched kubeconfigs at debug level (private keys masked).
+//   - Metrics: Metrics recording the runs of the Engine. If nil, no metrics are recorded.
+//   - Webhooks: Webhooks notified of the events of every apply, besides those of each cluster.
+//   - SecretStorePath: Path of the local secret store of secret: references; defaults to ~/.k3sd/secrets.json.
+type Config struct {
+	DBPath          string
+	Store           *db.Store
+	Logger          *utils.Logger
+	HelmAtomic      bool
+	YamlsPath       string
+	LogKubeconfigs  bool
+	Metrics         *metrics.Metrics
+	Webhooks        []types.Webhook
+	SecretStorePath string
+}
+
+// Engine runs k3sd operations. It is safe to use from one goroutine at a time. Apply, Destroy
+// and Reconcile lock the clusters they change in the database, so a concurrent run on the same
+// clusters (from this or another process) fails with a *lock.LockedError.
+type Engine struct {
+	store     *db.Store
+	logger    *utils.Logger
+	opts      utils.Options
+	metrics   *metrics.Metrics
+	webhooks  []types.Webhook
+	resolver  *secrets.Resolver
+	ownsStore bool
+}
+
+// New creates an Engine, opening the database unless cfg.Store is set.
+//
+// Parameters:
+//
+//	cfg: Engine configuration.
+//
+// Returns:
+//
+//	*Engine: the engine; Close it when done.
+//	error: Error if the database cannot be opened.
+func New(cfg Config) (*Engine, error) {
+	engine := &Engine{
+		store:    cfg.Store,
+		logger:   cfg.Logger,
+		metrics:  cfg.Metrics,
+		webhooks: cfg.Webhooks,
+		resolver: &secrets.Resolver{StorePath: cfg.SecretStorePath},
+		opts:     utils.Options{HelmAtomic: cfg.HelmAtomic, YamlsPath: cfg.YamlsPath, LogKubeconfigs: cfg.LogKubeconfigs},
+	}
+	if engine.store == nil {
+		store, err := db.Open(cfg.DBPath)
+		if err != nil {
+			return nil, err
+		}
+		engine.store = store
+		engine.ownsStore = true
+	}
+	if engine.logger == nil {
+		engine.logger = discardLogger()
+	}
+	for wi := range engine.webhooks {
+		utils.RegisterSecret(engine.webhooks[wi].SecretValues()...)
+	}
+	return engine, nil
+}
+
+// Close closes the database if the Engine opened it.
+//
+// Returns:
+//
+//	Error if closing the database fails.
+func (e *Engine) Close() error {
+	if !e.ownsStore {
+		return nil
+	}
+	return e.store.Close()
+}
+
+// Logger returns the logger of the Engine.
+func (e *Engine) Logger() *utils.Logger {
+	return e.logger
+}
+
+// Metrics returns the metrics of the Engine, or nil if it records none.
+func (e *Engine) Metrics() *metrics.Metrics {
+	return e.metrics
+}
+
+// Store returns the database of the Engine.
+func (e *Engine) Store() *db.Store {
+	return e.store
+}
+
+// Webhooks returns the global webhooks of the Engine, with the secret references resolved by
+// ResolveSecrets.
+func (e *Engine) Webhooks() []types.Webhook {
+	return e.webhooks
+}
+
+// WithLogger returns an Engine sharing the database, options, metrics and webhooks of e but
+// logging to logger.
+// Closing the returned Engine does not close the database.
+//
+// Parameters:
+//
+//	logger: Logger for the operations of the returned Engine.
+//
+// Returns:
+//
+//	*Engine: the derived engine.
+func (e *Engine) WithLogger(logger *utils.Logger) *Engine {
+	return &Engine{store: e.store, logger: logger, opts: e.opts, metrics: e.metrics, webhooks: e.webhooks, resolver: e.resolver}
+}
+
+// Apply installs the selected clusters, joins their workers and applies their addon changes.
+// The events of the run are posted to the global webhooks and those of the clusters. The
+// secret references of the clusters are resolved first (see ResolveSecrets).
+//
+// Parameters:
+//
+//	ctx: Context of the run; cancelling it aborts the running remote command.
+//	clusters: Clusters (desired state).
+//	selector: Restricts the run to specific clusters, nodes and addons.
+//
+// Returns:
+//
+//	Updated clusters (install state), the summary of all steps, and the joined errors of all
+//	failed steps (each a *utils.StepError). The clusters and the summary are returned even on
+//	error so the caller can report the failures; the install state of the nodes is recorded
+//	in the database as the run progresses.
+func (e *Engine) Apply(ctx context.Context, clusters []types.Cluster, selector utils.Selector) ([]types.Cluster, *cluster.Summary, error) {
+	held, err := e.lockClusters(ctx, clusters, selector)
+	if err != nil {
+		e.metrics.ObserveApply(nil, err)
+		return clusters, &cluster.Summary{}, err
+	}
+	defer held.Release()
+	if err := e.LoadState(ctx, clusters); err != nil {
+		e.metrics.ObserveApply(nil, err)
+		return clusters, &cluster.Summary{}, err
+	}
+	if err := e.ResolveSecrets(ctx, clusters); err != nil {
+		e.metrics.ObserveApply(nil, err)
+		return clusters, &cluster.Summary{}, err
+	}
+	registerSecrets(clusters)
+	selected := selectedClusters(clusters, selector)
+	notifier, err := notify.New(e.webhooks, selected, e.logger)
+	if err != nil {
+		e.logger.LogErr("error in webhook config: %v", err)
+	}
+	names := displayNames(selected)
+	notifier.RunStarted(names)
+	ctx = e.context(ctx)
+	if notifier != nil {
+		ctx = utils.WithProgress(ctx, utils.MultiProgress{utils.ProgressFrom(ctx), notifier})
+	}
+	clusters, summary, err := cluster.CreateCluster(ctx, e.store, e.resolver, clusters, e.logger, selector)
+	e.metrics.ObserveApply(summary, err)
+	notifier.RunFinished(names, summary, err)
+	if closeErr := notifier.Close(notifyCloseTimeout); closeErr != nil {
+		e.logger.Warn("%v", closeErr)
+	}
+	return clusters, summary, err
+}
+
+// Plan lists the actions Apply would perform on a cluster, without connecting to it.
+//
+// Parameters:
+//
+//	ctx: Context of the database queries.
+//	target: The cluster (desired state); its Done flags are set from the recorded install state.
+//	selector: Restricts the plan to specific nodes and addons.
+//
+// Returns:
+//
+//	*cluster.Plan: the planned actions.
+//	error: Error if the recorded version or install state cannot be read.
+func (e *Engine) Plan(ctx context.Context, target *types.Cluster, selector utils.Selector) (*cluster.Plan, error) {
+	if err := e.loadState(ctx, target); err != nil {
+		return nil, err
+	}
+	return cluster.PlanCluster(e.context(ctx), e.store, target, selector)
+}
+
+// Destroy uninstalls k3s from the selected clusters and deletes their recorded versions. The
+// secret references of the clusters are resolved first (see ResolveSecrets).
+//
+// Parameters:
+//
+//	ctx: Context of the run.
+//	clusters: Clusters from the config.
+//	selector: Restricts the destroy to specific clusters.
+//
+// Returns:
+//
+//	Updated clusters and error if a cluster is protected (ErrProtected) or a step fails.
+func (e *Engine) Destroy(ctx context.Context, clusters []types.Cluster, selector utils.Selector) ([]types.Cluster, error) {
+	held, err := e.lockClusters(ctx, clusters, selector)
+	if err != nil {
+		e.metrics.ObserveRun("destroy", err)
+		return nil, err
+	}
+	defer held.Release()
+	if err := e.LoadState(ctx, clusters); err != nil {
+		e.metrics.ObserveRun("destroy", err)
+		return nil, err
+	}
+	if err := e.ResolveSecrets(ctx, clusters); err != nil {
+		e.metrics.ObserveRun("destroy", err)
+		return nil, err
+	}
+	registerSecrets(clusters)
+	clusters, err = cluster.UninstallCluster(e.context(ctx), e.store, clusters, e.logger, selector)
+	e.metrics.ObserveRun("destroy", err)
+	return clusters, err
+}
+
+// Status gathers the live status of the selected clusters.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	clusters: Clusters from the config, with their secret references resolved (see ResolveSecrets).
+//	selector: Restricts the report to specific clusters.
+//
+// Returns:
+//
+//	Status of every selected cluster.
+func (e *Engine) Status(ctx context.Context, clusters []types.Cluster, selector utils.Selector) []status.ClusterStatus {
+	registerSecrets(clusters)
+	return status.CollectStatus(e.context(ctx), e.store, clusters, e.logger, selector)
+}
+
+// Drift compares the desired state of the selected clusters with the live clusters.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	clusters: Clusters from the config, with their secret references resolved (see ResolveSecrets).
+//	selector: Restricts the check to specific clusters, nodes and addons.
+//
+// Returns:
+//
+//	Drift items found across all selected clusters.
+func (e *Engine) Drift(ctx context.Context, clusters []types.Cluster, selector utils.Selector) []drift.Item {
+	registerSecrets(clusters)
+	items := drift.Detect(e.context(ctx), clusters, e.logger, selector)
+	if e.metrics != nil {
+		e.metrics.ObserveDrift(displayNames(selectedClusters(clusters, selector)), items)
+	}
+	return items
+}
+
+// Reconcile brings the live clusters back to the desired state for the given drift items.
+//
+// Parameters:
+//
+//	ctx: Context of the reconcile.
+//	items: Drift items returned by Drift.
+//	clusters: Clusters from the config, with their secret references resolved (see ResolveSecrets).
+//
+// Returns:
+//
+//	The items with their Reconciled and Error fields updated.
+func (e *Engine) Reconcile(ctx context.Context, items []drift.Item, clusters []types.Cluster) []drift.Item {
+	drifted := make(map[string]bool)
+	for _, item := range items {
+		drifted[item.Cluster] = true
+	}
+	var targets []*types.Cluster
+	for ci := range clusters {
+		if drifted[clusters[ci].DisplayName()] {
+			targets = append(targets, &clusters[ci])
+		}
+	}
+	held, err := e.lock(ctx, targets)
+	if err != nil {
+		e.metrics.ObserveRun("reconcile", err)
+		for i := range items {
+			items[i].Error = err.Error()
+		}
+		return items
+	}
+	defer held.Release()
+	registerSecrets(clusters)
+	items = drift.Reconcile(e.context(ctx), items, clusters, e.logger)
+	e.metrics.ObserveReconcile(items)
+	return items
+}
+
+// History returns the versions of a cluster recorded in the database, newest first.
+//
+// Parameters:
+//
+//	ctx: Context of the query.
+//	target: The cluster.
+//
+// Returns:
+//
+//	Recorded versions and error if the query fails.
+func (e *Engine) History(ctx context.Context, target *types.Cluster) ([]db.ClusterRecord, error) {
+	return e.store.ListClusterRecords(ctx, target)
+}
+
+// LoadState sets the Done flags of the nodes of the clusters from the install state recorded
+// in the database. The first time a cluster is seen, the Done flags of a config written by an
+// older version of k3sd are imported into the database instead; the config is never written.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	clusters: Clusters from the config; their Done flags are set.
+//
+// Returns:
+//
+//	Error if the recorded state cannot be read or imported.
+func (e *Engine) LoadState(ctx context.Context, clusters []types.Cluster) error {
+	for ci := range clusters {
+		if err := e.loadState(ctx, &clusters[ci]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadState sets the Done flags of the nodes of a cluster, importing them first if needed.
+func (e *Engine) loadState(ctx context.Context, target *types.Cluster) error {
+	recorded, err := e.store.HasNodeStates(ctx, target)
+	if err != nil {
+		return fmt.Errorf("read install state of %s: %w", target.DisplayName(), err)
+	}
+	if !recorded && hasDoneNodes(target) {
+		if err := e.store.SaveNodeStates(ctx, target); err != nil {
+			return fmt.Errorf("import install state of %s: %w", target.DisplayName(), err)
+		}
+		e.logger.Log("Imported the install state of %s from the config into the database", target.DisplayName())
+	}
+	if err := e.store.LoadNodeStates(ctx, target); err != nil {
+		return fmt.Errorf("read install state of %s: %w", target.DisplayName(), err)
+	}
+	return nil
+}
+
+// ResolveSecrets replaces the secret references (env:, file:, exec: and secret:) of the clusters
+// and of the global webhooks with the values they refer to, in memory only: the config keeps
+// the references and the versions recorded in the database hold them instead of the values.
+// The resolved values are masked in all output.
+//
+// Parameters:
+//
+//	ctx: Context of the commands of exec: references.
+//	clusters: Clusters from the config; their values are replaced.
+//
+// Returns:
+//
+//	The joined *utils.ConfigError of every cluster whose references cannot be resolved.
+func (e *Engine) ResolveSecrets(ctx context.Context, clusters []types.Cluster) error {
+	var errs []error
+	for ci := range clusters {
+		if err := e.resolver.Resolve(ctx, secrets.ClusterKey(&clusters[ci]), &clusters[ci]); err != nil {
+			errs = append(errs, &utils.ConfigError{Source: clusters[ci].DisplayName(), Err: err})
+		}
+	}
+	if err := e.resolver.Resolve(ctx, webhooksKey, e.webhooks); err != nil {
+		errs = append(errs, &utils.ConfigError{Source: "webhooks", Err: err})
+	}
+	return errors.Join(errs...)
+}
+
+// Find returns the index of the cluster with the given display name.
+//
+// Parameters:
+//
+//	clusters: Clusters from the config.
+//	name: Cluster context, or master address if the cluster has no context.
+//
+// Returns:
+//
+//	Index of the cluster and ErrClusterNotFound if there is none.
+func Find(clusters []types.Cluster, name string) (int, error) {
+	for ci := range clusters {
+		if clusters[ci].DisplayName() == name {
+			return ci, nil
+		}
+	}
+	return -1, ErrClusterNotFound
+}
+
+// Unlock removes the database locks of the selected clusters regardless of their holders, for
+// locks left behind by a run that cannot release them.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	clusters: Clusters from the config.
+//	selector: Restricts the unlock to specific clusters.
+//
+// Returns:
+//
+//	The removed locks and error if the query fails.
+func (e *Engine) Unlock(ctx context.Context, clusters []types.Cluster, selector utils.Selector) ([]db.Lock, error) {
+	return lock.ForceUnlockClusters(ctx, e.store, selectedClusters(clusters, selector))
+}
+
+// lockClusters locks the selected clusters against concurrent runs. Abandoned locks that are
+// taken over are logged.
+func (e *Engine) lockClusters(ctx context.Context, clusters []types.Cluster, selector utils.Selector) (*lock.Held, error) {
+	return e.lock(ctx, selectedClusters(clusters, selector))
+}
+
+func (e *Engine) lock(ctx context.Context, targets []*types.Cluster) (*lock.Held, error) {
+	held, stale, err := lock.Clusters(ctx, e.store, targets)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range stale {
+		e.logger.Warn("taking over stale lock on %s", l)
+	}
+	return held, nil
+}
+
+func selectedClusters(clusters []types.Cluster, selector utils.Selector) []*types.Cluster {
+	var selected []*types.Cluster
+	for ci := range clusters {
+		if selector.MatchCluster(clusters[ci].Context) {
+			selected = append(selected, &clusters[ci])
+		}
+	}
+	return selected
+}
+
+func displayNames(targets []*types.Cluster) []string {
+	names := make([]string, len(targets))
+	for ci, target := range targets {
+		names[ci] = target.DisplayName()
+	}
+	return names
+}
+
+func (e *Engine) context(ctx context.Context) context.Context {
+	return utils.WithOptions(ctx, e.opts)
+}
+
+// registerSecrets masks the passwords and secret substitutions of the clusters in the output.
+func registerSecrets(clusters []types.Cluster) {
+	for ci := range clusters {
+		utils.RegisterSecret(clusters[ci].SecretValues()...)
+	}
+}
+
+// hasDoneNodes reports whether the config marks the master or a worker of a cluster as done.
+func hasDoneNodes(target *types.Cluster) bool {
+	if target.Done {
+		return true
+	}
+	for _, worker := range target.Workers {
+		if worker.Done {
+			return true
+		}
+	}
+	return false
+}
+
+// discardLogger returns a logger whose messages are dropped.
+func discardLogger() *utils.Logger {
+	return utils.NewLogger("cli", nil)
+}
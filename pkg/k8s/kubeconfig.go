@@ -1,6 +1,7 @@
 package k8s
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -16,28 +17,36 @@ import (
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	client: SSH client connected to the node.
 //	cluster: Cluster information.
 //	nodeName: Name of the node.
 //	logger: Logger for output.
 //
+// Returns:
+//
+//	error: Error if the kubeconfig cannot be read or written.
+//
 // This function fetches the kubeconfig file from the specified cluster node using SSH,
 // patches the address if needed, writes it to a local file, and optionally renames the
 // kubeconfig context if the cluster specifies a custom context name.
-func SaveKubeConfig(client *ssh.Client, cluster types.Cluster, nodeName string, logger *utils.Logger) {
-	kubeConfig, err := readRemoteKubeConfig(client, cluster.Address, logger)
+func SaveKubeConfig(ctx context.Context, client *ssh.Client, cluster types.Cluster, nodeName string, logger *utils.Logger) error {
+	kubeConfig, err := readRemoteKubeConfig(ctx, client, cluster.Address, logger)
 	if err != nil {
-		logger.Log("Failed to read kubeconfig from %s: %v", cluster.Address, err)
-		return
+		return fmt.Errorf("read kubeconfig from %s: %w", cluster.Address, err)
 	}
 	kubeConfig = patchKubeConfigAddress(kubeConfig, cluster.Address)
 	kubeConfigPath := buildKubeConfigPath(logger.Id, nodeName)
-	logIfFileWriteErr(kubeConfigPath, kubeConfig, logger)
+	if err := createFileWithErr(kubeConfigPath, kubeConfig); err != nil {
+		logger.Warn("Failed to write kubeconfig to file: %v", err)
+		return err
+	}
 
 	if cluster.Context != "" {
 		oldContext := getCurrentContextFromKubeconfig(kubeConfig)
-		clusterutils.RenameKubeconfigContext(kubeConfigPath, oldContext, cluster.Context, logger)
+		clusterutils.RenameKubeconfigContext(ctx, kubeConfigPath, oldContext, cluster.Context, logger)
 	}
+	return nil
 }
 
 func patchKubeConfigAddress(kubeConfig, address string) string {
@@ -57,16 +66,10 @@ func buildKubeConfigPath(loggerId, nodeName string) string {
 	return path.Join("./kubeconfigs", fmt.Sprintf("%s/%s.yaml", loggerId, nodeName))
 }
 
-func logIfFileWriteErr(filePath, content string, logger *utils.Logger) {
-	if err := createFileWithErr(filePath, content); err != nil {
-		logger.Log("Failed to write kubeconfig to file: %v", err)
-	}
-}
-
-func readRemoteKubeConfig(client *ssh.Client, address string, logger *utils.Logger) (string, error) {
-	kubeConfig, err := clusterutils.ExecuteRemoteScript(client, "cat /etc/rancher/k3s/k3s.yaml", logger)
+func readRemoteKubeConfig(ctx context.Context, client *ssh.Client, address string, logger *utils.Logger) (string, error) {
+	kubeConfig, err := clusterutils.ExecuteRemoteScript(ctx, client, "cat /etc/rancher/k3s/k3s.yaml", logger)
 	if err != nil {
-		logger.Log("Failed to read kubeconfig from %s: %v\n", address, err)
+		logger.Warn("Failed to read kubeconfig from %s: %v", address, err)
 		return "", err
 	}
 	return kubeConfig, nil
@@ -89,7 +92,8 @@ func createFileWithErr(filePath, content string) error {
 //	logger: Logger for output.
 //
 // This function reads all files in the kubeconfigs directory for the current logger session
-// and logs their contents using the provided logger.
+// and logs their contents using the provided logger. Client keys and tokens are masked by the
+// logger; callers only log kubeconfigs when Options.LogKubeconfigs is set.
 func LogFiles(logger *utils.Logger) {
 	dir := path.Join("./kubeconfigs", logger.Id)
 	files, err := os.ReadDir(dir)
@@ -115,6 +119,7 @@ func LogFiles(logger *utils.Logger) {
 //
 // Parameters:
 //
+//	ctx: Context of the operation.
 //	cluster: The cluster containing the worker node.
 //	worker: The worker node to label.
 //	logger: Logger for output.
@@ -125,7 +130,7 @@ func LogFiles(logger *utils.Logger) {
 //
 // This function builds the kubeconfig path for the given cluster and worker, then calls
 // the clusterutils.LabelNode function to apply the labels using kubectl.
-func LabelWorkerNode(cluster *types.Cluster, worker *types.Worker, logger *utils.Logger) error {
+func LabelWorkerNode(ctx context.Context, cluster *types.Cluster, worker *types.Worker, logger *utils.Logger) error {
 	kubeconfigPath := path.Join("./kubeconfigs", fmt.Sprintf("%s/%s.yaml", logger.Id, cluster.NodeName))
-	return clusterutils.LabelNode(kubeconfigPath, worker.NodeName, worker.GetLabels(), logger)
+	return clusterutils.LabelNode(ctx, kubeconfigPath, worker.NodeName, worker.GetLabels(), logger)
 }
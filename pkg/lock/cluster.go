@@ -0,0 +1,89 @@
+package lock
+
+import (
+	"context"
+	"errors"
+
+	"github.com/argon-chat/k3sd/pkg/db"
+	"github.com/argon-chat/k3sd/pkg/types"
+)
+
+// ClusterKey returns the database lock key of a cluster, derived from the same identity as its
+// recorded versions (master address and node name).
+//
+// Parameters:
+//
+//	cluster: The cluster.
+//
+// Returns:
+//
+//	string: the lock key.
+func ClusterKey(cluster *types.Cluster) string {
+	return "cluster/" + cluster.Address + "/" + cluster.NodeName
+}
+
+// Clusters locks the given clusters in the database. If one of them is locked by another run,
+// the locks acquired so far are released.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	store: Database holding the locks.
+//	clusters: Clusters to lock.
+//
+// Returns:
+//
+//	*Held: the held locks; Release them when done.
+//	[]StaleLock: abandoned locks that were taken over.
+//	error: *LockedError if a cluster is locked by another run, or the query error.
+func Clusters(ctx context.Context, store *db.Store, clusters []*types.Cluster) (*Held, []StaleLock, error) {
+	owner := CurrentOwner()
+	held := newHeld()
+	var stale []StaleLock
+	for _, cluster := range clusters {
+		row := &db.Lock{Key: ClusterKey(cluster), Token: newToken(), Owner: owner.User, Host: owner.Host, PID: owner.PID}
+		previous, err := store.AcquireLock(ctx, row, StaleAfter)
+		if err != nil {
+			_ = held.Release()
+			if errors.Is(err, db.ErrLockHeld) && previous != nil {
+				return nil, nil, &LockedError{Resource: "cluster " + cluster.DisplayName(), Owner: rowOwner(previous), Since: previous.AcquiredAt}
+			}
+			return nil, nil, err
+		}
+		if previous != nil {
+			stale = append(stale, StaleLock{Resource: "cluster " + cluster.DisplayName(), Owner: rowOwner(previous), Since: previous.AcquiredAt, Heartbeat: previous.HeartbeatAt})
+		}
+		key, token := row.Key, row.Token
+		held.add(func() error {
+			return store.RefreshLock(context.Background(), key, token)
+		}, func() error {
+			return store.ReleaseLock(context.Background(), key, token)
+		})
+	}
+	return held, stale, nil
+}
+
+// ForceUnlockClusters deletes the database locks of the given clusters regardless of their
+// holders.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	store: Database holding the locks.
+//	clusters: Clusters to unlock.
+//
+// Returns:
+//
+//	[]db.Lock: the deleted locks.
+//	error: Error if the query fails.
+func ForceUnlockClusters(ctx context.Context, store *db.Store, clusters []*types.Cluster) ([]db.Lock, error) {
+	keys := make([]string, 0, len(clusters))
+	for _, cluster := range clusters {
+		keys = append(keys, ClusterKey(cluster))
+	}
+	return store.DeleteLocks(ctx, keys)
+}
+
+func rowOwner(row *db.Lock) Owner {
+	return Owner{User: row.Owner, Host: row.Host, PID: row.PID}
+}
@@ -0,0 +1,158 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// fileLock is the content of a lock file.
+type fileLock struct {
+	Owner      Owner     `json:"owner"`
+	Token      string    `json:"token"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+// FilePath returns the path of the lock file of a config file or directory.
+//
+// Parameters:
+//
+//	configPath: Path to the config file or directory.
+//
+// Returns:
+//
+//	string: configPath with a .lock suffix.
+func FilePath(configPath string) string {
+	return configPath + ".lock"
+}
+
+// File locks a config file (or directory) by creating its lock file. The lock file holds the
+// owner and is touched by the heartbeat; a lock file not touched for StaleAfter is replaced.
+//
+// Parameters:
+//
+//	configPath: Path to the config file or directory.
+//
+// Returns:
+//
+//	*Held: the held lock; Release it when done.
+//	*StaleLock: the abandoned lock that was replaced, or nil.
+//	error: *LockedError if another run holds the lock, or the file system error.
+func File(configPath string) (*Held, *StaleLock, error) {
+	path := FilePath(configPath)
+	own := fileLock{Owner: CurrentOwner(), Token: newToken(), AcquiredAt: time.Now()}
+	data, err := json.Marshal(own)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stale *StaleLock
+	for attempt := 0; attempt < 3; attempt++ {
+		err := createExclusive(path, data)
+		if err == nil {
+			held := newHeld()
+			held.add(func() error {
+				now := time.Now()
+				return os.Chtimes(path, now, now)
+			}, func() error {
+				return removeIfOwned(path, own.Token)
+			})
+			return held, stale, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, nil, fmt.Errorf("create lock file %s: %w", path, err)
+		}
+		current, modTime, err := readLockFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if time.Since(modTime) < StaleAfter {
+			return nil, nil, &LockedError{Resource: configPath, Owner: current.Owner, Since: current.AcquiredAt}
+		}
+		if err := removeIfOwned(path, current.Token); err != nil {
+			return nil, nil, err
+		}
+		stale = &StaleLock{Resource: configPath, Owner: current.Owner, Since: current.AcquiredAt, Heartbeat: modTime}
+	}
+	return nil, nil, fmt.Errorf("lock file %s keeps changing", path)
+}
+
+// ForceUnlockFile removes the lock file of a config file regardless of its holder.
+//
+// Parameters:
+//
+//	configPath: Path to the config file or directory.
+//
+// Returns:
+//
+//	*Owner: the holder of the removed lock, or nil if the config was not locked.
+//	error: Error if the lock file cannot be read or removed.
+func ForceUnlockFile(configPath string) (*Owner, error) {
+	path := FilePath(configPath)
+	current, _, err := readLockFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if current == nil {
+		// unreadable lock file
+		return &Owner{User: "unknown", Host: "unknown"}, nil
+	}
+	return &current.Owner, nil
+}
+
+func createExclusive(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// readLockFile returns the content and the last heartbeat of a lock file. An unparsable lock
+// file is returned as a lock of an unknown owner.
+func readLockFile(path string) (*fileLock, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var current fileLock
+	if err := json.Unmarshal(data, &current); err != nil {
+		current = fileLock{Owner: Owner{User: "unknown", Host: "unknown"}, AcquiredAt: info.ModTime()}
+	}
+	return &current, info.ModTime(), nil
+}
+
+// removeIfOwned removes the lock file if it still holds the given token.
+func removeIfOwned(path, token string) error {
+	current, _, err := readLockFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.Token != token {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
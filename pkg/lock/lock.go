@@ -0,0 +1,157 @@
+// Package lock implements the advisory locks that keep concurrent k3sd runs from interleaving
+// their changes: a lock file next to each config file, and a lock row in the database for
+// each cluster. Held locks are refreshed periodically; a lock whose holder stopped refreshing
+// it for StaleAfter is considered abandoned and is taken over.
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// StaleAfter is how long a lock stays valid without a heartbeat from its holder.
+const StaleAfter = 2 * time.Minute
+
+// heartbeatInterval is how often held locks are refreshed.
+const heartbeatInterval = 30 * time.Second
+
+// Owner identifies the holder of a lock.
+//
+// Fields:
+//   - User: Name of the user running k3sd.
+//   - Host: Host name.
+//   - PID: Process ID.
+type Owner struct {
+	User string `json:"user"`
+	Host string `json:"host"`
+	PID  int    `json:"pid"`
+}
+
+// String returns the owner as user@host (pid N).
+func (o Owner) String() string {
+	return fmt.Sprintf("%s@%s (pid %d)", o.User, o.Host, o.PID)
+}
+
+// CurrentOwner returns the owner identity of the running process.
+//
+// Returns:
+//
+//	Owner: the current user, host and process ID.
+func CurrentOwner() Owner {
+	owner := Owner{User: os.Getenv("USER"), PID: os.Getpid()}
+	if u, err := user.Current(); err == nil {
+		owner.User = u.Username
+	}
+	if owner.User == "" {
+		owner.User = "unknown"
+	}
+	owner.Host, _ = os.Hostname()
+	return owner
+}
+
+// LockedError is returned when a resource is locked by another run.
+//
+// Fields:
+//   - Resource: The locked config file or cluster.
+//   - Owner: Holder of the lock.
+//   - Since: Time the lock was acquired.
+type LockedError struct {
+	Resource string
+	Owner    Owner
+	Since    time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s since %s; if that run is gone, wait %s for the lock to expire or use force-unlock",
+		e.Resource, e.Owner, e.Since.Format(time.RFC3339), StaleAfter)
+}
+
+// StaleLock describes an abandoned lock that was taken over.
+//
+// Fields:
+//   - Resource: The config file or cluster.
+//   - Owner: Former holder of the lock.
+//   - Since: Time the former holder acquired the lock.
+//   - Heartbeat: Last heartbeat of the former holder.
+type StaleLock struct {
+	Resource  string
+	Owner     Owner
+	Since     time.Time
+	Heartbeat time.Time
+}
+
+func (l StaleLock) String() string {
+	return fmt.Sprintf("%s (held by %s since %s, last heartbeat %s)", l.Resource, l.Owner, l.Since.Format(time.RFC3339), l.Heartbeat.Format(time.RFC3339))
+}
+
+// Held is a set of held locks. Its locks are refreshed in the background until Release.
+type Held struct {
+	mu       sync.Mutex
+	refresh  []func() error
+	release  []func() error
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newHeld() *Held {
+	held := &Held{stop: make(chan struct{})}
+	go held.heartbeat()
+	return held
+}
+
+func (h *Held) add(refresh, release func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refresh = append(h.refresh, refresh)
+	h.release = append(h.release, release)
+}
+
+func (h *Held) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.mu.Lock()
+			for _, refresh := range h.refresh {
+				_ = refresh()
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// Release stops refreshing the locks and releases them. It is safe to call more than once.
+//
+// Returns:
+//
+//	Error if a lock cannot be released.
+func (h *Held) Release() error {
+	if h == nil {
+		return nil
+	}
+	h.stopOnce.Do(func() { close(h.stop) })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var firstErr error
+	for i := len(h.release) - 1; i >= 0; i-- {
+		if err := h.release[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	h.refresh, h.release = nil, nil
+	return firstErr
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,228 @@
+// Package metrics exposes Prometheus metrics of the runs of an Engine: runs by outcome, step
+// durations, SSH failures per node, addon operations, drift items and the last successful
+// reconcile of every cluster. The daemon and the API server serve them on /metrics.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/argon-chat/k3sd/pkg/cluster"
+	"github.com/argon-chat/k3sd/pkg/drift"
+	"github.com/argon-chat/k3sd/pkg/lock"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Run outcomes reported by k3sd_runs_total.
+const (
+	OutcomeSuccess   = "success"
+	OutcomeFailed    = "failed"
+	OutcomeLocked    = "locked"
+	OutcomeCancelled = "cancelled"
+)
+
+// driftKinds are the kinds of drift reported by k3sd_drift_items.
+var driftKinds = []drift.Kind{drift.KindAPI, drift.KindAddon, drift.KindManifest, drift.KindNode, drift.KindLabel, drift.KindLink}
+
+// Metrics holds the k3sd metrics in a registry of their own. It is safe for concurrent use; a
+// nil *Metrics records nothing.
+type Metrics struct {
+	registry       *prometheus.Registry
+	runs           *prometheus.CounterVec
+	stepDuration   *prometheus.HistogramVec
+	sshFailures    *prometheus.CounterVec
+	addonOps       *prometheus.CounterVec
+	addonFailures  *prometheus.CounterVec
+	driftItems     *prometheus.GaugeVec
+	lastReconciled *prometheus.GaugeVec
+}
+
+// New creates the k3sd metrics, along with the Go runtime and process metrics.
+//
+// Returns:
+//
+//	*Metrics: the metrics, all at zero.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k3sd_runs_total",
+			Help: "Runs by operation (apply, destroy, reconcile) and outcome (success, failed, locked, cancelled).",
+		}, []string{"operation", "outcome"}),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "k3sd_step_duration_seconds",
+			Help:    "Duration of the steps of apply runs by cluster, step and result.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1200},
+		}, []string{"cluster", "step", "result"}),
+		sshFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k3sd_ssh_failures_total",
+			Help: "Failed SSH connections by cluster and node.",
+		}, []string{"cluster", "node"}),
+		addonOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k3sd_addon_operations_total",
+			Help: "Addon applies and deletes by cluster, addon and operation.",
+		}, []string{"cluster", "addon", "operation"}),
+		addonFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "k3sd_addon_operation_failures_total",
+			Help: "Failed addon applies and deletes by cluster, addon and operation.",
+		}, []string{"cluster", "addon", "operation"}),
+		driftItems: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k3sd_drift_items",
+			Help: "Drift items found by the last drift check of a cluster, by kind.",
+		}, []string{"cluster", "kind"}),
+		lastReconciled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k3sd_last_successful_reconcile_timestamp_seconds",
+			Help: "Unix time of the last apply or drift reconcile of a cluster that succeeded.",
+		}, []string{"cluster"}),
+	}
+	m.registry.MustRegister(
+		m.runs, m.stepDuration, m.sshFailures, m.addonOps, m.addonFailures, m.driftItems, m.lastReconciled,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler returns the HTTP handler serving the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Registry returns the registry holding the metrics, e.g. to add metrics of the caller.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// ObserveApply records an apply run: its outcome, the duration of its steps, failed SSH
+// connections, addon operations and, for every cluster whose steps all succeeded, the time of
+// the last successful reconcile.
+//
+// Parameters:
+//
+//	summary: Summary returned by the run.
+//	err: Error returned by the run.
+func (m *Metrics) ObserveApply(summary *cluster.Summary, err error) {
+	if m == nil {
+		return
+	}
+	m.ObserveRun("apply", err)
+	if summary == nil {
+		return
+	}
+	failed := make(map[string]bool)
+	for _, step := range summary.Steps {
+		result := "ok"
+		if step.Failed() {
+			result = "failed"
+			failed[step.Cluster] = true
+		}
+		m.stepDuration.WithLabelValues(step.Cluster, step.Step, result).Observe(step.Duration.Seconds())
+		if utils.IsConnectionError(step.Err()) {
+			m.sshFailures.WithLabelValues(step.Cluster, step.Node).Inc()
+		}
+		if step.Addon != "" && (step.Step == "apply" || step.Step == "delete") {
+			m.addonOps.WithLabelValues(step.Cluster, step.Addon, step.Step).Inc()
+			if step.Failed() {
+				m.addonFailures.WithLabelValues(step.Cluster, step.Addon, step.Step).Inc()
+			}
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	now := float64(time.Now().Unix())
+	for _, step := range summary.Steps {
+		if !failed[step.Cluster] {
+			m.lastReconciled.WithLabelValues(step.Cluster).Set(now)
+		}
+	}
+}
+
+// ObserveRun records the outcome of a run.
+//
+// Parameters:
+//
+//	operation: "apply", "destroy" or "reconcile".
+//	err: Error returned by the run.
+func (m *Metrics) ObserveRun(operation string, err error) {
+	if m == nil {
+		return
+	}
+	m.runs.WithLabelValues(operation, outcome(err)).Inc()
+}
+
+// ObserveDrift records the drift items found on the checked clusters, per kind. Kinds without
+// drift are reported with zero items.
+//
+// Parameters:
+//
+//	clusters: Display names of the checked clusters.
+//	items: Drift items found.
+func (m *Metrics) ObserveDrift(clusters []string, items []drift.Item) {
+	if m == nil {
+		return
+	}
+	counts := make(map[string]map[drift.Kind]int)
+	for _, name := range clusters {
+		counts[name] = make(map[drift.Kind]int)
+	}
+	for _, item := range items {
+		if counts[item.Cluster] == nil {
+			counts[item.Cluster] = make(map[drift.Kind]int)
+		}
+		counts[item.Cluster][item.Kind]++
+	}
+	for name, kinds := range counts {
+		for _, kind := range driftKinds {
+			m.driftItems.WithLabelValues(name, string(kind)).Set(float64(kinds[kind]))
+		}
+	}
+}
+
+// ObserveReconcile records a drift reconcile: its outcome and, for every cluster whose items
+// were all reconciled without error, the time of the last successful reconcile.
+//
+// Parameters:
+//
+//	items: Items returned by the reconcile.
+func (m *Metrics) ObserveReconcile(items []drift.Item) {
+	if m == nil {
+		return
+	}
+	var errs []error
+	failed := make(map[string]bool)
+	for _, item := range items {
+		if item.Error != "" {
+			errs = append(errs, errors.New(item.Error))
+		}
+		if item.Error != "" || !item.Reconciled {
+			failed[item.Cluster] = true
+		}
+	}
+	m.ObserveRun("reconcile", errors.Join(errs...))
+	now := float64(time.Now().Unix())
+	for _, item := range items {
+		if !failed[item.Cluster] {
+			m.lastReconciled.WithLabelValues(item.Cluster).Set(now)
+		}
+	}
+}
+
+func outcome(err error) string {
+	var locked *lock.LockedError
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.As(err, &locked):
+		return OutcomeLocked
+	case errors.Is(err, context.Canceled):
+		return OutcomeCancelled
+	}
+	return OutcomeFailed
+}
@@ -0,0 +1,315 @@
+// Package notify posts the lifecycle events of apply runs (run started, node joined, addon
+// applied, deleted or failed, link created, run finished) to webhooks, signed with HMAC and
+// retried on failure. Webhooks are configured globally and per cluster.
+package notify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/cluster"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Event types.
+const (
+	EventRunStarted   = "run.started"
+	EventNodeJoined   = "node.joined"
+	EventAddonApplied = "addon.applied"
+	EventAddonDeleted = "addon.deleted"
+	EventAddonFailed  = "addon.failed"
+	EventLinkCreated  = "link.created"
+	EventRunFinished  = "run.finished"
+	EventTest         = "test"
+)
+
+// queueSize is how many events may wait for delivery before further events are dropped.
+const queueSize = 256
+
+// Event is a run event as posted to webhooks (the JSON payload, or the data of a template).
+//
+// Fields:
+//   - Type: Event type, e.g. "addon.applied".
+//   - Time: Time the event happened.
+//   - Run: ID shared by the events of one run.
+//   - Cluster: Cluster display name.
+//   - Node: Node name, for node events.
+//   - Addon: Addon name, for addon and link events.
+//   - Step: Step that produced the event, e.g. "join" or "apply".
+//   - Duration: Duration of the step, or of the run for run.finished (nanoseconds).
+//   - Error: Error of a failed step, or of the run, with secrets masked.
+//   - Steps: Number of steps run on the cluster, for run.finished.
+//   - Failed: Number of failed steps on the cluster, for run.finished.
+type Event struct {
+	Type     string        `json:"type"`
+	Time     time.Time     `json:"time"`
+	Run      string        `json:"run"`
+	Cluster  string        `json:"cluster"`
+	Node     string        `json:"node,omitempty"`
+	Addon    string        `json:"addon,omitempty"`
+	Step     string        `json:"step,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Steps    int           `json:"steps,omitempty"`
+	Failed   int           `json:"failed,omitempty"`
+}
+
+// delivery is an event waiting to be posted to a webhook.
+type delivery struct {
+	webhook *webhook
+	event   Event
+}
+
+// Notifier posts the events of one run to the webhooks of its clusters. It receives the step
+// events as a utils.Progress and delivers them in order from a background goroutine, so a slow
+// webhook never delays the run.
+type Notifier struct {
+	global   []*webhook
+	clusters map[string][]*webhook
+	logger   *utils.Logger
+	client   *http.Client
+	run      string
+	started  time.Time
+
+	queue     chan delivery
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a notifier for a run on the given clusters. Webhooks with an invalid URL or
+// template are reported in the returned error and skipped; the notifier still delivers to the
+// others.
+//
+// Parameters:
+//
+//	global: Webhooks notified of the events of every cluster.
+//	clusters: Clusters of the run; their Webhooks are notified of their own events.
+//	logger: Logger for delivery failures.
+//
+// Returns:
+//
+//	*Notifier: the notifier, or nil if no webhook is configured; Close it after the run.
+//	error: Errors of the invalid webhooks, joined.
+func New(global []types.Webhook, clusters []*types.Cluster, logger *utils.Logger) (*Notifier, error) {
+	var errs []error
+	parse := func(configs []types.Webhook) []*webhook {
+		var hooks []*webhook
+		for _, config := range configs {
+			hook, err := newWebhook(config)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			hooks = append(hooks, hook)
+		}
+		return hooks
+	}
+	n := &Notifier{global: parse(global), clusters: make(map[string][]*webhook)}
+	count := len(n.global)
+	for _, c := range clusters {
+		if hooks := parse(c.Webhooks); len(hooks) > 0 {
+			n.clusters[c.DisplayName()] = hooks
+			count += len(hooks)
+		}
+	}
+	if count == 0 {
+		return nil, errors.Join(errs...)
+	}
+	n.logger = logger
+	n.client = &http.Client{}
+	n.run = newID()
+	n.started = time.Now()
+	n.queue = make(chan delivery, queueSize)
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.done = make(chan struct{})
+	go n.work()
+	return n, errors.Join(errs...)
+}
+
+// work delivers the queued events until the queue is closed.
+func (n *Notifier) work() {
+	defer close(n.done)
+	for d := range n.queue {
+		if err := d.webhook.deliver(n.ctx, n.client, d.event); err != nil {
+			n.logger.Warn("webhook %s: %s event of %s not delivered: %v", d.webhook.name(), d.event.Type, d.event.Cluster, err)
+			continue
+		}
+		n.logger.Debug("webhook %s: delivered %s event of %s", d.webhook.name(), d.event.Type, d.event.Cluster)
+	}
+}
+
+// Notify queues an event for the global webhooks and those of its cluster that subscribed to
+// it. If the queue is full the event is dropped with a warning. It does nothing on a nil
+// Notifier.
+//
+// Parameters:
+//
+//	event: The event; Time and Run are filled in if empty.
+func (n *Notifier) Notify(event Event) {
+	if n == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Run == "" {
+		event.Run = n.run
+	}
+	event.Error = utils.Redact(event.Error)
+	hooks := append(append([]*webhook(nil), n.global...), n.clusters[event.Cluster]...)
+	for _, hook := range hooks {
+		if !hook.wants(event.Type) {
+			continue
+		}
+		select {
+		case n.queue <- delivery{webhook: hook, event: event}:
+		default:
+			n.logger.Warn("webhook %s: queue full, %s event of %s dropped", hook.name(), event.Type, event.Cluster)
+		}
+	}
+}
+
+// RunStarted sends a run.started event for every cluster of the run.
+//
+// Parameters:
+//
+//	clusters: Display names of the clusters of the run.
+func (n *Notifier) RunStarted(clusters []string) {
+	if n == nil {
+		return
+	}
+	for _, name := range clusters {
+		n.Notify(Event{Type: EventRunStarted, Time: n.started, Cluster: name})
+	}
+}
+
+// RunFinished sends a run.finished event for every cluster of the run with the number of its
+// steps and failures, and the error of its first failed step or "run cancelled".
+//
+// Parameters:
+//
+//	clusters: Display names of the clusters of the run.
+//	summary: Summary of the run.
+//	err: Error returned by the run.
+func (n *Notifier) RunFinished(clusters []string, summary *cluster.Summary, err error) {
+	if n == nil {
+		return
+	}
+	duration := time.Since(n.started)
+	for _, name := range clusters {
+		event := Event{Type: EventRunFinished, Cluster: name, Duration: duration}
+		for _, step := range summary.Steps {
+			if step.Cluster != name {
+				continue
+			}
+			event.Steps++
+			if step.Failed() {
+				event.Failed++
+				if event.Error == "" {
+					event.Error = step.Error
+				}
+			}
+		}
+		if event.Failed == 0 && errors.Is(err, context.Canceled) {
+			event.Error = "run cancelled"
+		}
+		n.Notify(event)
+	}
+}
+
+// StepStarted implements utils.Progress; starting a step is not an event.
+func (n *Notifier) StepStarted(utils.StepInfo) {}
+
+// StepCommand implements utils.Progress; commands are not events.
+func (n *Notifier) StepCommand(utils.StepInfo, string) {}
+
+// StepFinished implements utils.Progress and sends the event of a finished step, if it is one:
+// node.joined for an installed or joined node, addon.applied, addon.deleted or addon.failed
+// for an addon step and link.created for a created link.
+func (n *Notifier) StepFinished(step utils.StepInfo, duration time.Duration, err error) {
+	event := Event{Cluster: step.Cluster, Node: step.Node, Addon: step.Addon, Step: step.Step, Duration: duration}
+	switch {
+	case (step.Step == "install" || step.Step == "join") && err == nil:
+		event.Type = EventNodeJoined
+	case step.Step == "apply" || step.Step == "delete":
+		event.Type = EventAddonApplied
+		if step.Step == "delete" {
+			event.Type = EventAddonDeleted
+		}
+		if err != nil {
+			event.Type = EventAddonFailed
+			event.Error = err.Error()
+		}
+	case step.Step == "link" && err == nil:
+		event.Type = EventLinkCreated
+	default:
+		return
+	}
+	n.Notify(event)
+}
+
+// Close waits up to timeout for the queued events to be delivered, then abandons the rest.
+// It does nothing on a nil Notifier.
+//
+// Parameters:
+//
+//	timeout: Maximum time to wait.
+//
+// Returns:
+//
+//	Error if events were still pending when the timeout expired.
+func (n *Notifier) Close(timeout time.Duration) error {
+	if n == nil {
+		return nil
+	}
+	n.closeOnce.Do(func() { close(n.queue) })
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-n.done:
+		n.cancel()
+		return nil
+	case <-timer.C:
+		n.cancel()
+		<-n.done
+		return errors.New("webhook events still pending after " + timeout.String())
+	}
+}
+
+// Test posts a test event synchronously to every given webhook, without retries, e.g. to
+// check webhooks against a local HTTP stand-in.
+//
+// Parameters:
+//
+//	ctx: Context of the requests.
+//	webhooks: Webhooks to test.
+//	cluster: Cluster display name reported in the event ("" for global webhooks).
+//
+// Returns:
+//
+//	[]error: the outcome per webhook, in order; nil entries were delivered.
+func Test(ctx context.Context, webhooks []types.Webhook, cluster string) []error {
+	client := &http.Client{}
+	event := Event{Type: EventTest, Time: time.Now(), Run: newID(), Cluster: cluster}
+	results := make([]error, len(webhooks))
+	for i, config := range webhooks {
+		hook, err := newWebhook(config)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		body, err := hook.payload(event)
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		_, results[i] = hook.post(ctx, client, event.Type, newID(), body)
+	}
+	return results
+}
@@ -0,0 +1,227 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Headers of webhook requests.
+const (
+	HeaderEvent     = "X-K3sd-Event"
+	HeaderDelivery  = "X-K3sd-Delivery"
+	HeaderSignature = "X-K3sd-Signature"
+)
+
+const (
+	// defaultRetries is how often a failed delivery is retried unless the webhook says otherwise.
+	defaultRetries = 3
+	// retryDelay is the delay before the first retry; it doubles with every further retry.
+	retryDelay = time.Second
+	// requestTimeout bounds a single delivery attempt.
+	requestTimeout = 10 * time.Second
+)
+
+// webhook is a configured webhook with its parsed payload template.
+type webhook struct {
+	types.Webhook
+	template *template.Template
+}
+
+// newWebhook parses the payload template of a webhook.
+func newWebhook(config types.Webhook) (*webhook, error) {
+	if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		// the parse error quotes the URL, which may hold a token
+		return nil, errors.New("webhook URL must be an http:// or https:// URL")
+	}
+	w := &webhook{Webhook: config}
+	if config.Template != "" {
+		tmpl, err := template.New("payload").Funcs(templateFuncs).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: template: %w", w.name(), err)
+		}
+		w.template = tmpl
+	}
+	return w, nil
+}
+
+// templateFuncs are the functions available in payload templates.
+var templateFuncs = template.FuncMap{
+	// json encodes a value as JSON, e.g. to quote a string: {"text": {{json .Error}}}
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// wants reports whether the webhook subscribed to an event type. Patterns such as "addon.*"
+// match every event of a group.
+func (w *webhook) wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, pattern := range w.Events {
+		if ok, _ := path.Match(pattern, eventType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns the scheme and host of the webhook URL, for log messages.
+func (w *webhook) name() string {
+	if host := Host(w.URL); host != "" {
+		return host
+	}
+	return "webhook"
+}
+
+// Host returns the scheme and host of a webhook URL, to refer to the webhook in messages: the
+// full URL may hold a token.
+//
+// Parameters:
+//
+//	rawURL: Webhook URL.
+//
+// Returns:
+//
+//	string: e.g. "https://hooks.example.com", or "" if the URL is invalid.
+func Host(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// payload renders the request body of an event.
+func (w *webhook) payload(event Event) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, event); err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// deliver posts an event to the webhook, retrying failed attempts with exponential backoff.
+// Network errors, 429 and 5xx responses are retried, other responses are not.
+func (w *webhook) deliver(ctx context.Context, client *http.Client, event Event) error {
+	body, err := w.payload(event)
+	if err != nil {
+		return err
+	}
+	retries := w.Retries
+	if retries <= 0 {
+		retries = defaultRetries
+	}
+	delivery := newID()
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, client, event.Type, delivery, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (giving up: %v)", err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth retrying.
+func (w *webhook) post(ctx context.Context, client *http.Client, eventType, delivery string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	contentType := w.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "k3sd/"+utils.Version)
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderDelivery, delivery)
+	if w.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(w.Secret, body))
+	}
+	for key, value := range w.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// the error quotes the URL, which may hold a token
+		return true, fmt.Errorf("post to %s failed", w.name())
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("%s answered %s", w.name(), resp.Status)
+}
+
+// Sign returns the signature of a payload as sent in the X-K3sd-Signature header:
+// "sha256=" followed by the hex HMAC-SHA256 of the payload keyed with the webhook secret.
+//
+// Parameters:
+//
+//	secret: Webhook secret.
+//	payload: Request body.
+//
+// Returns:
+//
+//	string: the header value.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether a signature header matches a payload, for receivers written in Go.
+//
+// Parameters:
+//
+//	secret: Webhook secret.
+//	payload: Request body.
+//	signature: Value of the X-K3sd-Signature header.
+//
+// Returns:
+//
+//	bool: true if the signature is valid.
+func Verify(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}
+
+// newID returns a random identifier of deliveries and runs.
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
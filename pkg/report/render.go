@@ -0,0 +1,120 @@
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/cluster"
+)
+
+// RenderJSON writes the report as indented JSON.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	report: The report.
+//
+// Returns:
+//
+//	Error if encoding or writing fails.
+func RenderJSON(w io.Writer, report *Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Time     float64      `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Time      float64     `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr,omitempty"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// RenderJUnit writes the report as JUnit XML: one test suite per cluster and one test case
+// per step, with the commands of the step as its output.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	report: The report.
+//
+// Returns:
+//
+//	Error if encoding or writing fails.
+func RenderJUnit(w io.Writer, report *Report) error {
+	suites := junitSuites{
+		Name:     "k3sd",
+		Tests:    report.Steps,
+		Failures: report.Failed,
+		Time:     report.Duration.Seconds(),
+	}
+	for _, clusterReport := range report.Clusters {
+		suite := junitSuite{Name: clusterReport.Name, Timestamp: report.StartedAt.Format("2006-01-02T15:04:05")}
+		var steps []cluster.StepResult
+		steps = append(steps, clusterReport.Steps...)
+		for _, node := range clusterReport.Nodes {
+			steps = append(steps, node.Steps...)
+		}
+		for _, addon := range clusterReport.Addons {
+			steps = append(steps, addon.Steps...)
+		}
+		for _, step := range steps {
+			testCase := junitCase{
+				Name:      stepLabel(step),
+				ClassName: "k3sd." + clusterReport.Name,
+				Time:      step.Duration.Seconds(),
+				SystemOut: strings.Join(step.Commands, "\n"),
+			}
+			if step.Failed() {
+				testCase.Failure = &junitFailure{Message: firstLine(step.Error), Text: step.Error}
+				suite.Failures++
+			}
+			suite.Tests++
+			suite.Time += testCase.Time
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		suites.Suites = append(suites.Suites, suite)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,228 @@
+// Package report builds machine-readable reports of apply runs for CI pipelines.
+package report
+
+import (
+	"context"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/addons"
+	"github.com/argon-chat/k3sd/pkg/cluster"
+	"github.com/argon-chat/k3sd/pkg/clusterutils"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Report is the outcome of an apply run.
+//
+// Fields:
+//   - Version: k3sd version that ran.
+//   - StartedAt: Time the run started.
+//   - FinishedAt: Time the run finished.
+//   - Duration: Time the run took.
+//   - Success: Whether every step succeeded.
+//   - Steps: Number of steps run.
+//   - Failed: Number of failed steps.
+//   - Error: Error of the run, if any.
+//   - TraceID: ID of the run's trace, if spans were recorded; each step carries its span ID.
+//   - Clusters: Per-cluster results.
+type Report struct {
+	Version    string          `json:"version"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Duration   time.Duration   `json:"duration"`
+	Success    bool            `json:"success"`
+	Steps      int             `json:"steps"`
+	Failed     int             `json:"failed"`
+	Error      string          `json:"error,omitempty"`
+	TraceID    string          `json:"traceId,omitempty"`
+	Clusters   []ClusterReport `json:"clusters"`
+}
+
+// ClusterReport is the outcome of a run on one cluster.
+//
+// Fields:
+//   - Name: Cluster display name.
+//   - Address: Master node address.
+//   - DBVersion: Version recorded in the database by the run (0 if none was recorded).
+//   - Steps: Steps acting on the cluster as a whole (connect excluded, see Nodes).
+//   - Nodes: Steps per node.
+//   - Addons: Addon actions and their steps.
+//   - Errors: Errors of all failed steps of the cluster.
+type ClusterReport struct {
+	Name      string               `json:"name"`
+	Address   string               `json:"address"`
+	DBVersion int                  `json:"dbVersion"`
+	Steps     []cluster.StepResult `json:"steps"`
+	Nodes     []NodeReport         `json:"nodes"`
+	Addons    []AddonReport        `json:"addons"`
+	Errors    []string             `json:"errors,omitempty"`
+}
+
+// NodeReport is the outcome of a run on one node.
+//
+// Fields:
+//   - Name: Node name.
+//   - Steps: Steps acting on the node.
+type NodeReport struct {
+	Name  string               `json:"name"`
+	Steps []cluster.StepResult `json:"steps"`
+}
+
+// AddonReport is the action taken for one addon.
+//
+// Fields:
+//   - Name: Addon name.
+//   - Custom: Whether the addon is a custom addon.
+//   - Migration: Migration status: "apply", "delete" or "noop".
+//   - Release: Helm release after the run, if the addon installs one.
+//   - ReleaseError: Error returned when reading the Helm release.
+//   - Steps: Steps acting on the addon.
+type AddonReport struct {
+	Name         string                        `json:"name"`
+	Custom       bool                          `json:"custom"`
+	Migration    string                        `json:"migration"`
+	Release      *clusterutils.HelmReleaseInfo `json:"release,omitempty"`
+	ReleaseError string                        `json:"releaseError,omitempty"`
+	Steps        []cluster.StepResult          `json:"steps,omitempty"`
+}
+
+// Build assembles the report of an apply run and reads the Helm release revisions of the
+// installed addons from the clusters.
+//
+// Parameters:
+//
+//	ctx: Context of the Helm queries.
+//	clusters: Clusters as returned by the run.
+//	summary: Summary returned by the run.
+//	runErr: Error returned by the run.
+//	started: Time the run started.
+//	logger: Logger of the run (used for the kubeconfig session ID).
+//
+// Returns:
+//
+//	*Report: the report.
+func Build(ctx context.Context, clusters []types.Cluster, summary *cluster.Summary, runErr error, started time.Time, logger *utils.Logger) *Report {
+	finished := time.Now()
+	report := &Report{
+		Version:    utils.Version,
+		StartedAt:  started,
+		FinishedAt: finished,
+		Duration:   finished.Sub(started),
+		Success:    runErr == nil,
+		Steps:      len(summary.Steps),
+		Failed:     summary.Failed(),
+		TraceID:    summary.TraceID,
+		Clusters:   []ClusterReport{},
+	}
+	if runErr != nil {
+		report.Error = utils.Redact(runErr.Error())
+	}
+	for ci := range clusters {
+		if clusterReport, ok := buildCluster(ctx, &clusters[ci], summary, logger); ok {
+			report.Clusters = append(report.Clusters, clusterReport)
+		}
+	}
+	return report
+}
+
+// buildCluster returns the report of one cluster, and false if the run did not touch it.
+func buildCluster(ctx context.Context, target *types.Cluster, summary *cluster.Summary, logger *utils.Logger) (ClusterReport, bool) {
+	name := target.DisplayName()
+	result := ClusterReport{
+		Name:      name,
+		Address:   target.Address,
+		DBVersion: summary.Versions[name],
+		Steps:     []cluster.StepResult{},
+		Nodes:     []NodeReport{},
+		Addons:    []AddonReport{},
+	}
+	touched := false
+	nodes := make(map[string]int)
+	addonSteps := make(map[string][]cluster.StepResult)
+	for _, step := range summary.Steps {
+		if step.Cluster != name {
+			continue
+		}
+		touched = true
+		if step.Failed() {
+			result.Errors = append(result.Errors, stepLabel(step)+": "+step.Error)
+		}
+		switch {
+		case step.Addon != "":
+			addonSteps[step.Addon] = append(addonSteps[step.Addon], step)
+		case step.Node != "":
+			ni, ok := nodes[step.Node]
+			if !ok {
+				ni = len(result.Nodes)
+				nodes[step.Node] = ni
+				result.Nodes = append(result.Nodes, NodeReport{Name: step.Node})
+			}
+			result.Nodes[ni].Steps = append(result.Nodes[ni].Steps, step)
+		default:
+			result.Steps = append(result.Steps, step)
+		}
+	}
+
+	kubeconfig := clusterutils.KubeConfigPath(target, logger)
+	for _, addon := range summary.Addons {
+		if addon.Cluster != name {
+			continue
+		}
+		addonReport := AddonReport{
+			Name:      addon.Name,
+			Custom:    addon.Custom,
+			Migration: addon.Migration,
+			Steps:     addonSteps[addon.Name],
+		}
+		if release := addonRelease(target, addon); release != nil && addon.Migration != "delete" {
+			info, err := clusterutils.GetHelmReleaseStatus(ctx, kubeconfig, release.Name, release.Namespace)
+			if err != nil {
+				addonReport.ReleaseError = err.Error()
+			} else {
+				addonReport.Release = info
+			}
+		}
+		result.Addons = append(result.Addons, addonReport)
+	}
+	// linking is recorded as a step of the linkerd-mc addon even when the addon itself was a noop
+	if steps, ok := addonSteps["linkerd-mc"]; ok && !hasAddon(result.Addons, "linkerd-mc") {
+		result.Addons = append(result.Addons, AddonReport{Name: "linkerd-mc", Migration: "noop", Steps: steps})
+	}
+	return result, touched
+}
+
+// addonRelease returns the Helm release installed by an addon, or nil if it installs none.
+func addonRelease(target *types.Cluster, addon cluster.AddonResult) *addons.Workload {
+	if !addon.Custom {
+		return addons.AddonRegistry[addon.Name].Release
+	}
+	custom, ok := target.CustomAddons[addon.Name]
+	if !ok || custom.Helm == nil {
+		return nil
+	}
+	namespace := custom.Helm.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &addons.Workload{Name: addon.Name, Namespace: namespace}
+}
+
+func hasAddon(reports []AddonReport, name string) bool {
+	for _, report := range reports {
+		if report.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stepLabel names a step by its node or addon, e.g. "node worker1 join".
+func stepLabel(step cluster.StepResult) string {
+	switch {
+	case step.Addon != "":
+		return "addon " + step.Addon + " " + step.Step
+	case step.Node != "":
+		return "node " + step.Node + " " + step.Step
+	}
+	return step.Step
+}
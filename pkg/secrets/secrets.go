@@ -0,0 +1,371 @@
+// Package secrets resolves the secret references of cluster configs. Any string value of a
+// config may be a reference instead of the value itself:
+//
+//   - env:NAME: The value of the environment variable NAME.
+//   - file:PATH: The content of the file at PATH, without trailing line breaks.
+//   - exec:COMMAND: The output of COMMAND, run with sh, without trailing line breaks.
+//   - secret:NAME: The secret NAME of the local encrypted store (see Store).
+//
+// References are resolved only in memory, right before a run needs the values. The config
+// keeps the references, and the cluster versions recorded in the database hold them in place
+// of the resolved values (see Resolver.Seal), with the fields decrypted from configs encrypted
+// at rest masked.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// Schemes of secret references, with the separating colon.
+const (
+	SchemeEnv    = "env:"
+	SchemeFile   = "file:"
+	SchemeExec   = "exec:"
+	SchemeSecret = "secret:"
+)
+
+var schemes = []string{SchemeEnv, SchemeFile, SchemeExec, SchemeSecret}
+
+// IsRef reports whether a config value is a secret reference.
+//
+// Parameters:
+//   - value: A string value of a config.
+//
+// Returns:
+//   - bool: True if value starts with the scheme of a secret reference.
+func IsRef(value string) bool {
+	for _, scheme := range schemes {
+		if strings.HasPrefix(value, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver resolves secret references, and remembers the fields it resolved them in so that
+// Seal can put the references back. It is safe for concurrent use.
+//
+// Fields:
+//   - StorePath: Path of the local encrypted store; DefaultStorePath() if empty.
+type Resolver struct {
+	StorePath string
+
+	mu sync.Mutex
+	// resolved maps the keys of the values passed to Resolve to the fields it resolved in them,
+	// by path.
+	resolved map[string]map[string]resolvedField
+}
+
+// resolvedField is a field that held a secret reference.
+//
+// Fields:
+//   - value: The value the reference was resolved to.
+//   - ref: The reference.
+type resolvedField struct {
+	value string
+	ref   string
+}
+
+// ClusterKey returns the key a cluster is passed to Resolve and Seal with: its master address and
+// node name, which also identify its recorded versions.
+//
+// Parameters:
+//   - cluster: The cluster.
+//
+// Returns:
+//   - string: The key of the cluster.
+func ClusterKey(cluster *types.Cluster) string {
+	return cluster.Address + "/" + cluster.NodeName
+}
+
+// Value resolves a single value. Values that are not secret references are returned as they
+// are. Resolved values are masked in all output.
+//
+// Parameters:
+//   - ctx: Context of the command of an exec: reference.
+//   - value: The value, or a secret reference.
+//
+// Returns:
+//   - string: The resolved value.
+//   - error: Error if the reference cannot be resolved.
+func (r *Resolver) Value(ctx context.Context, value string) (string, error) {
+	if !IsRef(value) {
+		return value, nil
+	}
+	scheme, rest, _ := strings.Cut(value, ":")
+	if rest == "" {
+		return "", fmt.Errorf("secret reference %q names nothing", value)
+	}
+	var result string
+	var err error
+	switch scheme + ":" {
+	case SchemeEnv:
+		var ok bool
+		if result, ok = os.LookupEnv(rest); !ok {
+			err = fmt.Errorf("environment variable %s is not set", rest)
+		}
+	case SchemeFile:
+		result, err = readFile(rest)
+	case SchemeExec:
+		result, err = runCommand(ctx, rest)
+	case SchemeSecret:
+		var store *Store
+		if store, err = OpenStore(r.StorePath); err == nil {
+			result, err = store.Get(rest)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", value, err)
+	}
+	utils.RegisterSecret(result)
+	return result, nil
+}
+
+// Resolve replaces the secret references in all string fields, list items and map values of a
+// value in place, e.g. of a *types.Cluster. Map keys are not resolved. The fields resolved are
+// remembered under key for Seal, replacing those of the last value resolved under the same key;
+// fields that still hold the value they were resolved to then are left alone, so resolving a
+// value twice is harmless.
+//
+// Parameters:
+//   - ctx: Context of the commands of exec: references.
+//   - key: Identifies the value among those resolved by r, e.g. ClusterKey of a cluster.
+//   - v: Pointer to the value to resolve.
+//
+// Returns:
+//   - error: The joined errors of the references that cannot be resolved, each prefixed with
+//     the path of its field (e.g. "workers[0].password").
+func (r *Resolver) Resolve(ctx context.Context, key string, v any) error {
+	r.mu.Lock()
+	previous := r.resolved[key]
+	r.mu.Unlock()
+	fields := make(map[string]resolvedField)
+	err := r.resolve(ctx, "", reflect.ValueOf(v), previous, fields)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resolved == nil {
+		r.resolved = make(map[string]map[string]resolvedField)
+	}
+	r.resolved[key] = fields
+	return err
+}
+
+// resolve resolves the references of the value at path, adding the fields resolved to fields.
+// The fields in previous, resolved before, are kept as they are.
+func (r *Resolver) resolve(ctx context.Context, path string, value reflect.Value, previous, fields map[string]resolvedField) error {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			return r.resolve(ctx, path, value.Elem(), previous, fields)
+		}
+	case reflect.String:
+		if !value.CanSet() {
+			return nil
+		}
+		result, err := r.field(ctx, path, value.String(), previous, fields)
+		if err != nil {
+			return err
+		}
+		value.SetString(result)
+	case reflect.Slice, reflect.Array:
+		var errs []error
+		for i := 0; i < value.Len(); i++ {
+			errs = append(errs, r.resolve(ctx, fmt.Sprintf("%s[%d]", path, i), value.Index(i), previous, fields))
+		}
+		return errors.Join(errs...)
+	case reflect.Map:
+		var errs []error
+		for _, key := range sortedKeys(value) {
+			item := reflect.New(value.Type().Elem()).Elem()
+			item.Set(value.MapIndex(key))
+			errs = append(errs, r.resolve(ctx, JoinPath(path, key.String()), item, previous, fields))
+			value.SetMapIndex(key, item)
+		}
+		return errors.Join(errs...)
+	case reflect.Struct:
+		var errs []error
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			fieldPath := path
+			if !field.Anonymous {
+				if name == "" {
+					name = field.Name
+				}
+				fieldPath = JoinPath(path, name)
+			}
+			errs = append(errs, r.resolve(ctx, fieldPath, value.Field(i), previous, fields))
+		}
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// field resolves the string field at path and returns its value.
+func (r *Resolver) field(ctx context.Context, path, value string, previous, fields map[string]resolvedField) (string, error) {
+	if field, ok := previous[path]; ok && field.value == value {
+		fields[path] = field
+		return value, nil
+	}
+	if !IsRef(value) {
+		return value, nil
+	}
+	result, err := r.Value(ctx, value)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	fields[path] = resolvedField{value: result, ref: value}
+	return result, nil
+}
+
+// Seal replaces the values r resolved in a JSON document by their references, so that the
+// document can be stored without the secrets. A string is replaced only if it is in a field
+// that held a reference to it when the value with the same key was last resolved: other fields
+// that happen to hold the same value, like a user named after a resolved password, and other
+// values are kept. The strings of the concealed fields are masked with utils.Redacted, unless
+// they were resolved from a reference. A nil Resolver only masks those.
+//
+// Parameters:
+//   - key: The key the value of the document was resolved with, e.g. ClusterKey of a cluster.
+//   - data: The JSON document of a value passed to Resolve, e.g. an encoded cluster.
+//   - concealed: Paths of the fields to mask, like the decrypted fields of a cluster (see
+//     types.Cluster.DecryptedFields).
+//
+// Returns:
+//   - []byte: The sealed document; data itself if it holds no resolved value.
+//   - error: Error if data is not valid JSON.
+func (r *Resolver) Seal(key string, data []byte, concealed ...string) ([]byte, error) {
+	var fields map[string]resolvedField
+	if r != nil {
+		r.mu.Lock()
+		fields = r.resolved[key]
+		r.mu.Unlock()
+	}
+	if len(fields) == 0 && len(concealed) == 0 {
+		return data, nil
+	}
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	masked := make(map[string]bool, len(concealed))
+	for _, path := range concealed {
+		masked[path] = true
+	}
+	doc, sealed := seal("", doc, fields, masked)
+	if !sealed {
+		return data, nil
+	}
+	return json.Marshal(doc)
+}
+
+// seal returns v, the value at path, with the resolved fields replaced by their references and
+// the masked fields masked, and whether any was.
+func seal(path string, v any, fields map[string]resolvedField, masked map[string]bool) (any, bool) {
+	switch v := v.(type) {
+	case string:
+		if field, ok := fields[path]; ok && field.value == v {
+			return field.ref, true
+		}
+		if masked[path] && v != "" {
+			return utils.Redacted, true
+		}
+	case map[string]any:
+		changed := false
+		for key, item := range v {
+			var sealed bool
+			if v[key], sealed = seal(JoinPath(path, key), item, fields, masked); sealed {
+				changed = true
+			}
+		}
+		return v, changed
+	case []any:
+		changed := false
+		for i, item := range v {
+			var sealed bool
+			if v[i], sealed = seal(fmt.Sprintf("%s[%d]", path, i), item, fields, masked); sealed {
+				changed = true
+			}
+		}
+		return v, changed
+	}
+	return v, false
+}
+
+// readFile returns the content of a file without trailing line breaks. A leading "~/" is the
+// home directory.
+func readFile(path string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, rest)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// runCommand runs a command with sh and returns its output without trailing line breaks.
+func runCommand(ctx context.Context, command string) (string, error) {
+	cmd := utils.ExecCommand(ctx, "sh", "-c", command)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// JoinPath returns the path of a key of the object at path, like the paths of pkg/validate:
+// keys that would be ambiguous in a path are quoted.
+//
+// Parameters:
+//   - path: Path of the object; empty for the top level.
+//   - key: The key.
+//
+// Returns:
+//   - string: The path of the key, like "workers[0].password".
+func JoinPath(path, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\" ") {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/argon-chat/k3sd/pkg/types"
+)
+
+// TestSealByField checks that Seal puts references back only into the fields that held them,
+// not into other fields holding the same value.
+func TestSealByField(t *testing.T) {
+	t.Setenv("K3SD_TEST_SEAL_PASSWORD", "root")
+	t.Setenv("K3SD_TEST_SEAL_DB_PASSWORD", "admin")
+	cluster := types.Cluster{
+		Worker: types.Worker{Address: "10.0.0.1", User: "root", Password: "env:K3SD_TEST_SEAL_PASSWORD", NodeName: "master"},
+		Workers: []types.Worker{
+			{Address: "10.0.0.2", User: "admin", Password: "env:K3SD_TEST_SEAL_PASSWORD", NodeName: "worker"},
+		},
+		Addons: map[string]types.AddonConfig{
+			"gitea": {Enabled: true, Subs: map[string]string{
+				"${POSTGRES_USER}":     "admin",
+				"${POSTGRES_PASSWORD}": "env:K3SD_TEST_SEAL_DB_PASSWORD",
+			}},
+		},
+	}
+	resolver := &Resolver{}
+	if err := resolver.Resolve(context.Background(), ClusterKey(&cluster), &cluster); err != nil {
+		t.Fatal(err)
+	}
+	if cluster.Password != "root" || cluster.Addons["gitea"].Subs["${POSTGRES_PASSWORD}"] != "admin" {
+		t.Fatalf("references not resolved: %+v", cluster)
+	}
+
+	data, err := json.Marshal(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = resolver.Seal(ClusterKey(&cluster), data); err != nil {
+		t.Fatal(err)
+	}
+	var sealed types.Cluster
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []struct{ field, got, want string }{
+		{"password", sealed.Password, "env:K3SD_TEST_SEAL_PASSWORD"},
+		{"workers[0].password", sealed.Workers[0].Password, "env:K3SD_TEST_SEAL_PASSWORD"},
+		{"subs[${POSTGRES_PASSWORD}]", sealed.Addons["gitea"].Subs["${POSTGRES_PASSWORD}"], "env:K3SD_TEST_SEAL_DB_PASSWORD"},
+		{"user", sealed.User, "root"},
+		{"workers[0].user", sealed.Workers[0].User, "admin"},
+		{"subs[${POSTGRES_USER}]", sealed.Addons["gitea"].Subs["${POSTGRES_USER}"], "admin"},
+	} {
+		if check.got != check.want {
+			t.Errorf("sealed %s = %q, want %q", check.field, check.got, check.want)
+		}
+	}
+}
+
+// TestSealByCluster checks that Seal puts references back only into the cluster they were
+// resolved in, and only those of its last resolution.
+func TestSealByCluster(t *testing.T) {
+	t.Setenv("K3SD_TEST_SEAL_PASSWORD", "first-password")
+	resolver := &Resolver{}
+	resolved := types.Cluster{Worker: types.Worker{Address: "10.0.0.1", NodeName: "master", Password: "env:K3SD_TEST_SEAL_PASSWORD"}}
+	if err := resolver.Resolve(context.Background(), ClusterKey(&resolved), &resolved); err != nil {
+		t.Fatal(err)
+	}
+	literal := types.Cluster{Worker: types.Worker{Address: "10.0.1.1", NodeName: "master", Password: "first-password"}}
+	if err := resolver.Resolve(context.Background(), ClusterKey(&literal), &literal); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := func(cluster types.Cluster) string {
+		t.Helper()
+		data, err := json.Marshal(cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err = resolver.Seal(ClusterKey(&cluster), data); err != nil {
+			t.Fatal(err)
+		}
+		var out types.Cluster
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Password
+	}
+	if got := sealed(resolved); got != "env:K3SD_TEST_SEAL_PASSWORD" {
+		t.Errorf("sealed password of the resolved cluster = %q, want the reference", got)
+	}
+	if got := sealed(literal); got != "first-password" {
+		t.Errorf("sealed password of the other cluster = %q, want its literal value", got)
+	}
+
+	// a rotated value replaces the one resolved before
+	t.Setenv("K3SD_TEST_SEAL_PASSWORD", "second-password")
+	rotated := types.Cluster{Worker: types.Worker{Address: "10.0.0.1", NodeName: "master", Password: "env:K3SD_TEST_SEAL_PASSWORD"}}
+	if err := resolver.Resolve(context.Background(), ClusterKey(&rotated), &rotated); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Password != "second-password" {
+		t.Fatalf("rotated password resolved to %q", rotated.Password)
+	}
+	if got := sealed(rotated); got != "env:K3SD_TEST_SEAL_PASSWORD" {
+		t.Errorf("sealed rotated password = %q, want the reference", got)
+	}
+	if got := sealed(resolved); got != "first-password" {
+		t.Errorf("sealed password resolved before the rotation = %q, want it no longer replaced", got)
+	}
+}
+
+// TestSealConcealed checks that Seal masks the concealed fields only, not other fields holding
+// the same value.
+func TestSealConcealed(t *testing.T) {
+	doc := `{"user":"decrypted","password":"decrypted","workers":[{"password":"decrypted"},{"password":""}]}`
+	data, err := (*Resolver)(nil).Seal("", []byte(doc), "password", "workers[0].password", "workers[1].password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"password":"******","user":"decrypted","workers":[{"password":"******"},{"password":""}]}`
+	if string(data) != want {
+		t.Errorf("sealed %s, want %s", data, want)
+	}
+}
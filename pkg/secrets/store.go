@@ -0,0 +1,277 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// KeyEnv is the environment variable holding the key of the local store, base64-encoded. If it
+// is not set, the key is read from the key file next to the store, which is created with a
+// random key when the first secret is stored.
+const KeyEnv = "K3SD_SECRET_KEY"
+
+// keySize is the size of the AES-256 key of the store.
+const keySize = 32
+
+// ErrNotFound is returned by Store.Get for a secret that is not in the store.
+var ErrNotFound = errors.New("secret not found")
+
+// secretName matches the names of stored secrets.
+var secretName = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_./]*$`)
+
+// Store is the local encrypted secret store, a JSON file mapping secret names to their values
+// encrypted with AES-256-GCM. The key is kept apart from the store, in KeyEnv or a key file
+// readable only by its owner, so that the store itself can be copied and backed up.
+//
+// Fields:
+//   - path: Path of the store file.
+//   - keyPath: Path of the key file.
+type Store struct {
+	path    string
+	keyPath string
+}
+
+// storeFile is the content of the store file.
+//
+// Fields:
+//   - Secrets: Encrypted secrets by name, each the base64 encoding of a nonce and a ciphertext.
+type storeFile struct {
+	Secrets map[string]string `json:"secrets"`
+}
+
+// DefaultStorePath returns the path of the local store, ~/.k3sd/secrets.json.
+//
+// Returns:
+//   - string: The path of the store file.
+//   - error: Error if the home directory cannot be determined.
+func DefaultStorePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".k3sd", "secrets.json"), nil
+}
+
+// OpenStore returns the local store at path. The store file and its key file (secrets.key in
+// the same directory) are created when the first secret is stored.
+//
+// Parameters:
+//   - path: Path of the store file; DefaultStorePath() if empty.
+//
+// Returns:
+//   - *Store: The store.
+//   - error: Error if the default path cannot be determined.
+func OpenStore(path string) (*Store, error) {
+	if path == "" {
+		var err error
+		if path, err = DefaultStorePath(); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{path: path, keyPath: filepath.Join(filepath.Dir(path), "secrets.key")}, nil
+}
+
+// Path returns the path of the store file.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get decrypts a secret.
+//
+// Parameters:
+//   - name: Name of the secret.
+//
+// Returns:
+//   - string: The value of the secret.
+//   - error: ErrNotFound if there is no such secret, or an error if the store cannot be read
+//     or the secret cannot be decrypted with the key.
+func (s *Store) Get(name string) (string, error) {
+	file, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := file.Secrets[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	aead, err := s.cipher(false)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("secret %s is corrupt", name)
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret %s: wrong key or corrupt store", name)
+	}
+	return string(value), nil
+}
+
+// Set encrypts and stores a secret, replacing an existing one of the same name.
+//
+// Parameters:
+//   - name: Name of the secret: letters, digits, '-', '_', '.' and '/'.
+//   - value: The value of the secret.
+//
+// Returns:
+//   - error: Error if the name is invalid or the store cannot be written.
+func (s *Store) Set(name, value string) error {
+	if !secretName.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q: use letters, digits, '-', '_', '.' and '/'", name)
+	}
+	file, err := s.read()
+	if err != nil {
+		return err
+	}
+	aead, err := s.cipher(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	file.Secrets[name] = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), []byte(name)))
+	return s.write(file)
+}
+
+// Delete removes a secret from the store.
+//
+// Parameters:
+//   - name: Name of the secret.
+//
+// Returns:
+//   - error: ErrNotFound if there is no such secret, or an error if the store cannot be written.
+func (s *Store) Delete(name string) error {
+	file, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := file.Secrets[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	delete(file.Secrets, name)
+	return s.write(file)
+}
+
+// Names lists the names of the stored secrets.
+//
+// Returns:
+//   - []string: The names in lexical order.
+//   - error: Error if the store cannot be read.
+func (s *Store) Names() ([]string, error) {
+	file, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(file.Secrets))
+	for name := range file.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// read reads the store file; a missing file is an empty store.
+func (s *Store) read() (*storeFile, error) {
+	file := &storeFile{}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read secret store: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, file); err != nil {
+			return nil, fmt.Errorf("read secret store %s: %w", s.path, err)
+		}
+	}
+	if file.Secrets == nil {
+		file.Secrets = make(map[string]string)
+	}
+	return file, nil
+}
+
+// write replaces the store file.
+func (s *Store) write(file *storeFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("write secret store: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("write secret store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write secret store: %w", err)
+	}
+	return nil
+}
+
+// cipher returns the AEAD of the store key. If create is set and there is no key yet, a random
+// key is written to the key file.
+func (s *Store) cipher(create bool) (cipher.AEAD, error) {
+	key, err := s.key(create)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *Store) key(create bool) ([]byte, error) {
+	encoded, fromEnv := os.LookupEnv(KeyEnv)
+	source := KeyEnv
+	if !fromEnv {
+		source = s.keyPath
+		data, err := os.ReadFile(s.keyPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && create:
+			return s.createKey()
+		case errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("no secret store key: set %s or create %s", KeyEnv, s.keyPath)
+		case err != nil:
+			return nil, fmt.Errorf("read secret store key: %w", err)
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("secret store key in %s must be %d base64-encoded bytes", source, keySize)
+	}
+	return key, nil
+}
+
+// createKey writes a random key to the key file, readable only by its owner.
+func (s *Store) createKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.keyPath), 0700); err != nil {
+		return nil, fmt.Errorf("create secret store key: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(s.keyPath, []byte(encoded), 0600); err != nil {
+		return nil, fmt.Errorf("create secret store key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	clusterpkg "github.com/argon-chat/k3sd/pkg/cluster"
+	"github.com/argon-chat/k3sd/pkg/clusterstore"
+	"github.com/argon-chat/k3sd/pkg/lock"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+	"github.com/argon-chat/k3sd/pkg/validate"
+)
+
+// maxClusterBody is the maximum size of a submitted cluster document.
+const maxClusterBody = 1 << 20
+
+// HistoryEntry is a recorded version of a cluster.
+//
+// Fields:
+//   - Version: Version number.
+//   - CreatedAt: Time the version was recorded, if known.
+//   - Cluster: Recorded cluster state without node passwords and with its secrets masked.
+type HistoryEntry struct {
+	Version   int           `json:"version"`
+	CreatedAt *time.Time    `json:"createdAt,omitempty"`
+	Cluster   types.Cluster `json:"cluster"`
+}
+
+func (s *Server) handleListClusters(w http.ResponseWriter, r *http.Request) {
+	s.configMu.Lock()
+	clusters, err := s.loadClusters()
+	s.configMu.Unlock()
+	if err == nil {
+		err = s.engine.LoadState(r.Context(), clusters)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]types.Cluster, 0, len(clusters))
+	for _, cluster := range clusters {
+		redacted, err := redact(cluster)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		result = append(result, redacted)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleGetCluster(w http.ResponseWriter, r *http.Request) {
+	clusters, ci, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	if err := s.engine.LoadState(r.Context(), clusters[ci:ci+1]); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	redacted, err := redact(clusters[ci])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, redacted)
+}
+
+// handlePutCluster creates or replaces the desired state of a cluster in the config. Node
+// passwords left empty are kept from the config. The install state of the nodes is kept in the
+// database and never written to the config. The config file is locked while it is read and
+// written, so it is not changed under a run of another process that holds its lock.
+func (s *Server) handlePutCluster(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var desired types.Cluster
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxClusterBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&desired); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cluster: %v", err))
+		return
+	}
+	if desired.DisplayName() != name {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("cluster context %q does not match %q", desired.DisplayName(), name))
+		return
+	}
+	if desired.Address == "" || desired.NodeName == "" {
+		writeError(w, http.StatusBadRequest, errors.New("address and nodeName are required"))
+		return
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	held, stale, err := lock.File(s.opts.ConfigPath)
+	var locked *lock.LockedError
+	if errors.As(err, &locked) {
+		writeError(w, http.StatusLocked, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer held.Release()
+	if stale != nil {
+		s.logger.Warn("taking over stale lock on %s", stale)
+	}
+	clusters, err := s.loadClusters()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	desired.Done = false
+	for wi := range desired.Workers {
+		desired.Workers[wi].Done = false
+	}
+	code := http.StatusOK
+	if ci := indexOf(clusters, name); ci >= 0 {
+		// the install state of an older config must reach the database before it is replaced
+		if err := s.engine.LoadState(r.Context(), clusters[ci:ci+1]); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := keepSecrets(&desired, &clusters[ci]); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		clusters[ci] = desired
+	} else {
+		clusters = append(clusters, desired)
+		code = http.StatusCreated
+	}
+	if problems := validate.Clusters(clusters); len(problems) > 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cluster: %w", &validate.Error{Problems: problems}))
+		return
+	}
+	if err := clusterstore.SaveClusters(s.opts.ConfigPath, clusters); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, clusterstore.ErrComposed) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err)
+		return
+	}
+	redacted, err := redact(desired)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, code, redacted)
+}
+
+// keepSecrets fills empty node passwords of dst from the nodes of src with the same name, and
+// the values masked by redact from the same place in src, so a redacted cluster read from the
+// API can be submitted back unchanged.
+func keepSecrets(dst, src *types.Cluster) error {
+	if dst.Password == "" && dst.NodeName == src.NodeName {
+		dst.Password = src.Password
+	}
+	passwords := make(map[string]string)
+	for _, worker := range src.Workers {
+		passwords[worker.NodeName] = worker.Password
+	}
+	for wi := range dst.Workers {
+		if dst.Workers[wi].Password == "" {
+			dst.Workers[wi].Password = passwords[dst.Workers[wi].NodeName]
+		}
+	}
+	dstTree, err := toTree(dst)
+	if err != nil {
+		return err
+	}
+	srcTree, err := toTree(src)
+	if err != nil {
+		return err
+	}
+	var restored types.Cluster
+	if err := fromTree(restoreRedacted(dstTree, srcTree), &restored); err != nil {
+		return err
+	}
+	*dst = restored
+	return nil
+}
+
+// restoreRedacted replaces the utils.Redacted values of the JSON tree dst by the value at the
+// same place in src, if src has one.
+func restoreRedacted(dst, src any) any {
+	switch v := dst.(type) {
+	case map[string]any:
+		srcMap, _ := src.(map[string]any)
+		for key, value := range v {
+			v[key] = restoreRedacted(value, srcMap[key])
+		}
+	case []any:
+		srcList, _ := src.([]any)
+		for i, value := range v {
+			var srcValue any
+			if i < len(srcList) {
+				srcValue = srcList[i]
+			}
+			v[i] = restoreRedacted(value, srcValue)
+		}
+	case string:
+		if srcValue, ok := src.(string); ok && v == utils.Redacted {
+			return srcValue
+		}
+	}
+	return dst
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	clusters, ci, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	if err := s.engine.ResolveSecrets(r.Context(), clusters[ci:ci+1]); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	statuses := s.engine.Status(r.Context(), clusters[ci:ci+1], selectorFromQuery(r, r.PathValue("name")))
+	if len(statuses) == 0 {
+		writeError(w, http.StatusNotFound, errors.New("cluster not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses[0])
+}
+
+func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	clusters, ci, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	plan, err := s.engine.Plan(r.Context(), &clusters[ci], selectorFromQuery(r, r.PathValue("name")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (s *Server) handleApply(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := s.lookup(w, r); !ok {
+		return
+	}
+	name := r.PathValue("name")
+	selector := selectorFromQuery(r, name)
+	s.submit(w, "apply", name, func(ctx context.Context, logger *utils.Logger) error {
+		clusters, ci, err := s.findCluster(name)
+		if err != nil {
+			return err
+		}
+		if ci < 0 {
+			return fmt.Errorf("cluster %s not found", name)
+		}
+		_, _, err = s.engine.WithLogger(logger).Apply(ctx, clusters, selector)
+		return err
+	})
+}
+
+// handleDestroy destroys a cluster. Protected clusters are refused and production clusters
+// require the confirm query parameter to repeat the cluster name.
+func (s *Server) handleDestroy(w http.ResponseWriter, r *http.Request) {
+	clusters, ci, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	if err := clusterpkg.CheckDestroyAllowed(&clusters[ci]); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if clusters[ci].IsProduction() && r.URL.Query().Get("confirm") != name {
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("cluster %s is a production cluster; pass confirm=%s to destroy it", name, name))
+		return
+	}
+	s.submit(w, "destroy", name, func(ctx context.Context, logger *utils.Logger) error {
+		clusters, ci, err := s.findCluster(name)
+		if err != nil {
+			return err
+		}
+		if ci < 0 {
+			return fmt.Errorf("cluster %s not found", name)
+		}
+		_, err = s.engine.WithLogger(logger).Destroy(ctx, clusters, utils.Selector{Clusters: []string{name}})
+		return err
+	})
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	clusters, ci, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	records, err := s.engine.History(r.Context(), &clusters[ci])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	history := make([]HistoryEntry, 0, len(records))
+	for _, record := range records {
+		var recorded types.Cluster
+		if err := json.Unmarshal([]byte(record.Cluster), &recorded); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("decoding version %d: %v", record.Version, err))
+			return
+		}
+		if recorded, err = redact(recorded); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		history = append(history, HistoryEntry{Version: record.Version, CreatedAt: record.CreatedAt, Cluster: recorded})
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (s *Server) handleListJobs(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.jobs.list())
+}
+
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.jobs.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleJobLogs streams the job log as server-sent events: one "log" event per line, and an
+// "end" event carrying the final job state once the job has finished.
+func (s *Server) handleJobLogs(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	lines, sub, ok := s.jobs.subscribe(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+	if sub != nil {
+		defer s.jobs.unsubscribe(id, sub)
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, line := range lines {
+		writeEvent(w, "log", line)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for sub != nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, open := <-sub:
+			if !open {
+				sub = nil
+				continue
+			}
+			writeEvent(w, "log", line)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	job, _ := s.jobs.get(id)
+	writeEvent(w, "end", string(job.State))
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// lookup loads the config and writes a 404 if the cluster in the path does not exist.
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) ([]types.Cluster, int, bool) {
+	clusters, ci, err := s.findCluster(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, -1, false
+	}
+	if ci < 0 {
+		writeError(w, http.StatusNotFound, errors.New("cluster not found"))
+		return nil, -1, false
+	}
+	return clusters, ci, true
+}
+
+func (s *Server) submit(w http.ResponseWriter, jobType, name string, run func(ctx context.Context, logger *utils.Logger) error) {
+	job, err := s.jobs.submit(jobType, name, run)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
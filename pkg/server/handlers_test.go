@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/argon-chat/k3sd/pkg/clusterstore"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/lock"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+const testToken = "test-token"
+
+// testConfig holds secrets in every place the API must mask: node passwords, a secret
+// substitution, a webhook secret and header, a secret hook env value and a substitution whose
+// value was registered as decrypted from an encrypted config.
+const testConfig = `{
+  "clusters": [
+    {
+      "address": "10.0.0.1",
+      "user": "root",
+      "password": "master-password",
+      "nodeName": "master",
+      "context": "dev",
+      "domain": "dev.example.com",
+      "workers": [
+        {"address": "10.0.0.2", "user": "root", "password": "env:K3SD_TEST_WORKER_PASSWORD", "nodeName": "worker"}
+      ],
+      "addons": {
+        "gitea": {
+          "enabled": true,
+          "subs": {
+            "${POSTGRES_USER}": "gitea",
+            "${POSTGRES_PASSWORD}": "postgres-password",
+            "${POSTGRES_DB}": "decrypted-db-name"
+          }
+        }
+      },
+      "webhooks": [
+        {"url": "https://hooks.example.com/k3sd", "secret": "webhook-secret", "headers": {"Authorization": "Bearer webhook-token"}}
+      ],
+      "hooks": {
+        "postAddons": [{"run": "./seed.sh", "env": {"SEED_TOKEN": "seed-token", "SEED_USER": "admin"}}]
+      }
+    }
+  ]
+}
+`
+
+// plaintext are the secrets of testConfig that no response may contain.
+var plaintext = []string{"master-password", "postgres-password", "decrypted-db-name", "webhook-secret", "webhook-token", "seed-token"}
+
+func newTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "clusters.json")
+	if err := os.WriteFile(configPath, []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// stands for a value decrypted from an encrypted config, which is registered when loaded
+	utils.RegisterSecret("decrypted-db-name")
+
+	engine, err := k3sd.New(k3sd.Config{DBPath: filepath.Join(dir, "k3sd.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = engine.Close() })
+	s, err := New(Options{ConfigPath: configPath, Token: testToken}, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, configPath
+}
+
+func request(t *testing.T, handler http.Handler, method, path string, body []byte) (int, []byte) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	data, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, data
+}
+
+func assertNoSecrets(t *testing.T, what string, body []byte) {
+	t.Helper()
+	for _, secret := range plaintext {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("%s returned the secret %q: %s", what, secret, body)
+		}
+	}
+}
+
+func TestResponsesMaskSecrets(t *testing.T) {
+	s, configPath := newTestServer(t)
+	handler := s.Handler()
+
+	clusters, err := clusterstore.LoadClusters(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.engine.Store().InsertCluster(context.Background(), &clusters[0], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := request(t, handler, http.MethodGet, "/api/v1/clusters", nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET /clusters: %d %s", code, body)
+	}
+	assertNoSecrets(t, "GET /clusters", body)
+
+	code, body = request(t, handler, http.MethodGet, "/api/v1/clusters/dev", nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET /clusters/dev: %d %s", code, body)
+	}
+	assertNoSecrets(t, "GET /clusters/dev", body)
+
+	var cluster types.Cluster
+	if err := json.Unmarshal(body, &cluster); err != nil {
+		t.Fatal(err)
+	}
+	if got := cluster.Workers[0].Password; got != "env:K3SD_TEST_WORKER_PASSWORD" {
+		t.Errorf("secret reference = %q, want it kept", got)
+	}
+	if got := cluster.Addons["gitea"].Subs["${POSTGRES_USER}"]; got != "gitea" {
+		t.Errorf("non-secret sub = %q, want it kept", got)
+	}
+	if got := cluster.Hooks.PostAddons[0].Env["SEED_USER"]; got != "admin" {
+		t.Errorf("non-secret hook env = %q, want it kept", got)
+	}
+
+	code, body = request(t, handler, http.MethodGet, "/api/v1/clusters/dev/history", nil)
+	if code != http.StatusOK {
+		t.Fatalf("GET /clusters/dev/history: %d %s", code, body)
+	}
+	assertNoSecrets(t, "GET /clusters/dev/history", body)
+
+	// the redacted cluster submitted back keeps the stored secrets
+	put, err := json.Marshal(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body = request(t, handler, http.MethodPut, "/api/v1/clusters/dev", put)
+	if code != http.StatusOK {
+		t.Fatalf("PUT /clusters/dev: %d %s", code, body)
+	}
+	assertNoSecrets(t, "PUT /clusters/dev", body)
+
+	saved, err := clusterstore.LoadClusters(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved[0].Password != "master-password" {
+		t.Errorf("saved master password = %q", saved[0].Password)
+	}
+	if got := saved[0].Addons["gitea"].Subs["${POSTGRES_PASSWORD}"]; got != "postgres-password" {
+		t.Errorf("saved secret sub = %q", got)
+	}
+	if got := saved[0].Webhooks[0].Secret; got != "webhook-secret" {
+		t.Errorf("saved webhook secret = %q", got)
+	}
+	if got := saved[0].Hooks.PostAddons[0].Env["SEED_TOKEN"]; got != "seed-token" {
+		t.Errorf("saved hook env = %q", got)
+	}
+}
+
+func TestPutRefusesLockedConfig(t *testing.T) {
+	s, configPath := newTestServer(t)
+	held, _, err := lock.File(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	put := []byte(`{"address": "10.0.0.1", "user": "root", "password": "", "nodeName": "master", "context": "dev", "workers": []}`)
+	before, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := request(t, s.Handler(), http.MethodPut, "/api/v1/clusters/dev", put)
+	if code != http.StatusLocked {
+		t.Fatalf("PUT on a locked config: %d %s, want %d", code, body, http.StatusLocked)
+	}
+	if owner := lock.CurrentOwner().String(); !strings.Contains(string(body), owner) {
+		t.Errorf("error %s does not name the holder %s", body, owner)
+	}
+	after, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("locked config was written:\n%s", after)
+	}
+}
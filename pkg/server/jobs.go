@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// JobState is the lifecycle state of a job.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// maxFinishedJobs is the number of finished jobs kept in memory.
+const maxFinishedJobs = 100
+
+// Job is an asynchronous apply or destroy operation.
+//
+// Fields:
+//   - ID: Job identifier.
+//   - Type: Operation, "apply" or "destroy".
+//   - Cluster: Cluster the job acts on.
+//   - State: Lifecycle state.
+//   - Error: Error of a failed job.
+//   - CreatedAt, StartedAt, FinishedAt: Lifecycle timestamps.
+type Job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Cluster    string     `json:"cluster"`
+	State      JobState   `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	run         func(ctx context.Context, logger *utils.Logger) error
+	lines       []string
+	subscribers map[chan string]struct{}
+}
+
+// jobQueue runs jobs one at a time, since all of them share the config file and database.
+type jobQueue struct {
+	mu     sync.Mutex
+	jobs   map[string]*Job
+	order  []string
+	queue  chan *Job
+	nextID int
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{
+		jobs:  make(map[string]*Job),
+		queue: make(chan *Job, 64),
+	}
+}
+
+// submit queues a job and returns a snapshot of it.
+func (q *jobQueue) submit(jobType, cluster string, run func(ctx context.Context, logger *utils.Logger) error) (Job, error) {
+	q.mu.Lock()
+	q.nextID++
+	job := &Job{
+		ID:          fmt.Sprintf("%d", q.nextID),
+		Type:        jobType,
+		Cluster:     cluster,
+		State:       JobQueued,
+		CreatedAt:   time.Now(),
+		run:         run,
+		subscribers: make(map[chan string]struct{}),
+	}
+	select {
+	case q.queue <- job:
+	default:
+		q.mu.Unlock()
+		return Job{}, fmt.Errorf("job queue is full")
+	}
+	q.jobs[job.ID] = job
+	q.order = append(q.order, job.ID)
+	snapshot := job.snapshot()
+	q.mu.Unlock()
+	return snapshot, nil
+}
+
+// work runs queued jobs until stop is closed.
+func (q *jobQueue) work(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case job := <-q.queue:
+			q.runJob(job)
+		}
+	}
+}
+
+func (q *jobQueue) runJob(job *Job) {
+	q.mu.Lock()
+	now := time.Now()
+	job.State = JobRunning
+	job.StartedAt = &now
+	q.mu.Unlock()
+
+	// "cli" keeps kubeconfigs in the same directory as command-line runs
+	handler := utils.NewTextHandler(&jobWriter{queue: q, job: job}, slog.LevelDebug).WithoutContent()
+	logger := utils.NewLogger("cli", handler)
+
+	// a running job is allowed to finish when the server shuts down
+	err := job.run(context.Background(), logger)
+
+	q.mu.Lock()
+	finished := time.Now()
+	job.FinishedAt = &finished
+	job.State = JobSucceeded
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	for sub := range job.subscribers {
+		close(sub)
+	}
+	job.subscribers = nil
+	q.prune()
+	q.mu.Unlock()
+}
+
+// jobWriter appends the lines written by a job's log handler to the job log.
+type jobWriter struct {
+	queue *jobQueue
+	job   *Job
+}
+
+func (w *jobWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.queue.appendLine(w.job, line)
+	}
+	return len(p), nil
+}
+
+func (q *jobQueue) appendLine(job *Job, line string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.lines = append(job.lines, line)
+	for sub := range job.subscribers {
+		select {
+		case sub <- line:
+		default:
+			// a slow client misses lines rather than blocking the job
+		}
+	}
+}
+
+// subscribe returns the lines logged so far and, for unfinished jobs, a channel receiving
+// new lines that is closed when the job finishes.
+func (q *jobQueue) subscribe(id string) ([]string, chan string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, nil, false
+	}
+	lines := append([]string(nil), job.lines...)
+	if job.subscribers == nil {
+		return lines, nil, true
+	}
+	sub := make(chan string, 256)
+	job.subscribers[sub] = struct{}{}
+	return lines, sub, true
+}
+
+func (q *jobQueue) unsubscribe(id string, sub chan string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job, ok := q.jobs[id]; ok && job.subscribers != nil {
+		if _, subscribed := job.subscribers[sub]; subscribed {
+			delete(job.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+func (q *jobQueue) get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+func (q *jobQueue) list() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.order))
+	for _, id := range q.order {
+		jobs = append(jobs, q.jobs[id].snapshot())
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// prune drops the oldest finished jobs beyond maxFinishedJobs. q.mu must be held.
+func (q *jobQueue) prune() {
+	finished := 0
+	for _, id := range q.order {
+		if q.jobs[id].FinishedAt != nil {
+			finished++
+		}
+	}
+	kept := q.order[:0]
+	for _, id := range q.order {
+		if finished > maxFinishedJobs && q.jobs[id].FinishedAt != nil {
+			delete(q.jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	q.order = kept
+}
+
+func (job *Job) snapshot() Job {
+	return Job{
+		ID:         job.ID,
+		Type:       job.Type,
+		Cluster:    job.Cluster,
+		State:      job.State,
+		Error:      job.Error,
+		CreatedAt:  job.CreatedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+}
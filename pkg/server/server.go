@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/clusterstore"
+	"github.com/argon-chat/k3sd/pkg/k3sd"
+	"github.com/argon-chat/k3sd/pkg/secrets"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Options configures the REST API server.
+//
+// Fields:
+//   - ConfigPath: Path to the cluster config file holding the desired state.
+//   - Environment: Environment of the config, if it is composed of environments.
+//   - Listen: Address the server listens on.
+//   - Token: Bearer token required on every /api request.
+type Options struct {
+	ConfigPath  string
+	Environment string
+	Listen      string
+	Token       string
+}
+
+// Server exposes the k3sd operations over a REST API.
+type Server struct {
+	opts   Options
+	engine *k3sd.Engine
+	logger *utils.Logger
+	jobs   *jobQueue
+
+	// configMu serializes reads and writes of the config file.
+	configMu sync.Mutex
+}
+
+// New creates a REST API server.
+//
+// Parameters:
+//
+//	opts: Server options.
+//	engine: Engine running the operations. Synchronous requests such as status and plan
+//	log to its logger; every job gets a logger of its own.
+//
+// Returns:
+//
+//	*Server: the server, ready to Run.
+//	error: Error if no token is configured.
+func New(opts Options, engine *k3sd.Engine) (*Server, error) {
+	if opts.Token == "" {
+		return nil, errors.New("an API token is required")
+	}
+	return &Server{opts: opts, engine: engine, logger: engine.Logger(), jobs: newJobQueue()}, nil
+}
+
+// Run serves the API until ctx is cancelled. Jobs that are running when ctx is cancelled are
+// allowed to finish.
+//
+// Parameters:
+//
+//	ctx: Context whose cancellation stops the server.
+//
+// Returns:
+//
+//	Error if the server fails.
+func (s *Server) Run(ctx context.Context) error {
+	stop := make(chan struct{})
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		s.jobs.work(stop)
+	}()
+
+	server := &http.Server{Addr: s.opts.Listen, Handler: s.Handler()}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	s.logger.Log("k3sd API listening on http://%s", s.opts.Listen)
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-serverErr:
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = server.Shutdown(shutdownCtx)
+	close(stop)
+	<-workerDone
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Handler returns the HTTP handler of the API.
+func (s *Server) Handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/v1/clusters", s.handleListClusters)
+	api.HandleFunc("GET /api/v1/clusters/{name}", s.handleGetCluster)
+	api.HandleFunc("PUT /api/v1/clusters/{name}", s.handlePutCluster)
+	api.HandleFunc("GET /api/v1/clusters/{name}/status", s.handleStatus)
+	api.HandleFunc("GET /api/v1/clusters/{name}/plan", s.handlePlan)
+	api.HandleFunc("POST /api/v1/clusters/{name}/apply", s.handleApply)
+	api.HandleFunc("POST /api/v1/clusters/{name}/destroy", s.handleDestroy)
+	api.HandleFunc("GET /api/v1/clusters/{name}/history", s.handleHistory)
+	api.HandleFunc("GET /api/v1/jobs", s.handleListJobs)
+	api.HandleFunc("GET /api/v1/jobs/{id}", s.handleGetJob)
+	api.HandleFunc("GET /api/v1/jobs/{id}/logs", s.handleJobLogs)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /openapi.yaml", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(openAPISpec)
+	})
+	if m := s.engine.Metrics(); m != nil {
+		mux.Handle("GET /metrics", m.Handler())
+	}
+	mux.Handle("/api/", s.authenticate(api))
+	return mux
+}
+
+// authenticate rejects requests without the configured bearer token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="k3sd"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadClusters reads the config file. s.configMu must be held.
+func (s *Server) loadClusters() ([]types.Cluster, error) {
+	return clusterstore.LoadEnvironment(s.opts.ConfigPath, s.opts.Environment)
+}
+
+// findCluster loads the config and returns the clusters and the index of the named cluster.
+func (s *Server) findCluster(name string) ([]types.Cluster, int, error) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	clusters, err := s.loadClusters()
+	if err != nil {
+		return nil, -1, err
+	}
+	return clusters, indexOf(clusters, name), nil
+}
+
+func indexOf(clusters []types.Cluster, name string) int {
+	for ci := range clusters {
+		if clusters[ci].DisplayName() == name {
+			return ci
+		}
+	}
+	return -1
+}
+
+// redact returns a copy of the cluster that is safe to return from the API. Node passwords are
+// left empty; the other secrets of the cluster (see types.Cluster.SecretValues) and the values
+// registered with utils.RegisterSecret, e.g. those decrypted from an encrypted config, are
+// replaced by utils.Redacted wherever they appear. Secret references are kept, they do not hold
+// the secret.
+//
+// Parameters:
+//
+//	cluster: Cluster to redact.
+//
+// Returns:
+//
+//	types.Cluster: the redacted copy.
+//	error: Error if the cluster cannot be copied.
+func redact(cluster types.Cluster) (types.Cluster, error) {
+	known := make(map[string]bool)
+	redactor := &utils.Redactor{}
+	for _, value := range cluster.SecretValues() {
+		if value != "" && !secrets.IsRef(value) {
+			known[value] = true
+			redactor.Register(value)
+		}
+	}
+	cluster.Password = redactPassword(cluster.Password)
+	workers := make([]types.Worker, len(cluster.Workers))
+	for wi, worker := range cluster.Workers {
+		worker.Password = redactPassword(worker.Password)
+		workers[wi] = worker
+	}
+	cluster.Workers = workers
+
+	// the cluster is masked as a JSON tree, which also copies its maps
+	tree, err := toTree(cluster)
+	if err != nil {
+		return types.Cluster{}, err
+	}
+	tree = mapStrings(tree, func(value string) string {
+		switch {
+		case value == "" || secrets.IsRef(value):
+			return value
+		case known[value]:
+			// secrets too short for the redactor are masked when they are the whole value
+			return utils.Redacted
+		}
+		return utils.DefaultRedactor.RedactValues(redactor.RedactValues(value))
+	})
+	var redacted types.Cluster
+	if err := fromTree(tree, &redacted); err != nil {
+		return types.Cluster{}, err
+	}
+	return redacted, nil
+}
+
+func redactPassword(password string) string {
+	if secrets.IsRef(password) {
+		return password
+	}
+	return ""
+}
+
+// toTree converts v to its JSON tree of maps, lists and values.
+func toTree(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	err = json.Unmarshal(data, &tree)
+	return tree, err
+}
+
+// fromTree decodes a JSON tree of maps, lists and values into v.
+func fromTree(tree any, v any) error {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// mapStrings replaces every string value of a JSON tree, but not the keys of its maps, by
+// fn(value).
+func mapStrings(tree any, fn func(string) string) any {
+	switch v := tree.(type) {
+	case map[string]any:
+		for key, value := range v {
+			v[key] = mapStrings(value, fn)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = mapStrings(value, fn)
+		}
+	case string:
+		return fn(v)
+	}
+	return tree
+}
+
+// selectorFromQuery builds a selector for the named cluster from the node, addon and
+// skipAddons query parameters.
+func selectorFromQuery(r *http.Request, name string) utils.Selector {
+	query := r.URL.Query()
+	return utils.Selector{
+		Clusters:   []string{name},
+		Nodes:      splitList(query["node"]),
+		Addons:     splitList(query["addon"]),
+		SkipAddons: query.Get("skipAddons") == "true",
+	}
+}
+
+func splitList(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,136 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RenderJSON writes the cluster statuses as indented JSON.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	statuses: Cluster statuses to render.
+//
+// Returns:
+//
+//	Error if encoding or writing fails.
+func RenderJSON(w io.Writer, statuses []ClusterStatus) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(statuses)
+}
+
+// RenderTable writes the cluster statuses as human-readable tables.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	statuses: Cluster statuses to render.
+//
+// Returns:
+//
+//	Error if writing fails.
+func RenderTable(w io.Writer, statuses []ClusterStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, s := range statuses {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "CLUSTER %s (%s)\n", s.Name, s.Address)
+		fmt.Fprintf(tw, "  API:\t%s\n", reachability(s))
+		fmt.Fprintf(tw, "  DB version:\t%s\n", dbVersion(s))
+		if !s.APIReachable {
+			continue
+		}
+
+		fmt.Fprintln(tw, "  NODE\tVERSION\tREADY\tCONFIGURED")
+		for _, n := range s.Nodes {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", n.Name, n.Version, yesNo(n.Ready), yesNo(n.Configured))
+		}
+		for _, name := range s.MissingNodes {
+			fmt.Fprintf(tw, "  %s\t-\tmissing\tyes\n", name)
+		}
+
+		if len(s.Addons) > 0 {
+			fmt.Fprintln(tw, "  ADDON\tHEALTH\tRELEASE\tDEPLOYMENTS")
+			for _, a := range s.Addons {
+				fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", addonName(a), health(a), release(a), deployments(a))
+			}
+		}
+
+		if len(s.Gateways) > 0 || s.GatewayError != "" {
+			fmt.Fprintln(tw, "  GATEWAY\tALIVE\tPAIRED SERVICES")
+			for _, g := range s.Gateways {
+				fmt.Fprintf(tw, "  %s\t%s\t%d\n", g.ClusterName, yesNo(g.Alive), g.PairedServices)
+			}
+			if s.GatewayError != "" {
+				fmt.Fprintf(tw, "  (error: %s)\n", s.GatewayError)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func reachability(s ClusterStatus) string {
+	if s.APIReachable {
+		return "reachable"
+	}
+	return "unreachable: " + s.APIError
+}
+
+func dbVersion(s ClusterStatus) string {
+	if s.DBVersion == 0 {
+		return "none"
+	}
+	if s.DBUpdatedAt == nil {
+		return fmt.Sprintf("%d", s.DBVersion)
+	}
+	return fmt.Sprintf("%d (%s)", s.DBVersion, s.DBUpdatedAt.Local().Format(time.RFC3339))
+}
+
+func addonName(a AddonStatus) string {
+	if a.Custom {
+		return a.Name + " (custom)"
+	}
+	return a.Name
+}
+
+func health(a AddonStatus) string {
+	if a.Healthy {
+		return "healthy"
+	}
+	if len(a.Errors) > 0 {
+		return "unhealthy: " + strings.Join(a.Errors, "; ")
+	}
+	return "unhealthy"
+}
+
+func release(a AddonStatus) string {
+	if a.Release == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s rev %d", a.Release.Status, a.Release.Revision)
+}
+
+func deployments(a AddonStatus) string {
+	if len(a.Deployments) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(a.Deployments))
+	for _, d := range a.Deployments {
+		parts = append(parts, fmt.Sprintf("%s %d/%d", d.Name, d.Ready, d.Desired))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,234 @@
+package status
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/argon-chat/k3sd/pkg/addons"
+	"github.com/argon-chat/k3sd/pkg/clusterutils"
+	"github.com/argon-chat/k3sd/pkg/db"
+	"github.com/argon-chat/k3sd/pkg/types"
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// ClusterStatus is the live status of a single cluster.
+//
+// Fields:
+//   - Name: Cluster display name (context or address).
+//   - Address: Master node address.
+//   - APIReachable: Whether the Kubernetes API answered its readiness endpoint.
+//   - APIError: Error returned when the API was not reachable.
+//   - Nodes: Nodes reported by the API.
+//   - MissingNodes: Configured nodes that are not part of the cluster.
+//   - UnexpectedNodes: Cluster nodes that are not in the config.
+//   - Addons: Health of the enabled addons.
+//   - Gateways: Linkerd multicluster gateways (only when linkerd-mc is enabled).
+//   - GatewayError: Error returned when listing the gateways.
+//   - DBVersion: Latest version recorded in the k3sd database (0 if none).
+//   - DBUpdatedAt: Time the latest version was recorded, if known.
+type ClusterStatus struct {
+	Name            string                  `json:"name"`
+	Address         string                  `json:"address"`
+	APIReachable    bool                    `json:"apiReachable"`
+	APIError        string                  `json:"apiError,omitempty"`
+	Nodes           []NodeStatus            `json:"nodes"`
+	MissingNodes    []string                `json:"missingNodes,omitempty"`
+	UnexpectedNodes []string                `json:"unexpectedNodes,omitempty"`
+	Addons          []AddonStatus           `json:"addons"`
+	Gateways        []addons.LinkerdGateway `json:"gateways,omitempty"`
+	GatewayError    string                  `json:"gatewayError,omitempty"`
+	DBVersion       int                     `json:"dbVersion"`
+	DBUpdatedAt     *time.Time              `json:"dbUpdatedAt,omitempty"`
+}
+
+// NodeStatus is the live status of a node.
+//
+// Fields:
+//   - Name: Node name.
+//   - Version: k3s version running on the node.
+//   - Ready: Whether the node is Ready.
+//   - Configured: Whether the node is part of the cluster config.
+type NodeStatus struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Ready      bool   `json:"ready"`
+	Configured bool   `json:"configured"`
+}
+
+// AddonStatus is the health of an enabled addon.
+//
+// Fields:
+//   - Name: Addon name.
+//   - Custom: Whether the addon is a custom addon.
+//   - Healthy: Whether the release is deployed and all deployments are ready.
+//   - Release: Helm release state, if the addon installs one.
+//   - Deployments: Rollout state of the addon's deployments.
+//   - Errors: Problems found while checking the addon.
+type AddonStatus struct {
+	Name        string                        `json:"name"`
+	Custom      bool                          `json:"custom"`
+	Healthy     bool                          `json:"healthy"`
+	Release     *clusterutils.HelmReleaseInfo `json:"release,omitempty"`
+	Deployments []clusterutils.DeploymentInfo `json:"deployments,omitempty"`
+	Errors      []string                      `json:"errors,omitempty"`
+}
+
+// CollectStatus gathers the live status of all selected clusters.
+//
+// Parameters:
+//
+//	ctx: Context of the queries.
+//	store: Database holding the recorded cluster versions.
+//	clusters: Clusters from the config.
+//	logger: Logger for output (used for the kubeconfig session ID).
+//	selector: Restricts the report to specific clusters.
+//
+// Returns:
+//
+//	Status of every selected cluster.
+func CollectStatus(ctx context.Context, store *db.Store, clusters []types.Cluster, logger *utils.Logger, selector utils.Selector) []ClusterStatus {
+	var statuses []ClusterStatus
+	for ci := range clusters {
+		if !selector.MatchCluster(clusters[ci].Context) {
+			continue
+		}
+		statuses = append(statuses, collectClusterStatus(ctx, store, &clusters[ci], logger))
+	}
+	return statuses
+}
+
+func collectClusterStatus(ctx context.Context, store *db.Store, cluster *types.Cluster, logger *utils.Logger) ClusterStatus {
+	result := ClusterStatus{
+		Name:    cluster.DisplayName(),
+		Address: cluster.Address,
+	}
+	collectDBStatus(ctx, store, cluster, &result, logger)
+
+	kubeconfig := clusterutils.KubeConfigPath(cluster, logger)
+	if err := clusterutils.CheckAPIReachable(ctx, kubeconfig); err != nil {
+		result.APIError = err.Error()
+		return result
+	}
+	result.APIReachable = true
+
+	collectNodeStatus(ctx, cluster, kubeconfig, &result, logger)
+	result.Addons = collectAddonStatus(ctx, cluster, kubeconfig)
+
+	if linkerdMC, ok := cluster.Addons["linkerd-mc"]; ok && linkerdMC.Enabled {
+		gateways, err := addons.GetLinkerdGateways(ctx, cluster, logger)
+		if err != nil {
+			result.GatewayError = err.Error()
+		}
+		result.Gateways = gateways
+	}
+	return result
+}
+
+func collectDBStatus(ctx context.Context, store *db.Store, cluster *types.Cluster, result *ClusterStatus, logger *utils.Logger) {
+	record, err := store.GetLatestClusterRecord(ctx, cluster)
+	if err != nil {
+		logger.LogErr("error reading database history for %s: %v", cluster.Address, err)
+		return
+	}
+	if record != nil {
+		result.DBVersion = record.Version
+		result.DBUpdatedAt = record.CreatedAt
+	}
+}
+
+func collectNodeStatus(ctx context.Context, cluster *types.Cluster, kubeconfig string, result *ClusterStatus, logger *utils.Logger) {
+	nodes, err := clusterutils.GetNodes(ctx, kubeconfig)
+	if err != nil {
+		logger.LogErr("error listing nodes of %s: %v", cluster.Address, err)
+		return
+	}
+	configured := map[string]bool{cluster.NodeName: true}
+	for _, worker := range cluster.Workers {
+		configured[worker.NodeName] = true
+	}
+	live := make(map[string]bool)
+	for _, node := range nodes {
+		live[node.Name] = true
+		result.Nodes = append(result.Nodes, NodeStatus{
+			Name:       node.Name,
+			Version:    node.Version,
+			Ready:      node.Ready,
+			Configured: configured[node.Name],
+		})
+		if !configured[node.Name] {
+			result.UnexpectedNodes = append(result.UnexpectedNodes, node.Name)
+		}
+	}
+	for name := range configured {
+		if !live[name] {
+			result.MissingNodes = append(result.MissingNodes, name)
+		}
+	}
+	sort.Strings(result.MissingNodes)
+}
+
+func collectAddonStatus(ctx context.Context, cluster *types.Cluster, kubeconfig string) []AddonStatus {
+	var statuses []AddonStatus
+	for _, name := range sortedKeys(cluster.Addons) {
+		migration, ok := addons.AddonRegistry[name]
+		if !ok || !cluster.Addons[name].Enabled {
+			continue
+		}
+		statuses = append(statuses, checkAddon(ctx, name, false, migration.Release, migration.Deployments, kubeconfig))
+	}
+	for _, name := range sortedKeys(cluster.CustomAddons) {
+		addon := cluster.CustomAddons[name]
+		if !addon.Enabled {
+			continue
+		}
+		var release *addons.Workload
+		if addon.Helm != nil {
+			namespace := addon.Helm.Namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			release = &addons.Workload{Name: name, Namespace: namespace}
+		}
+		statuses = append(statuses, checkAddon(ctx, name, true, release, nil, kubeconfig))
+	}
+	return statuses
+}
+
+func checkAddon(ctx context.Context, name string, custom bool, release *addons.Workload, deployments []addons.Workload, kubeconfig string) AddonStatus {
+	result := AddonStatus{Name: name, Custom: custom, Healthy: true}
+	if release != nil {
+		info, err := clusterutils.GetHelmReleaseStatus(ctx, kubeconfig, release.Name, release.Namespace)
+		if err != nil {
+			result.Healthy = false
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			result.Release = info
+			if info.Status != "deployed" {
+				result.Healthy = false
+			}
+		}
+	}
+	for _, d := range deployments {
+		info, err := clusterutils.GetDeployment(ctx, kubeconfig, d.Name, d.Namespace)
+		if err != nil {
+			result.Healthy = false
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		result.Deployments = append(result.Deployments, *info)
+		if info.Ready < info.Desired {
+			result.Healthy = false
+		}
+	}
+	return result
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
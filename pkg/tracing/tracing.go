@@ -0,0 +1,194 @@
+// Package tracing records OpenTelemetry spans of k3sd runs: one per run, step, remote command,
+// Helm chart installation, manifest apply and deployment wait. Spans are exported over OTLP/HTTP
+// to a collector or written as JSON to a file; without Setup they are not recorded.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/argon-chat/k3sd/pkg/utils"
+)
+
+// instrumentation is the name of the tracer recording k3sd spans.
+const instrumentation = "github.com/argon-chat/k3sd"
+
+// Attribute keys of k3sd spans.
+const (
+	AttrCluster    = attribute.Key("k3sd.cluster")
+	AttrNode       = attribute.Key("k3sd.node")
+	AttrAddon      = attribute.Key("k3sd.addon")
+	AttrStep       = attribute.Key("k3sd.step")
+	AttrCommand    = attribute.Key("k3sd.command")
+	AttrRelease    = attribute.Key("k3sd.helm.release")
+	AttrChart      = attribute.Key("k3sd.helm.chart")
+	AttrNamespace  = attribute.Key("k8s.namespace.name")
+	AttrManifest   = attribute.Key("k3sd.manifest")
+	AttrDeployment = attribute.Key("k8s.deployment.name")
+	AttrMigration  = attribute.Key("k3sd.addon.migration")
+	AttrCustom     = attribute.Key("k3sd.addon.custom")
+)
+
+// Config configures the export of spans.
+//
+// Fields:
+//   - Endpoint: OTLP/HTTP endpoint of a collector, e.g. "localhost:4318" or
+//     "https://otel.example.com:4318". Plain host:port and http:// URLs are sent unencrypted.
+//   - File: Path of a file the spans are written to as JSON, one object per span.
+//   - ServiceVersion: k3sd version reported as service.version.
+type Config struct {
+	Endpoint       string
+	File           string
+	ServiceVersion string
+}
+
+// Setup installs a global tracer provider exporting spans as configured. If neither an
+// endpoint nor a file is set, spans are not recorded.
+//
+// Parameters:
+//
+//	ctx: Context of the exporter setup.
+//	cfg: Export configuration.
+//
+// Returns:
+//
+//	func(context.Context) error: exports the remaining spans and stops the exporters; call it
+//	before exiting.
+//	error: Error if an exporter cannot be created.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" && cfg.File == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName("k3sd"),
+		semconv.ServiceVersion(cfg.ServiceVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	var file *os.File
+	if cfg.Endpoint != "" {
+		exporter, err := otlptracehttp.New(ctx, endpointOptions(cfg.Endpoint)...)
+		if err != nil {
+			return nil, fmt.Errorf("OTLP exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	if cfg.File != "" {
+		file, err = os.Create(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+// endpointOptions returns the OTLP/HTTP options for an endpoint given as host:port or URL.
+func endpointOptions(endpoint string) []otlptracehttp.Option {
+	switch {
+	case strings.HasPrefix(endpoint, "https://"):
+		return []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint)}
+	case strings.HasPrefix(endpoint, "http://"):
+		return []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint), otlptracehttp.WithInsecure()}
+	}
+	return []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure()}
+}
+
+// Start starts a span as a child of the span in ctx.
+//
+// Parameters:
+//
+//	ctx: Parent context.
+//	name: Span name, e.g. "InstallHelmChart".
+//	attrs: Span attributes.
+//
+// Returns:
+//
+//	context.Context: ctx carrying the new span.
+//	trace.Span: the span; finish it with End.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if any, with secrets masked, and ends it. It returns err so it
+// can be used as "return tracing.End(span, err)".
+//
+// Parameters:
+//
+//	span: The span to end.
+//	err: Outcome of the traced operation.
+//
+// Returns:
+//
+//	error: err unchanged.
+func End(span trace.Span, err error) error {
+	if err != nil {
+		message := utils.Redact(err.Error())
+		span.RecordError(errors.New(message))
+		span.SetStatus(codes.Error, message)
+	}
+	span.End()
+	return err
+}
+
+// TraceID returns the trace ID of the span in ctx, or "" if spans are not recorded.
+//
+// Parameters:
+//
+//	ctx: Context carrying a span.
+//
+// Returns:
+//
+//	string: the hex trace ID, or "".
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// SpanID returns the ID of the span in ctx, or "" if spans are not recorded.
+//
+// Parameters:
+//
+//	ctx: Context carrying a span.
+//
+// Returns:
+//
+//	string: the hex span ID, or "".
+func SpanID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasSpanID() {
+		return ""
+	}
+	return sc.SpanID().String()
+}
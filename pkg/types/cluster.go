@@ -1,6 +1,9 @@
 package types
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // AddonConfig represents the configuration for a built-in addon.
 //
@@ -9,10 +12,12 @@ import "fmt"
 //	Enabled: bool, whether the addon is enabled
 //	Path: string, optional path to a manifest or values file
 //	Subs: map[string]string, optional substitutions for templating
+//	SecretSubs: []string, keys of Subs whose values are secret and masked in logs
 type AddonConfig struct {
-	Enabled bool              `json:"enabled"`
-	Path    string            `json:"path,omitempty"`
-	Subs    map[string]string `json:"subs,omitempty"`
+	Enabled    bool              `json:"enabled"`
+	Path       string            `json:"path,omitempty"`
+	Subs       map[string]string `json:"subs,omitempty"`
+	SecretSubs []string          `json:"secretSubs,omitempty"`
 }
 
 // CustomAddonConfig represents a user-defined custom addon.
@@ -38,7 +43,7 @@ type CustomAddonConfig struct {
 //	ValuesFile: string, path to values.yaml
 //	Namespace: string, Kubernetes namespace
 type HelmConfig struct {
-	Chart      string   `json:"chart"`
+	Chart      string   `json:"chart" validate:"required"`
 	Repo       HelmRepo `json:"repo"`
 	Version    string   `json:"version"`
 	ValuesFile string   `json:"valuesFile"`
@@ -62,12 +67,15 @@ type HelmRepo struct {
 //
 //	Path: string, path to manifest file
 //	Subs: map[string]string, substitutions for templating
+//	SecretSubs: []string, keys of Subs whose values are secret and masked in logs
 type ManifestConfig struct {
-	Path string            `json:"path"`
-	Subs map[string]string `json:"subs,omitempty"`
+	Path       string            `json:"path" validate:"required"`
+	Subs       map[string]string `json:"subs,omitempty"`
+	SecretSubs []string          `json:"secretSubs,omitempty"`
 }
 
 // Cluster represents a K3s cluster configuration, including master and worker nodes, domain, and optional addons.
+// Fields tagged validate:"required" must be set in a valid config (see pkg/validate).
 //
 // Fields:
 //
@@ -79,6 +87,10 @@ type ManifestConfig struct {
 //	LinksTo: []string, list of clusters to link for multicluster
 //	Addons: map[string]AddonConfig, built-in addon configs
 //	CustomAddons: map[string]CustomAddonConfig, user-defined custom addons
+//	Environment: string, optional environment label (e.g. "production")
+//	Protected: bool, if true, the cluster cannot be destroyed until the flag is cleared
+//	Webhooks: []Webhook, webhooks notified of the run events of this cluster
+//	Hooks: *Hooks, optional scripts run before and after the install, join and addon steps
 type Cluster struct {
 	Worker
 	Domain       string                       `json:"domain"`
@@ -88,6 +100,155 @@ type Cluster struct {
 	LinksTo      []string                     `json:"linksTo,omitempty"`
 	Addons       map[string]AddonConfig       `json:"addons,omitempty"`
 	CustomAddons map[string]CustomAddonConfig `json:"customAddons,omitempty"`
+	Environment  string                       `json:"environment,omitempty"`
+	Protected    bool                         `json:"protected,omitempty"`
+	Webhooks     []Webhook                    `json:"webhooks,omitempty"`
+	Hooks        *Hooks                       `json:"hooks,omitempty"`
+
+	// decrypted holds the paths of the fields decrypted from a config encrypted at rest
+	decrypted []string
+}
+
+// Hooks are scripts run around the steps of an apply. The install and join hooks run on the
+// node over SSH, and only when the node is installed or joined; the addon hooks run locally
+// whenever the addons of the cluster are applied.
+//
+// Fields:
+//
+//	PreInstall: []Hook, run on the master before k3s is installed
+//	PostInstall: []Hook, run on the master after k3s is installed
+//	PreJoin: []Hook, run on each worker before it joins
+//	PostJoin: []Hook, run on each worker after it joined
+//	PreAddons: []Hook, run locally before the addons are applied
+//	PostAddons: []Hook, run locally after the addons were applied
+type Hooks struct {
+	PreInstall  []Hook `json:"preInstall,omitempty"`
+	PostInstall []Hook `json:"postInstall,omitempty"`
+	PreJoin     []Hook `json:"preJoin,omitempty"`
+	PostJoin    []Hook `json:"postJoin,omitempty"`
+	PreAddons   []Hook `json:"preAddons,omitempty"`
+	PostAddons  []Hook `json:"postAddons,omitempty"`
+}
+
+// Hook is a shell script run before or after a step.
+//
+// Fields:
+//
+//	Name: string, name of the hook in logs and reports (default: its position, e.g. "preJoin[0]")
+//	Run: string, the script, run with bash on nodes and sh locally
+//	Env: map[string]string, environment variables added to those describing the cluster
+//	Sudo: bool, run a remote script as root (sudo is given the node password)
+//	ContinueOnError: bool, log a failure and go on instead of aborting the node or the addons
+type Hook struct {
+	Name            string            `json:"name,omitempty"`
+	Run             string            `json:"run" validate:"required"`
+	Env             map[string]string `json:"env,omitempty"`
+	Sudo            bool              `json:"sudo,omitempty"`
+	ContinueOnError bool              `json:"continueOnError,omitempty"`
+}
+
+// All returns every hook with the name of its phase, e.g. "preJoin". It may be called on nil.
+//
+// Returns:
+//
+//	map[string][]Hook: the hooks keyed by phase; phases without hooks are omitted.
+func (hooks *Hooks) All() map[string][]Hook {
+	all := make(map[string][]Hook)
+	if hooks == nil {
+		return all
+	}
+	for phase, list := range map[string][]Hook{
+		"preInstall":  hooks.PreInstall,
+		"postInstall": hooks.PostInstall,
+		"preJoin":     hooks.PreJoin,
+		"postJoin":    hooks.PostJoin,
+		"preAddons":   hooks.PreAddons,
+		"postAddons":  hooks.PostAddons,
+	} {
+		if len(list) > 0 {
+			all[phase] = list
+		}
+	}
+	return all
+}
+
+// Webhook is an HTTP endpoint notified of run events.
+//
+// Fields:
+//
+//	URL: string, URL the events are posted to
+//	Secret: string, optional key signing the payload with HMAC-SHA256 (X-K3sd-Signature header)
+//	Events: []string, event types to send (e.g. "addon.failed"); all events if empty
+//	Template: string, optional Go template of the payload; the event as JSON if empty
+//	ContentType: string, content type of the payload (default application/json)
+//	Headers: map[string]string, additional request headers
+//	Retries: int, retries of a failed delivery (default 3)
+type Webhook struct {
+	URL         string            `json:"url" validate:"required"`
+	Secret      string            `json:"secret,omitempty"`
+	Events      []string          `json:"events,omitempty"`
+	Template    string            `json:"template,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Retries     int               `json:"retries,omitempty"`
+}
+
+// SecretValues returns the secrets of the webhook that must not appear in logs: the signing
+// key and the values of headers named Authorization or containing PASSWORD, TOKEN or SECRET.
+//
+// Returns:
+//
+//	[]string: the secret values; may contain empty strings.
+func (webhook *Webhook) SecretValues() []string {
+	values := []string{webhook.Secret}
+	for key, value := range webhook.Headers {
+		if strings.EqualFold(key, "Authorization") || isSecretSub(key, nil) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// IsProduction reports whether the cluster is labelled as a production cluster.
+//
+// Returns:
+//
+//	bool: true if Environment is "production" or "prod" (case-insensitive)
+func (cluster *Cluster) IsProduction() bool {
+	env := strings.ToLower(strings.TrimSpace(cluster.Environment))
+	return env == "production" || env == "prod"
+}
+
+// DisplayName returns the name used to refer to the cluster in prompts and reports.
+//
+// Returns:
+//
+//	string: the kubeconfig context, or the master address if no context is set
+func (cluster *Cluster) DisplayName() string {
+	if cluster.Context != "" {
+		return cluster.Context
+	}
+	return cluster.Address
+}
+
+// DecryptedFields returns the paths of the fields of the cluster whose values were decrypted
+// from a config encrypted at rest, like "workers[0].password" (see pkg/clusterstore).
+//
+// Returns:
+//
+//	[]string: the paths of the decrypted fields
+func (cluster *Cluster) DecryptedFields() []string {
+	return cluster.decrypted
+}
+
+// SetDecryptedFields records the paths of the fields of the cluster whose values were
+// decrypted from a config encrypted at rest.
+//
+// Parameters:
+//
+//	paths: the paths of the decrypted fields, like "workers[0].password"
+func (cluster *Cluster) SetDecryptedFields(paths []string) {
+	cluster.decrypted = paths
 }
 
 // Worker represents a node in the cluster (master or worker).
@@ -96,17 +257,17 @@ type Cluster struct {
 //
 //	Address: string, IP or hostname
 //	User: string, SSH username
-//	Password: string, SSH password
+//	Password: string, SSH password, or a secret reference like "env:NAME" (see pkg/secrets)
 //	NodeName: string, Kubernetes node name
 //	Labels: map[string]string, node labels
-//	Done: bool, internal flag for install status
+//	Done: bool, install status, kept in the k3sd database; read from older configs only to import it
 type Worker struct {
-	Address  string            `json:"address"`
-	User     string            `json:"user"`
+	Address  string            `json:"address" validate:"required"`
+	User     string            `json:"user" validate:"required"`
 	Password string            `json:"password"`
-	NodeName string            `json:"nodeName"`
+	NodeName string            `json:"nodeName" validate:"required"`
 	Labels   map[string]string `json:"labels"`
-	Done     bool              `json:"done"`
+	Done     bool              `json:"done,omitempty"`
 }
 
 // GetLabels returns a comma-separated string of labels for the worker.
@@ -128,3 +289,55 @@ func (worker *Worker) GetLabels() string {
 	}
 	return labels
 }
+
+// SecretValues returns the secrets of the cluster that must not appear in logs: the passwords
+// of all nodes, the values of secret substitutions, the secrets of its webhooks and the values
+// of secret hook environment variables. A substitution is secret if its key is
+// listed in SecretSubs or its name contains PASSWORD, TOKEN or SECRET.
+//
+// Returns:
+//
+//	[]string: the secret values; may contain empty strings.
+func (cluster *Cluster) SecretValues() []string {
+	values := []string{cluster.Password}
+	for _, worker := range cluster.Workers {
+		values = append(values, worker.Password)
+	}
+	for _, addon := range cluster.Addons {
+		values = append(values, secretSubValues(addon.Subs, addon.SecretSubs)...)
+	}
+	for _, addon := range cluster.CustomAddons {
+		if addon.Manifest != nil {
+			values = append(values, secretSubValues(addon.Manifest.Subs, addon.Manifest.SecretSubs)...)
+		}
+	}
+	for wi := range cluster.Webhooks {
+		values = append(values, cluster.Webhooks[wi].SecretValues()...)
+	}
+	for _, hooks := range cluster.Hooks.All() {
+		for _, hook := range hooks {
+			values = append(values, secretSubValues(hook.Env, nil)...)
+		}
+	}
+	return values
+}
+
+func secretSubValues(subs map[string]string, secretKeys []string) []string {
+	var values []string
+	for key, value := range subs {
+		if isSecretSub(key, secretKeys) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func isSecretSub(key string, secretKeys []string) bool {
+	for _, secret := range secretKeys {
+		if key == secret {
+			return true
+		}
+	}
+	upper := strings.ToUpper(key)
+	return strings.Contains(upper, "PASSWORD") || strings.Contains(upper, "TOKEN") || strings.Contains(upper, "SECRET")
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CommandLog collects the commands run while it is attached to a context. It is safe for
+// concurrent use.
+type CommandLog struct {
+	// OnCommand, if set, is called with every recorded command (secrets masked).
+	OnCommand func(command string)
+
+	mu       sync.Mutex
+	commands []string
+}
+
+type commandLogKey struct{}
+
+// WithCommandLog returns a copy of ctx that records the commands run with it in log.
+//
+// Parameters:
+//
+//	ctx: Parent context.
+//	log: Destination of the recorded commands.
+//
+// Returns:
+//
+//	context.Context: the derived context.
+func WithCommandLog(ctx context.Context, log *CommandLog) context.Context {
+	return context.WithValue(ctx, commandLogKey{}, log)
+}
+
+// RecordCommand adds a command to the CommandLog attached to ctx, if there is one, and as an
+// event to the span in ctx, if spans are recorded. Secrets in the command are masked.
+//
+// Parameters:
+//
+//	ctx: Context of the operation running the command.
+//	command: The command line, local or remote.
+func RecordCommand(ctx context.Context, command string) {
+	command = Redact(command)
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		span.AddEvent("command", trace.WithAttributes(attribute.String("k3sd.command", command)))
+	}
+	log, ok := ctx.Value(commandLogKey{}).(*CommandLog)
+	if !ok {
+		return
+	}
+	log.mu.Lock()
+	log.commands = append(log.commands, command)
+	log.mu.Unlock()
+	if log.OnCommand != nil {
+		log.OnCommand(command)
+	}
+}
+
+// Commands returns the recorded commands in the order they were run.
+func (l *CommandLog) Commands() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.commands...)
+}
+
+// localAbortGrace is how long a local command may take to exit after it was interrupted.
+const localAbortGrace = 10 * time.Second
+
+// ExecCommand is exec.CommandContext that also records the command line in the CommandLog
+// attached to ctx. When ctx is cancelled the process is interrupted rather than killed, and
+// killed only if it has not exited after a grace period.
+//
+// Parameters:
+//
+//	ctx: Context of the operation; cancelling it kills the process.
+//	name: Program to run.
+//	args: Program arguments.
+//
+// Returns:
+//
+//	*exec.Cmd: the prepared command.
+func ExecCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	RecordCommand(ctx, strings.Join(append([]string{name}, args...), " "))
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = localAbortGrace
+	return cmd
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConnectionError is returned when a node cannot be reached or the SSH handshake fails.
+//
+// Fields:
+//   - Host: Address of the node.
+//   - Err: Underlying error.
+type ConnectionError struct {
+	Host string
+	Err  error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("connect to %s: %v", e.Host, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is returned when the cluster config cannot be read or describes something that
+// cannot be installed.
+//
+// Fields:
+//   - Source: Config file or config element the error refers to.
+//   - Err: Underlying error.
+type ConfigError struct {
+	Source string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("config %s: %v", e.Source, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// StepError is the failure of a single step of a run, located by cluster, node and addon.
+//
+// Fields:
+//   - Cluster: Cluster display name.
+//   - Node: Node name, if the step acts on a node.
+//   - Addon: Addon name, if the step acts on an addon.
+//   - Step: Step that failed, e.g. "connect", "install", "join", "label", "apply" or "delete".
+//   - Err: Underlying error.
+type StepError struct {
+	Cluster string
+	Node    string
+	Addon   string
+	Step    string
+	Err     error
+}
+
+func (e *StepError) Error() string {
+	parts := []string{e.Cluster}
+	if e.Node != "" {
+		parts = append(parts, "node "+e.Node)
+	}
+	if e.Addon != "" {
+		parts = append(parts, "addon "+e.Addon)
+	}
+	return fmt.Sprintf("%s: %s: %v", strings.Join(parts, ", "), e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// IsConnectionError reports whether err is or wraps a ConnectionError.
+func IsConnectionError(err error) bool {
+	var connErr *ConnectionError
+	return errors.As(err, &connErr)
+}
+
+// IsConfigError reports whether err is or wraps a ConfigError.
+func IsConfigError(err error) bool {
+	var configErr *ConfigError
+	return errors.As(err, &configErr)
+}
@@ -3,11 +3,18 @@ package utils
 import (
 	"flag"
 	"fmt"
+	"time"
 )
 
 var (
+	// Command is the subcommand given on the command line (e.g. "destroy"); empty for the default apply run.
+	Command string
+	// CommandArgs are the arguments following the subcommand, e.g. "set" and the name of "secret set NAME".
+	CommandArgs []string
 	// ConfigPath is the path to the cluster config file.
 	ConfigPath string
+	// Environment selects the environment overlay of composed configs (empty: none).
+	Environment string
 	// Uninstall indicates whether to uninstall the cluster.
 	Uninstall bool
 	// VersionFlag indicates whether to print version and exit.
@@ -23,6 +30,56 @@ var (
 	GenerateFlag bool
 	// DBPath is the path to the sqlite database file.
 	DBPath string
+	// Selection restricts the run to specific clusters, nodes and addons.
+	Selection Selector
+	// AutoApprove skips the interactive yes/no confirmation of destructive commands.
+	AutoApprove bool
+	// OutputFormat is the output format of reporting commands such as status ("table" or "json").
+	OutputFormat string
+	// Reconcile makes the drift command bring the live clusters back to the desired state.
+	Reconcile bool
+	// ConfirmContexts holds context names confirmed up front for destroying production clusters.
+	ConfirmContexts []string
+	// ListenAddr is the address of the daemon's HTTP health and status endpoint.
+	ListenAddr string
+	// WatchInterval is how often the daemon checks the config files for changes.
+	WatchInterval time.Duration
+	// DriftInterval is how often the daemon checks the live clusters for drift.
+	DriftInterval time.Duration
+	// MinApplyInterval is the minimum time between two daemon applies of the same cluster.
+	MinApplyInterval time.Duration
+	// APITokenFile is the path to a file holding the bearer token of the REST API server.
+	APITokenFile string
+	// ReportPath is the path of the JSON run report written after an apply (empty: none).
+	ReportPath string
+	// JUnitPath is the path of the JUnit XML run report written after an apply (empty: none).
+	JUnitPath string
+	// LogLevel is the minimum level of console log messages (empty: warn, or debug with -v).
+	LogLevel string
+	// LogFormat is the format of console log messages ("text" or "json").
+	LogFormat string
+	// LogDir is the directory of the per-run log files (empty: ~/.k3sd/logs).
+	LogDir string
+	// NoLogFile disables the per-run log file.
+	NoLogFile bool
+	// LogKubeconfigs logs the content of fetched kubeconfigs at debug level.
+	LogKubeconfigs bool
+	// LogEndpoint is the URL log messages are posted to as JSON lines (empty: none).
+	LogEndpoint string
+	// ProgressMode is how the progress of an apply is shown: "auto", "tty", "plain" or "none".
+	ProgressMode string
+	// TraceEndpoint is the OTLP/HTTP endpoint spans are exported to (empty: none).
+	TraceEndpoint string
+	// TraceFile is the file spans are written to as JSON (empty: none).
+	TraceFile string
+	// WebhooksPath is the JSON file listing the webhooks notified of every apply (empty: none).
+	WebhooksPath string
+	// SecretStorePath is the path of the local encrypted secret store (empty: ~/.k3sd/secrets.json).
+	SecretStorePath string
+	// AgeRecipients are the age recipients `config encrypt` encrypts a config to (empty: $SOPS_AGE_RECIPIENTS or the local age keys).
+	AgeRecipients []string
+	// EncryptedRegex selects the keys whose values `config encrypt` encrypts (empty: passwords, tokens and secrets).
+	EncryptedRegex string
 )
 
 // boolFlagDef defines a boolean flag for command-line parsing.
@@ -30,35 +87,133 @@ var (
 // ParseFlags parses command-line flags and populates global variables for configuration and feature toggles.
 //
 // Sets:
-//   - Flags: map of feature flags
+//   - Command, CommandArgs: subcommand given before or after the flags, and its arguments
 //   - ConfigPath: path to cluster config file
+//   - Environment: environment of composed configs
 //   - Uninstall: uninstall mode
 //   - VersionFlag: print version and exit
 //   - Verbose: enable verbose logging
 //   - HelmAtomic: enable atomic Helm operations
+//   - Selection: cluster, node and addon selectors
+//   - AutoApprove, ConfirmContexts: confirmation safeguards for destroy
+//   - OutputFormat: output format of reporting commands
+//   - Reconcile: reconcile detected drift
+//   - ListenAddr, WatchInterval, DriftInterval, MinApplyInterval: daemon settings
+//   - APITokenFile: token file of the REST API server
+//   - ReportPath, JUnitPath: run report files
+//   - LogLevel, LogFormat, LogDir, NoLogFile, LogKubeconfigs, LogEndpoint: logging settings
+//   - ProgressMode: progress display of apply runs
+//   - TraceEndpoint, TraceFile: span export settings
+//   - WebhooksPath: global webhooks
+//   - SecretStorePath: local secret store
+//   - AgeRecipients, EncryptedRegex: config encryption settings
 func ParseFlags() {
-	configPath := flag.String("config-path", "", "Path to clusters.json")
+	configPath := flag.String("config-path", "", "Path to the cluster config (JSON, YAML or TOML)")
+	env := flag.String("env", "", "Environment of the config to use: merges the overlay of this name from its environments")
 	yamlsPath := flag.String("yamls-path", "", "Prefix path to all YAMLs for installing additional components. If not set, defaults to ./yamls or ~/.k3sd/yamls.")
 	uninstallFlag := flag.Bool("uninstall", false, "Uninstall the cluster")
+	forceUnlock := flag.Bool("force-unlock", false, "Remove the locks of the config and the selected clusters (alias for the force-unlock command)")
 	versionFlag := flag.Bool("version", false, "Print the version and exit")
-	verbose := flag.Bool("v", false, "Enable verbose stdout logging")
+	verbose := flag.Bool("v", false, "Enable verbose logging (same as --log-level=debug)")
 	helmAtomic := flag.Bool("helm-atomic", false, "Enable --atomic for all Helm operations (rollback on failure)")
 	generateFlag := flag.Bool("generate", false, "Launch interactive TUI to generate a cluster config")
 	dbPath := flag.String("db-path", "", "Path to the k3sd sqlite database file (default: ~/.k3sd/k3sd.db)")
+	var clusters, nodes, addons stringListFlag
+	flag.Var(&clusters, "cluster", "Only act on the cluster with this context (repeatable or comma-separated)")
+	flag.Var(&nodes, "node", "Only act on the node with this name (repeatable or comma-separated)")
+	flag.Var(&addons, "addon", "Only act on the addon with this name (repeatable or comma-separated)")
+	skipAddons := flag.Bool("skip-addons", false, "Do not apply or delete any addons")
+	yes := flag.Bool("yes", false, "Do not ask for confirmation before destroying clusters")
+	autoApprove := flag.Bool("auto-approve", false, "Alias for --yes")
+	outputFormat := flag.String("output", "table", "Output format of reporting commands: table or json")
+	reconcile := flag.Bool("reconcile", false, "Reconcile detected drift (drift command)")
+	var confirm stringListFlag
+	flag.Var(&confirm, "confirm", "Confirm destroying the production cluster with this context without typing it (repeatable or comma-separated)")
+	listen := flag.String("listen", "127.0.0.1:8089", "Address of the daemon's status endpoint or the API server")
+	watchInterval := flag.Duration("watch-interval", 10*time.Second, "How often the daemon checks config files for changes")
+	driftInterval := flag.Duration("interval", 5*time.Minute, "How often the daemon checks the clusters for drift")
+	apiTokenFile := flag.String("api-token-file", "", "File holding the API server's bearer token (default: $K3SD_API_TOKEN)")
+	minApplyInterval := flag.Duration("min-apply-interval", time.Minute, "Minimum time between two daemon applies of the same cluster")
+	reportPath := flag.String("report", "", "Write a JSON report of the apply run to this file")
+	junitPath := flag.String("junit", "", "Write a JUnit XML report of the apply run to this file")
+	logLevel := flag.String("log-level", "", "Minimum level of console log messages: debug, info, warn or error (default warn, or debug with -v)")
+	logFormat := flag.String("log-format", "text", "Format of console log messages: text or json")
+	logDir := flag.String("log-dir", "", "Directory of the per-run log files (default: ~/.k3sd/logs)")
+	noLogFile := flag.Bool("no-log-file", false, "Do not write a per-run log file")
+	logEndpoint := flag.String("log-endpoint", "", "Also post log messages as JSON lines to this HTTP endpoint")
+	progress := flag.String("progress", "auto", "Progress display of apply runs: auto, tty (live view), plain (one line per step) or none")
+	traceEndpoint := flag.String("trace-endpoint", "", "Export OpenTelemetry spans of the run to this OTLP/HTTP endpoint, e.g. localhost:4318")
+	traceFile := flag.String("trace-file", "", "Write OpenTelemetry spans of the run as JSON to this file")
+	webhooks := flag.String("webhooks", "", "JSON file listing webhooks notified of the events of every apply, besides the clusters' own")
+	secretStore := flag.String("secret-store", "", "Path of the local encrypted store of secret: references (default: ~/.k3sd/secrets.json)")
+	var ageRecipients stringListFlag
+	flag.Var(&ageRecipients, "age-recipient", "Age recipient to encrypt the config to with config encrypt (repeatable or comma-separated; default: $SOPS_AGE_RECIPIENTS or the local age keys)")
+	encryptedRegex := flag.String("encrypted-regex", "", "Regular expression of the keys whose values config encrypt encrypts (default: passwords, tokens and secrets)")
+	logKubeconfigs := flag.Bool("log-kubeconfigs", false, "Log the content of fetched kubeconfigs at debug level (private keys are masked)")
 
 	flag.Parse()
+	if flag.NArg() > 0 {
+		Command = flag.Arg(0)
+		// flags may also follow the arguments of the subcommand, as in "config encrypt --config-path FILE"
+		rest := flag.Args()[1:]
+		for {
+			_ = flag.CommandLine.Parse(rest)
+			if flag.NArg() == 0 {
+				break
+			}
+			CommandArgs = append(CommandArgs, flag.Arg(0))
+			rest = flag.Args()[1:]
+		}
+	}
 
 	VersionFlag = *versionFlag
 	Uninstall = *uninstallFlag
+	if Uninstall && Command == "" {
+		Command = "destroy"
+	}
+	if *forceUnlock && Command == "" {
+		Command = "force-unlock"
+	}
 	Verbose = *verbose
 	HelmAtomic = *helmAtomic
 	YamlsPath = *yamlsPath
 	GenerateFlag = *generateFlag
 	DBPath = *dbPath
+	Environment = *env
+	Selection = Selector{
+		Clusters:   clusters,
+		Nodes:      nodes,
+		Addons:     addons,
+		SkipAddons: *skipAddons,
+	}
+	AutoApprove = *yes || *autoApprove
+	ConfirmContexts = confirm
+	OutputFormat = *outputFormat
+	Reconcile = *reconcile
+	ListenAddr = *listen
+	WatchInterval = *watchInterval
+	DriftInterval = *driftInterval
+	MinApplyInterval = *minApplyInterval
+	APITokenFile = *apiTokenFile
+	ReportPath = *reportPath
+	JUnitPath = *junitPath
+	LogLevel = *logLevel
+	LogFormat = *logFormat
+	LogDir = *logDir
+	NoLogFile = *noLogFile
+	LogKubeconfigs = *logKubeconfigs
+	LogEndpoint = *logEndpoint
+	ProgressMode = *progress
+	TraceEndpoint = *traceEndpoint
+	TraceFile = *traceFile
+	WebhooksPath = *webhooks
+	SecretStorePath = *secretStore
+	AgeRecipients = ageRecipients
+	EncryptedRegex = *encryptedRegex
 
 	if *configPath != "" {
 		ConfigPath = *configPath
-	} else if !VersionFlag {
+	} else if !VersionFlag && Command != "schema" && Command != "secret" {
 		fmt.Println("Must specify --config-path")
 		flag.Usage()
 	}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 )
 
@@ -20,126 +22,165 @@ func LogIfError(logger *Logger, err error, format string, args ...interface{}) {
 	}
 }
 
+// Logger is the structured logger passed through all k3sd operations. It wraps a slog.Logger;
+// messages are formatted with fmt.Sprintf and carry the fields added with With (cluster, node,
+// addon, step). Messages go to the logger's sink, a slog.Handler; slow sinks are wrapped in an
+// AsyncHandler so logging never waits on them. Close the logger before exiting so buffered
+// messages are written out.
 type Logger struct {
-	// Stdout is the channel for standard output log messages.
-	Stdout chan string
-	// Stderr is the channel for error log messages.
-	Stderr chan string
-	// File is the channel for file log messages.
-	File chan FileWithInfo
-	// Cmd is the channel for command log messages.
-	Cmd chan string
-	// Id is the logger/session ID, used to distinguish log streams.
+	// Id is the logger/session ID; it also names the kubeconfig directory (./kubeconfigs/<Id>).
 	Id string
-}
 
-type FileWithInfo struct {
-	// FileName is the name of the file being logged.
-	FileName string
-	// Content is the content of the file being logged.
-	Content string
+	log  *slog.Logger
+	sink slog.Handler
 }
 
-// NewLogger creates and returns a new Logger instance with the given ID.
-// The logger provides separate channels for stdout, stderr, file, and command logs.
+// Field names used by k3sd log records.
+const (
+	FieldCluster = "cluster"
+	FieldNode    = "node"
+	FieldAddon   = "addon"
+	FieldStep    = "step"
+	FieldKind    = "kind"
+	FieldFile    = "file"
+	FieldContent = "content"
+)
+
+// NewLogger creates and returns a new Logger instance with the given ID writing to handler.
+// Secrets known to the DefaultRedactor are masked in every message and field before they
+// reach the handler.
 //
 // Parameters:
 //
 //	id: a string identifier for the logger/session (useful for grouping logs).
+//	handler: slog handler receiving the records; nil discards them.
 //
 // Returns:
 //
 //	*Logger: a pointer to the new Logger instance.
-func NewLogger(id string) *Logger {
-	return &Logger{
-		Stdout: make(chan string, 100),
-		Stderr: make(chan string, 100),
-		File:   make(chan FileWithInfo, 100),
-		Cmd:    make(chan string, 100),
-		Id:     id,
+func NewLogger(id string, handler slog.Handler) *Logger {
+	if handler == nil {
+		handler = slog.DiscardHandler
 	}
+	return &Logger{Id: id, log: slog.New(redactHandler{next: handler, redactor: DefaultRedactor}), sink: handler}
+}
+
+// With returns a logger that adds the given fields to every record, e.g.
+// logger.With(utils.FieldCluster, "prod", utils.FieldNode, "worker1").
+//
+// Parameters:
+//
+//	args: Alternating keys and values, or slog.Attr values.
+//
+// Returns:
+//
+//	*Logger: the derived logger, sharing the ID and handler.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{Id: l.Id, log: l.log.With(args...), sink: l.sink}
+}
+
+// Flush writes out the records buffered by the logger's sinks, such as a remote sink.
+//
+// Parameters:
+//
+//	timeout: Maximum time to wait.
+//
+// Returns:
+//
+//	error: ErrFlushTimeout if records are still pending at the timeout, or a sink's error.
+func (l *Logger) Flush(timeout time.Duration) error {
+	return flushSink(l.sink, timeout)
+}
+
+// Close flushes the logger's sinks, waiting at most timeout, and closes them (e.g. the run
+// log file). Call it once when the logger is no longer used; it closes the sinks shared with
+// the loggers derived with With.
+//
+// Parameters:
+//
+//	timeout: Maximum time to wait for buffered records.
+//
+// Returns:
+//
+//	error: The flush or close errors.
+func (l *Logger) Close(timeout time.Duration) error {
+	return errors.Join(l.Flush(timeout), closeSink(l.sink))
+}
+
+// Slog returns the underlying slog.Logger.
+func (l *Logger) Slog() *slog.Logger {
+	return l.log
+}
+
+// Debug logs a formatted message at debug level.
+//
+// Parameters:
+//
+//	format: a format string (as in fmt.Sprintf)
+//	args: arguments for the format string
+func (l *Logger) Debug(format string, args ...interface{}) {
+	l.log.Debug(fmt.Sprintf(format, args...))
 }
 
-// Log sends a formatted message to the logger's Stdout channel.
+// Log logs a formatted message at info level.
 //
 // Parameters:
 //
 //	format: a format string (as in fmt.Sprintf)
 //	args: arguments for the format string
 func (l *Logger) Log(format string, args ...interface{}) {
-	l.Stdout <- fmt.Sprintf(format, args...)
+	l.log.Info(fmt.Sprintf(format, args...))
 }
 
-// LogErr sends a formatted error message to the logger's Stderr channel.
+// Warn logs a formatted message at warning level.
+//
+// Parameters:
+//
+//	format: a format string (as in fmt.Sprintf)
+//	args: arguments for the format string
+func (l *Logger) Warn(format string, args ...interface{}) {
+	l.log.Warn(fmt.Sprintf(format, args...))
+}
+
+// LogErr logs a formatted message at error level.
 //
 // Parameters:
 //
 //	format: a format string (as in fmt.Sprintf)
 //	args: arguments for the format string
 func (l *Logger) LogErr(format string, args ...interface{}) {
-	l.Stderr <- fmt.Sprintf(format, args...)
+	l.log.Error(fmt.Sprintf(format, args...))
 }
 
-// LogFile sends a file's content to the logger's File channel.
+// LogFile logs a file's content at debug level.
 //
 // Parameters:
 //
 //	filePath: the name of the file being logged
 //	content: the content of the file
 func (l *Logger) LogFile(filePath, content string) {
-	l.File <- FileWithInfo{FileName: filePath, Content: content}
+	l.log.Debug("file "+filePath, FieldKind, "file", FieldFile, filePath, FieldContent, content)
 }
 
-// LogCmd sends a formatted command string to the logger's Cmd channel.
+// LogCmd logs a formatted command line at debug level.
 //
 // Parameters:
 //
 //	format: a format string (as in fmt.Sprintf)
 //	args: arguments for the format string
 func (l *Logger) LogCmd(format string, args ...interface{}) {
-	l.Cmd <- fmt.Sprintf(format, args...)
-}
-
-// LogWorker processes and prints all messages from the Stdout channel.
-// If Verbose is false, it simply drains the channel with a delay (for background logging).
-// Otherwise, it prints each message to the standard logger with a [stdout] prefix.
-func (l *Logger) LogWorker() {
-	if !Verbose {
-		for range l.Stdout {
-			time.Sleep(100 * time.Millisecond)
-		}
-		return
-	}
-	for logMessage := range l.Stdout {
-		log.Printf("[stdout] %s", logMessage)
-	}
-}
-
-// LogWorkerErr processes and prints all messages from the Stderr channel.
-// Each message is printed to the standard logger with a [stderr] prefix.
-func (l *Logger) LogWorkerErr() {
-	for logMessage := range l.Stderr {
-		log.Printf("[stderr] %s", logMessage)
-	}
-}
-
-// LogWorkerFile processes and prints all file log messages from the File channel.
-// Each file's content is printed with delimiters and the file name for clarity.
-func (l *Logger) LogWorkerFile() {
-	delimiter := "----------------------------------------"
-	for logMessage := range l.File {
-		strings := []string{delimiter, logMessage.FileName, delimiter, logMessage.Content, delimiter, logMessage.FileName, delimiter}
-		log.Println("[FILE]")
-		for _, s := range strings {
-			log.Println(s)
-		}
-	}
+	l.log.Debug(fmt.Sprintf(format, args...), FieldKind, "cmd")
 }
 
-// LogWorkerCmd processes and prints all command log messages from the Cmd channel.
-// Each message is printed to the standard logger with a [CMD] prefix.
-func (l *Logger) LogWorkerCmd() {
-	for logMessage := range l.Cmd {
-		log.Printf("[CMD] %s", logMessage)
-	}
+// Enabled reports whether records at the given level are handled.
+//
+// Parameters:
+//
+//	level: Log level.
+//
+// Returns:
+//
+//	bool: true if a record at level would be written.
+func (l *Logger) Enabled(level slog.Level) bool {
+	return l.log.Enabled(context.Background(), level)
 }
@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log output formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// ParseLevel parses a log level name: debug, info, warn (or warning) or error.
+//
+// Parameters:
+//
+//	name: Level name, case-insensitive.
+//
+// Returns:
+//
+//	slog.Level: The parsed level.
+//	error: Error if the name is not a level.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+}
+
+// NewLogHandler returns a handler writing records of at least level to w in the given format.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	format: LogFormatText or LogFormatJSON.
+//	level: Minimum level of the written records.
+//
+// Returns:
+//
+//	slog.Handler: The handler.
+//	error: Error if the format is unknown.
+func NewLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	switch format {
+	case "", LogFormatText:
+		return NewTextHandler(w, level), nil
+	case LogFormatJSON:
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+// OpenRunLog creates the log file of a run in dir, named after the start time and the command,
+// e.g. 20250102-150405-apply.log.
+//
+// Parameters:
+//
+//	dir: Log directory; created if missing.
+//	command: Command of the run; empty for apply.
+//
+// Returns:
+//
+//	*os.File: The log file; close it when the run ends.
+//	error: Error if the directory or file cannot be created.
+func OpenRunLog(dir, command string) (*os.File, error) {
+	if command == "" {
+		command = "apply"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s.log", time.Now().Format("20060102-150405"), command)
+	return os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+}
+
+// TextHandler is a slog.Handler writing human-readable lines: time, level, message and the
+// record's fields as key=value. The content of logged files is written below the line,
+// between delimiters.
+type TextHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+
+	omitContent bool
+}
+
+// NewTextHandler returns a TextHandler writing records of at least level to w.
+//
+// Parameters:
+//
+//	w: Destination writer.
+//	level: Minimum level of the written records; nil means info.
+//
+// Returns:
+//
+//	*TextHandler: The handler.
+func NewTextHandler(w io.Writer, level slog.Leveler) *TextHandler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &TextHandler{w: w, mu: &sync.Mutex{}, level: level}
+}
+
+// WithoutContent returns a handler that writes the line of logged files but not their content.
+func (h *TextHandler) WithoutContent() *TextHandler {
+	clone := *h
+	clone.omitContent = true
+	return &clone
+}
+
+// Enabled reports whether records of level are written.
+func (h *TextHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle writes a record.
+func (h *TextHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if !r.Time.IsZero() {
+		b.WriteString(r.Time.Format("2006/01/02 15:04:05"))
+		b.WriteByte(' ')
+	}
+	fmt.Fprintf(&b, "%-5s %s", r.Level.String(), r.Message)
+	var content string
+	write := func(a slog.Attr, prefix string) {
+		if a.Key == FieldContent && prefix == "" {
+			content = a.Value.String()
+			return
+		}
+		appendAttr(&b, prefix, a)
+	}
+	for _, a := range h.attrs {
+		write(a, "")
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		write(a, h.prefix)
+		return true
+	})
+	b.WriteByte('\n')
+	if content != "" && !h.omitContent {
+		const delimiter = "----------------------------------------"
+		b.WriteString(delimiter + "\n" + strings.TrimRight(content, "\n") + "\n" + delimiter + "\n")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// WithAttrs returns a handler adding attrs to every record.
+func (h *TextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		clone.attrs = append(clone.attrs, a)
+	}
+	return &clone
+}
+
+// WithGroup returns a handler prefixing the keys of later attributes with name.
+func (h *TextHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, value)
+}
+
+// MultiHandler fans records out to several handlers, e.g. the console and the run log file.
+type MultiHandler []slog.Handler
+
+// Enabled reports whether any of the handlers writes records of level.
+func (m MultiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle passes a record to every handler that writes its level and returns their errors.
+func (m MultiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WithAttrs returns a MultiHandler adding attrs to every handler.
+func (m MultiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(MultiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+// WithGroup returns a MultiHandler opening the group in every handler.
+func (m MultiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(MultiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
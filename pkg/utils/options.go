@@ -0,0 +1,46 @@
+package utils
+
+import "context"
+
+// Options holds the settings that affect how clusters and addons are installed.
+//
+// Fields:
+//   - HelmAtomic: Pass --atomic to all Helm operations (rollback on failure).
+//   - YamlsPath: Prefix path to the YAMLs of the built-in addons. If empty, ./yamls or
+//     ~/.k3sd/yamls is used.
+//   - LogKubeconfigs: Log the content of fetched kubeconfigs at debug level.
+type Options struct {
+	HelmAtomic     bool
+	YamlsPath      string
+	LogKubeconfigs bool
+}
+
+type optionsKey struct{}
+
+// WithOptions returns a copy of ctx carrying the given options.
+//
+// Parameters:
+//
+//	ctx: Parent context.
+//	opts: Options for the operations run with the returned context.
+//
+// Returns:
+//
+//	context.Context: the derived context.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, opts)
+}
+
+// OptionsFrom returns the options carried by ctx, or the zero Options if there are none.
+//
+// Parameters:
+//
+//	ctx: Context created with WithOptions.
+//
+// Returns:
+//
+//	Options: the carried options.
+func OptionsFrom(ctx context.Context) Options {
+	opts, _ := ctx.Value(optionsKey{}).(Options)
+	return opts
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// StepInfo identifies a step of a run.
+//
+// Fields:
+//   - Cluster: Cluster display name.
+//   - Node: Node name, if the step acts on a node.
+//   - Addon: Addon name, if the step acts on an addon.
+//   - Step: Step name, e.g. "install" or "apply".
+type StepInfo struct {
+	Cluster string
+	Node    string
+	Addon   string
+	Step    string
+}
+
+// Progress receives the progress of a run as it happens, e.g. to display it. Its methods are
+// called from the goroutine running the step and must not block for long.
+type Progress interface {
+	// StepStarted is called when a step starts.
+	StepStarted(step StepInfo)
+	// StepCommand is called when a step runs a local or remote command; secrets are masked.
+	StepCommand(step StepInfo, command string)
+	// StepFinished is called when a step ends; err is nil if it succeeded.
+	StepFinished(step StepInfo, duration time.Duration, err error)
+}
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx that reports the progress of the steps run with it to p.
+//
+// Parameters:
+//
+//	ctx: Parent context.
+//	p: Receiver of the progress.
+//
+// Returns:
+//
+//	context.Context: the derived context.
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// ProgressFrom returns the Progress carried by ctx, or nil if there is none.
+//
+// Parameters:
+//
+//	ctx: Context created with WithProgress.
+//
+// Returns:
+//
+//	Progress: the carried receiver, or nil.
+func ProgressFrom(ctx context.Context) Progress {
+	p, _ := ctx.Value(progressKey{}).(Progress)
+	return p
+}
+
+// MultiProgress passes the progress of a run to every non-nil receiver in order.
+type MultiProgress []Progress
+
+// StepStarted calls StepStarted of every receiver.
+func (m MultiProgress) StepStarted(step StepInfo) {
+	for _, p := range m {
+		if p != nil {
+			p.StepStarted(step)
+		}
+	}
+}
+
+// StepCommand calls StepCommand of every receiver.
+func (m MultiProgress) StepCommand(step StepInfo, command string) {
+	for _, p := range m {
+		if p != nil {
+			p.StepCommand(step, command)
+		}
+	}
+}
+
+// StepFinished calls StepFinished of every receiver.
+func (m MultiProgress) StepFinished(step StepInfo, duration time.Duration, err error) {
+	for _, p := range m {
+		if p != nil {
+			p.StepFinished(step, duration, err)
+		}
+	}
+}
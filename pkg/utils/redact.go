@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in log messages, recorded commands and errors.
+const Redacted = "******"
+
+// minSecretLength is the length below which registered values are not masked: masking a
+// one- or two-character password would garble every message that contains those characters.
+const minSecretLength = 4
+
+// secretPatterns match secrets that are recognisable by their context: k3s join tokens,
+// PEM private keys and the credentials in kubeconfigs. The first group is kept, the rest of
+// the match is masked.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(K3S_(?:AGENT_)?TOKEN=)(?:'[^']*'|"[^"]*"|[^\s'"]+)`),
+	regexp.MustCompile(`(--(?:token|password)[= ])(?:'[^']*'|"[^"]*"|\S+)`),
+	regexp.MustCompile(`(-----BEGIN [A-Z ]*PRIVATE KEY-----)[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`(?m)(^[ \t]*(?:client-key-data|token|password):[ \t]*)\S+`),
+}
+
+// Redactor masks secrets in text. Secrets are either registered values, such as node
+// passwords and secret substitution values, or recognised by secretPatterns. It is safe for
+// concurrent use.
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// DefaultRedactor is the Redactor used by loggers, recorded commands and step errors.
+var DefaultRedactor = &Redactor{}
+
+// Register adds secret values to mask. Empty values and values shorter than four characters
+// are ignored.
+//
+// Parameters:
+//
+//	values: Secret values, e.g. passwords and tokens.
+func (r *Redactor) Register(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) < minSecretLength || containsString(r.secrets, value) {
+			continue
+		}
+		r.secrets = append(r.secrets, value)
+	}
+	// longest first, so a secret containing another one is masked as a whole
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+// RedactValues returns s with the registered secrets replaced by Redacted. Unlike Redact, it
+// leaves the secrets recognised by their context alone, e.g. to mask a single config value.
+//
+// Parameters:
+//
+//	s: Text to mask.
+//
+// Returns:
+//
+//	string: the masked text.
+func (r *Redactor) RedactValues(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	return s
+}
+
+// Redact returns s with all registered and recognised secrets replaced by Redacted.
+//
+// Parameters:
+//
+//	s: Text to mask.
+//
+// Returns:
+//
+//	string: the masked text.
+func (r *Redactor) Redact(s string) string {
+	s = r.RedactValues(s)
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+Redacted)
+	}
+	return s
+}
+
+// RegisterSecret adds secret values to the DefaultRedactor.
+//
+// Parameters:
+//
+//	values: Secret values, e.g. passwords and tokens.
+func RegisterSecret(values ...string) {
+	DefaultRedactor.Register(values...)
+}
+
+// Redact masks secrets in s with the DefaultRedactor.
+//
+// Parameters:
+//
+//	s: Text to mask.
+//
+// Returns:
+//
+//	string: the masked text.
+func Redact(s string) string {
+	return DefaultRedactor.Redact(s)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHandler masks secrets in the message and the string fields of records before passing
+// them to the next handler.
+type redactHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+func (h redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, h.redactor.Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redactAttr(a)
+	}
+	return redactHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+func (h redactHandler) redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(h.redactor.Redact(a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]any, len(group))
+		for i, ga := range group {
+			redacted[i] = h.redactAttr(ga)
+		}
+		a = slog.Group(a.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(h.redactor.Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"strings"
+)
+
+// Selector narrows a run down to specific clusters, nodes and addons.
+//
+// Fields:
+//
+//	Clusters: kubeconfig context names of the clusters to act on (empty means all)
+//	Nodes: node names (master or worker) to act on (empty means all)
+//	Addons: addon names (built-in or custom) to act on (empty means all)
+//	SkipAddons: if true, no addon is applied or deleted
+//
+// Node and addon selections are exclusive by default: selecting only nodes skips
+// addons, and selecting only addons skips node setup. Select both to run both.
+type Selector struct {
+	Clusters   []string
+	Nodes      []string
+	Addons     []string
+	SkipAddons bool
+}
+
+// MatchCluster reports whether the cluster with the given context is selected.
+func (s Selector) MatchCluster(context string) bool {
+	return len(s.Clusters) == 0 || contains(s.Clusters, context)
+}
+
+// MatchNode reports whether the node with the given name is selected.
+func (s Selector) MatchNode(nodeName string) bool {
+	if len(s.Nodes) > 0 {
+		return contains(s.Nodes, nodeName)
+	}
+	return len(s.Addons) == 0
+}
+
+// MatchAddon reports whether the addon with the given name is selected.
+func (s Selector) MatchAddon(name string) bool {
+	if s.SkipAddons {
+		return false
+	}
+	if len(s.Addons) > 0 {
+		return contains(s.Addons, name)
+	}
+	return len(s.Nodes) == 0
+}
+
+// ExplicitAddon reports whether the addon was named explicitly with --addon.
+// Explicitly named addons are re-applied even if their config did not change.
+func (s Selector) ExplicitAddon(name string) bool {
+	return !s.SkipAddons && contains(s.Addons, name)
+}
+
+// IsEmpty reports whether the selector selects everything.
+func (s Selector) IsEmpty() bool {
+	return len(s.Clusters) == 0 && len(s.Nodes) == 0 && len(s.Addons) == 0 && !s.SkipAddons
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// stringListFlag is a flag.Value collecting repeated and comma-separated values.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
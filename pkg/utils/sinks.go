@@ -0,0 +1,403 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A sink is a slog.Handler receiving the records of a Logger. Sinks that buffer records
+// implement Flusher, sinks that hold resources implement io.Closer; Logger.Flush and
+// Logger.Close call them. The sinks of this package are:
+//
+//   - console and file: NewLogHandler, with WithCloser to close the file,
+//   - in-memory: MemoryHandler, e.g. for tests,
+//   - remote: NewRemoteHandler, posting JSON lines over HTTP,
+//   - AsyncHandler, which moves a slow sink off the logging goroutine,
+//   - MultiHandler, which fans records out to several sinks.
+
+// Flusher is implemented by sinks that buffer records.
+type Flusher interface {
+	// Flush writes out the buffered records, waiting at most timeout.
+	Flush(timeout time.Duration) error
+}
+
+// ErrFlushTimeout is returned by Flush when buffered records are still pending at the timeout.
+var ErrFlushTimeout = errors.New("log flush timed out")
+
+// flushSink flushes h if it buffers records.
+func flushSink(h slog.Handler, timeout time.Duration) error {
+	if f, ok := h.(Flusher); ok {
+		return f.Flush(timeout)
+	}
+	return nil
+}
+
+// closeSink closes h if it holds resources.
+func closeSink(h slog.Handler) error {
+	if c, ok := h.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Flush implements Flusher by flushing every handler.
+func (m MultiHandler) Flush(timeout time.Duration) error {
+	var errs []error
+	for _, h := range m {
+		errs = append(errs, flushSink(h, timeout))
+	}
+	return errors.Join(errs...)
+}
+
+// Close implements io.Closer by closing every handler.
+func (m MultiHandler) Close() error {
+	var errs []error
+	for _, h := range m {
+		errs = append(errs, closeSink(h))
+	}
+	return errors.Join(errs...)
+}
+
+// closingHandler is a handler that owns a resource, such as the file it writes to.
+type closingHandler struct {
+	slog.Handler
+	closer io.Closer
+}
+
+// WithCloser returns a sink that writes through h and closes c when the sink is closed, e.g.
+// a file handler and its file.
+//
+// Parameters:
+//
+//	h: The handler.
+//	c: The resource to close with the sink.
+//
+// Returns:
+//
+//	slog.Handler: the sink.
+func WithCloser(h slog.Handler, c io.Closer) slog.Handler {
+	return closingHandler{Handler: h, closer: c}
+}
+
+// Flush implements Flusher by flushing the wrapped handler.
+func (h closingHandler) Flush(timeout time.Duration) error {
+	return flushSink(h.Handler, timeout)
+}
+
+// Close closes the wrapped handler and the resource.
+func (h closingHandler) Close() error {
+	return errors.Join(closeSink(h.Handler), h.closer.Close())
+}
+
+// asyncRecord is a record queued for the handler it was logged to.
+type asyncRecord struct {
+	handler slog.Handler
+	record  slog.Record
+}
+
+// asyncQueue is the queue shared by an AsyncHandler and the handlers derived from it.
+type asyncQueue struct {
+	next    slog.Handler
+	records chan asyncRecord
+	pending atomic.Int64
+	dropped atomic.Int64
+	done    chan struct{}
+
+	// sendMu is held for reading while records are sent and for writing while the queue is
+	// closed, so no record is sent on the closed channel.
+	sendMu sync.RWMutex
+	closed bool
+}
+
+// AsyncHandler passes records to the next handler from a background goroutine, so a slow sink
+// such as a remote endpoint never delays the operation that logs. When the queue is full,
+// records below warning level are dropped and counted; warnings and errors wait for room, so
+// they are never lost.
+type AsyncHandler struct {
+	queue *asyncQueue
+	next  slog.Handler
+}
+
+// NewAsyncHandler returns an AsyncHandler queuing up to size records for next.
+//
+// Parameters:
+//
+//	next: The slow handler.
+//	size: Queue capacity.
+//
+// Returns:
+//
+//	*AsyncHandler: the handler; Close it to drain the queue.
+func NewAsyncHandler(next slog.Handler, size int) *AsyncHandler {
+	queue := &asyncQueue{next: next, records: make(chan asyncRecord, size), done: make(chan struct{})}
+	go queue.run()
+	return &AsyncHandler{queue: queue, next: next}
+}
+
+func (q *asyncQueue) run() {
+	defer close(q.done)
+	for item := range q.records {
+		_ = item.handler.Handle(context.Background(), item.record)
+		q.pending.Add(-1)
+	}
+}
+
+// Enabled reports whether the next handler writes records of level.
+func (h *AsyncHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle queues a record.
+func (h *AsyncHandler) Handle(_ context.Context, r slog.Record) error {
+	q := h.queue
+	q.sendMu.RLock()
+	defer q.sendMu.RUnlock()
+	if q.closed {
+		return nil
+	}
+	item := asyncRecord{handler: h.next, record: r.Clone()}
+	q.pending.Add(1)
+	if r.Level >= slog.LevelWarn {
+		q.records <- item
+		return nil
+	}
+	select {
+	case q.records <- item:
+	default:
+		q.pending.Add(-1)
+		q.dropped.Add(1)
+	}
+	return nil
+}
+
+// WithAttrs returns a handler adding attrs to the records it queues.
+func (h *AsyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &AsyncHandler{queue: h.queue, next: h.next.WithAttrs(attrs)}
+}
+
+// WithGroup returns a handler opening the group in the records it queues.
+func (h *AsyncHandler) WithGroup(name string) slog.Handler {
+	return &AsyncHandler{queue: h.queue, next: h.next.WithGroup(name)}
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+func (h *AsyncHandler) Dropped() int64 {
+	return h.queue.dropped.Load()
+}
+
+// Flush waits until the queued records are handled, then flushes the next handler.
+func (h *AsyncHandler) Flush(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for h.queue.pending.Load() > 0 {
+		if time.Now().After(deadline) {
+			return ErrFlushTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return flushSink(h.queue.next, time.Until(deadline))
+}
+
+// Close drains the queue, reports the number of dropped records and closes the next handler.
+// Records logged after Close are discarded.
+func (h *AsyncHandler) Close() error {
+	q := h.queue
+	q.sendMu.Lock()
+	if q.closed {
+		q.sendMu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.records)
+	q.sendMu.Unlock()
+	<-q.done
+	if dropped := q.dropped.Load(); dropped > 0 {
+		r := slog.NewRecord(time.Now(), slog.LevelWarn, fmt.Sprintf("%d log messages were dropped because the sink was too slow", dropped), 0)
+		_ = q.next.Handle(context.Background(), r)
+	}
+	return closeSink(q.next)
+}
+
+// MemoryRecord is a record kept by a MemoryHandler.
+//
+// Fields:
+//   - Time: Time of the record.
+//   - Level: Level of the record.
+//   - Message: Log message.
+//   - Fields: The record's fields, including those added with Logger.With.
+type MemoryRecord struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Fields  map[string]any
+}
+
+// memoryStore is the record list shared by a MemoryHandler and the handlers derived from it.
+type memoryStore struct {
+	mu      sync.Mutex
+	records []MemoryRecord
+}
+
+// MemoryHandler keeps records in memory, e.g. to inspect the output of an operation in tests.
+type MemoryHandler struct {
+	store  *memoryStore
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+}
+
+// NewMemoryHandler returns a MemoryHandler keeping records of at least level.
+//
+// Parameters:
+//
+//	level: Minimum level of the kept records; nil means debug.
+//
+// Returns:
+//
+//	*MemoryHandler: the handler.
+func NewMemoryHandler(level slog.Leveler) *MemoryHandler {
+	if level == nil {
+		level = slog.LevelDebug
+	}
+	return &MemoryHandler{store: &memoryStore{}, level: level}
+}
+
+// Enabled reports whether records of level are kept.
+func (h *MemoryHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle keeps a record.
+func (h *MemoryHandler) Handle(_ context.Context, r slog.Record) error {
+	record := MemoryRecord{Time: r.Time, Level: r.Level, Message: r.Message, Fields: make(map[string]any)}
+	for _, a := range h.attrs {
+		record.Fields[a.Key] = a.Value.Resolve().Any()
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		record.Fields[h.prefix+a.Key] = a.Value.Resolve().Any()
+		return true
+	})
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	h.store.records = append(h.store.records, record)
+	return nil
+}
+
+// WithAttrs returns a handler adding attrs to the records it keeps.
+func (h *MemoryHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		clone.attrs = append(clone.attrs, a)
+	}
+	return &clone
+}
+
+// WithGroup returns a handler prefixing the keys of later fields with name.
+func (h *MemoryHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+// Records returns the records kept so far, oldest first.
+func (h *MemoryHandler) Records() []MemoryRecord {
+	h.store.mu.Lock()
+	defer h.store.mu.Unlock()
+	return append([]MemoryRecord(nil), h.store.records...)
+}
+
+// remoteBatchSize is the buffered size after which a remote sink posts its records.
+const remoteBatchSize = 64 << 10
+
+// remoteBuffer collects the JSON lines of a remote sink and posts them in batches.
+type remoteBuffer struct {
+	url    string
+	client *http.Client
+	mu     sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (b *remoteBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	b.buf.Write(p)
+	full := b.buf.Len() >= remoteBatchSize
+	b.mu.Unlock()
+	if full {
+		return len(p), b.post()
+	}
+	return len(p), nil
+}
+
+func (b *remoteBuffer) post() error {
+	b.mu.Lock()
+	if b.buf.Len() == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	body := bytes.NewReader(append([]byte(nil), b.buf.Bytes()...))
+	b.buf.Reset()
+	b.mu.Unlock()
+
+	resp, err := b.client.Post(b.url, "application/x-ndjson", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("log endpoint %s: %s", b.url, resp.Status)
+	}
+	return nil
+}
+
+// remoteHandler writes records as JSON lines into a remoteBuffer.
+type remoteHandler struct {
+	slog.Handler
+	buffer *remoteBuffer
+}
+
+func (h remoteHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return remoteHandler{Handler: h.Handler.WithAttrs(attrs), buffer: h.buffer}
+}
+
+func (h remoteHandler) WithGroup(name string) slog.Handler {
+	return remoteHandler{Handler: h.Handler.WithGroup(name), buffer: h.buffer}
+}
+
+func (h remoteHandler) Flush(time.Duration) error {
+	return h.buffer.post()
+}
+
+func (h remoteHandler) Close() error {
+	return h.buffer.post()
+}
+
+// NewRemoteHandler returns a sink posting records as JSON lines (application/x-ndjson) to an
+// HTTP endpoint, such as a log collector. Records are posted in batches of about 64 KiB, on
+// Flush and on Close, from a background goroutine: a slow or unreachable endpoint never
+// delays the run, and at most 1024 records wait for it.
+//
+// Parameters:
+//
+//	url: Endpoint receiving POST requests.
+//	level: Minimum level of the posted records.
+//
+// Returns:
+//
+//	*AsyncHandler: the sink; Close it to post the remaining records.
+func NewRemoteHandler(url string, level slog.Leveler) *AsyncHandler {
+	buffer := &remoteBuffer{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+	handler := remoteHandler{Handler: slog.NewJSONHandler(buffer, &slog.HandlerOptions{Level: level}), buffer: buffer}
+	return NewAsyncHandler(handler, 1024)
+}
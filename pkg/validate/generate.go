@@ -0,0 +1,22 @@
+//go:build ignore
+
+// generate writes the JSON Schema of cluster configs to schema/clusters.schema.json.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/argon-chat/k3sd/pkg/validate"
+)
+
+func main() {
+	data, err := json.MarshalIndent(validate.ConfigSchema(), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("../../schema/clusters.schema.json", append(data, '\n'), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
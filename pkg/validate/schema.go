@@ -0,0 +1,349 @@
+package validate
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/addons"
+	"github.com/argon-chat/k3sd/pkg/types"
+)
+
+//go:generate go run generate.go
+
+// SchemaID is the URL the JSON Schema of cluster configs is published at.
+const SchemaID = "https://raw.githubusercontent.com/argon-chat/k3sd/main/schema/clusters.schema.json"
+
+// Schema is a JSON Schema (draft 2020-12), limited to the keywords describing cluster configs.
+//
+// Fields:
+//   - Schema: URI of the JSON Schema dialect, on the root schema only.
+//   - ID: URL the schema is published at, on the root schema only.
+//   - Ref: Reference to a schema of Defs, as "#/$defs/<name>".
+//   - Defs: Schemas referenced by name, on the root schema only.
+//   - Title: Title of the schema.
+//   - Description: Description of the value.
+//   - Type: JSON type of the value: object, array, string, boolean or integer; any type if empty.
+//   - Properties: Schemas of the known keys of an object.
+//   - PatternProperties: Schemas of the keys of an object matching a regular expression.
+//   - AdditionalProperties: Schema of the other keys of an object, or false if there may be none.
+//   - PropertyNames: Schema of the keys of an object.
+//   - Required: Keys an object must have.
+//   - Items: Schema of the items of an array.
+//   - Enum: Values the value must be one of.
+//   - OneOf: Schemas of which the value must match exactly one.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	ID                   string             `json:"$id,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	PatternProperties    map[string]*Schema `json:"patternProperties,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+	PropertyNames        *Schema            `json:"propertyNames,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// ConfigSchema returns the JSON Schema of cluster configs, generated from types.Cluster: a
+// list of clusters, or an object with a "clusters" list. The object may also hold "$schema",
+// to point editors at the schema, keys starting with "x-", e.g. for YAML anchors, the SOPS
+// metadata of encrypted configs and the keys composing a config of others: "include",
+// "defaults" and "environments". As those complete the clusters of the object, its clusters
+// need not have the required keys.
+//
+// Returns:
+//   - *Schema: The schema of cluster configs.
+func ConfigSchema() *Schema {
+	defs := make(map[string]*Schema)
+	list := &Schema{Type: "array", Items: schemaOf(reflect.TypeOf(types.Cluster{}), defs)}
+	cluster := defs["cluster"]
+	cluster.Description = "A k3s cluster: its master node, workers and addons."
+	// addons are keyed by name; list the known ones for editors, Clusters rejects the others
+	known := addons.Names()
+	addonMap := cluster.Properties["addons"]
+	addonMap.Properties = make(map[string]*Schema, len(known))
+	for _, name := range known {
+		addonMap.Properties[name] = addonMap.AdditionalProperties.(*Schema)
+	}
+	addonMap.PropertyNames = &Schema{Enum: known}
+	// overlays hold partial clusters, merged onto others before the required keys are checked
+	defs["workerOverlay"] = optional(defs["worker"])
+	defs["workerOverlay"].Description = "Settings merged onto the worker of the same nodeName."
+	defs["clusterOverlay"] = optional(cluster)
+	defs["clusterOverlay"].Description = "Settings merged onto the cluster of the same context."
+	defs["clusterOverlay"].Properties["workers"] = &Schema{Type: "array", Items: &Schema{Ref: "#/$defs/workerOverlay"}}
+	overlay := &Schema{Ref: "#/$defs/clusterOverlay"}
+	include := &Schema{Type: "array", Items: &Schema{Type: "string"}, Description: "Config files merged under this one, relative to it."}
+	environment := &Schema{
+		Type:        "object",
+		Description: "Overlay merged onto the config when the environment is selected with --env.",
+		Properties: map[string]*Schema{
+			"include":  include,
+			"defaults": overlay,
+			"clusters": {Type: "array", Items: overlay},
+		},
+		AdditionalProperties: false,
+	}
+	return &Schema{
+		Schema:      "https://json-schema.org/draft/2020-12/schema",
+		ID:          SchemaID,
+		Defs:        defs,
+		Title:       "k3sd cluster config",
+		Description: "Clusters managed by k3sd, as a list or as an object with a \"clusters\" list.",
+		OneOf: []*Schema{
+			list,
+			{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"$schema":      {Type: "string"},
+					"clusters":     {Type: "array", Items: overlay},
+					"include":      include,
+					"defaults":     overlay,
+					"environments": {Type: "object", AdditionalProperties: environment},
+					"sops":         {Type: "object", Description: "SOPS metadata of an encrypted config."},
+				},
+				PatternProperties:    map[string]*Schema{"^x-": {}},
+				AdditionalProperties: false,
+			},
+		},
+	}
+}
+
+// optional returns a copy of an object schema without required keys.
+func optional(s *Schema) *Schema {
+	c := *s
+	c.Required = nil
+	c.Properties = maps.Clone(s.Properties)
+	return &c
+}
+
+// schemaOf returns the schema of the JSON encoding of a Go type. The schemas of structs are
+// added to defs, named after their type (e.g. "hook"), and referenced. The fields of a struct
+// are named by their json tags and those tagged validate:"required" are required; embedded
+// structs add their fields.
+func schemaOf(t reflect.Type, defs map[string]*Schema) *Schema {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), defs)
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem(), defs)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), defs)}
+	case reflect.Struct:
+		name := strings.ToLower(t.Name()[:1]) + t.Name()[1:]
+		ref := &Schema{Ref: "#/$defs/" + name}
+		if _, ok := defs[name]; ok {
+			return ref
+		}
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+		defs[name] = s
+		forEachField(t, func(name string, field reflect.StructField) {
+			s.Properties[name] = schemaOf(field.Type, defs)
+			if field.Tag.Get("validate") == "required" {
+				s.Required = append(s.Required, name)
+			}
+		})
+		return ref
+	}
+	return &Schema{}
+}
+
+// forEachField calls fn with the JSON name of every field of a struct type, descending into
+// embedded structs. The index of a field is its index in t.
+func forEachField(t reflect.Type, fn func(name string, field reflect.StructField)) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			forEachField(field.Type, func(name string, embedded reflect.StructField) {
+				embedded.Index = append([]int{i}, embedded.Index...)
+				fn(name, embedded)
+			})
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fn(name, field)
+	}
+}
+
+// Document checks the structure of a config decoded into generic values (maps, lists and
+// scalars, as encoding/json decodes into an any): that it has no unknown fields and that every
+// value has the type of its field. Null is accepted anywhere, like the zero value of a field.
+// The values with problems are removed from doc, so that the rest of it can still be decoded
+// and checked by Clusters, which checks the other constraints of the schema (required fields
+// and addon names).
+//
+// Parameters:
+//   - doc: The decoded config.
+//
+// Returns:
+//   - []Problem: The problems found; nil if there are none.
+func Document(doc any) []Problem {
+	schema := ConfigSchema()
+	c := &checker{defs: schema.Defs}
+	root := "clusters"
+	if _, ok := doc.(map[string]any); ok {
+		root = ""
+	}
+	c.check(schema, root, doc)
+	return c.problems
+}
+
+// checker checks a document against a schema.
+//
+// Fields:
+//   - defs: Schemas references are resolved to.
+//   - problems: Problems found so far.
+type checker struct {
+	defs     map[string]*Schema
+	problems []Problem
+}
+
+// check records the problems of a value at path and removes the values inside it that have
+// problems. It returns false if the value itself has the wrong type.
+func (c *checker) check(s *Schema, path string, v any) bool {
+	if v == nil {
+		return true
+	}
+	if s.Ref != "" {
+		s = c.defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	}
+	if len(s.OneOf) > 0 {
+		var expected []string
+		for _, alt := range s.OneOf {
+			if alt.hasType(v) {
+				return c.check(alt, path, v)
+			}
+			expected = append(expected, typeName(alt.Type))
+		}
+		c.problems = append(c.problems, Problem{Path: path, Message: fmt.Sprintf("expected %s, got %s", strings.Join(expected, " or "), typeOf(v))})
+		return false
+	}
+	if s.Type == "" {
+		return true
+	}
+	if !s.hasType(v) {
+		c.problems = append(c.problems, Problem{Path: path, Message: fmt.Sprintf("expected %s, got %s", typeName(s.Type), typeOf(v))})
+		return false
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := keyPath(path, key)
+			if schema := s.propertySchema(key); schema == nil {
+				c.problems = append(c.problems, Problem{Path: child, Message: "unknown field"})
+			} else if c.check(schema, child, v[key]) {
+				continue
+			}
+			delete(v, key)
+		}
+	case []any:
+		if s.Items == nil {
+			return true
+		}
+		for i, item := range v {
+			if !c.check(s.Items, fmt.Sprintf("%s[%d]", path, i), item) {
+				v[i] = nil
+			}
+		}
+	}
+	return true
+}
+
+// propertySchema returns the schema of a key of an object, or nil if the key is not allowed.
+func (s *Schema) propertySchema(key string) *Schema {
+	if schema, ok := s.Properties[key]; ok {
+		return schema
+	}
+	for pattern, schema := range s.PatternProperties {
+		if regexp.MustCompile(pattern).MatchString(key) {
+			return schema
+		}
+	}
+	if schema, ok := s.AdditionalProperties.(*Schema); ok {
+		return schema
+	}
+	return nil
+}
+
+// hasType reports whether a value has the type of the schema.
+func (s *Schema) hasType(v any) bool {
+	switch s.Type {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == float64(int64(n))
+	}
+	return true
+}
+
+// typeName returns a schema type as used in problems.
+func typeName(schemaType string) string {
+	switch schemaType {
+	case "object":
+		return "an object"
+	case "array":
+		return "a list"
+	case "string":
+		return "a string"
+	case "boolean":
+		return "true or false"
+	case "integer":
+		return "an integer"
+	}
+	return "a value"
+}
+
+// typeOf returns the type of a decoded value as used in problems.
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "a list"
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	case bool:
+		return fmt.Sprintf("%t", v)
+	case float64:
+		return fmt.Sprintf("the number %v", v)
+	}
+	return fmt.Sprintf("%v", v)
+}
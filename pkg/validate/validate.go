@@ -0,0 +1,285 @@
+// Package validate checks cluster configs before they are used: their structure against the
+// JSON Schema generated from types.Cluster, and the values the schema cannot express, like the
+// syntax of addresses and labels, duplicate nodes and links to unknown clusters.
+package validate
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/argon-chat/k3sd/pkg/addons"
+	"github.com/argon-chat/k3sd/pkg/secrets"
+	"github.com/argon-chat/k3sd/pkg/types"
+)
+
+// Problem is a problem found in a config.
+//
+// Fields:
+//   - Path: Location of the value in the config, e.g. "clusters[0].workers[1].nodeName".
+//   - Message: What is wrong with the value.
+type Problem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// Error is the error of a config with problems.
+type Error struct {
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d problems:", len(e.Problems))
+	for _, problem := range e.Problems {
+		b.WriteString("\n  - " + problem.String())
+	}
+	return b.String()
+}
+
+var (
+	// dnsLabel matches a label of a hostname (RFC 1123).
+	dnsLabel = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9]{0,61}[A-Za-z0-9])?$`)
+	// nodeNameLabel matches a label of a Kubernetes node name, which is lowercase.
+	nodeNameLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	// labelName matches the name of a label key and a label value (without the length limit).
+	labelName = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	// dottedNumbers matches what can only be meant as an IPv4 address.
+	dottedNumbers = regexp.MustCompile(`^[0-9.]+$`)
+)
+
+// Clusters checks the values of decoded clusters: that required fields are set, that
+// addresses are IP addresses or hostnames, node names and labels are valid in Kubernetes, no
+// node name or address is used twice in a cluster, no master or context is used by two
+// clusters, addons are known and linksTo names the context of another cluster. Secret
+// references are accepted in place of any value but those identifying clusters and nodes.
+//
+// Parameters:
+//   - clusters: The clusters of a config.
+//
+// Returns:
+//   - []Problem: The problems found, cluster by cluster; nil if there are none.
+func Clusters(clusters []types.Cluster) []Problem {
+	var problems []Problem
+	add := func(path, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	known := make(map[string]bool)
+	for _, name := range addons.Names() {
+		known[name] = true
+	}
+	masters := make(map[string]string)
+	contexts := make(map[string]string)
+	for ci := range clusters {
+		cluster := &clusters[ci]
+		path := fmt.Sprintf("clusters[%d]", ci)
+		problems = append(problems, required(path, reflect.ValueOf(cluster).Elem())...)
+
+		names := make(map[string]string)
+		addresses := make(map[string]string)
+		checkNode := func(path string, node *types.Worker) {
+			problems = append(problems, nodeProblems(path, node)...)
+			if other, ok := names[node.NodeName]; ok && node.NodeName != "" {
+				add(path+".nodeName", "%q is also the name of %s", node.NodeName, other)
+			} else {
+				names[node.NodeName] = path
+			}
+			if other, ok := addresses[node.Address]; ok && node.Address != "" {
+				add(path+".address", "%q is also the address of %s", node.Address, other)
+			} else {
+				addresses[node.Address] = path
+			}
+		}
+		checkNode(path, &cluster.Worker)
+		for wi := range cluster.Workers {
+			checkNode(fmt.Sprintf("%s.workers[%d]", path, wi), &cluster.Workers[wi])
+		}
+
+		if secrets.IsRef(cluster.Context) {
+			add(path+".context", "a secret reference cannot be used here, the context identifies the cluster")
+		}
+		if other, ok := masters[cluster.Address]; ok && cluster.Address != "" {
+			add(path+".address", "%q is also the master of %s", cluster.Address, other)
+		} else {
+			masters[cluster.Address] = path
+		}
+		if other, ok := contexts[cluster.Context]; ok {
+			add(path+".context", "%q is also the context of %s", cluster.Context, other)
+		} else if cluster.Context != "" {
+			contexts[cluster.Context] = path
+		}
+		if cluster.Domain != "" && !secrets.IsRef(cluster.Domain) && !isHostname(cluster.Domain) {
+			add(path+".domain", "%q is not a valid domain", cluster.Domain)
+		}
+		for _, name := range sortedKeys(cluster.Addons) {
+			if !known[name] {
+				add(keyPath(path+".addons", name), "unknown addon; known addons are %s", strings.Join(addons.Names(), ", "))
+			}
+		}
+		for _, name := range sortedKeys(cluster.CustomAddons) {
+			addon := cluster.CustomAddons[name]
+			if addon.Enabled && addon.Helm == nil && addon.Manifest == nil {
+				add(keyPath(path+".customAddons", name), "an enabled custom addon needs a helm chart or a manifest")
+			}
+		}
+		for wi, webhook := range cluster.Webhooks {
+			if webhook.URL == "" || secrets.IsRef(webhook.URL) {
+				continue
+			}
+			if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add(fmt.Sprintf("%s.webhooks[%d].url", path, wi), "%q is not an http or https URL", webhook.URL)
+			}
+		}
+	}
+	for ci := range clusters {
+		cluster := &clusters[ci]
+		for li, link := range cluster.LinksTo {
+			path := fmt.Sprintf("clusters[%d].linksTo[%d]", ci, li)
+			switch {
+			case secrets.IsRef(link):
+				add(path, "a secret reference cannot be used here, links name the context of a cluster")
+			case cluster.Context != "" && link == cluster.Context:
+				add(path, "a cluster cannot link to itself")
+			case contexts[link] == "":
+				add(path, "no cluster has the context %q", link)
+			}
+		}
+	}
+	return problems
+}
+
+// nodeProblems checks the address, node name and labels of a master or worker node.
+func nodeProblems(path string, node *types.Worker) []Problem {
+	var problems []Problem
+	add := func(path, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if secrets.IsRef(node.Address) {
+		add(path+".address", "a secret reference cannot be used here, the address identifies the node")
+	} else if node.Address != "" {
+		if dottedNumbers.MatchString(node.Address) && net.ParseIP(node.Address) == nil {
+			add(path+".address", "%q is not a valid IP address", node.Address)
+		} else if net.ParseIP(node.Address) == nil && !isHostname(node.Address) {
+			add(path+".address", "%q is not an IP address or hostname", node.Address)
+		}
+	}
+	if secrets.IsRef(node.NodeName) {
+		add(path+".nodeName", "a secret reference cannot be used here, the name identifies the node")
+	} else if node.NodeName != "" && !isNodeName(node.NodeName) {
+		add(path+".nodeName", "%q is not a valid node name: use lowercase letters, digits, '-' and '.'", node.NodeName)
+	}
+	for _, key := range sortedKeys(node.Labels) {
+		labelPath := keyPath(path+".labels", key)
+		if err := checkLabelKey(key); err != "" {
+			add(labelPath, "invalid label key: %s", err)
+		}
+		if value := node.Labels[key]; value != "" && !secrets.IsRef(value) && (len(value) > 63 || !labelName.MatchString(value)) {
+			add(labelPath, "invalid label value %q: at most 63 letters, digits, '-', '_' and '.', starting and ending with a letter or digit", value)
+		}
+	}
+	return problems
+}
+
+// checkLabelKey returns what is wrong with a label key, an optional DNS subdomain prefix and a
+// name separated by a slash, or "" if it is valid.
+func checkLabelKey(key string) string {
+	prefix, name, hasPrefix := strings.Cut(key, "/")
+	if !hasPrefix {
+		name, prefix = prefix, ""
+	}
+	if hasPrefix && (prefix == "" || len(prefix) > 253 || !isHostname(prefix)) {
+		return fmt.Sprintf("prefix %q is not a DNS subdomain", prefix)
+	}
+	if name == "" || len(name) > 63 || !labelName.MatchString(name) {
+		return fmt.Sprintf("name %q must be at most 63 letters, digits, '-', '_' and '.', starting and ending with a letter or digit", name)
+	}
+	return ""
+}
+
+// isHostname reports whether s is a hostname (RFC 1123).
+func isHostname(s string) bool {
+	return isDNSName(s, dnsLabel)
+}
+
+// isNodeName reports whether s is a valid Kubernetes node name, a lowercase DNS subdomain.
+func isNodeName(s string) bool {
+	return isDNSName(s, nodeNameLabel)
+}
+
+func isDNSName(s string, label *regexp.Regexp) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, part := range strings.Split(s, ".") {
+		if !label.MatchString(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// required returns a problem for every field tagged validate:"required" that is not set in a
+// value, or in the structs, lists and maps it holds.
+func required(path string, value reflect.Value) []Problem {
+	var problems []Problem
+	switch value.Kind() {
+	case reflect.Pointer:
+		if !value.IsNil() {
+			problems = append(problems, required(path, value.Elem())...)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			problems = append(problems, required(fmt.Sprintf("%s[%d]", path, i), value.Index(i))...)
+		}
+	case reflect.Map:
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			problems = append(problems, required(keyPath(path, key.String()), value.MapIndex(key))...)
+		}
+	case reflect.Struct:
+		forEachField(value.Type(), func(name string, field reflect.StructField) {
+			fieldValue := value.FieldByIndex(field.Index)
+			if field.Tag.Get("validate") == "required" && fieldValue.IsZero() {
+				problems = append(problems, Problem{Path: keyPath(path, name), Message: "required field is missing"})
+			}
+			problems = append(problems, required(keyPath(path, name), fieldValue)...)
+		})
+	}
+	return problems
+}
+
+// keyPath returns the path of a key of the object at path. Keys that would be ambiguous in a
+// path are quoted.
+func keyPath(path, key string) string {
+	if key == "" || strings.ContainsAny(key, ".[]\" ") {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}